@@ -0,0 +1,90 @@
+package forktraffic
+
+import (
+   "net/http"
+   "time"
+)
+
+//
+// production proxy error handler
+// - a client that went away is counted as a client abort, not an upstream error
+func (reqMgr *RequestManager) proxyErrorHandler(respw http.ResponseWriter, req *http.Request, err error) {
+   ex := exchangeOf(req)
+   if ex != nil && ex.tee != nil && ex.tee.err != nil {
+      err = ex.tee.err
+   }
+   if reqMgr.tooLarge(respw, err) {
+      if ex != nil {
+         ex.prodStatus, ex.bodyTooLarge = http.StatusRequestEntityTooLarge, true
+      }
+      return
+   }
+   clientGone := req.Context().Err() != nil || (ex != nil && ex.tee != nil && ex.tee.err != nil)
+
+   if clientGone {
+      reqMgr.Metrics.Inc("forktraffic_client_aborts_total", "stage", "production")
+      if ex != nil {
+         ex.clientAbort = true
+      }
+      return
+   }
+
+   reqMgr.Metrics.Inc("forktraffic_upstream_errors_total", "upstream", "production")
+   reqMgr.reportError(&ForwardError{Class: ErrProductionUnavailable, Path: req.URL.Path, Err: err})
+   respw.WriteHeader(http.StatusBadGateway)
+}
+
+//
+// the production response could not be copied to the client; the proxy aborts the
+// handler with http.ErrAbortHandler, skipping the accounting after it
+// - a failed read of the production body while the client is still connected is
+//   an upstream error, anything else a client abort
+// - the exchange is observed and finished as a regular one and the abort carried on
+func (reqMgr *RequestManager) productionAborted(respw http.ResponseWriter, req *http.Request, ex *exchange, bodyBuf []byte, shadow, sampled bool, prodStart time.Time) {
+   r := recover()
+   if r == nil {
+      return
+   }
+   if r != http.ErrAbortHandler {
+      panic(r)
+   }
+   ex.prodLatency = reqMgr.Clock.Now().Sub(prodStart)
+   if req.Context().Err() == nil && ex.prodBody != nil && ex.prodBody.err != nil {
+      reqMgr.Metrics.Inc("forktraffic_upstream_errors_total", "upstream", "production")
+      reqMgr.reportError(&ForwardError{Class: ErrProductionUnavailable, Path: req.URL.Path, Err: ex.prodBody.err})
+   } else {
+      reqMgr.Metrics.Inc("forktraffic_client_aborts_total", "stage", "production")
+      ex.clientAbort = true
+   }
+   reqMgr.chaos.observeProduction(ex)
+   reqMgr.productionDone(respw, req, ex, bodyBuf, shadow, sampled)
+   panic(r)
+}
+
+//
+// the request body could not be read; the client aborted or sent a broken body
+// - production is not called with the partial body
+// - a read failure while the client is still connected is reported as ErrReadBody
+// - the captured portion is mirrored only when MirrorAbortedRequests is set, through
+//   the regular mirror filters
+func (reqMgr *RequestManager) requestAborted(req *http.Request, body []byte, err error, op operatorFlags, sampled bool, received time.Time) {
+   if req.Context().Err() == nil {
+      reqMgr.reportError(&ForwardError{Class: ErrReadBody, Path: req.URL.Path, Err: err})
+   }
+   reqMgr.Metrics.Inc("forktraffic_client_aborts_total", "stage", "request")
+   if !reqMgr.MirrorAbortedRequests {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "client_abort")
+      return
+   }
+
+   req, ex := withExchange(req)
+   ex.clientAbort = true
+   ex.operator = op
+   ex.experiment = reqMgr.Experiment()
+   ex.clientHost = req.Host
+   ex.received = received
+   ex.apiOp, ex.operation = reqMgr.operationOf(req)
+   gqlOp := reqMgr.graphqlOf(req, body)
+   ex.route = reqMgr.routeLabel(req, gqlOp, ex.operation)
+   reqMgr.mirrorFilteredRequest(req, http.Header{}, body, ex, gqlOp, sampled)
+}
@@ -0,0 +1,128 @@
+package forktraffic
+
+import (
+   "bufio"
+   "net"
+   "net/http"
+   "net/http/httptest"
+   "net/http/httputil"
+   "net/url"
+   "testing"
+   "time"
+)
+
+// fork in front of a production handler; production is served by the returned server
+func newAbortFork(t *testing.T, production http.HandlerFunc) (*RequestManager, *httptest.Server) {
+   prod := httptest.NewServer(production)
+   t.Cleanup(prod.Close)
+   prodUrl, _ := url.Parse(prod.URL)
+
+   reqMgr := &RequestManager{
+      UrlProduction:  prodUrl,
+      DestProduction: httputil.NewSingleHostReverseProxy(prodUrl),
+      CacheData:      map[string]*StagKeys{"": new(StagKeys)},
+      QueueSize:      10,
+   }
+   reqMgr.Init()
+   fork := httptest.NewServer(reqMgr)
+   t.Cleanup(fork.Close)
+   return reqMgr, fork
+}
+
+// wait for a metric to reach a value
+func waitMetric(t *testing.T, m *Metrics, want int64, name string, labels ...string) {
+   deadline := time.Now().Add(5 * time.Second)
+   for m.Get(name, labels...) != want {
+      if time.Now().After(deadline) {
+         t.Fatalf("%s%v = %d, want %d", name, labels, m.Get(name, labels...), want)
+      }
+      time.Sleep(10 * time.Millisecond)
+   }
+}
+
+// production streams a body until the client of the fork goes away
+func streamUntilGone(w http.ResponseWriter, r *http.Request) {
+   chunk := make([]byte, 32*1024)
+   for r.Context().Err() == nil {
+      if _, err := w.Write(chunk); err != nil {
+         return
+      }
+      w.(http.Flusher).Flush()
+      time.Sleep(time.Millisecond)
+   }
+}
+
+func TestClientAbortMidResponse(t *testing.T) {
+   reqMgr, fork := newAbortFork(t, streamUntilGone)
+
+   conn, err := net.Dial("tcp", fork.Listener.Addr().String())
+   if err != nil {
+      t.Fatal(err)
+   }
+   conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+   resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   resp.Body.Read(make([]byte, 1024))
+   conn.Close()
+
+   m := reqMgr.Metrics
+   waitMetric(t, m, 1, "forktraffic_client_aborts_total", "stage", "production")
+   waitMetric(t, m, 1, "forktraffic_mirror_skipped_total", "reason", "client_abort")
+   waitMetric(t, m, 0, "forktraffic_upstream_inflight", "destination", "production")
+   waitMetric(t, m, 0, "forktraffic_upstream_active_connections", "destination", "production")
+   if n := m.Get("forktraffic_upstream_errors_total", "upstream", "production"); n != 0 {
+      t.Errorf("upstream errors = %d, want 0", n)
+   }
+}
+
+func TestUpstreamAbortMidResponse(t *testing.T) {
+   // production promises more than it sends and drops the connection
+   reqMgr, fork := newAbortFork(t, func(w http.ResponseWriter, r *http.Request) {
+      w.Header().Set("Content-Length", "1000")
+      w.Write(make([]byte, 10))
+      w.(http.Flusher).Flush()
+      conn, _, _ := w.(http.Hijacker).Hijack()
+      conn.Close()
+   })
+
+   resp, err := http.Get(fork.URL + "/short")
+   if err == nil {
+      buf := make([]byte, 2048)
+      for err == nil {
+         _, err = resp.Body.Read(buf)
+      }
+      resp.Body.Close()
+   }
+
+   m := reqMgr.Metrics
+   waitMetric(t, m, 1, "forktraffic_upstream_errors_total", "upstream", "production")
+   waitMetric(t, m, 0, "forktraffic_upstream_inflight", "destination", "production")
+   if n := m.Get("forktraffic_client_aborts_total", "stage", "production"); n != 0 {
+      t.Errorf("client aborts = %d, want 0", n)
+   }
+}
+
+func TestProductionTruncateFault(t *testing.T) {
+   reqMgr, fork := newAbortFork(t, func(w http.ResponseWriter, r *http.Request) {
+      w.Write(make([]byte, 1000))
+   })
+   reqMgr.FaultPercent = 100
+   reqMgr.FaultProduction = true
+   reqMgr.FaultKinds = []string{faultTruncate}
+
+   resp, err := http.Get(fork.URL + "/truncated")
+   if err == nil {
+      buf := make([]byte, 2048)
+      for err == nil {
+         _, err = resp.Body.Read(buf)
+      }
+      resp.Body.Close()
+   }
+
+   m := reqMgr.Metrics
+   waitMetric(t, m, 1, "forktraffic_faults_injected_total", "destination", "production", "kind", faultTruncate)
+   waitMetric(t, m, 1, "forktraffic_upstream_errors_total", "upstream", "production")
+   waitMetric(t, m, 0, "forktraffic_upstream_inflight", "destination", "production")
+}
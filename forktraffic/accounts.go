@@ -0,0 +1,126 @@
+package forktraffic
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/json"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "strings"
+)
+
+//
+// load the production to staging account mapping of AccountMapFile
+// - a JSON object {"prod id": "staging id"}, or lines "prod id,staging id"
+//   ("=" or blanks also separate them; "#" starts a comment)
+func loadAccountMap(file string) (map[string]string, error) {
+   buf, err := ioutil.ReadFile(file)
+   if err != nil {
+      return nil, err
+   }
+   accounts := make(map[string]string)
+   if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+      err = json.Unmarshal(trimmed, &accounts)
+      return accounts, err
+   }
+   scanner := bufio.NewScanner(bytes.NewReader(buf))
+   for scanner.Scan() {
+      line := scanner.Text()
+      if i := strings.Index(line, "#"); i >= 0 {
+         line = line[:i]
+      }
+      fields := strings.FieldsFunc(line, func(r rune) bool {
+         return r == ',' || r == '=' || r == ' ' || r == '\t'
+      })
+      if len(fields) == 2 {
+         accounts[fields[0]] = fields[1]
+      }
+   }
+   return accounts, scanner.Err()
+}
+
+//
+// set up the account mapping of the staging copies
+// - an unreadable mapping file leaves the accounts alone
+func (reqMgr *RequestManager) initAccounts() {
+   if reqMgr.AccountMapFile == "" {
+      return
+   }
+   accounts, err := loadAccountMap(reqMgr.AccountMapFile)
+   if err != nil {
+      log.Printf("Warning - account mapping %v: %v; the accounts are not mapped", reqMgr.AccountMapFile, err)
+      return
+   }
+   reqMgr.accounts = accounts
+   if len(reqMgr.AccountFields) > 0 {
+      reqMgr.AddBodyTransform(reqMgr.remapJsonAccounts)
+   }
+}
+
+// the staging account of a production account; false when it is not mapped
+func (reqMgr *RequestManager) stagingAccount(id, where string) (string, bool) {
+   if id == "" {
+      return id, false
+   }
+   mapped, ok := reqMgr.accounts[id]
+   if ok {
+      reqMgr.Metrics.Inc("forktraffic_accounts_mapped_total", "where", where)
+   } else {
+      reqMgr.Metrics.Inc("forktraffic_accounts_unmapped_total", "where", where)
+   }
+   return mapped, ok
+}
+
+//
+// map the accounts of the AccountHeaders and of the path segment following an
+// AccountPathPrefixes prefix of a staging copy; unmapped accounts are left alone
+func (reqMgr *RequestManager) remapAccounts(stagReq *http.Request) {
+   if reqMgr.accounts == nil {
+      return
+   }
+   for _, name := range reqMgr.AccountHeaders {
+      vals := stagReq.Header.Values(name)
+      for i, val := range vals {
+         if mapped, ok := reqMgr.stagingAccount(val, "header"); ok {
+            vals[i] = mapped
+         }
+      }
+   }
+
+   path := stagReq.URL.Path
+   for _, prefix := range reqMgr.AccountPathPrefixes {
+      if !strings.HasPrefix(path, prefix) {
+         continue
+      }
+      rest := path[len(prefix):]
+      end := strings.Index(rest, "/")
+      if end < 0 {
+         end = len(rest)
+      }
+      if mapped, ok := reqMgr.stagingAccount(rest[:end], "path"); ok {
+         stagReq.URL.Path = prefix + mapped + rest[end:]
+         stagReq.URL.RawPath = ""
+      }
+      break
+   }
+}
+
+//
+// map the accounts of the AccountFields of a JSON staging body, at any depth
+func (reqMgr *RequestManager) remapJsonAccounts(req *http.Request, plain []byte) []byte {
+   return rewriteJsonFields(req, plain, reqMgr.accountField, func(id string) (string, bool) {
+      return reqMgr.stagingAccount(id, "body")
+   })
+}
+
+// is this a JSON field holding an account id
+func (reqMgr *RequestManager) accountField(name string) bool {
+   for _, field := range reqMgr.AccountFields {
+      if strings.EqualFold(name, field) {
+         return true
+      }
+   }
+   return false
+}
+
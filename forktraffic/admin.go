@@ -0,0 +1,112 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "net/http"
+   "runtime/pprof"
+   "strconv"
+   "strings"
+   "time"
+)
+
+//
+// admin API; ping, metrics, operational views and profiling
+// - served on the management listener only, never with the traffic
+func (reqMgr *RequestManager) AdminHandler() http.Handler {
+   mux := http.NewServeMux()
+   mux.Handle("/ping", reqMgr.PingManager)
+   mux.Handle("/metrics", reqMgr.Metrics)
+   mux.HandleFunc("/admin/errors", reqMgr.adminErrors)
+   mux.HandleFunc("/admin/assertions", reqMgr.adminAssertions)
+   mux.HandleFunc("/admin/peers", reqMgr.adminPeers)
+   mux.HandleFunc("/admin/sessions", reqMgr.adminSessions)
+   mux.HandleFunc("/admin/sessions/mapping", reqMgr.adminSessionMapping)
+   mux.HandleFunc("/admin/traffic", reqMgr.adminTraffic)
+   mux.HandleFunc("/admin/staging", reqMgr.adminStaging)
+   mux.HandleFunc("/admin/canary", reqMgr.adminCanary)
+   mux.HandleFunc("/admin/mismatches", reqMgr.adminMismatches)
+   mux.HandleFunc("/admin/replay", reqMgr.adminReplay)
+   mux.HandleFunc("/admin/findings", reqMgr.adminFindings)
+   mux.HandleFunc("/admin/triage", reqMgr.adminTriage)
+   mux.HandleFunc("/admin/chaos", reqMgr.adminChaos)
+   mux.HandleFunc("/admin/morfs", reqMgr.adminMorfs)
+   mux.HandleFunc("/admin/deadletters", reqMgr.adminDeadLetters)
+   mux.HandleFunc("/admin/coverage", reqMgr.adminCoverage)
+   mux.HandleFunc("/admin/mode", reqMgr.adminMode)
+   mux.HandleFunc("/admin/experiment", reqMgr.adminExperiment)
+   mux.HandleFunc("/admin/queue", reqMgr.adminQueue)
+   mux.HandleFunc("/admin/overhead", reqMgr.adminOverhead)
+   mux.HandleFunc("/debug/pprof/", pprofHandler)
+   return mux
+}
+
+// write a JSON response
+func writeJson(w http.ResponseWriter, v interface{}) {
+   buf, err := json.MarshalIndent(v, "", "  ")
+   if err != nil {
+      ResponseHttpError(w, http.StatusInternalServerError, ": "+err.Error())
+      return
+   }
+   w.Header().Set("Content-Type", "application/json")
+   w.Write(buf)
+}
+
+//
+// handle "/debug/pprof/<profile>"
+// - "profile?seconds=N" records a CPU profile; other names are runtime profiles
+//   (heap, goroutine, allocs, block, mutex, threadcreate); "?debug=1" for text
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+   name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+   debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+
+   if name == "" {
+      w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+      for _, profile := range pprof.Profiles() {
+         w.Write([]byte(profile.Name() + "\n"))
+      }
+      w.Write([]byte("profile\n"))
+      return
+   }
+
+   if name == "profile" {
+      seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+      if err != nil || seconds <= 0 {
+         seconds = 30
+      }
+      w.Header().Set("Content-Type", "application/octet-stream")
+      if err := pprof.StartCPUProfile(w); err != nil {
+         ResponseHttpError(w, http.StatusConflict, ": "+err.Error())
+         return
+      }
+      time.Sleep(time.Duration(seconds) * time.Second)
+      pprof.StopCPUProfile()
+      return
+   }
+
+   profile := pprof.Lookup(name)
+   if profile == nil {
+      ResponseHttpError(w, http.StatusNotFound, ": unknown profile "+name)
+      return
+   }
+   if debug > 0 {
+      w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+   } else {
+      w.Header().Set("Content-Type", "application/octet-stream")
+   }
+   profile.WriteTo(w, debug)
+}
+
+//
+// handle "/admin/errors"; error counts per class and the latest errors
+func (reqMgr *RequestManager) adminErrors(w http.ResponseWriter, r *http.Request) {
+   counts := make(map[string]int64)
+   for _, name := range errorClassNames {
+      counts[name] = reqMgr.Metrics.Get("forktraffic_errors_total", "class", name)
+   }
+   counts["other"] = reqMgr.Metrics.Get("forktraffic_errors_total", "class", "other")
+
+   writeJson(w, struct {
+      Counts map[string]int64
+      Recent []errorRecord
+   }{counts, reqMgr.recentErrors.list()})
+}
@@ -0,0 +1,77 @@
+package forktraffic
+
+import (
+   "log"
+   "net/http"
+   "strings"
+   "sync/atomic"
+)
+
+//
+// expectation on the staging response of a route
+// - PathPrefix selects the route; Method optionally narrows it
+// - Expect is "same-status", "same-class" or a status class ("2xx", "4xx", ...)
+type AssertionRule struct {
+   PathPrefix string
+   Method     string
+   Expect     string
+
+   checked    int64
+   violations int64
+}
+
+// does the rule apply to a request
+func (rule *AssertionRule) matches(req *http.Request) bool {
+   return strings.HasPrefix(req.URL.Path, rule.PathPrefix) &&
+      (rule.Method == "" || strings.EqualFold(rule.Method, req.Method))
+}
+
+// does the staging status satisfy the rule
+func (rule *AssertionRule) holds(prodStatus, stagStatus int) bool {
+   switch strings.ToLower(rule.Expect) {
+   case "same-status":
+      return prodStatus == stagStatus
+   case "same-class":
+      return prodStatus/100 == stagStatus/100
+   default:
+      return strings.EqualFold(rule.Expect, statusClass(stagStatus))
+   }
+}
+
+//
+// check the staging response against the rules of its route
+func (reqMgr *RequestManager) checkAssertions(sendReq *PendingRequest, stagStatus int) {
+   if len(reqMgr.AssertionRules) == 0 || sendReq.exchange == nil {
+      return
+   }
+   prodStatus := sendReq.exchange.status()
+   for i := range reqMgr.AssertionRules {
+      rule := &reqMgr.AssertionRules[i]
+      if !rule.matches(sendReq.req) {
+         continue
+      }
+      atomic.AddInt64(&rule.checked, 1)
+      if !rule.holds(prodStatus, stagStatus) {
+         atomic.AddInt64(&rule.violations, 1)
+         reqMgr.Metrics.Inc("forktraffic_assertion_violations_total", "route", rule.PathPrefix, "expect", rule.Expect, "region", sendReq.target.label())
+         log.Printf("Warning - assertion %q failed on %v %v: production %d, staging %d",
+            rule.Expect, sendReq.req.Method, sendReq.req.URL.Path, prodStatus, stagStatus)
+      }
+   }
+}
+
+//
+// handle "/admin/assertions"; checks and violations per rule
+func (reqMgr *RequestManager) adminAssertions(w http.ResponseWriter, r *http.Request) {
+   type ruleStats struct {
+      PathPrefix, Method, Expect string
+      Checked, Violations        int64
+   }
+   stats := make([]ruleStats, 0, len(reqMgr.AssertionRules))
+   for i := range reqMgr.AssertionRules {
+      rule := &reqMgr.AssertionRules[i]
+      stats = append(stats, ruleStats{rule.PathPrefix, rule.Method, rule.Expect,
+         atomic.LoadInt64(&rule.checked), atomic.LoadInt64(&rule.violations)})
+   }
+   writeJson(w, stats)
+}
@@ -0,0 +1,197 @@
+package forktraffic
+
+import (
+   "bytes"
+   "errors"
+   "io/ioutil"
+   "mime/multipart"
+   "net/http"
+   "net/textproto"
+   "strconv"
+   "sync"
+   "time"
+)
+
+// default batch size and the longest wait before a partial batch is posted
+const DefaultBatchSize int = 100
+const DefaultBatchWaitMs int = 1000
+
+//
+// staging copy waiting in a batch
+type batchEntry struct {
+   sendReq *PendingRequest
+   stagReq *http.Request
+   body    []byte
+}
+
+//
+// batch of staging copies posted as one envelope to BatchUrl
+// - by default the RequestRecords in CaptureEncoding, framed one after the other
+// - "multipart": multipart/mixed, one application/http request per part
+type batcher struct {
+   lock    sync.Mutex
+   entries []batchEntry
+   full    chan struct{}
+   started bool
+}
+
+func (reqMgr *RequestManager) batchLimit() int {
+   if reqMgr.BatchSize <= 0 {
+      return DefaultBatchSize
+   }
+   return reqMgr.BatchSize
+}
+
+//
+// build the staging copy of a request and add it to the batch
+// - the copy is built like a single request: staging keys, shadow marker and morfs
+func (reqMgr *RequestManager) batchRequest(sendReq *PendingRequest) {
+   stagReq, err := reqMgr.buildForwardRequest(sendReq)
+   if err != nil {
+      reqMgr.reportError(err)
+      return
+   }
+   var body []byte = nil
+   if stagReq.Body != nil {
+      body, _ = ioutil.ReadAll(stagReq.Body)
+      stagReq.Body.Close()
+   }
+
+   bt := &reqMgr.batch
+   bt.lock.Lock()
+   if !bt.started {
+      bt.started = true
+      bt.full = make(chan struct{}, 1)
+      go reqMgr.batchFlusher()
+   }
+   bt.entries = append(bt.entries, batchEntry{sendReq: sendReq, stagReq: stagReq, body: body})
+   full := len(bt.entries) >= reqMgr.batchLimit()
+   bt.lock.Unlock()
+
+   if full {
+      select {
+      case bt.full <- struct{}{}:
+      default:
+      }
+   }
+}
+
+//
+// post the batch when it is full or every BatchWaitMs
+func (reqMgr *RequestManager) batchFlusher() {
+   wait := reqMgr.BatchWaitMs
+   if wait <= 0 {
+      wait = DefaultBatchWaitMs
+   }
+   ticker := time.NewTicker(time.Duration(wait) * time.Millisecond)
+   defer ticker.Stop()
+   for {
+      select {
+      case <-ticker.C:
+      case <-reqMgr.batch.full:
+      }
+      for {
+         bt := &reqMgr.batch
+         bt.lock.Lock()
+         n := len(bt.entries)
+         if limit := reqMgr.batchLimit(); n > limit {
+            n = limit
+         }
+         entries := bt.entries[:n:n]
+         bt.entries = bt.entries[n:]
+         bt.lock.Unlock()
+         if n == 0 {
+            break
+         }
+         reqMgr.postBatch(entries)
+      }
+   }
+}
+
+//
+// serialize the entries of a batch; returns the envelope and its content type
+func (reqMgr *RequestManager) batchEnvelope(entries []batchEntry) ([]byte, string, error) {
+   buf := new(bytes.Buffer)
+   if reqMgr.BatchFormat != "multipart" {
+      var stream []byte = nil
+      for _, entry := range entries {
+         rec := &RequestRecord{
+            Time:       reqMgr.Clock.Now(),
+            Region:     entry.sendReq.target.region,
+            Method:     entry.stagReq.Method,
+            Url:        entry.stagReq.URL.String(),
+            Header:     entry.stagReq.Header,
+            Body:       entry.body,
+            Experiment: entry.sendReq.experiment,
+            Scenario:   entry.sendReq.scenario,
+         }
+         if ex := entry.sendReq.exchange; ex != nil {
+            rec.ProdStatus, rec.Route = ex.status(), ex.route
+         }
+         encoded, err := reqMgr.captureEncoder.Encode(rec)
+         if err != nil {
+            return nil, "", err
+         }
+         stream = reqMgr.captureEncoder.Frame(stream, encoded)
+      }
+      return stream, reqMgr.captureEncoder.ContentType(), nil
+   }
+
+   mw := multipart.NewWriter(buf)
+   for i, entry := range entries {
+      part, err := mw.CreatePart(textproto.MIMEHeader{
+         "Content-Type": {"application/http; msgtype=request"},
+         "Content-Id":   {strconv.Itoa(i + 1)},
+      })
+      if err != nil {
+         return nil, "", err
+      }
+      entry.stagReq.Body = ioutil.NopCloser(bytes.NewReader(entry.body))
+      if err := entry.stagReq.Write(part); err != nil {
+         return nil, "", err
+      }
+   }
+   if err := mw.Close(); err != nil {
+      return nil, "", err
+   }
+   return buf.Bytes(), "multipart/mixed; boundary=" + mw.Boundary(), nil
+}
+
+//
+// post a batch to BatchUrl
+// - the copies of a batch staging did not take are retried, then dead-lettered, one by one
+func (reqMgr *RequestManager) postBatch(entries []batchEntry) {
+   envelope, contentType, err := reqMgr.batchEnvelope(entries)
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrBuildRequest, Path: reqMgr.BatchUrl, Err: err})
+      return
+   }
+   req, err := http.NewRequest("POST", reqMgr.BatchUrl, bytes.NewReader(envelope))
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrBuildRequest, Path: reqMgr.BatchUrl, Err: err})
+      return
+   }
+   req.Header.Set("Content-Type", contentType)
+   req.Header.Set("X-Fork-Batch-Size", strconv.Itoa(len(entries)))
+   reqMgr.markShadow(req)
+
+   resp, err := reqMgr.DestStaging.Do(req)
+   if err == nil {
+      ioutil.ReadAll(resp.Body)
+      resp.Body.Close()
+      if resp.StatusCode >= http.StatusInternalServerError {
+         err = errors.New(resp.Status)
+      }
+   }
+   if err != nil {
+      reqMgr.Metrics.Inc("forktraffic_batches_total", "status", "error")
+      reqMgr.reportError(&ForwardError{Class: ErrStagingUnavailable, Path: req.URL.Path, Err: err})
+      for _, entry := range entries {
+         reqMgr.forwardFailed(entry.sendReq, err)
+      }
+      return
+   }
+   reqMgr.Metrics.Inc("forktraffic_batches_total", "status", statusClass(resp.StatusCode))
+   reqMgr.Metrics.Add("forktraffic_batched_requests_total", int64(len(entries)))
+   reqMgr.Metrics.Add("forktraffic_batch_bytes_total", int64(len(envelope)))
+}
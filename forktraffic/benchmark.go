@@ -0,0 +1,80 @@
+package forktraffic
+
+import (
+   "io"
+   "io/ioutil"
+   "net/http"
+   "time"
+)
+
+// default requests of a benchmark
+const DefaultBenchmarkRequests int = 200
+
+//
+// latency of the fork against the production it fronts, from a benchmark
+// - AddedMs are the fork's percentiles less production's; within budget when
+//   the added 99th percentile keeps to BudgetMs (0 for no budget)
+type BenchmarkReport struct {
+   Requests     int
+   Errors       int
+   Fork         LatencyReport
+   Direct       LatencyReport
+   AddedP50Ms   float64
+   AddedP95Ms   float64
+   AddedP99Ms   float64
+   BudgetMs     int
+   WithinBudget bool
+}
+
+//
+// benchmark a fork against its production: the same GET request is sent to both
+// in turn, one at a time, so both see the same network and load
+// - the fork copies carry the shadow marker (X-Duplicate-By by default); the fork
+//   sends them to production without mirroring them to staging
+func Benchmark(client *http.Client, forkUrl, directUrl string, requests, budgetMs int) *BenchmarkReport {
+   if requests <= 0 {
+      requests = DefaultBenchmarkRequests
+   }
+   report := &BenchmarkReport{Requests: requests, BudgetMs: budgetMs}
+   var fork, direct []time.Duration
+   for i := 0; i < requests; i++ {
+      for _, target := range []struct {
+         url       string
+         latencies *[]time.Duration
+         shadow    bool
+      }{{forkUrl, &fork, true}, {directUrl, &direct, false}} {
+         elapsed, err := benchmarkRequest(client, target.url, target.shadow)
+         if err != nil {
+            report.Errors++
+            continue
+         }
+         *target.latencies = append(*target.latencies, elapsed)
+      }
+   }
+
+   report.Fork, report.Direct = latencyReport(fork), latencyReport(direct)
+   report.AddedP50Ms = report.Fork.P50Ms - report.Direct.P50Ms
+   report.AddedP95Ms = report.Fork.P95Ms - report.Direct.P95Ms
+   report.AddedP99Ms = report.Fork.P99Ms - report.Direct.P99Ms
+   report.WithinBudget = budgetMs <= 0 || report.AddedP99Ms <= float64(budgetMs)
+   return report
+}
+
+// time a GET request to its last body byte
+func benchmarkRequest(client *http.Client, url string, shadow bool) (time.Duration, error) {
+   req, err := http.NewRequest("GET", url, nil)
+   if err != nil {
+      return 0, err
+   }
+   if shadow {
+      req.Header.Set(httpDuplicateHeader, httpNameHeader)
+   }
+   start := time.Now()
+   resp, err := client.Do(req)
+   if err != nil {
+      return 0, err
+   }
+   _, err = io.Copy(ioutil.Discard, resp.Body)
+   resp.Body.Close()
+   return time.Since(start), err
+}
@@ -0,0 +1,82 @@
+package forktraffic
+
+import (
+   "encoding/base64"
+   "encoding/hex"
+   "mime"
+   "strconv"
+   "strings"
+   "unicode"
+   "unicode/utf8"
+)
+
+// how the logs show binary bodies
+const LogBinaryBase64 string = "base64"
+const LogBinaryHex string = "hex"
+const LogBinaryOmit string = "omit"
+
+// media types whose bodies are binary whatever their bytes; prefixes end in "/"
+var binaryMediaTypes = []string{"application/grpc", "application/grpc+proto", "application/grpc-web",
+   "application/grpc-web+proto", "application/protobuf", "application/x-protobuf",
+   "application/vnd.google.protobuf", "application/octet-stream", "application/zip", "application/gzip",
+   "application/pdf", "application/cbor", "application/msgpack", "application/x-msgpack",
+   "application/avro", "image/", "audio/", "video/", "font/"}
+
+//
+// is a media type binary
+// - gRPC-Web text ("application/grpc-web-text") is base64 and not binary
+func binaryMediaType(contentType string) bool {
+   mediaType, _, err := mime.ParseMediaType(contentType)
+   if err != nil {
+      return false
+   }
+   for _, t := range binaryMediaTypes {
+      if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// is a body binary: of a binary media type, or not printable UTF-8 text
+func binaryBody(contentType string, body []byte) bool {
+   if binaryMediaType(contentType) {
+      return true
+   }
+   if !utf8.Valid(body) {
+      return true
+   }
+   for _, ch := range string(body) {
+      if !unicode.IsGraphic(ch) && ch != '\t' && ch != '\r' && ch != '\n' {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// a body as it is shown in the logs, up to limit bytes
+// - text is cut at a character boundary; binary bodies are shown as LogBinaryBodies
+//   says: "base64" (default), "hex", or "omit" for their size only
+// - only the logs are wrapped; the bodies sent to staging are never changed
+func (reqMgr *RequestManager) loggableBody(contentType string, body []byte, limit int) string {
+   cut := body
+   if len(cut) > limit {
+      cut = cut[:limit]
+   }
+   text := cut
+   for i := 1; i < utf8.UTFMax && len(text) > 0 && len(text) < len(body) && !utf8.Valid(text); i++ {
+      text = text[:len(text)-1]
+   }
+   if !binaryBody(contentType, text) {
+      return string(text)
+   }
+   switch reqMgr.LogBinaryBodies {
+   case LogBinaryHex:
+      return hex.EncodeToString(cut)
+   case LogBinaryOmit:
+      return "<" + strconv.Itoa(len(body)) + " bytes binary>"
+   }
+   return base64.StdEncoding.EncodeToString(cut)
+}
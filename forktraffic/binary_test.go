@@ -0,0 +1,175 @@
+package forktraffic
+
+import (
+   "bytes"
+   "compress/gzip"
+   "encoding/base64"
+   "encoding/hex"
+   "io/ioutil"
+   "net/http"
+   "net/http/httputil"
+   "net/url"
+   "strconv"
+   "testing"
+)
+
+// gRPC-Web frame: NUL bytes, invalid UTF-8 and multibyte characters
+var grpcWebBody = append([]byte{0, 0, 0, 0, 0x1c, 0x0a, 0xff, 0xfe, 0xc3, 0x28}, []byte("héllo 日本 \x00 wörld")...)
+
+// request manager with a staging target and staging body transforms
+func newBinaryManager(t *testing.T) *RequestManager {
+   prodUrl, _ := url.Parse("http://127.0.0.1:1/")
+   stagUrl, _ := url.Parse("http://127.0.0.1:2/")
+   reqMgr := &RequestManager{
+      UrlProduction:  prodUrl,
+      DestProduction: httputil.NewSingleHostReverseProxy(prodUrl),
+      UrlStaging:     stagUrl,
+      CacheData:      map[string]*StagKeys{"": new(StagKeys)},
+      QueueSize:      10,
+   }
+   reqMgr.ScrubFields = []string{"password"}
+   reqMgr.Init()
+   // a transform that would change any binary body it is given
+   reqMgr.AddBodyTransform(func(req *http.Request, plain []byte) []byte {
+      return bytes.Replace(plain, []byte{0}, []byte(" "), -1)
+   })
+   return reqMgr
+}
+
+// the staging copy of a request
+func forwardOf(t *testing.T, reqMgr *RequestManager, contentType, contentEncoding string, body []byte) (*http.Request, []byte) {
+   req, _ := http.NewRequest("POST", "http://fork.example.com/greeter.Greeter/SayHello", bytes.NewReader(body))
+   req.Header.Set("Content-Type", contentType)
+   if contentEncoding != "" {
+      req.Header.Set("Content-Encoding", contentEncoding)
+   }
+   sendReq := &PendingRequest{req: req, target: reqMgr.stagingTargets()[0], body: body}
+   stagReq, err := reqMgr.buildForwardRequest(sendReq)
+   if err != nil {
+      t.Fatal(err)
+   }
+   sent, err := ioutil.ReadAll(stagReq.Body)
+   if err != nil {
+      t.Fatal(err)
+   }
+   return stagReq, sent
+}
+
+func gzipped(t *testing.T, body []byte) []byte {
+   var buf bytes.Buffer
+   zw := gzip.NewWriter(&buf)
+   zw.Write(body)
+   if err := zw.Close(); err != nil {
+      t.Fatal(err)
+   }
+   return buf.Bytes()
+}
+
+func TestBinaryBodyByteExact(t *testing.T) {
+   reqMgr := newBinaryManager(t)
+   for _, contentType := range []string{"application/grpc-web+proto", "application/grpc", "application/octet-stream"} {
+      if got := reqMgr.stagingBody(&http.Request{Header: http.Header{"Content-Type": {contentType}}}, grpcWebBody); !bytes.Equal(got, grpcWebBody) {
+         t.Errorf("%s: staging body %q, want %q", contentType, got, grpcWebBody)
+      }
+      stagReq, sent := forwardOf(t, reqMgr, contentType, "", grpcWebBody)
+      if !bytes.Equal(sent, grpcWebBody) {
+         t.Errorf("%s: forwarded body %q, want %q", contentType, sent, grpcWebBody)
+      }
+      if got := stagReq.Header.Get("Content-Type"); got != contentType {
+         t.Errorf("%s: forwarded Content-Type %q", contentType, got)
+      }
+   }
+}
+
+func TestForwardKeepsContentHeaders(t *testing.T) {
+   reqMgr := newBinaryManager(t)
+
+   // a compressed binary body is sent as received, not re-encoded
+   compressed := gzipped(t, grpcWebBody)
+   stagReq, sent := forwardOf(t, reqMgr, "application/grpc-web+proto", "gzip", compressed)
+   if !bytes.Equal(sent, compressed) {
+      t.Errorf("compressed binary body changed")
+   }
+   if stagReq.Header.Get("Content-Encoding") != "gzip" || stagReq.Header.Get("Content-Type") != "application/grpc-web+proto" {
+      t.Errorf("forwarded headers %v", stagReq.Header)
+   }
+
+   // a compressed JSON body is transformed inside its encoding
+   stagReq, sent = forwardOf(t, reqMgr, "application/json; charset=utf-8", "gzip", gzipped(t, []byte(`{"password":"pw","name":"日本"}`)))
+   if stagReq.Header.Get("Content-Encoding") != "gzip" || stagReq.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+      t.Errorf("forwarded headers %v", stagReq.Header)
+   }
+   zr, err := gzip.NewReader(bytes.NewReader(sent))
+   if err != nil {
+      t.Fatal(err)
+   }
+   plain, _ := ioutil.ReadAll(zr)
+   if want := `{"name":"日本","password":"[redacted]"}`; string(plain) != want {
+      t.Errorf("forwarded JSON %s, want %s", plain, want)
+   }
+}
+
+func TestGrpcResponsesNotCompressed(t *testing.T) {
+   reqMgr := &RequestManager{Metrics: NewMetrics()}
+   reqMgr.Compression = []string{"gzip"}
+   reqMgr.CompressTypes = []string{"application/"}
+
+   compressed := func(contentType string) bool {
+      req, _ := http.NewRequest("POST", "http://fork.example.com/", nil)
+      req.Header.Set("Accept-Encoding", "gzip")
+      resp := &http.Response{
+         StatusCode:    http.StatusOK,
+         Header:        http.Header{"Content-Type": {contentType}},
+         Body:          ioutil.NopCloser(bytes.NewReader(grpcWebBody)),
+         ContentLength: -1,
+         Request:       req,
+      }
+      reqMgr.compressResponse(resp)
+      body, _ := ioutil.ReadAll(resp.Body)
+      if resp.Header.Get("Content-Encoding") == "" && !bytes.Equal(body, grpcWebBody) {
+         t.Errorf("%s: uncompressed body changed", contentType)
+      }
+      return resp.Header.Get("Content-Encoding") != ""
+   }
+
+   for _, contentType := range []string{"application/grpc", "application/grpc+proto", "application/grpc-web", "application/grpc-web+proto", "application/grpc-web-text"} {
+      if compressed(contentType) {
+         t.Errorf("%s response compressed", contentType)
+      }
+   }
+   if !compressed("application/json") {
+      t.Errorf("application/json response not compressed")
+   }
+}
+
+func TestLoggableBody(t *testing.T) {
+   reqMgr := &RequestManager{}
+
+   // text is cut at a character boundary
+   if got := reqMgr.loggableBody("text/plain", []byte("hé"), 2); got != "h" {
+      t.Errorf("text cut in a character: %q", got)
+   }
+   if got := reqMgr.loggableBody("text/plain", []byte("日本語"), 7); got != "日本" {
+      t.Errorf("text cut in a character: %q", got)
+   }
+   if got := reqMgr.loggableBody("application/json", []byte(`{"a":"日本"}`), 100); got != `{"a":"日本"}` {
+      t.Errorf("text changed: %q", got)
+   }
+
+   cut := grpcWebBody[:12]
+   for mode, want := range map[string]string{
+      "":              base64.StdEncoding.EncodeToString(cut),
+      LogBinaryBase64: base64.StdEncoding.EncodeToString(cut),
+      LogBinaryHex:    hex.EncodeToString(cut),
+      LogBinaryOmit:   "<" + strconv.Itoa(len(grpcWebBody)) + " bytes binary>",
+   } {
+      reqMgr.LogBinaryBodies = mode
+      if got := reqMgr.loggableBody("application/grpc-web+proto", grpcWebBody, 12); got != want {
+         t.Errorf("mode %q: %q, want %q", mode, got, want)
+      }
+      // invalid UTF-8 is binary whatever its media type
+      if got := reqMgr.loggableBody("text/plain", grpcWebBody, 12); got != want {
+         t.Errorf("mode %q, invalid text: %q, want %q", mode, got, want)
+      }
+   }
+}
@@ -0,0 +1,149 @@
+package forktraffic
+
+import (
+   "bytes"
+   "io"
+   "io/ioutil"
+   "log"
+   "mime"
+   "net/http"
+   "net/url"
+   "regexp"
+   "sort"
+   "strconv"
+   "strings"
+)
+
+// content type prefixes of the bodies rewritten unless RewriteBodyTypes is set
+var DefaultRewriteBodyTypes = []string{"text/html", "application/xhtml+xml", "application/json", "text/css", "text/javascript", "application/javascript"}
+
+// larger bodies are sent as they are unless RewriteBodyMaxBytes is set
+const DefaultRewriteBodyMaxBytes int64 = 4 << 20
+
+// a URL origin ends where a host and port cannot go on
+const originEnd string = `(?:[^A-Za-z0-9.:\-]|$)`
+
+// the JSON escaped form of an origin
+func jsonEscapedOrigin(origin string) string {
+   return strings.ReplaceAll(origin, "/", `\/`)
+}
+
+//
+// set up the URL rewriting of the response bodies
+// - RewriteBodyHosts pairs origins ("http://prod.internal:8080": "https://fork.example.com");
+//   without it the http and https origins of production's hosts become the public URL
+// - every origin also matches in its JSON escaped form
+func (reqMgr *RequestManager) initBodyUrls() {
+   if !reqMgr.RewriteBodyUrls {
+      return
+   }
+   pairs := make(map[string]string)
+   for from, to := range reqMgr.RewriteBodyHosts {
+      u, err := url.Parse(from)
+      if err != nil || u.Host == "" {
+         log.Printf("Warning - invalid RewriteBodyHosts origin %q", from)
+         continue
+      }
+      pairs[strings.ToLower(u.Scheme+"://"+u.Host)] = strings.TrimSuffix(to, "/")
+   }
+   if len(reqMgr.RewriteBodyHosts) == 0 {
+      hosts := append([]string{reqMgr.UrlProduction.Host}, reqMgr.ProductionHosts...)
+      for _, host := range hosts {
+         pairs["http://"+strings.ToLower(host)] = ""
+         pairs["https://"+strings.ToLower(host)] = ""
+      }
+   }
+   if len(pairs) == 0 {
+      return
+   }
+
+   all := make(map[string]string, 2*len(pairs))
+   origins := make([]string, 0, 2*len(pairs))
+   for from, to := range pairs {
+      all[from], all[jsonEscapedOrigin(from)] = to, jsonEscapedOrigin(to)
+      origins = append(origins, from, jsonEscapedOrigin(from))
+   }
+   sort.Slice(origins, func(i, j int) bool { return len(origins[i]) > len(origins[j]) })
+   for i := range origins {
+      origins[i] = regexp.QuoteMeta(origins[i])
+   }
+   reqMgr.bodyUrlPairs = all
+   reqMgr.bodyUrlPattern = regexp.MustCompile(`(?i)(` + strings.Join(origins, "|") + `)` + originEnd)
+}
+
+// should a body with this Content-Type be rewritten
+func (reqMgr *RequestManager) rewriteBodyType(contentType string) bool {
+   types := reqMgr.RewriteBodyTypes
+   if types == nil {
+      types = DefaultRewriteBodyTypes
+   }
+   mediaType, _, _ := mime.ParseMediaType(contentType)
+   for _, prefix := range types {
+      if strings.HasPrefix(mediaType, strings.ToLower(prefix)) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// replace the production origins of a body; "" pairs get the public origin
+func (reqMgr *RequestManager) rewriteUrls(plain []byte, public *url.URL) []byte {
+   count := 0
+   out := reqMgr.bodyUrlPattern.ReplaceAllFunc(plain, func(match []byte) []byte {
+      sub := reqMgr.bodyUrlPattern.FindSubmatchIndex(match)
+      origin, rest := match[:sub[3]], match[sub[3]:]
+      to, ok := reqMgr.bodyUrlPairs[strings.ToLower(string(origin))]
+      if to == "" && public != nil {
+         to = public.Scheme + "://" + public.Host
+         if bytes.Contains(origin, []byte(`\/`)) {
+            to = jsonEscapedOrigin(to)
+         }
+      }
+      if !ok || to == "" {
+         return match
+      }
+      count++
+      return append([]byte(to), rest...)
+   })
+   if count > 0 {
+      reqMgr.Metrics.Add("forktraffic_body_urls_rewritten_total", int64(count))
+   }
+   return out
+}
+
+//
+// rewrite the absolute production URLs of a response body to the fork's host
+// - bodies of the RewriteBodyTypes (default DefaultRewriteBodyTypes) up to
+//   RewriteBodyMaxBytes (default DefaultRewriteBodyMaxBytes), decoded and re-encoded
+//   by their Content-Encoding; larger ones stream unchanged
+func (reqMgr *RequestManager) rewriteBodyUrls(resp *http.Response) error {
+   if reqMgr.bodyUrlPattern == nil || resp.Body == nil || resp.Body == http.NoBody || !reqMgr.rewriteBodyType(resp.Header.Get("Content-Type")) {
+      return nil
+   }
+   limit := reqMgr.RewriteBodyMaxBytes
+   if limit <= 0 {
+      limit = DefaultRewriteBodyMaxBytes
+   }
+   if resp.ContentLength > limit {
+      return nil
+   }
+   body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+   if err != nil || int64(len(body)) > limit {
+      resp.Body = struct {
+         io.Reader
+         io.Closer
+      }{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+      return nil
+   }
+   resp.Body.Close()
+
+   public := reqMgr.publicUrl(resp)
+   body, _ = transformBody(body, resp.Header.Get("Content-Encoding"), func(plain []byte) []byte {
+      return reqMgr.rewriteUrls(plain, public)
+   })
+   resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+   resp.ContentLength = int64(len(body))
+   resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+   return nil
+}
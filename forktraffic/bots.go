@@ -0,0 +1,94 @@
+package forktraffic
+
+import (
+   "bufio"
+   "log"
+   "net/http"
+   "os"
+   "regexp"
+   "strings"
+)
+
+// bots are neither mirrored nor morfed or fuzzed
+const BotFilterMirror string = "mirror"
+
+// bots are mirrored but never morfed or fuzzed
+const BotFilterFuzz string = "fuzz"
+
+// User-Agent patterns of the known crawlers, monitors and HTTP libraries
+var DefaultBotPatterns = []string{
+   `bot\b`, `bot/`, `crawl`, `spider`, `slurp`, `googlebot`, `bingbot`, `yandex`, `baiduspider`,
+   `duckduckbot`, `applebot`, `ahrefs`, `semrush`, `mj12bot`, `petalbot`, `bytespider`,
+   `facebookexternalhit`, `twitterbot`, `linkedinbot`, `slackbot`, `discordbot`, `whatsapp`,
+   `headlesschrome`, `phantomjs`, `puppeteer`, `playwright`, `selenium`, `python-requests`,
+   `python-urllib`, `aiohttp`, `go-http-client`, `java/`, `okhttp`, `libwww-perl`, `wget`,
+   `scrapy`, `httpclient`, `pingdom`, `uptimerobot`, `statuscake`, `site24x7`, `newrelicpinger`,
+}
+
+//
+// load a crawler list: one User-Agent pattern per line, "#" starts a comment
+func loadBotList(file string) ([]string, error) {
+   fh, err := os.Open(file)
+   if err != nil {
+      return nil, err
+   }
+   defer fh.Close()
+   var patterns []string
+   scanner := bufio.NewScanner(fh)
+   for scanner.Scan() {
+      line := scanner.Text()
+      if i := strings.Index(line, "#"); i >= 0 {
+         line = line[:i]
+      }
+      if line = strings.TrimSpace(line); line != "" {
+         patterns = append(patterns, line)
+      }
+   }
+   return patterns, scanner.Err()
+}
+
+//
+// set up the bot detection
+// - DefaultBotPatterns, BotPatterns and the BotListFile patterns match case
+//   insensitive; invalid patterns are left out with a warning
+func (reqMgr *RequestManager) initBots() {
+   if reqMgr.BotFilter == "" {
+      return
+   }
+   if reqMgr.BotFilter != BotFilterMirror && reqMgr.BotFilter != BotFilterFuzz {
+      log.Printf("Warning - unknown bot filter %q; using %q", reqMgr.BotFilter, BotFilterMirror)
+      reqMgr.BotFilter = BotFilterMirror
+   }
+   patterns := append(append([]string{}, DefaultBotPatterns...), reqMgr.BotPatterns...)
+   if reqMgr.BotListFile != "" {
+      list, err := loadBotList(reqMgr.BotListFile)
+      if err != nil {
+         log.Printf("Warning - bot list %v: %v", reqMgr.BotListFile, err)
+      }
+      patterns = append(patterns, list...)
+   }
+   valid := make([]string, 0, len(patterns))
+   for _, pattern := range patterns {
+      if _, err := regexp.Compile(pattern); err != nil {
+         log.Printf("Warning - invalid bot pattern %q: %v", pattern, err)
+         continue
+      }
+      valid = append(valid, "(?:"+pattern+")")
+   }
+   reqMgr.botPattern = regexp.MustCompile("(?i)" + strings.Join(valid, "|"))
+}
+
+//
+// is the client a bot; requests without a User-Agent are
+func (reqMgr *RequestManager) isBot(req *http.Request) bool {
+   if reqMgr.botPattern == nil {
+      return false
+   }
+   ua := req.Header.Get("User-Agent")
+   return ua == "" || reqMgr.botPattern.MatchString(ua)
+}
+
+// is the request mirrored given its client
+func (reqMgr *RequestManager) mirrorBot(req *http.Request) bool {
+   return reqMgr.BotFilter != BotFilterMirror || !reqMgr.isBot(req)
+}
@@ -0,0 +1,281 @@
+package forktraffic
+
+import (
+   "fmt"
+   "math"
+   "net/http"
+   "sort"
+   "strings"
+   "sync"
+   "time"
+)
+
+// default canary analysis interval and the reports kept per target
+const DefaultCanaryIntervalSec int = 60
+const canaryReportsKept int = 60
+
+// latency histogram of a canary window: buckets 10% apart from 0.1ms, the last
+// one takes everything above ~2.5 minutes
+const latencyBuckets int = 150
+const latencyBucketMin float64 = 0.1
+const latencyBucketGrowth float64 = 1.1
+
+//
+// one mirrored request as seen by the canary analysis
+type canaryObservation struct {
+   prodStatus, stagStatus   int
+   prodLatency, stagLatency time.Duration
+   failed                   bool   // staging could not be reached
+   mismatch                 bool   // the statuses or the responses differ
+   bodyDiff                 string // chunk comparison of large bodies; "" when identical
+   diffs                    []string // differences found by DiffResponses
+}
+
+// observations of a target during the current interval
+type canaryWindow struct {
+   requests, failures, mismatches int64
+   prodErrors, stagErrors         int64
+   prodLatency, stagLatency       latencyHistogram
+}
+
+//
+// bounded latency distribution; percentiles are accurate to a bucket (10%)
+type latencyHistogram struct {
+   counts [latencyBuckets]int64
+   total  int64
+}
+
+func (lh *latencyHistogram) add(latency time.Duration) {
+   ms := float64(latency) / float64(time.Millisecond)
+   bucket := 0
+   if ms > latencyBucketMin {
+      bucket = int(math.Ceil(math.Log(ms/latencyBucketMin) / math.Log(latencyBucketGrowth)))
+   }
+   if bucket >= latencyBuckets {
+      bucket = latencyBuckets - 1
+   }
+   lh.counts[bucket]++
+   lh.total++
+}
+
+// percentile of the latencies in ms: the upper bound of its bucket
+func (lh *latencyHistogram) percentileMs(p float64) float64 {
+   if lh.total == 0 {
+      return 0
+   }
+   rank := int64(p*float64(lh.total-1)) + 1
+   var seen int64
+   for bucket, count := range lh.counts {
+      if seen += count; seen >= rank {
+         return latencyBucketMin * math.Pow(latencyBucketGrowth, float64(bucket))
+      }
+   }
+   return latencyBucketMin * math.Pow(latencyBucketGrowth, float64(latencyBuckets-1))
+}
+
+//
+// canary judgment of a staging target over one interval
+type CanaryReport struct {
+   Target        string
+   From, To      time.Time
+   Requests      int64
+   ProdErrorRate float64
+   StagErrorRate float64 // 5xx and unreachable
+   MismatchRate  float64
+   ProdP50Ms     float64
+   StagP50Ms     float64
+   ProdP95Ms     float64
+   StagP95Ms     float64
+   Score         float64 // 0..100
+   Verdict       string  // pass, marginal, fail, nodata
+   Reasons       []string
+}
+
+type canaryAnalysis struct {
+   lock    sync.Mutex
+   from    time.Time
+   windows map[string]*canaryWindow
+   reports map[string][]CanaryReport
+}
+
+//
+// record an observation of a target
+func (ca *canaryAnalysis) observe(target string, obs canaryObservation) {
+   ca.lock.Lock()
+   defer ca.lock.Unlock()
+   if ca.windows == nil {
+      ca.windows = make(map[string]*canaryWindow)
+   }
+   win := ca.windows[target]
+   if win == nil {
+      win = new(canaryWindow)
+      ca.windows[target] = win
+   }
+
+   win.requests++
+   if obs.prodStatus >= http.StatusInternalServerError {
+      win.prodErrors++
+   }
+   if obs.failed {
+      win.failures++
+      win.stagErrors++
+      return
+   }
+   if obs.stagStatus >= http.StatusInternalServerError {
+      win.stagErrors++
+   }
+   if obs.mismatch {
+      win.mismatches++
+   }
+   if obs.prodLatency > 0 {
+      win.prodLatency.add(obs.prodLatency)
+   }
+   win.stagLatency.add(obs.stagLatency)
+}
+
+// percentile of the latencies in ms
+func percentileMs(latencies []time.Duration, p float64) float64 {
+   if len(latencies) == 0 {
+      return 0
+   }
+   sorted := append([]time.Duration(nil), latencies...)
+   sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+   idx := int(p * float64(len(sorted)-1))
+   return float64(sorted[idx]) / float64(time.Millisecond)
+}
+
+//
+// score a window
+// - the score starts at 100; staging errors above production, mismatches
+//   and latency regressions take points off
+func judge(target string, win *canaryWindow, from, to time.Time) CanaryReport {
+   report := CanaryReport{Target: target, From: from, To: to, Requests: win.requests, Score: 100}
+   if win.requests == 0 {
+      report.Verdict = "nodata"
+      return report
+   }
+   n := float64(win.requests)
+   report.ProdErrorRate = float64(win.prodErrors) / n
+   report.StagErrorRate = float64(win.stagErrors) / n
+   report.MismatchRate = float64(win.mismatches) / n
+   report.ProdP50Ms = win.prodLatency.percentileMs(0.50)
+   report.StagP50Ms = win.stagLatency.percentileMs(0.50)
+   report.ProdP95Ms = win.prodLatency.percentileMs(0.95)
+   report.StagP95Ms = win.stagLatency.percentileMs(0.95)
+
+   if delta := report.StagErrorRate - report.ProdErrorRate; delta > 0 {
+      report.Score -= 400 * delta
+      report.Reasons = append(report.Reasons, fmt.Sprintf("staging error rate %.2f%% above production", 100*delta))
+   }
+   if report.MismatchRate > 0 {
+      report.Score -= 200 * report.MismatchRate
+      report.Reasons = append(report.Reasons, fmt.Sprintf("%.2f%% responses differ", 100*report.MismatchRate))
+   }
+   if report.ProdP95Ms > 0 && report.StagP95Ms > 1.2*report.ProdP95Ms {
+      ratio := report.StagP95Ms / report.ProdP95Ms
+      report.Score -= 20 * (ratio - 1.2)
+      report.Reasons = append(report.Reasons, fmt.Sprintf("staging p95 latency %.1fx production", ratio))
+   }
+
+   if report.Score < 0 {
+      report.Score = 0
+   }
+   switch {
+   case report.Score >= 75:
+      report.Verdict = "pass"
+   case report.Score >= 50:
+      report.Verdict = "marginal"
+   default:
+      report.Verdict = "fail"
+   }
+   return report
+}
+
+//
+// close the current interval: judge every target and start a new window
+func (ca *canaryAnalysis) rotate(now time.Time) {
+   ca.lock.Lock()
+   defer ca.lock.Unlock()
+   if ca.reports == nil {
+      ca.reports = make(map[string][]CanaryReport)
+   }
+   for target, win := range ca.windows {
+      reports := append(ca.reports[target], judge(target, win, ca.from, now))
+      if len(reports) > canaryReportsKept {
+         reports = reports[len(reports)-canaryReportsKept:]
+      }
+      ca.reports[target] = reports
+   }
+   ca.windows = make(map[string]*canaryWindow)
+   ca.from = now
+}
+
+// latest report of every target
+func (ca *canaryAnalysis) latest() []CanaryReport {
+   ca.lock.Lock()
+   defer ca.lock.Unlock()
+   var latest []CanaryReport
+   for _, reports := range ca.reports {
+      if len(reports) > 0 {
+         latest = append(latest, reports[len(reports)-1])
+      }
+   }
+   sort.Slice(latest, func(i, j int) bool { return latest[i].Target < latest[j].Target })
+   return latest
+}
+
+// all kept reports of a target
+func (ca *canaryAnalysis) history(target string) []CanaryReport {
+   ca.lock.Lock()
+   defer ca.lock.Unlock()
+   return append([]CanaryReport(nil), ca.reports[target]...)
+}
+
+//
+// run the canary analysis periodically
+func (reqMgr *RequestManager) startCanary() {
+   interval := reqMgr.CanaryIntervalSec
+   if interval <= 0 {
+      interval = DefaultCanaryIntervalSec
+   }
+   reqMgr.canary.from = reqMgr.Clock.Now()
+   go func() {
+      for {
+         time.Sleep(time.Duration(interval) * time.Second)
+         reqMgr.canary.rotate(reqMgr.Clock.Now())
+      }
+   }()
+}
+
+//
+// handle "/admin/canary"; the latest report per target
+// - ?target=name returns the report history of a target
+// - ?format=text returns a human readable summary
+func (reqMgr *RequestManager) adminCanary(w http.ResponseWriter, r *http.Request) {
+   var reports []CanaryReport
+   if target := r.URL.Query().Get("target"); target != "" {
+      reports = reqMgr.canary.history(target)
+   } else {
+      reports = reqMgr.canary.latest()
+   }
+
+   if r.URL.Query().Get("format") != "text" {
+      writeJson(w, reports)
+      return
+   }
+
+   var out strings.Builder
+   for _, rep := range reports {
+      fmt.Fprintf(&out, "%s  %s .. %s  %s (score %.0f)\n", rep.Target,
+         rep.From.Format(time.RFC3339), rep.To.Format(time.RFC3339), strings.ToUpper(rep.Verdict), rep.Score)
+      fmt.Fprintf(&out, "   requests %d; errors production %.2f%% staging %.2f%%; mismatches %.2f%%\n",
+         rep.Requests, 100*rep.ProdErrorRate, 100*rep.StagErrorRate, 100*rep.MismatchRate)
+      fmt.Fprintf(&out, "   latency p50 %.1f/%.1f ms, p95 %.1f/%.1f ms (production/staging)\n",
+         rep.ProdP50Ms, rep.StagP50Ms, rep.ProdP95Ms, rep.StagP95Ms)
+      for _, reason := range rep.Reasons {
+         fmt.Fprintf(&out, "   - %s\n", reason)
+      }
+   }
+   w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+   w.Write([]byte(out.String()))
+}
@@ -0,0 +1,131 @@
+package forktraffic
+
+import (
+   "io"
+   "mime"
+   "net/http"
+   "strings"
+   "sync"
+)
+
+// default limit of a captured response body
+const DefaultCaptureMaxBytes int = 64 * 1024
+
+//
+// captured response of production or staging
+type ResponseCapture struct {
+   Status    int
+   Header    http.Header
+   Body      []byte
+   Truncated bool // the body was longer than the capture limit
+}
+
+//
+// response capture options
+type CaptureOptions struct {
+   // capture production and staging response bodies for comparison
+   CaptureResponses bool
+
+   // compare the status, DiffHeaders and captured bodies (translated and normalized)
+   // of production and staging for every mirrored request; the mismatches are
+   // counted per route and logged with a correlation id, also sent to staging in
+   // X-Fork-Correlation-Id; bodies are captured as by CaptureResponses
+   DiffResponses bool
+
+   // JSON pointers (RFC 6901) left out of the comparison of JSON bodies, e.g.
+   // "/meta/requestId" or "/items/*/updatedAt"; "*" stands for any key or index
+   DiffIgnorePointers []string
+
+   // bytes captured per body; 0 uses DefaultCaptureMaxBytes
+   CaptureMaxBytes int
+
+   // captured media types (prefix match, e.g. "application/json", "text/"); empty captures all
+   CaptureContentTypes []string
+
+   // compare bodies of StreamCompareBytes or more, or of unknown length, by the
+   // hashes of their StreamChunkBytes chunks (default DefaultStreamChunkBytes)
+   // instead of buffering them; raw bytes, not normalized; 0 disables
+   StreamCompareBytes int
+   StreamChunkBytes   int
+}
+
+// are the response bodies captured
+func (co *CaptureOptions) capturing() bool {
+   return co.CaptureResponses || co.DiffResponses
+}
+
+// limit of a captured body
+func (co *CaptureOptions) captureLimit() int {
+   if co.CaptureMaxBytes <= 0 {
+      return DefaultCaptureMaxBytes
+   }
+   return co.CaptureMaxBytes
+}
+
+// should a response with this Content-Type be captured
+func (co *CaptureOptions) captureType(contentType string) bool {
+   if len(co.CaptureContentTypes) == 0 {
+      return true
+   }
+   mediaType, _, _ := mime.ParseMediaType(contentType)
+   for _, prefix := range co.CaptureContentTypes {
+      if strings.HasPrefix(mediaType, strings.ToLower(prefix)) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// body reader keeping a copy of the first bytes read
+// - the response streams to the client as before; only the copy is limited
+type captureReader struct {
+   io.ReadCloser
+   lock    sync.Mutex
+   capture *ResponseCapture
+   limit   int
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+   n, err := cr.ReadCloser.Read(p)
+   if n > 0 {
+      cr.lock.Lock()
+      room := cr.limit - len(cr.capture.Body)
+      if room >= n {
+         cr.capture.Body = append(cr.capture.Body, p[:n]...)
+      } else {
+         if room > 0 {
+            cr.capture.Body = append(cr.capture.Body, p[:room]...)
+         }
+         cr.capture.Truncated = true
+      }
+      cr.lock.Unlock()
+   }
+   return n, err
+}
+
+//
+// start capturing a production response
+func (reqMgr *RequestManager) captureProduction(resp *http.Response, ex *exchange) {
+   if !reqMgr.capturing() || !reqMgr.captureType(resp.Header.Get("Content-Type")) {
+      return
+   }
+   ex.prodCapture = &ResponseCapture{Status: resp.StatusCode, Header: resp.Header.Clone()}
+   resp.Body = &captureReader{ReadCloser: resp.Body, capture: ex.prodCapture, limit: reqMgr.captureLimit()}
+}
+
+//
+// capture a staging response from its (already read) body
+func (reqMgr *RequestManager) captureStaging(resp *http.Response, body []byte) *ResponseCapture {
+   if !reqMgr.capturing() || !reqMgr.captureType(resp.Header.Get("Content-Type")) {
+      return nil
+   }
+   capture := &ResponseCapture{Status: resp.StatusCode, Header: resp.Header.Clone()}
+   limit := reqMgr.captureLimit()
+   if len(body) > limit {
+      body = body[:limit]
+      capture.Truncated = true
+   }
+   capture.Body = append([]byte(nil), body...)
+   return capture
+}
@@ -0,0 +1,407 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "log"
+   "net/http"
+   "sort"
+   "sync"
+   "time"
+)
+
+// default length of a chaos experiment, the guardrail check interval and the summaries kept
+const DefaultChaosDurationSec int = 300
+const chaosCheckInterval time.Duration = time.Second
+const chaosSummariesKept int = 20
+
+var errChaosRunning = errors.New("a chaos experiment is running")
+var errChaosUnknown = errors.New("unknown chaos experiment")
+
+//
+// named chaos experiment; a test profile run on a sample of the traffic for a while
+// - the sampled requests use Profile in place of the configured TestOptions
+// - the experiment is aborted when production crosses a guardrail
+type ChaosExperiment struct {
+   Name    string
+   Profile TestOptions
+
+   // percent of the requests run with the profile; 0 for all
+   Percent int
+
+   // length in seconds (default DefaultChaosDurationSec) and start in seconds
+   // after the fork started; 0 starts only from "/admin/chaos"
+   DurationSec int
+   StartSec    int
+
+   // production guardrails of the sampled requests: error rate (0..1) and p95
+   // latency in ms, checked once MinRequests were seen; 0 disables
+   MaxProdErrorRate float64
+   MaxProdP95Ms     float64
+   MinRequests      int64
+}
+
+//
+// outcome of the requests of one arm of an experiment
+type ChaosArmReport struct {
+   Requests      int64
+   ProdErrorRate float64
+   ProdP50Ms     float64
+   ProdP95Ms     float64
+   Mirrored      int64
+   StagErrorRate float64 // 5xx and unreachable
+   Morfs         map[string]int64
+}
+
+//
+// summary of a chaos experiment; Sampled ran with the profile, Control without
+type ChaosSummary struct {
+   Name             string
+   Start, End       time.Time
+   Outcome          string // running, completed, aborted
+   AbortReason      string
+   Sampled, Control ChaosArmReport
+   NewFailureGroups int // triage signatures first seen during the experiment
+}
+
+// requests of one arm
+type chaosArm struct {
+   requests, prodErrors int64
+   prodLatency          latencyHistogram
+   mirrored, stagErrors int64
+   morfs                map[string]int64
+}
+
+func (arm *chaosArm) report() ChaosArmReport {
+   report := ChaosArmReport{Requests: arm.requests, Mirrored: arm.mirrored, Morfs: make(map[string]int64)}
+   if arm.requests > 0 {
+      report.ProdErrorRate = float64(arm.prodErrors) / float64(arm.requests)
+   }
+   if arm.mirrored > 0 {
+      report.StagErrorRate = float64(arm.stagErrors) / float64(arm.mirrored)
+   }
+   report.ProdP50Ms = arm.prodLatency.percentileMs(0.50)
+   report.ProdP95Ms = arm.prodLatency.percentileMs(0.95)
+   for morf, n := range arm.morfs {
+      report.Morfs[morf] = n
+   }
+   return report
+}
+
+// a running experiment
+type chaosRun struct {
+   experiment       *ChaosExperiment
+   start            time.Time
+   stop             chan string
+   sampled, control chaosArm
+   groups           int
+}
+
+type chaosScheduler struct {
+   lock      sync.Mutex
+   running   *chaosRun
+   summaries []ChaosSummary
+}
+
+// the arm of an exchange
+func (run *chaosRun) arm(ex *exchange) *chaosArm {
+   if ex != nil && ex.tests == &run.experiment.Profile {
+      return &run.sampled
+   }
+   return &run.control
+}
+
+//
+// test options of a new request; the profile of the running experiment for
+// its sample of the requests, the configured TestOptions otherwise
+func (reqMgr *RequestManager) chaosTests() *TestOptions {
+   cs := &reqMgr.chaos
+   cs.lock.Lock()
+   defer cs.lock.Unlock()
+   if run := cs.running; run != nil {
+      if run.experiment.Percent <= 0 || reqMgr.Rand.Intn(100) < run.experiment.Percent {
+         return &run.experiment.Profile
+      }
+   }
+   return &reqMgr.TestOptions
+}
+
+//
+// test options selected for the exchange of a staging copy
+// - without an exchange the configured TestOptions, unless the request is never morfed
+func (reqMgr *RequestManager) testsOf(sendReq *PendingRequest) *TestOptions {
+   if ex := sendReq.exchange; ex != nil && ex.tests != nil {
+      return ex.tests
+   }
+   if reqMgr.noMorf(sendReq.req) {
+      return &noMorfTests
+   }
+   return &reqMgr.TestOptions
+}
+
+//
+// record the production outcome of a request
+func (cs *chaosScheduler) observeProduction(ex *exchange) {
+   cs.lock.Lock()
+   defer cs.lock.Unlock()
+   if cs.running == nil {
+      return
+   }
+   arm := cs.running.arm(ex)
+   arm.requests++
+   if ex.status() >= http.StatusInternalServerError {
+      arm.prodErrors++
+   }
+   arm.prodLatency.add(ex.prodLatency)
+}
+
+//
+// record the staging outcome of a mirrored request
+func (cs *chaosScheduler) observeStaging(sendReq *PendingRequest, obs canaryObservation) {
+   cs.lock.Lock()
+   defer cs.lock.Unlock()
+   if cs.running == nil {
+      return
+   }
+   arm := cs.running.arm(sendReq.exchange)
+   arm.mirrored++
+   if obs.failed || obs.stagStatus >= http.StatusInternalServerError {
+      arm.stagErrors++
+   }
+   if arm.morfs == nil {
+      arm.morfs = make(map[string]int64)
+   }
+   for _, morf := range sendReq.morfs {
+      arm.morfs[morf]++
+   }
+}
+
+//
+// the crossed guardrail of a run; "" while production is within them
+func (cs *chaosScheduler) guardrail(run *chaosRun) string {
+   cs.lock.Lock()
+   report := run.sampled.report()
+   cs.lock.Unlock()
+
+   exp := run.experiment
+   if report.Requests == 0 || report.Requests < exp.MinRequests {
+      return ""
+   }
+   if exp.MaxProdErrorRate > 0 && report.ProdErrorRate > exp.MaxProdErrorRate {
+      return fmt.Sprintf("production error rate %.2f%% above %.2f%%", 100*report.ProdErrorRate, 100*exp.MaxProdErrorRate)
+   }
+   if exp.MaxProdP95Ms > 0 && report.ProdP95Ms > exp.MaxProdP95Ms {
+      return fmt.Sprintf("production p95 latency %.1f ms above %.1f ms", report.ProdP95Ms, exp.MaxProdP95Ms)
+   }
+   return ""
+}
+
+// summary of a run, finished or not
+func (cs *chaosScheduler) summary(run *chaosRun) ChaosSummary {
+   return ChaosSummary{
+      Name:    run.experiment.Name,
+      Start:   run.start,
+      Outcome: "running",
+      Sampled: run.sampled.report(),
+      Control: run.control.report(),
+   }
+}
+
+// number of triage failure groups
+func (reqMgr *RequestManager) triageGroups() int {
+   reqMgr.triage.lock.Lock()
+   defer reqMgr.triage.lock.Unlock()
+   return len(reqMgr.triage.groups)
+}
+
+//
+// start a configured chaos experiment by name
+// - one experiment runs at a time
+func (reqMgr *RequestManager) RunChaos(name string) error {
+   var exp *ChaosExperiment = nil
+   for i := range reqMgr.ChaosExperiments {
+      if reqMgr.ChaosExperiments[i].Name == name {
+         exp = &reqMgr.ChaosExperiments[i]
+      }
+   }
+   if exp == nil {
+      return errChaosUnknown
+   }
+
+   run := &chaosRun{experiment: exp, start: reqMgr.Clock.Now(), stop: make(chan string, 1), groups: reqMgr.triageGroups()}
+   cs := &reqMgr.chaos
+   cs.lock.Lock()
+   if cs.running != nil {
+      cs.lock.Unlock()
+      return errChaosRunning
+   }
+   cs.running = run
+   cs.lock.Unlock()
+
+   log.Printf("chaos experiment %v started", name)
+   reqMgr.Metrics.Set("forktraffic_chaos_running", 1, "experiment", name)
+   go reqMgr.runChaos(run)
+   return nil
+}
+
+//
+// abort the running chaos experiment; false if none is running
+func (reqMgr *RequestManager) AbortChaos(reason string) bool {
+   cs := &reqMgr.chaos
+   cs.lock.Lock()
+   defer cs.lock.Unlock()
+   if cs.running == nil {
+      return false
+   }
+   select {
+   case cs.running.stop <- reason:
+   default:
+   }
+   return true
+}
+
+//
+// watch a run until it completes or is aborted, then publish its summary
+func (reqMgr *RequestManager) runChaos(run *chaosRun) {
+   duration := run.experiment.DurationSec
+   if duration <= 0 {
+      duration = DefaultChaosDurationSec
+   }
+   end := run.start.Add(time.Duration(duration) * time.Second)
+
+   outcome, reason := "", ""
+   ticker := time.NewTicker(chaosCheckInterval)
+   defer ticker.Stop()
+   for outcome == "" {
+      select {
+      case reason = <-run.stop:
+         outcome = "aborted"
+      case <-ticker.C:
+         if reason = reqMgr.chaos.guardrail(run); reason != "" {
+            outcome = "aborted"
+         } else if !reqMgr.Clock.Now().Before(end) {
+            outcome = "completed"
+         }
+      }
+   }
+
+   cs := &reqMgr.chaos
+   cs.lock.Lock()
+   cs.running = nil
+   summary := cs.summary(run)
+   summary.End = reqMgr.Clock.Now()
+   summary.Outcome, summary.AbortReason = outcome, reason
+   summary.NewFailureGroups = reqMgr.triageGroups() - run.groups
+   cs.summaries = append(cs.summaries, summary)
+   if len(cs.summaries) > chaosSummariesKept {
+      cs.summaries = cs.summaries[len(cs.summaries)-chaosSummariesKept:]
+   }
+   cs.lock.Unlock()
+
+   reqMgr.Metrics.Set("forktraffic_chaos_running", 0, "experiment", summary.Name)
+   reqMgr.Metrics.Inc("forktraffic_chaos_experiments_total", "outcome", outcome)
+   reqMgr.publishChaos(summary)
+}
+
+//
+// publish an experiment summary to the log and to ChaosSummaryUrl
+func (reqMgr *RequestManager) publishChaos(summary ChaosSummary) {
+   outcome := summary.Outcome
+   if summary.AbortReason != "" {
+      outcome += " (" + summary.AbortReason + ")"
+   }
+   log.Printf("chaos experiment %v %v after %v: %d requests (%d sampled), production errors %.2f%%/%.2f%%, p95 %.1f/%.1f ms, staging errors %.2f%%/%.2f%% (sampled/control), %d new failure groups",
+      summary.Name, outcome, summary.End.Sub(summary.Start).Round(time.Second),
+      summary.Sampled.Requests+summary.Control.Requests, summary.Sampled.Requests,
+      100*summary.Sampled.ProdErrorRate, 100*summary.Control.ProdErrorRate,
+      summary.Sampled.ProdP95Ms, summary.Control.ProdP95Ms,
+      100*summary.Sampled.StagErrorRate, 100*summary.Control.StagErrorRate,
+      summary.NewFailureGroups)
+
+   if reqMgr.ChaosSummaryUrl == "" {
+      return
+   }
+   buf, _ := json.Marshal(summary)
+   client := &http.Client{Timeout: 10 * time.Second}
+   resp, err := client.Post(reqMgr.ChaosSummaryUrl, "application/json", bytes.NewReader(buf))
+   if err != nil {
+      log.Printf("chaos summary not published: %v", err)
+      return
+   }
+   resp.Body.Close()
+   if resp.StatusCode >= http.StatusBadRequest {
+      log.Printf("chaos summary not published: %v", resp.Status)
+   }
+}
+
+//
+// start the configured experiments at their StartSec, one after the other
+func (reqMgr *RequestManager) startChaos() {
+   var scheduled []*ChaosExperiment
+   for i := range reqMgr.ChaosExperiments {
+      if reqMgr.ChaosExperiments[i].StartSec > 0 {
+         scheduled = append(scheduled, &reqMgr.ChaosExperiments[i])
+      }
+   }
+   if len(scheduled) == 0 {
+      return
+   }
+   sort.SliceStable(scheduled, func(i, j int) bool { return scheduled[i].StartSec < scheduled[j].StartSec })
+
+   go func() {
+      for _, exp := range scheduled {
+         at := reqMgr.started.Add(time.Duration(exp.StartSec) * time.Second)
+         if wait := at.Sub(reqMgr.Clock.Now()); wait > 0 {
+            time.Sleep(wait)
+         }
+         for reqMgr.RunChaos(exp.Name) == errChaosRunning {
+            time.Sleep(chaosCheckInterval)
+         }
+      }
+   }()
+}
+
+//
+// handle "/admin/chaos"; the experiments, the running one and the latest summaries
+// - POST ?name=experiment starts an experiment
+// - DELETE aborts the running experiment
+func (reqMgr *RequestManager) adminChaos(w http.ResponseWriter, r *http.Request) {
+   switch r.Method {
+   case "GET":
+   case "POST":
+      err := reqMgr.RunChaos(r.URL.Query().Get("name"))
+      if err == errChaosUnknown {
+         ResponseHttpError(w, http.StatusNotFound, ": "+err.Error())
+         return
+      } else if err != nil {
+         ResponseHttpError(w, http.StatusConflict, ": "+err.Error())
+         return
+      }
+   case "DELETE":
+      if !reqMgr.AbortChaos("aborted from the admin API") {
+         ResponseHttpError(w, http.StatusNotFound, "")
+         return
+      }
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+      return
+   }
+
+   cs := &reqMgr.chaos
+   cs.lock.Lock()
+   var running *ChaosSummary = nil
+   if cs.running != nil {
+      summary := cs.summary(cs.running)
+      running = &summary
+   }
+   summaries := append([]ChaosSummary(nil), cs.summaries...)
+   cs.lock.Unlock()
+
+   writeJson(w, struct {
+      Experiments []ChaosExperiment
+      Running     *ChaosSummary
+      Summaries   []ChaosSummary
+   }{reqMgr.ChaosExperiments, running, summaries})
+}
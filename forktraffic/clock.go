@@ -0,0 +1,95 @@
+package forktraffic
+
+import (
+   "crypto/rand"
+   "math/big"
+   "sync"
+   "time"
+)
+
+//
+// time source used by the request manager
+// - expiration and cache logic read the time only through this interface
+// - network deadlines are set on the wall clock; the sockets know no other
+type Clock interface {
+   Now() time.Time
+}
+
+//
+// random source used by the request manager
+// - Intn returns a value in [0,n); a non-positive n returns 0
+type Rand interface {
+   Intn(n int) int
+}
+
+//
+// wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+//
+// crypto random numbers
+type cryptoRand struct{}
+
+func (cryptoRand) Intn(n int) int {
+   if n <= 0 {
+      return 0
+   }
+   bigCh, _ := rand.Int(rand.Reader, big.NewInt(int64(n)))
+   return int(bigCh.Uint64())
+}
+
+//
+// clock that only moves when told to; for tests and replays
+type FakeClock struct {
+   lock sync.Mutex
+   now  time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+   return &FakeClock{now: start}
+}
+
+func (fc *FakeClock) Now() time.Time {
+   fc.lock.Lock()
+   defer fc.lock.Unlock()
+   return fc.now
+}
+
+// set the current time
+func (fc *FakeClock) Set(t time.Time) {
+   fc.lock.Lock()
+   fc.now = t
+   fc.lock.Unlock()
+}
+
+// move the clock forward
+func (fc *FakeClock) Advance(d time.Duration) {
+   fc.lock.Lock()
+   fc.now = fc.now.Add(d)
+   fc.lock.Unlock()
+}
+
+//
+// random source returning a scripted sequence of values
+// - each value is reduced modulo n; the sequence repeats when exhausted
+type FakeRand struct {
+   lock   sync.Mutex
+   Values []int
+   next   int
+}
+
+func (fr *FakeRand) Intn(n int) int {
+   fr.lock.Lock()
+   defer fr.lock.Unlock()
+   if n <= 0 || len(fr.Values) == 0 {
+      return 0
+   }
+   v := fr.Values[fr.next%len(fr.Values)]
+   fr.next++
+   if v < 0 {
+      v = -v
+   }
+   return v % n
+}
@@ -0,0 +1,174 @@
+package forktraffic
+
+import (
+   "compress/gzip"
+   "compress/zlib"
+   "io"
+   "log"
+   "mime"
+   "net/http"
+   "strconv"
+   "strings"
+)
+
+// content types compressed unless CompressTypes is set; a trailing "/" matches the whole type
+var DefaultCompressTypes = []string{"text/", "application/json", "application/javascript", "application/xml",
+   "application/graphql-response+json", "application/problem+json", "image/svg+xml"}
+
+// responses announcing fewer bytes are sent as they are
+const DefaultCompressMinBytes int64 = 1024
+
+// supported encodings, in order of preference
+var compressEncodings = []string{"gzip", "deflate"}
+
+//
+// check the Compression encodings; unsupported ones are left out with a warning
+func (reqMgr *RequestManager) initCompression() {
+   var encodings []string
+   for _, name := range reqMgr.Compression {
+      name = strings.ToLower(name)
+      supported := false
+      for _, enc := range compressEncodings {
+         supported = supported || enc == name
+      }
+      if !supported {
+         log.Printf("Warning - unsupported compression %q", name)
+         continue
+      }
+      encodings = append(encodings, name)
+   }
+   reqMgr.Compression = encodings
+}
+
+//
+// the encoding a client accepts, of the Compression encodings; "" for none
+// - q=0 refuses an encoding, "*" accepts any; the server preference breaks ties
+func (reqMgr *RequestManager) acceptedEncoding(req *http.Request) string {
+   accepted := make(map[string]float64)
+   for _, line := range req.Header.Values("Accept-Encoding") {
+      for _, part := range strings.Split(line, ",") {
+         fields := strings.Split(part, ";")
+         name, q := strings.ToLower(strings.TrimSpace(fields[0])), 1.0
+         for _, param := range fields[1:] {
+            if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+               q, _ = strconv.ParseFloat(param[2:], 64)
+            }
+         }
+         if name != "" {
+            accepted[name] = q
+         }
+      }
+   }
+   best, bestQ := "", 0.0
+   for _, enc := range reqMgr.Compression {
+      q, ok := accepted[enc]
+      if !ok {
+         q = accepted["*"]
+      }
+      if q > bestQ {
+         best, bestQ = enc, q
+      }
+   }
+   return best
+}
+
+// is this content type compressed
+func (reqMgr *RequestManager) compressType(contentType string) bool {
+   mediaType, _, err := mime.ParseMediaType(contentType)
+   if err != nil || strings.HasPrefix(mediaType, "application/grpc") {
+      return false
+   }
+   types := reqMgr.CompressTypes
+   if types == nil {
+      types = DefaultCompressTypes
+   }
+   for _, t := range types {
+      if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// compress a production response to its client
+// - only uncompressed responses of the CompressTypes (default DefaultCompressTypes)
+//   announcing at least CompressMinBytes (default DefaultCompressMinBytes), or of
+//   unknown length, are compressed; HEAD, partial and bodiless responses never are
+func (reqMgr *RequestManager) compressResponse(resp *http.Response) {
+   if len(reqMgr.Compression) == 0 || resp.Request == nil || resp.Request.Method == "HEAD" {
+      return
+   }
+   if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+      resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+      return
+   }
+   minBytes := reqMgr.CompressMinBytes
+   if minBytes <= 0 {
+      minBytes = DefaultCompressMinBytes
+   }
+   if resp.ContentLength >= 0 && resp.ContentLength < minBytes || !reqMgr.compressType(resp.Header.Get("Content-Type")) {
+      return
+   }
+   resp.Header.Add("Vary", "Accept-Encoding")
+   encoding := reqMgr.acceptedEncoding(resp.Request)
+   if encoding == "" {
+      return
+   }
+
+   level := reqMgr.CompressLevel
+   if level == 0 {
+      level = gzip.DefaultCompression
+   }
+   pr, pw := io.Pipe()
+   out := &countingWriter{Writer: pw}
+   var enc io.WriteCloser
+   var err error
+   if encoding == "gzip" {
+      enc, err = gzip.NewWriterLevel(out, level)
+   } else {
+      // HTTP deflate is the zlib format
+      enc, err = zlib.NewWriterLevel(out, level)
+   }
+   if err != nil {
+      return
+   }
+   body := resp.Body
+   go func() {
+      in, err := io.Copy(enc, body)
+      if cerr := enc.Close(); err == nil {
+         err = cerr
+      }
+      pw.CloseWithError(err)
+      reqMgr.Metrics.Add("forktraffic_compression_bytes_total", in, "direction", "in")
+      reqMgr.Metrics.Add("forktraffic_compression_bytes_total", out.count, "direction", "out")
+   }()
+
+   reqMgr.Metrics.Inc("forktraffic_compressed_responses_total", "encoding", encoding)
+   resp.Body = struct {
+      io.Reader
+      io.Closer
+   }{pr, closerFunc(func() error {
+      pr.Close()
+      return body.Close()
+   })}
+   resp.Header.Set("Content-Encoding", encoding)
+   resp.Header.Del("Content-Length")
+   resp.ContentLength = -1
+}
+
+// writer counting the bytes written
+type countingWriter struct {
+   io.Writer
+   count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+   n, err := cw.Writer.Write(p)
+   cw.count += int64(n)
+   return n, err
+}
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error { return fn() }
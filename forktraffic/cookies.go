@@ -0,0 +1,99 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+)
+
+//
+// scope of a cached staging cookie, as staging set it
+// - a production Domain (e.g. staging echoing the production domain) is mapped to
+//   its staging domain through CookieDomainMap; a domain that does not cover the
+//   staging host keeps the cookie from being sent, as a browser would
+func (reqMgr *RequestManager) scopeCookie(cc *http.Cookie) *http.Cookie {
+   scope := &http.Cookie{Name: cc.Name, Domain: strings.TrimPrefix(strings.ToLower(cc.Domain), "."), Path: cc.Path,
+      Secure: cc.Secure, SameSite: cc.SameSite}
+   if to, ok := reqMgr.CookieDomainMap[scope.Domain]; ok {
+      scope.Domain = strings.TrimPrefix(strings.ToLower(to), ".")
+   }
+   return scope
+}
+
+//
+// the path a staging cookie is matched against: the path of the staging copy,
+// with its production prefix mapped to the staging one through CookiePathMap
+func (reqMgr *RequestManager) stagingCookiePath(path string) string {
+   for from, to := range reqMgr.CookiePathMap {
+      if strings.HasPrefix(path, from) {
+         return to + path[len(from):]
+      }
+   }
+   return path
+}
+
+//
+// RFC 6265 domain matching
+func domainMatch(host, domain string) bool {
+   host = strings.ToLower(host)
+   return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+//
+// RFC 6265 path matching
+func pathMatch(reqPath, cookiePath string) bool {
+   if cookiePath == "" || reqPath == cookiePath {
+      return true
+   }
+   if strings.HasPrefix(reqPath, cookiePath) {
+      return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+   }
+   return false
+}
+
+//
+// is the production request cross-site; from the browser fetch metadata or the Origin
+// compared with the host the client addressed (the request Host is production's by now)
+func crossSite(req *http.Request) bool {
+   if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+      return site == "cross-site"
+   }
+   if origin := req.Header.Get("Origin"); origin != "" && origin != "null" {
+      originHost := strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://")
+      clientHost := req.Host
+      if ex := exchangeOf(req); ex != nil && ex.clientHost != "" {
+         clientHost = ex.clientHost
+      }
+      return !strings.EqualFold(originHost, clientHost)
+   }
+   return false
+}
+
+//
+// should the scoped cookie be sent with a staging request
+// - the staging host and the path of the staging copy, mapped through
+//   CookiePathMap, must be in the scope
+// - Secure cookies are not sent to a plaintext staging unless StripSecureCookies is set
+// - SameSite=Strict cookies are not sent for cross-site requests unless IgnoreSameSite is set
+func (reqMgr *RequestManager) cookieInScope(scope *http.Cookie, target *stagingTarget, req *http.Request, path string) bool {
+   if scope == nil {
+      return true
+   }
+   if !(scope.Domain == "" || domainMatch(target.url.Hostname(), scope.Domain)) || !pathMatch(reqMgr.stagingCookiePath(path), scope.Path) {
+      reqMgr.Metrics.Inc("forktraffic_cookies_dropped_total", "reason", "scope")
+      return false
+   }
+
+   if scope.Secure && target.url.Scheme != "https" {
+      if !reqMgr.StripSecureCookies {
+         reqMgr.Metrics.Inc("forktraffic_cookies_dropped_total", "reason", "secure")
+         return false
+      }
+      reqMgr.Metrics.Inc("forktraffic_cookies_secure_stripped_total")
+   }
+
+   if scope.SameSite == http.SameSiteStrictMode && !reqMgr.IgnoreSameSite && crossSite(req) {
+      reqMgr.Metrics.Inc("forktraffic_cookies_dropped_total", "reason", "samesite")
+      return false
+   }
+   return true
+}
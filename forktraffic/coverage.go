@@ -0,0 +1,87 @@
+package forktraffic
+
+import (
+   "net/http"
+   "sort"
+   "strings"
+)
+
+//
+// how much of the production traffic reached staging
+// - Excluded: production requests not mirrored, by reason (filters, status,
+//   retries, aborts, warmup, ...)
+// - Dropped: staging copies lost after they were queued, by reason (queue
+//   overflow, removed destination, dead letters)
+// - Coverage is Mirrored / Requests; DeliveredCoverage also discounts the dropped copies
+type MirrorCoverage struct {
+   Requests          int64
+   Mirrored          int64
+   Copies            int64
+   Coverage          float64
+   DeliveredCoverage float64
+   Excluded          []CoverageReason
+   Dropped           []CoverageReason
+}
+
+type CoverageReason struct {
+   Reason   string
+   Count    int64
+   Fraction float64
+}
+
+// the reasons of a labelled counter, most frequent first; Fraction is against total
+func coverageReasons(snap map[string]int64, name string, total int64) []CoverageReason {
+   prefix := name + "{reason=\""
+   reasons := []CoverageReason{}
+   for key, n := range snap {
+      if !strings.HasPrefix(key, prefix) || n == 0 {
+         continue
+      }
+      reason := CoverageReason{Reason: strings.TrimSuffix(key[len(prefix):], "\"}"), Count: n}
+      if total > 0 {
+         reason.Fraction = float64(n) / float64(total)
+      }
+      reasons = append(reasons, reason)
+   }
+   sort.Slice(reasons, func(i, j int) bool {
+      if reasons[i].Count != reasons[j].Count {
+         return reasons[i].Count > reasons[j].Count
+      }
+      return reasons[i].Reason < reasons[j].Reason
+   })
+   return reasons
+}
+
+// mirror coverage from the metrics
+func (reqMgr *RequestManager) mirrorCoverage() MirrorCoverage {
+   snap := reqMgr.Metrics.Snapshot()
+   cov := MirrorCoverage{
+      Requests: snap["forktraffic_production_requests_total"],
+      Mirrored: snap["forktraffic_mirrored_requests_total"],
+      Copies:   snap["forktraffic_mirror_copies_total"],
+   }
+   cov.Excluded = coverageReasons(snap, "forktraffic_mirror_skipped_total", cov.Requests)
+   cov.Dropped = coverageReasons(snap, "forktraffic_mirror_dropped_total", cov.Copies)
+
+   if cov.Requests > 0 {
+      cov.Coverage = float64(cov.Mirrored) / float64(cov.Requests)
+      cov.DeliveredCoverage = cov.Coverage
+   }
+   if cov.Copies > 0 {
+      var dropped int64 = 0
+      for _, reason := range cov.Dropped {
+         dropped += reason.Count
+      }
+      if dropped > cov.Copies {
+         dropped = cov.Copies
+      }
+      cov.DeliveredCoverage *= 1 - float64(dropped)/float64(cov.Copies)
+   }
+   return cov
+}
+
+//
+// handle "/admin/coverage"; the fraction of the production traffic mirrored to staging
+func (reqMgr *RequestManager) adminCoverage(w http.ResponseWriter, r *http.Request) {
+   writeJson(w, reqMgr.mirrorCoverage())
+}
@@ -0,0 +1,275 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "os"
+   "path/filepath"
+   "strings"
+   "sync"
+   "time"
+)
+
+// default pause before the first forward retry; it doubles with every retry
+const DefaultForwardRetryMs int = 500
+
+// dead letters kept in memory
+const deadLettersLimit int = 1000
+
+//
+// a staging copy that could not be delivered after its retries
+// - Header and Body are redacted; the original request is kept in memory for
+//   requeueing, entries loaded from DeadLetterDir are requeued as stored
+type deadLetter struct {
+   Id       string
+   Time     time.Time
+   Region   string
+   Method   string
+   Url      string
+   Host     string
+   Header   http.Header
+   Body     []byte
+   Attempts int
+   Error    string
+
+   pending *PendingRequest
+}
+
+type deadLetterLog struct {
+   lock    sync.Mutex
+   letters []*deadLetter
+}
+
+// add a letter; returns the letter pushed out by the limit, if any
+func (dl *deadLetterLog) add(letter *deadLetter) *deadLetter {
+   dl.lock.Lock()
+   defer dl.lock.Unlock()
+   dl.letters = append(dl.letters, letter)
+   if len(dl.letters) > deadLettersLimit {
+      dropped := dl.letters[0]
+      dl.letters = dl.letters[1:]
+      return dropped
+   }
+   return nil
+}
+
+// the letters without headers and bodies
+func (dl *deadLetterLog) list() []deadLetter {
+   dl.lock.Lock()
+   defer dl.lock.Unlock()
+   letters := make([]deadLetter, len(dl.letters))
+   for i, letter := range dl.letters {
+      letters[i] = *letter
+      letters[i].Header, letters[i].Body = nil, nil
+   }
+   return letters
+}
+
+// remove letters by id, all of them without ids
+func (dl *deadLetterLog) remove(ids ...string) []*deadLetter {
+   dl.lock.Lock()
+   defer dl.lock.Unlock()
+   var removed, kept []*deadLetter
+   for _, letter := range dl.letters {
+      match := len(ids) == 0
+      for _, id := range ids {
+         match = match || letter.Id == id
+      }
+      if match {
+         removed = append(removed, letter)
+      } else {
+         kept = append(kept, letter)
+      }
+   }
+   dl.letters = kept
+   return removed
+}
+
+func (dl *deadLetterLog) find(id string) *deadLetter {
+   dl.lock.Lock()
+   defer dl.lock.Unlock()
+   for _, letter := range dl.letters {
+      if letter.Id == id {
+         return letter
+      }
+   }
+   return nil
+}
+
+func (dl *deadLetterLog) size() int {
+   dl.lock.Lock()
+   defer dl.lock.Unlock()
+   return len(dl.letters)
+}
+
+//
+// a staging copy could not be delivered
+// - retried ForwardRetries times (or its route's Retries) with a doubling pause, then dead-lettered
+func (reqMgr *RequestManager) forwardFailed(sendReq *PendingRequest, err error) {
+   if sendReq.attempts < reqMgr.forwardRetries(sendReq) {
+      pause := reqMgr.ForwardRetryMs
+      if pause <= 0 {
+         pause = DefaultForwardRetryMs
+      }
+      pause <<= uint(sendReq.attempts)
+      sendReq.attempts++
+      reqMgr.Metrics.Inc("forktraffic_forward_retries_total", "region", sendReq.target.label())
+      go func() {
+         time.Sleep(time.Duration(pause) * time.Millisecond)
+         reqMgr.sendStaging(sendReq)
+      }()
+      return
+   }
+
+   req := sendReq.req
+   letter := &deadLetter{
+      Id:       reqMgr.createReqId(),
+      Time:     reqMgr.Clock.Now(),
+      Region:   sendReq.target.region,
+      Method:   req.Method,
+      Url:      req.URL.RequestURI(),
+      Host:     req.Host,
+      Header:   reqMgr.redactHeader(req.Header),
+      Body:     reqMgr.redactBody(sendReq.body, req.Header.Get("Content-Encoding")),
+      Attempts: sendReq.attempts + 1,
+      Error:    err.Error(),
+      pending:  sendReq,
+   }
+   reqMgr.addDeadLetter(letter)
+   reqMgr.Metrics.Inc("forktraffic_dead_letters_total", "region", sendReq.target.label())
+   reqMgr.Metrics.Inc("forktraffic_mirror_dropped_total", "reason", "dead_letter")
+}
+
+// keep a letter in memory and in DeadLetterDir
+func (reqMgr *RequestManager) addDeadLetter(letter *deadLetter) {
+   if dropped := reqMgr.deadLetters.add(letter); dropped != nil {
+      reqMgr.removeDeadLetterFile(dropped)
+   }
+   reqMgr.Metrics.Set("forktraffic_dead_letters", int64(reqMgr.deadLetters.size()))
+   if reqMgr.DeadLetterDir == "" || letter.pending == nil {
+      return
+   }
+   buf, err := json.MarshalIndent(letter, "", "  ")
+   if err == nil {
+      err = os.MkdirAll(reqMgr.DeadLetterDir, 0700)
+   }
+   if err == nil {
+      err = ioutil.WriteFile(filepath.Join(reqMgr.DeadLetterDir, letter.Id+".json"), buf, 0600)
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: letter.Url, Err: err})
+   }
+}
+
+func (reqMgr *RequestManager) removeDeadLetterFile(letter *deadLetter) {
+   if reqMgr.DeadLetterDir != "" {
+      os.Remove(filepath.Join(reqMgr.DeadLetterDir, letter.Id+".json"))
+   }
+}
+
+//
+// load the dead letters of a previous run from DeadLetterDir
+func (reqMgr *RequestManager) loadDeadLetters() {
+   if reqMgr.DeadLetterDir == "" {
+      return
+   }
+   files, _ := filepath.Glob(filepath.Join(reqMgr.DeadLetterDir, "*.json"))
+   for _, file := range files {
+      buf, err := ioutil.ReadFile(file)
+      letter := new(deadLetter)
+      if err == nil && json.Unmarshal(buf, letter) == nil && letter.Id != "" {
+         reqMgr.addDeadLetter(letter)
+      }
+   }
+   if len(files) > 0 {
+      log.Printf("dead letters loaded: %d", reqMgr.deadLetters.size())
+   }
+}
+
+//
+// queue a dead letter again; false when its staging destination was removed
+func (reqMgr *RequestManager) requeueDeadLetter(letter *deadLetter) bool {
+   // the destination of the region may have been replaced meanwhile
+   var target *stagingTarget = nil
+   for _, t := range reqMgr.stagingTargets() {
+      if t.region == letter.Region {
+         target = t
+      }
+   }
+   if target == nil {
+      return false
+   }
+   sendReq := letter.pending
+   if sendReq == nil {
+      req, err := http.NewRequest(letter.Method, letter.Url, bytes.NewReader(letter.Body))
+      if err != nil {
+         return false
+      }
+      req.Header, req.Host, req.RequestURI = letter.Header, letter.Host, letter.Url
+      if req.Header == nil {
+         req.Header = http.Header{}
+      }
+      sendReq = &PendingRequest{req: req, target: target, body: letter.Body}
+      if len(letter.Body) == 0 {
+         sendReq.body = nil
+      }
+   }
+   sendReq.target, sendReq.attempts = target, 0
+   reqMgr.Metrics.Inc("forktraffic_dead_letters_requeued_total", "region", sendReq.target.label())
+   go reqMgr.sendStaging(sendReq)
+   return true
+}
+
+//
+// handle "/admin/deadletters"; the staging copies that could not be delivered
+// - GET lists them; ?id=letter returns one with its (redacted) headers and body
+// - POST ?id=letter[,letter] requeues letters; no id requeues all of them; letters
+//   of a removed staging destination are kept
+// - DELETE ?id=letter[,letter] purges letters; no id purges all of them
+func (reqMgr *RequestManager) adminDeadLetters(w http.ResponseWriter, r *http.Request) {
+   var ids []string
+   if id := r.URL.Query().Get("id"); id != "" {
+      ids = strings.Split(id, ",")
+   }
+
+   switch r.Method {
+   case "GET":
+      if len(ids) == 0 {
+         writeJson(w, reqMgr.deadLetters.list())
+         return
+      }
+      letter := reqMgr.deadLetters.find(ids[0])
+      if letter == nil {
+         ResponseHttpError(w, http.StatusNotFound, "")
+         return
+      }
+      writeJson(w, letter)
+   case "POST", "DELETE":
+      removed := reqMgr.deadLetters.remove(ids...)
+      if len(ids) > 0 && len(removed) == 0 {
+         ResponseHttpError(w, http.StatusNotFound, "")
+         return
+      }
+      result := struct{ Requeued, Purged, Kept int }{}
+      for _, letter := range removed {
+         if r.Method == "DELETE" {
+            result.Purged++
+         } else if reqMgr.requeueDeadLetter(letter) {
+            result.Requeued++
+         } else {
+            // the staging destination is gone; keep the letter
+            reqMgr.deadLetters.add(letter)
+            result.Kept++
+            continue
+         }
+         reqMgr.removeDeadLetterFile(letter)
+      }
+      reqMgr.Metrics.Set("forktraffic_dead_letters", int64(reqMgr.deadLetters.size()))
+      writeJson(w, result)
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+   }
+}
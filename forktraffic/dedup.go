@@ -0,0 +1,74 @@
+package forktraffic
+
+import (
+   "crypto/sha256"
+   "encoding/hex"
+   "net/http"
+   "sync"
+)
+
+// client supplied idempotency key
+const httpIdempotencyHeader string = "Idempotency-Key"
+
+//
+// recently mirrored requests, for client retry detection
+// - a request is a retry when the same session sent the same idempotency key,
+//   or the same method, path and body, within the window
+type retryFilter struct {
+   lock    sync.Mutex
+   seen    map[string]int64 // request fingerprint -> expiration ms
+   pruneAt int64
+}
+
+// fingerprint of a request; "" when it cannot be recognized as a retry
+func retryFingerprint(req *http.Request, body []byte, session string) string {
+   if key := req.Header.Get(httpIdempotencyHeader); key != "" {
+      return session + "|key|" + key
+   }
+   if len(body) == 0 {
+      return ""
+   }
+   sum := sha256.Sum256(body)
+   return session + "|" + req.Method + " " + req.URL.Path + "|" + hex.EncodeToString(sum[:])
+}
+
+//
+// check and record a request; true when it repeats a request seen within the window
+func (rf *retryFilter) isRetry(fingerprint string, now, windowMs int64) bool {
+   rf.lock.Lock()
+   defer rf.lock.Unlock()
+
+   if rf.seen == nil {
+      rf.seen = make(map[string]int64)
+   }
+
+   // drop expired entries once per window
+   if now >= rf.pruneAt {
+      for key, expires := range rf.seen {
+         if expires <= now {
+            delete(rf.seen, key)
+         }
+      }
+      rf.pruneAt = now + windowMs
+   }
+
+   if expires, ok := rf.seen[fingerprint]; ok && expires > now {
+      return true
+   }
+   rf.seen[fingerprint] = now + windowMs
+   return false
+}
+
+//
+// is the request a client retry that should not be mirrored again
+func (reqMgr *RequestManager) suppressRetry(req *http.Request, body []byte) bool {
+   if reqMgr.RetryWindowMs <= 0 {
+      return false
+   }
+   session, _ := getSessionKey(req.Cookies())
+   fingerprint := retryFingerprint(req, body, session)
+   if fingerprint == "" {
+      return false
+   }
+   return reqMgr.retries.isRetry(fingerprint, reqMgr.nowMs(), int64(reqMgr.RetryWindowMs))
+}
@@ -0,0 +1,272 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "log"
+   "log/slog"
+   "mime"
+   "net/http"
+   "sort"
+   "strings"
+)
+
+// correlation id of a compared staging copy; the X-Request-Id of the client when it sent one
+const httpCorrelationHeader string = "X-Fork-Correlation-Id"
+
+// give an exchange whose responses are compared its correlation id
+func (reqMgr *RequestManager) correlate(req *http.Request, ex *exchange) {
+   if !reqMgr.DiffResponses || ex.correlationId != "" {
+      return
+   }
+   ex.correlationId = req.Header.Get(httpRequestIdHeader)
+   if ex.correlationId == "" {
+      ex.correlationId = reqMgr.createReqId()
+   }
+}
+
+//
+// differences between a production and a staging response: status code, DiffHeaders
+// and bodies, once translated, normalized and decoded from their Content-Encoding
+// - a body missing on either side (not captured) is not compared
+func (reqMgr *RequestManager) diffResponses(req *http.Request, prod, stag *ResponseCapture) []string {
+   var diffs []string
+   if prod.Status != stag.Status {
+      diffs = append(diffs, fmt.Sprintf("status %d vs %d", prod.Status, stag.Status))
+   }
+   for _, name := range reqMgr.DiffHeaders {
+      name = http.CanonicalHeaderKey(name)
+      if !sameValues(prod.Header.Values(name), stag.Header.Values(name)) {
+         diffs = append(diffs, "header "+name)
+      }
+   }
+   if prod.Body == nil || stag.Body == nil {
+      return diffs
+   }
+
+   prod, stag = reqMgr.translateCapture(req, prod, false), reqMgr.translateCapture(req, stag, true)
+   prod, stag = reqMgr.normalizeCapture(req, prod), reqMgr.normalizeCapture(req, stag)
+   prodBody, stagBody := prod.Body, stag.Body
+   if plain, ok := decodeBody(prodBody, prod.Header.Get("Content-Encoding")); ok {
+      prodBody = plain
+   }
+   if plain, ok := decodeBody(stagBody, stag.Header.Get("Content-Encoding")); ok {
+      stagBody = plain
+   }
+   diff, isJson := "", false
+   if !prod.Truncated && !stag.Truncated && jsonBody(prod.Header) && jsonBody(stag.Header) {
+      diff, isJson = reqMgr.diffJsonBodies(prodBody, stagBody)
+   }
+   if !isJson {
+      diff = diffBodies(prodBody, stagBody, prod.Truncated || stag.Truncated)
+   }
+   if diff != "" {
+      diffs = append(diffs, diff)
+   }
+   return diffs
+}
+
+//
+// split the DiffIgnorePointers in their tokens; invalid pointers are skipped
+func (reqMgr *RequestManager) initDiffIgnore() {
+   reqMgr.diffIgnore = nil
+   for _, pointer := range reqMgr.DiffIgnorePointers {
+      if !strings.HasPrefix(pointer, "/") {
+         log.Printf("Warning - invalid JSON pointer %q", pointer)
+         continue
+      }
+      var tokens []string
+      for _, token := range strings.Split(pointer[1:], "/") {
+         tokens = append(tokens, strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1))
+      }
+      reqMgr.diffIgnore = append(reqMgr.diffIgnore, tokens)
+   }
+}
+
+// is a response body JSON, by its Content-Type
+func jsonBody(header http.Header) bool {
+   mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+   return jsonMediaType(mediaType)
+}
+
+//
+// compare two JSON bodies regardless of key order, without the DiffIgnorePointers;
+// false when either body is not a JSON document
+func (reqMgr *RequestManager) diffJsonBodies(prod, stag []byte) (string, bool) {
+   var prodDoc, stagDoc interface{}
+   if decodeJson(prod, &prodDoc) != nil || decodeJson(stag, &stagDoc) != nil {
+      return "", false
+   }
+   for _, tokens := range reqMgr.diffIgnore {
+      prodDoc = removeJsonPointer(prodDoc, tokens)
+      stagDoc = removeJsonPointer(stagDoc, tokens)
+   }
+   return diffJson(prodDoc, stagDoc, ""), true
+}
+
+// decode a whole JSON document, keeping the numbers as written
+func decodeJson(body []byte, doc *interface{}) error {
+   dec := json.NewDecoder(bytes.NewReader(body))
+   dec.UseNumber()
+   if err := dec.Decode(doc); err != nil {
+      return err
+   }
+   if dec.More() {
+      return errJsonTrailing
+   }
+   return nil
+}
+
+// remove the values a tokenized JSON pointer selects; the document itself is never removed
+func removeJsonPointer(doc interface{}, tokens []string) interface{} {
+   if len(tokens) == 0 {
+      return doc
+   }
+   token, rest := tokens[0], tokens[1:]
+   switch v := doc.(type) {
+   case map[string]interface{}:
+      for key, val := range v {
+         if token != "*" && key != token {
+            continue
+         }
+         if len(rest) == 0 {
+            delete(v, key)
+         } else {
+            v[key] = removeJsonPointer(val, rest)
+         }
+      }
+   case []interface{}:
+      kept := v[:0]
+      for i, val := range v {
+         if token != "*" && fmt.Sprint(i) != token {
+            kept = append(kept, val)
+         } else if len(rest) > 0 {
+            kept = append(kept, removeJsonPointer(val, rest))
+         }
+      }
+      return kept
+   }
+   return doc
+}
+
+//
+// the first difference between two JSON documents, by JSON pointer; "" when equal
+// - object keys are visited in order, so the key order of the bodies does not matter
+func diffJson(prod, stag interface{}, pointer string) string {
+   switch p := prod.(type) {
+   case map[string]interface{}:
+      s, ok := stag.(map[string]interface{})
+      if !ok {
+         return "body type differs at " + jsonPointerOf(pointer)
+      }
+      keys := make([]string, 0, len(p)+len(s))
+      for key := range p {
+         keys = append(keys, key)
+      }
+      for key := range s {
+         if _, found := p[key]; !found {
+            keys = append(keys, key)
+         }
+      }
+      sort.Strings(keys)
+      for _, key := range keys {
+         child := pointer + "/" + strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+         prodVal, inProd := p[key]
+         stagVal, inStag := s[key]
+         if !inStag {
+            return "body misses " + child + " in staging"
+         }
+         if !inProd {
+            return "body adds " + child + " in staging"
+         }
+         if diff := diffJson(prodVal, stagVal, child); diff != "" {
+            return diff
+         }
+      }
+      return ""
+   case []interface{}:
+      s, ok := stag.([]interface{})
+      if !ok {
+         return "body type differs at " + jsonPointerOf(pointer)
+      }
+      for i := 0; i < len(p) && i < len(s); i++ {
+         if diff := diffJson(p[i], s[i], fmt.Sprintf("%v/%d", pointer, i)); diff != "" {
+            return diff
+         }
+      }
+      if len(p) != len(s) {
+         return fmt.Sprintf("body length of %v %d vs %d", jsonPointerOf(pointer), len(p), len(s))
+      }
+      return ""
+   default:
+      if prod != stag {
+         return "body differs at " + jsonPointerOf(pointer)
+      }
+      return ""
+   }
+}
+
+// the pointer of the whole document reads better as "/"
+func jsonPointerOf(pointer string) string {
+   if pointer == "" {
+      return "/"
+   }
+   return pointer
+}
+
+//
+// where two bodies differ; "" when identical
+// - truncated bodies are only compared over their common captured length
+func diffBodies(prod, stag []byte, truncated bool) string {
+   common := len(prod)
+   if len(stag) < common {
+      common = len(stag)
+   }
+   for i := 0; i < common; i++ {
+      if prod[i] != stag[i] {
+         return fmt.Sprintf("body differs at byte %d", i)
+      }
+   }
+   if len(prod) != len(stag) && !truncated {
+      return fmt.Sprintf("body length %d vs %d", len(prod), len(stag))
+   }
+   return ""
+}
+
+//
+// compare the responses of a mirrored request when DiffResponses is set
+// - the production response is the one captured by respHandler; without a
+//   captured body only the status and DiffHeaders are compared
+// - forktraffic_response_comparisons_total counts the comparisons and
+//   forktraffic_response_diffs_total the differences, by region, route and "what"
+//   (status, header, body); every mismatch is logged with its correlation id
+func (reqMgr *RequestManager) diffExchange(sendReq *PendingRequest, resp *http.Response, stag *ResponseCapture) []string {
+   ex := sendReq.exchange
+   if !reqMgr.DiffResponses || ex == nil {
+      return nil
+   }
+   prod := ex.prodCapture
+   if prod == nil || stag == nil {
+      prod = &ResponseCapture{Status: ex.status(), Header: ex.prodHeader}
+      stag = &ResponseCapture{Status: resp.StatusCode, Header: resp.Header}
+   }
+   region := sendReq.target.label()
+   reqMgr.Metrics.Inc("forktraffic_response_comparisons_total", "region", region, "route", ex.route)
+   diffs := reqMgr.diffResponses(sendReq.req, prod, stag)
+   if len(diffs) == 0 {
+      return nil
+   }
+   for _, diff := range diffs {
+      what := strings.SplitN(diff, " ", 2)[0]
+      reqMgr.Metrics.Inc("forktraffic_response_diffs_total", "region", region, "route", ex.route, "what", what)
+   }
+   slog.Warn("response mismatch",
+      "id", ex.correlationId,
+      "region", region,
+      "method", sendReq.req.Method,
+      "path", sendReq.req.URL.Path,
+      "route", ex.route,
+      "diffs", strings.Join(diffs, "; "))
+   return diffs
+}
@@ -0,0 +1,142 @@
+package forktraffic
+
+import (
+   "fmt"
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+)
+
+//
+// disk-backed queue; one file per request in a directory
+// - files are named by sequence number; requests left by a previous run are sent first
+type diskQueue struct {
+   reqMgr   *RequestManager
+   dir      string
+   capacity int
+
+   lock   sync.Mutex
+   ready  *sync.Cond
+   seqs   []uint64
+   next   uint64
+   closed bool
+}
+
+func newDiskQueue(reqMgr *RequestManager, dir string, capacity int) (*diskQueue, error) {
+   if dir == "" {
+      return nil, errNoQueueDir
+   }
+   if err := os.MkdirAll(dir, 0700); err != nil {
+      return nil, err
+   }
+   files, err := ioutil.ReadDir(dir)
+   if err != nil {
+      return nil, err
+   }
+
+   dq := &diskQueue{reqMgr: reqMgr, dir: dir, capacity: capacity}
+   dq.ready = sync.NewCond(&dq.lock)
+   for _, file := range files {
+      name := file.Name()
+      if strings.HasSuffix(name, ".tmp") {
+         os.Remove(filepath.Join(dir, name))
+         continue
+      }
+      if seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".req"), 10, 64); err == nil && strings.HasSuffix(name, ".req") {
+         dq.seqs = append(dq.seqs, seq)
+      }
+   }
+   sort.Slice(dq.seqs, func(i, j int) bool { return dq.seqs[i] < dq.seqs[j] })
+   if len(dq.seqs) > 0 {
+      dq.next = dq.seqs[len(dq.seqs)-1] + 1
+   }
+   return dq, nil
+}
+
+func (dq *diskQueue) path(seq uint64) string {
+   return filepath.Join(dq.dir, fmt.Sprintf("%020d.req", seq))
+}
+
+// write the file, then make it visible under its final name
+func (dq *diskQueue) Push(sendReq *PendingRequest) error {
+   buf, err := dq.reqMgr.encodePending(sendReq)
+   if err != nil {
+      return err
+   }
+   dq.lock.Lock()
+   seq := dq.next
+   dq.next++
+   dq.lock.Unlock()
+
+   tmp := dq.path(seq) + ".tmp"
+   if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+      return err
+   }
+   if err := os.Rename(tmp, dq.path(seq)); err != nil {
+      return err
+   }
+
+   dq.lock.Lock()
+   dq.seqs = append(dq.seqs, seq)
+   if n := len(dq.seqs); n > 1 && dq.seqs[n-2] > seq {
+      sort.Slice(dq.seqs, func(i, j int) bool { return dq.seqs[i] < dq.seqs[j] })
+   }
+   dq.lock.Unlock()
+   dq.ready.Signal()
+   return nil
+}
+
+// take the file of the oldest request
+func (dq *diskQueue) take(wait bool) ([]byte, bool, error) {
+   dq.lock.Lock()
+   for wait && len(dq.seqs) == 0 && !dq.closed {
+      dq.ready.Wait()
+   }
+   if len(dq.seqs) == 0 {
+      dq.lock.Unlock()
+      return nil, false, nil
+   }
+   seq := dq.seqs[0]
+   dq.seqs = dq.seqs[1:]
+   dq.lock.Unlock()
+
+   buf, err := ioutil.ReadFile(dq.path(seq))
+   os.Remove(dq.path(seq))
+   return buf, true, err
+}
+
+func (dq *diskQueue) Pop() (*PendingRequest, error) {
+   buf, ok, err := dq.take(true)
+   if !ok || err != nil {
+      return nil, err
+   }
+   return dq.reqMgr.decodePending(buf)
+}
+
+func (dq *diskQueue) DropOldest() *PendingRequest {
+   buf, ok, err := dq.take(false)
+   if !ok || err != nil {
+      return nil
+   }
+   sendReq, _ := dq.reqMgr.decodePending(buf)
+   return sendReq
+}
+
+func (dq *diskQueue) Close() {
+   dq.lock.Lock()
+   dq.closed = true
+   dq.lock.Unlock()
+   dq.ready.Broadcast()
+}
+
+func (dq *diskQueue) Len() int {
+   dq.lock.Lock()
+   defer dq.lock.Unlock()
+   return len(dq.seqs)
+}
+
+func (dq *diskQueue) Cap() int { return dq.capacity }
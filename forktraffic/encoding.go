@@ -0,0 +1,136 @@
+package forktraffic
+
+import (
+   "bytes"
+   "compress/flate"
+   "compress/gzip"
+   "compress/zlib"
+   "io"
+   "io/ioutil"
+   "net/http"
+   "strings"
+)
+
+//
+// decode a body by its Content-Encoding
+// - returns false for encodings we do not handle (e.g. br) or corrupt input
+func decodeBody(body []byte, encoding string) ([]byte, bool) {
+   var rd io.ReadCloser
+   var err error
+   switch strings.ToLower(strings.TrimSpace(encoding)) {
+   case "", "identity":
+      return body, true
+   case "gzip", "x-gzip":
+      rd, err = gzip.NewReader(bytes.NewReader(body))
+   case "deflate":
+      // HTTP deflate is zlib framed; some clients send raw deflate
+      rd, err = zlib.NewReader(bytes.NewReader(body))
+      if err != nil {
+         rd, err = flate.NewReader(bytes.NewReader(body)), nil
+      }
+   default:
+      return body, false
+   }
+   if err != nil {
+      return body, false
+   }
+   defer rd.Close()
+   plain, err := ioutil.ReadAll(rd)
+   if err != nil {
+      return body, false
+   }
+   return plain, true
+}
+
+//
+// encode a body with the given Content-Encoding
+func encodeBody(plain []byte, encoding string) ([]byte, error) {
+   var buf bytes.Buffer
+   var wr io.WriteCloser
+   switch strings.ToLower(strings.TrimSpace(encoding)) {
+   case "", "identity":
+      return plain, nil
+   case "gzip", "x-gzip":
+      wr = gzip.NewWriter(&buf)
+   case "deflate":
+      wr = zlib.NewWriter(&buf)
+   default:
+      return plain, nil
+   }
+   if _, err := wr.Write(plain); err != nil {
+      return nil, err
+   }
+   if err := wr.Close(); err != nil {
+      return nil, err
+   }
+   return buf.Bytes(), nil
+}
+
+//
+// apply a transformation to the decoded body and re-encode it
+// - the Content-Encoding stays consistent with the returned bytes
+// - false for a body we cannot decode (e.g. br, stacked encodings) or re-encode;
+//   the body is returned unchanged and the caller decides whether it may be used
+func transformBody(body []byte, encoding string, fn func(plain []byte) []byte) ([]byte, bool) {
+   if len(body) == 0 {
+      return body, true
+   }
+   plain, ok := decodeBody(body, encoding)
+   if !ok {
+      return body, false
+   }
+   changed := fn(plain)
+   if bytes.Equal(changed, plain) {
+      return body, true
+   }
+   encoded, err := encodeBody(changed, encoding)
+   if err != nil {
+      return body, false
+   }
+   return encoded, true
+}
+
+//
+// can the staging body transformations (redaction, scrubbing, pseudonyms) be
+// applied to a request body
+// - a body that cannot be decoded is not mirrored, so it never reaches staging
+//   untransformed; forktraffic_undecodable_bodies_total counts them, by "use"
+func (reqMgr *RequestManager) transformable(req *http.Request, body []byte) bool {
+   if len(reqMgr.bodyTransforms) == 0 || len(body) == 0 || binaryMediaType(req.Header.Get("Content-Type")) {
+      return true
+   }
+   if _, ok := decodeBody(body, req.Header.Get("Content-Encoding")); ok {
+      return true
+   }
+   reqMgr.Metrics.Inc("forktraffic_undecodable_bodies_total", "use", "staging")
+   return false
+}
+
+//
+// body transformation applied to the staging copy
+type BodyTransform func(req *http.Request, plain []byte) []byte
+
+// register a staging body transformation; transformations run in registration order
+func (reqMgr *RequestManager) AddBodyTransform(fn BodyTransform) {
+   reqMgr.bodyTransforms = append(reqMgr.bodyTransforms, fn)
+}
+
+//
+// the body sent to staging: decoded, transformed, re-encoded
+// - binary bodies are sent as production received them
+// - a body that cannot be transformed is never sent; nil
+func (reqMgr *RequestManager) stagingBody(req *http.Request, body []byte) []byte {
+   if len(reqMgr.bodyTransforms) == 0 || binaryMediaType(req.Header.Get("Content-Type")) {
+      return body
+   }
+   transformed, ok := transformBody(body, req.Header.Get("Content-Encoding"), func(plain []byte) []byte {
+      for _, fn := range reqMgr.bodyTransforms {
+         plain = fn(req, plain)
+      }
+      return plain
+   })
+   if !ok {
+      return nil
+   }
+   return transformed
+}
@@ -0,0 +1,35 @@
+package forktraffic
+
+import (
+   "net"
+   "net/http"
+)
+
+// Envoy request id; kept identical on the shadow copy
+const httpRequestIdHeader string = "X-Request-Id"
+
+// headers Envoy propagates unchanged to the shadow copy: the request id and the
+// trace context (B3, OpenTracing, W3C)
+var envoyPropagatedHeaders = []string{httpRequestIdHeader,
+   httpB3Single, httpB3TraceId, httpB3SpanId, httpB3ParentSpan, "X-B3-Sampled", "X-B3-Flags",
+   "X-Ot-Span-Context", httpTraceParent, httpTraceState}
+
+//
+// apply the Envoy request mirroring conventions to a staging copy
+// - the Host/Authority gets a "-shadow" suffix (before the port)
+// - x-request-id and the trace headers are carried over as production got them,
+//   so both copies share the request id and the trace
+func envoyShadow(stagReq *http.Request, req *http.Request) {
+   host, port, err := net.SplitHostPort(stagReq.Host)
+   if err != nil {
+      stagReq.Host = stagReq.Host + "-shadow"
+   } else {
+      stagReq.Host = net.JoinHostPort(host+"-shadow", port)
+   }
+
+   for _, name := range envoyPropagatedHeaders {
+      if vals := req.Header.Values(name); len(vals) > 0 {
+         stagReq.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), vals...)
+      }
+   }
+}
@@ -0,0 +1,108 @@
+package forktraffic
+
+import (
+   "errors"
+   "sync"
+   "time"
+)
+
+//
+// error classes; every failure on the staging path is reported as one of these
+var (
+   ErrReadBody              = errors.New("cannot read request body")
+   ErrQueueFull             = errors.New("pending requests queue full")
+   ErrQueue                 = errors.New("pending requests queue unavailable")
+   ErrBuildRequest          = errors.New("cannot build staging request")
+   ErrStagingUnavailable    = errors.New("staging unavailable")
+   ErrProductionUnavailable = errors.New("production unavailable")
+   ErrCapture               = errors.New("cannot write capture")
+)
+
+// a destination URL without scheme or host
+var errInvalidDestination = errors.New("destination requires a scheme and a host")
+
+// queue backend configuration errors
+var errUnknownQueue = errors.New("unknown queue backend")
+var errNoQueueDir = errors.New("the disk queue requires QueueDir")
+var errNoQueueRedis = errors.New("the redis queue requires RedisAddr")
+
+// a JSON body followed by more data
+var errJsonTrailing = errors.New("data after the JSON document")
+
+// a scenario rule without a name, a start or an end
+var errScenarioRule = errors.New("scenario requires a name, a start and an end")
+
+// metric label for each error class
+var errorClassNames = map[error]string{
+   ErrReadBody:              "read_body",
+   ErrQueueFull:             "queue_full",
+   ErrQueue:                 "queue",
+   ErrBuildRequest:          "build_request",
+   ErrStagingUnavailable:    "staging_unavailable",
+   ErrProductionUnavailable: "production_unavailable",
+   ErrCapture:               "capture",
+}
+
+//
+// a classified failure of a mirrored request
+// - errors.Is(err, ErrQueueFull) etc. matches the class
+type ForwardError struct {
+   Class error
+   Path  string
+   Err   error
+}
+
+func (fe *ForwardError) Error() string {
+   msg := fe.Class.Error()
+   if fe.Path != "" {
+      msg += " (" + fe.Path + ")"
+   }
+   if fe.Err != nil {
+      msg += ": " + fe.Err.Error()
+   }
+   return msg
+}
+
+func (fe *ForwardError) Is(target error) bool { return target == fe.Class }
+func (fe *ForwardError) Unwrap() error        { return fe.Err }
+
+//
+// get the metric label of an error
+func ErrorClass(err error) string {
+   for class, name := range errorClassNames {
+      if errors.Is(err, class) {
+         return name
+      }
+   }
+   return "other"
+}
+
+//
+// recently reported errors; served by the admin API
+const recentErrorsLimit int = 100
+
+type errorRecord struct {
+   Time  time.Time
+   Class string
+   Error string
+}
+
+type errorLog struct {
+   lock    sync.Mutex
+   records []errorRecord
+}
+
+func (el *errorLog) add(rec errorRecord) {
+   el.lock.Lock()
+   el.records = append(el.records, rec)
+   if len(el.records) > recentErrorsLimit {
+      el.records = el.records[len(el.records)-recentErrorsLimit:]
+   }
+   el.lock.Unlock()
+}
+
+func (el *errorLog) list() []errorRecord {
+   el.lock.Lock()
+   defer el.lock.Unlock()
+   return append([]errorRecord(nil), el.records...)
+}
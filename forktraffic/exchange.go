@@ -0,0 +1,166 @@
+package forktraffic
+
+import (
+   "context"
+   "log"
+   "net/http"
+   "strings"
+   "time"
+)
+
+//
+// production side of a proxied request
+// - created by handleRequest and filled in by respHandler
+type exchange struct {
+   prodStatus  int
+   prodLatency time.Duration
+
+   // host the client addressed; production is sent its own
+   clientHost string
+
+   // arrival of the request at the fork
+   received time.Time
+
+   // production round trip: connection requested to first response byte
+   upstreamStart     time.Time
+   upstreamFirstByte time.Time
+
+   // reproduction bundle id when the request is replayed for debugging
+   reproId string
+
+   // route used to group metrics and comparisons
+   route string
+
+   // operation of the OpenAPI spec or gRPC method; "" when not classified
+   operation string
+   apiOp     *apiOperation
+
+   // production response kept for its validation; nil when not validated
+   prodSchema *ResponseCapture
+
+   // production values of the compared headers; nil when not compared
+   prodHeader http.Header
+
+   // captured production response; nil when not captured
+   prodCapture *ResponseCapture
+
+   // id correlating the compared responses in the logs and mismatches; "" when not compared
+   correlationId string
+
+   // production response body, counting its bytes
+   prodBody *countingReader
+
+   // chunk hashes of a large production body; nil when not compared by chunks
+   prodDigest *bodyDigest
+
+   // test mutations applied to the request and the options selecting them
+   morfs []string
+   tests *TestOptions
+
+   // steering by the operator headers
+   operator operatorFlags
+
+   // experiment id when the request arrived; "" for none
+   experiment string
+
+   // flow of the client the request belongs to; nil for none
+   scenario *scenarioFlow
+
+   // fault injected into the production exchange; nil for none
+   fault *fault
+
+   // body copied while production reads it; the client went away during the exchange
+   tee         *bodyTee
+   clientAbort bool
+
+   // the body passed MaxBodyBytes while production read it
+   bodyTooLarge bool
+}
+
+type exchangeKeyType int
+
+const exchangeKey exchangeKeyType = 0
+
+// attach a new exchange to the request
+func withExchange(req *http.Request) (*http.Request, *exchange) {
+   ex := new(exchange)
+   return req.WithContext(context.WithValue(req.Context(), exchangeKey, ex)), ex
+}
+
+// get the exchange of a request; nil if there is none
+func exchangeOf(req *http.Request) *exchange {
+   if req == nil {
+      return nil
+   }
+   ex, _ := req.Context().Value(exchangeKey).(*exchange)
+   return ex
+}
+
+//
+// production status of the exchange
+// - no response means the proxy answered with 502 Bad Gateway
+func (ex *exchange) status() int {
+   if ex.prodStatus == 0 {
+      return http.StatusBadGateway
+   }
+   return ex.prodStatus
+}
+
+//
+// should a request be mirrored given the production status
+// - MirrorStatusClasses lists the accepted classes (2 for 2xx, 5 for 5xx, ...); empty accepts all
+func (reqMgr *RequestManager) mirrorStatus(status int) bool {
+   if len(reqMgr.MirrorStatusClasses) == 0 {
+      return true
+   }
+   for _, class := range reqMgr.MirrorStatusClasses {
+      if status/100 == class {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// set up the MirrorFilter; an invalid filter mirrors nothing rather than everything
+func (reqMgr *RequestManager) initMirrorFilter() {
+   filter, err := parseCaptureFilter(reqMgr.MirrorFilter)
+   if err != nil {
+      log.Printf("Warning - invalid mirror filter: %v; nothing is mirrored", err)
+      filter = captureNothing{}
+   }
+   reqMgr.mirrorFilter = filter
+}
+
+// does the MirrorFilter accept a request given the production status
+func (reqMgr *RequestManager) mirrorFiltered(req *http.Request, status int) bool {
+   return reqMgr.mirrorFilter == nil || reqMgr.mirrorFilter.match(req, status)
+}
+
+//
+// is the body of a request mirrored
+// - BodyMethods lists the methods whose body is; empty mirrors the body of any request having one
+func (reqMgr *RequestManager) mirrorBody(req *http.Request) bool {
+   if req.Body == nil || req.Body == http.NoBody {
+      return false
+   }
+   if len(reqMgr.BodyMethods) == 0 {
+      return true
+   }
+   for _, method := range reqMgr.BodyMethods {
+      if strings.EqualFold(req.Method, method) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// is a request sampled for mirroring
+// - MirrorPercent of the requests are; 0 (default) or 100 mirrors every request
+func (reqMgr *RequestManager) mirrorSampled() bool {
+   if reqMgr.MirrorPercent <= 0 || reqMgr.MirrorPercent >= 100 {
+      return true
+   }
+   return reqMgr.Rand.Intn(100) < reqMgr.MirrorPercent
+}
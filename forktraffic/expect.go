@@ -0,0 +1,44 @@
+package forktraffic
+
+import (
+   "bytes"
+   "io"
+   "net/http"
+   "strings"
+   "time"
+)
+
+// how long the transports wait for a 100 Continue before sending the body anyway
+const ExpectContinueTimeout time.Duration = 1 * time.Second
+
+// does the client wait for a 100 Continue before sending the body
+func expectsContinue(req *http.Request) bool {
+   return strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+//
+// request body copied while production reads it
+// - the body is not read before production asks for it, so the interim
+//   100 Continue reaches the client only once production has sent one
+type bodyTee struct {
+   io.ReadCloser
+   buf      bytes.Buffer
+   complete bool
+   err      error
+}
+
+func (bt *bodyTee) Read(p []byte) (int, error) {
+   n, err := bt.ReadCloser.Read(p)
+   bt.buf.Write(p[:n])
+   if err == io.EOF {
+      bt.complete = true
+   } else if err != nil {
+      bt.err = err
+   }
+   return n, err
+}
+
+// the copied body; false if production did not read all of it
+func (bt *bodyTee) body() ([]byte, bool) {
+   return bt.buf.Bytes(), bt.complete
+}
@@ -0,0 +1,70 @@
+package forktraffic
+
+import (
+   "net/http"
+   "sync"
+   "time"
+)
+
+// experiment id of the staging copies
+const httpExperimentHeader string = "X-Fork-Experiment"
+
+// experiment or run the mirrored traffic belongs to; set from ExperimentId or the admin API
+type experimentLabel struct {
+   lock  sync.RWMutex
+   id    string
+   since time.Time
+}
+
+//
+// label the traffic mirrored from now on with an experiment id; "" removes the label
+// - copies queued before keep the id they were mirrored with
+func (reqMgr *RequestManager) SetExperiment(id string) {
+   el := &reqMgr.experiment
+   el.lock.Lock()
+   el.id, el.since = id, reqMgr.Clock.Now()
+   el.lock.Unlock()
+}
+
+// the experiment id of the traffic mirrored now; "" for none
+func (reqMgr *RequestManager) Experiment() string {
+   el := &reqMgr.experiment
+   el.lock.RLock()
+   defer el.lock.RUnlock()
+   return el.id
+}
+
+//
+// handle "/admin/experiment"; the experiment id, POST "?id=" sets it, DELETE removes it
+func (reqMgr *RequestManager) adminExperiment(w http.ResponseWriter, r *http.Request) {
+   switch r.Method {
+   case "GET":
+   case "POST":
+      id := r.URL.Query().Get("id")
+      if id == "" {
+         ResponseHttpError(w, http.StatusBadRequest, ": missing id")
+         return
+      }
+      reqMgr.SetExperiment(id)
+   case "DELETE":
+      reqMgr.SetExperiment("")
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+      return
+   }
+
+   el := &reqMgr.experiment
+   el.lock.RLock()
+   defer el.lock.RUnlock()
+   writeJson(w, struct {
+      Id    string
+      Since time.Time
+   }{el.id, el.since})
+}
+
+// count an event of a labeled staging copy by its experiment
+func (reqMgr *RequestManager) countExperiment(sendReq *PendingRequest, name string, labels ...string) {
+   if sendReq.experiment != "" {
+      reqMgr.Metrics.Inc(name, append([]string{"experiment", sendReq.experiment}, labels...)...)
+   }
+}
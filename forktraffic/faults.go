@@ -0,0 +1,120 @@
+package forktraffic
+
+import (
+   "context"
+   "io"
+   "net/http"
+   "net/http/httptrace"
+   "sync"
+   "time"
+)
+
+// fault kinds
+const (
+   faultReset    string = "reset"    // drop the connection once the request headers are sent
+   faultTruncate string = "truncate" // drop the connection part way through the response
+   faultStall    string = "stall"    // pause before reading the response
+)
+
+var faultKinds = []string{faultReset, faultTruncate, faultStall}
+
+// default pause of a stalled read
+const DefaultFaultStallMs int = 5000
+
+//
+// fault injected into one exchange with an upstream
+type fault struct {
+   kind   string
+   stall  time.Duration
+   cancel context.CancelFunc
+}
+
+//
+// maybe inject a fault into a request to an upstream
+// - FaultPercent of the staging copies get a fault of one of FaultKinds
+// - production requests only with FaultProduction
+// - returns nil when no fault is injected
+func (reqMgr *RequestManager) injectFault(req *http.Request, tests *TestOptions, destination string, production bool) (*http.Request, *fault) {
+   if tests.FaultPercent <= 0 || (production && !tests.FaultProduction) {
+      return req, nil
+   }
+   if reqMgr.Rand.Intn(100) >= tests.FaultPercent {
+      return req, nil
+   }
+   kinds := tests.FaultKinds
+   if len(kinds) == 0 {
+      kinds = faultKinds
+   }
+
+   ft := &fault{kind: kinds[reqMgr.Rand.Intn(len(kinds))]}
+   ft.stall = time.Duration(tests.FaultStallMs) * time.Millisecond
+   if ft.stall <= 0 {
+      ft.stall = time.Duration(DefaultFaultStallMs) * time.Millisecond
+   }
+   ctx, cancel := context.WithCancel(req.Context())
+   ft.cancel = cancel
+   if ft.kind == faultReset {
+      ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+         WroteHeaders: func() { cancel() },
+      })
+   }
+   reqMgr.Metrics.Inc("forktraffic_faults_injected_total", "destination", destination, "kind", ft.kind)
+   return req.WithContext(ctx), ft
+}
+
+//
+// apply the fault to a response body of the given length (-1 unknown)
+func (ft *fault) wrap(body io.ReadCloser, length int64) io.ReadCloser {
+   if ft == nil || ft.kind == faultReset {
+      return body
+   }
+   // an empty or single byte body has nothing to cut
+   if ft.kind == faultTruncate && length >= 0 && length <= 1 {
+      return body
+   }
+   // truncated bodies stop half way; bodies of unknown length after the first read
+   keep := length / 2
+   if length < 0 {
+      keep = -1
+   }
+   return &faultReader{ReadCloser: body, fault: ft, keep: keep}
+}
+
+// release the fault's context; call when the exchange is over
+func (ft *fault) done() {
+   if ft != nil {
+      ft.cancel()
+   }
+}
+
+//
+// response body reader misbehaving like a flaky client
+// - stall: sleeps once before the first read
+// - truncate: drops the connection after keep bytes (after the first read if keep < 0)
+type faultReader struct {
+   io.ReadCloser
+   fault *fault
+   once  sync.Once
+   keep  int64
+}
+
+func (fr *faultReader) Read(p []byte) (int, error) {
+   if fr.fault.kind == faultStall {
+      fr.once.Do(func() { time.Sleep(fr.fault.stall) })
+      return fr.ReadCloser.Read(p)
+   }
+   if fr.keep == 0 {
+      fr.fault.cancel()
+      return 0, io.ErrUnexpectedEOF
+   }
+   if fr.keep > 0 && int64(len(p)) > fr.keep {
+      p = p[:fr.keep]
+   }
+   n, err := fr.ReadCloser.Read(p)
+   if fr.keep > 0 {
+      fr.keep -= int64(n)
+   } else {
+      fr.keep = 0
+   }
+   return n, err
+}
@@ -0,0 +1,129 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "io/ioutil"
+   "net/http"
+   "net/url"
+   "os"
+   "path/filepath"
+   "sync"
+)
+
+// scheme of a staging destination written to a file
+const fileScheme string = "file"
+
+//
+// staging destination appending the mirrored requests to a file, one
+// RequestRecord JSON document per line
+// - lets a team capture traffic before its staging environment exists
+// - the file is opened on the first copy and kept open; it is rotated and pruned
+//   like RecordFile
+type fileSink struct {
+   path    string
+   dirOnce sync.Once
+   rec     recorder
+}
+
+//
+// is a url a valid staging destination: an http(s) target or webhook with a host,
+// a file destination with a path or a nats destination with a subject
+// - "file:///var/log/mirror.ndjson" is absolute; "file://mirror.ndjson" relative
+func validStagingUrl(dest *url.URL) bool {
+   if dest.Scheme == fileScheme {
+      return fileTargetPath(dest) != ""
+   }
+   if hook := webhookUrl(dest); hook != nil {
+      return hook.Scheme != "" && hook.Host != ""
+   }
+   if dest.Scheme == natsScheme {
+      client, _ := jetStreamOf(dest)
+      return client != nil
+   }
+   return dest.Scheme != "" && dest.Host != ""
+}
+
+func fileTargetPath(dest *url.URL) string {
+   if dest.Host != "" {
+      return filepath.Join(dest.Host, dest.Path)
+   }
+   return dest.Path
+}
+
+//
+// build a staging target of a destination url
+// - the root path is added to http(s) targets missing one; a webhook is posted
+//   to as given
+func newStagingTarget(region string, dest *url.URL) *stagingTarget {
+   target := &stagingTarget{region: region, url: dest}
+   if dest.Scheme == fileScheme {
+      target.sink = &fileSink{path: fileTargetPath(dest)}
+   } else if hook := webhookUrl(dest); hook != nil {
+      target.hook = &webhookSink{url: hook}
+   } else if client, subject := jetStreamOf(dest); client != nil {
+      target.jet = &jetStreamSink{client: client, subject: subject}
+   } else if dest.Path == "" {
+      dest.Path = "/"
+   }
+   return target
+}
+
+//
+// record of a staging copy written or published in place of sending it
+// - the copy as built for staging: staging keys, shadow marker and morfs applied;
+//   headers and body are redacted like the recording
+func (reqMgr *RequestManager) copyRecord(reqSend *http.Request, sendReq *PendingRequest) *RequestRecord {
+   var body []byte = nil
+   if reqSend.Body != nil {
+      body, _ = ioutil.ReadAll(reqSend.Body)
+      reqSend.Body.Close()
+   }
+   rec := &RequestRecord{
+      Time:       reqMgr.Clock.Now(),
+      Region:     sendReq.target.region,
+      Method:     reqSend.Method,
+      Url:        reqMgr.redactUrl(reqSend.URL, true),
+      Host:       reqSend.Host,
+      Header:     reqMgr.redactHeader(reqSend.Header),
+      Body:       reqMgr.redactBody(body, reqSend.Header.Get("Content-Encoding")),
+      Experiment: sendReq.experiment,
+      Scenario:   sendReq.scenario,
+   }
+   if ex := sendReq.exchange; ex != nil {
+      rec.ProdStatus, rec.Route = ex.status(), ex.route
+      if !ex.received.IsZero() {
+         rec.Time = ex.received
+      }
+   }
+   return rec
+}
+
+//
+// write a staging copy to its file destination in place of sending it
+// - forktraffic_file_copies_total counts the copies written, by region
+func (reqMgr *RequestManager) writeFileCopy(reqSend *http.Request, sendReq *PendingRequest) {
+   rec := reqMgr.copyRecord(reqSend, sendReq)
+   buf, err := json.Marshal(rec)
+   if err == nil {
+      err = reqMgr.appendSink(sendReq.target.sink, frameLine(buf, nil))
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: sendReq.target.sink.path, Err: err})
+      return
+   }
+   reqMgr.Metrics.Inc("forktraffic_file_copies_total", "region", sendReq.target.label())
+}
+
+// append to a file destination, creating its directory first
+func (reqMgr *RequestManager) appendSink(sink *fileSink, line []byte) error {
+   var err error
+   sink.dirOnce.Do(func() {
+      if dir := filepath.Dir(sink.path); dir != "." {
+         err = os.MkdirAll(dir, 0700)
+      }
+   })
+   if err != nil {
+      return err
+   }
+   return reqMgr.appendFile(&sink.rec, sink.path, line)
+}
@@ -0,0 +1,245 @@
+package forktraffic
+
+import (
+   "fmt"
+   "net/http"
+   "regexp"
+   "strconv"
+   "strings"
+)
+
+//
+// capture filter expression
+// - comparisons: method, path, host, header[Name], cookie[Name] and status with ==,
+//   != and ~, !~ (regular expression match); status takes a code (503) or a class (5xx)
+// - combined with and, or, not and parentheses; values may be "quoted"
+// - e.g.: method == POST and path ~ "^/api/" and not header[X-Tenant] == test or status == 5xx
+type captureFilter interface {
+   match(req *http.Request, status int) bool
+}
+
+type filterAnd struct{ left, right captureFilter }
+type filterOr struct{ left, right captureFilter }
+type filterNot struct{ inner captureFilter }
+
+func (f filterAnd) match(req *http.Request, status int) bool {
+   return f.left.match(req, status) && f.right.match(req, status)
+}
+
+func (f filterOr) match(req *http.Request, status int) bool {
+   return f.left.match(req, status) || f.right.match(req, status)
+}
+
+func (f filterNot) match(req *http.Request, status int) bool {
+   return !f.inner.match(req, status)
+}
+
+// one comparison
+type filterCompare struct {
+   field  string
+   header string // header or cookie name
+   op     string
+   value  string
+   regex  *regexp.Regexp
+}
+
+func (f *filterCompare) match(req *http.Request, status int) bool {
+   var val string
+   switch f.field {
+   case "method":
+      val = req.Method
+   case "path":
+      val = req.URL.Path
+   case "host":
+      val = req.Host
+   case "header":
+      val = req.Header.Get(f.header)
+   case "cookie":
+      if cookie, err := req.Cookie(f.header); err == nil {
+         val = cookie.Value
+      }
+   case "status":
+      if len(f.value) == 3 && strings.HasSuffix(f.value, "xx") {
+         val = statusClass(status)
+      } else {
+         val = strconv.Itoa(status)
+      }
+   }
+
+   switch f.op {
+   case "==":
+      return strings.EqualFold(val, f.value)
+   case "!=":
+      return !strings.EqualFold(val, f.value)
+   case "~":
+      return f.regex.MatchString(val)
+   default:
+      return !f.regex.MatchString(val)
+   }
+}
+
+//
+// parse a capture filter expression; an empty expression matches everything (nil filter)
+func parseCaptureFilter(expr string) (captureFilter, error) {
+   tokens, err := filterTokens(expr)
+   if err != nil || len(tokens) == 0 {
+      return nil, err
+   }
+   p := &filterParser{tokens: tokens}
+   filter, err := p.parseOr()
+   if err == nil && p.pos < len(p.tokens) {
+      err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+   }
+   if err != nil {
+      return nil, fmt.Errorf("filter %q: %v", expr, err)
+   }
+   return filter, nil
+}
+
+// split an expression into words, operators, parentheses and quoted values
+// - quoted values start with a quote character so they are never taken for keywords
+func filterTokens(expr string) ([]string, error) {
+   var tokens []string
+   for i := 0; i < len(expr); {
+      ch := expr[i]
+      switch {
+      case ch == ' ' || ch == '\t':
+         i++
+      case ch == '(' || ch == ')':
+         tokens = append(tokens, string(ch))
+         i++
+      case ch == '=' || ch == '!' || ch == '~':
+         j := i + 1
+         for j < len(expr) && (expr[j] == '=' || expr[j] == '~') {
+            j++
+         }
+         tokens = append(tokens, expr[i:j])
+         i = j
+      case ch == '"':
+         var val strings.Builder
+         j := i + 1
+         for ; j < len(expr) && expr[j] != '"'; j++ {
+            // \" and \\ are escapes; other backslashes belong to the value (regular expressions)
+            if expr[j] == '\\' && j+1 < len(expr) && (expr[j+1] == '"' || expr[j+1] == '\\') {
+               j++
+            }
+            val.WriteByte(expr[j])
+         }
+         if j >= len(expr) {
+            return nil, fmt.Errorf("unterminated quote")
+         }
+         tokens = append(tokens, "\""+val.String())
+         i = j + 1
+      default:
+         j := i
+         for j < len(expr) && !strings.ContainsRune(" \t()=!~\"", rune(expr[j])) {
+            j++
+         }
+         tokens = append(tokens, expr[i:j])
+         i = j
+      }
+   }
+   return tokens, nil
+}
+
+type filterParser struct {
+   tokens []string
+   pos    int
+}
+
+func (p *filterParser) next() string {
+   if p.pos >= len(p.tokens) {
+      return ""
+   }
+   tok := p.tokens[p.pos]
+   p.pos++
+   return tok
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+   return p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], keyword)
+}
+
+func (p *filterParser) parseOr() (captureFilter, error) {
+   left, err := p.parseAnd()
+   for err == nil && p.peekKeyword("or") {
+      p.pos++
+      var right captureFilter
+      if right, err = p.parseAnd(); err == nil {
+         left = filterOr{left, right}
+      }
+   }
+   return left, err
+}
+
+func (p *filterParser) parseAnd() (captureFilter, error) {
+   left, err := p.parseUnary()
+   for err == nil && p.peekKeyword("and") {
+      p.pos++
+      var right captureFilter
+      if right, err = p.parseUnary(); err == nil {
+         left = filterAnd{left, right}
+      }
+   }
+   return left, err
+}
+
+func (p *filterParser) parseUnary() (captureFilter, error) {
+   if p.peekKeyword("not") {
+      p.pos++
+      inner, err := p.parseUnary()
+      return filterNot{inner}, err
+   }
+   if p.peekKeyword("(") {
+      p.pos++
+      inner, err := p.parseOr()
+      if err == nil && p.next() != ")" {
+         err = fmt.Errorf("missing )")
+      }
+      return inner, err
+   }
+   return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (captureFilter, error) {
+   cmp := &filterCompare{field: strings.ToLower(p.next())}
+   if strings.HasPrefix(cmp.field, "header[") && strings.HasSuffix(cmp.field, "]") {
+      cmp.header = p.tokens[p.pos-1][len("header[") : len(cmp.field)-1]
+      cmp.field = "header"
+   } else if strings.HasPrefix(cmp.field, "cookie[") && strings.HasSuffix(cmp.field, "]") {
+      cmp.header = p.tokens[p.pos-1][len("cookie[") : len(cmp.field)-1]
+      cmp.field = "cookie"
+   }
+   switch cmp.field {
+   case "method", "path", "host", "header", "cookie", "status":
+   case "":
+      return nil, fmt.Errorf("missing comparison")
+   default:
+      return nil, fmt.Errorf("unknown field %q", cmp.field)
+   }
+
+   cmp.op = p.next()
+   switch cmp.op {
+   case "==", "!=":
+   case "~", "!~":
+      if cmp.field == "status" {
+         return nil, fmt.Errorf("status takes == or !=")
+      }
+   default:
+      return nil, fmt.Errorf("unknown operator %q", cmp.op)
+   }
+
+   value := p.next()
+   if value == "" {
+      return nil, fmt.Errorf("missing value")
+   }
+   cmp.value = strings.TrimPrefix(value, "\"")
+   if cmp.op == "~" || cmp.op == "!~" {
+      regex, err := regexp.Compile(cmp.value)
+      if err != nil {
+         return nil, err
+      }
+      cmp.regex = regex
+   }
+   return cmp, nil
+}
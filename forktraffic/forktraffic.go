@@ -5,20 +5,24 @@ import (
    "bytes"
    "container/heap"
    "crypto/rand"
-   "encoding/base64"
+   "crypto/sha256"
+   "encoding/hex"
    "io"
    "io/ioutil"
    "log"
    "math"
    "math/big"
+   "net"
    "net/http"
    "net/http/httputil"
    "net/url"
+   "regexp"
    "strconv"
    "strings"
+   "sync"
    "sync/atomic"
+   "text/template"
    "time"
-   "unicode"
 )
 
 //
@@ -27,19 +31,15 @@ func UnixMs(t time.Time) int64 {
    return t.UnixNano() / 1000000
 }
 
-//
-// extend random
-func randInt(maxRand int) int {
-   bigCh, _ := rand.Int(rand.Reader, big.NewInt(int64(maxRand)))
-   return int(bigCh.Uint64())
-}
-
 //
 // our http headers
 const httpNameHeader string = "Http-Splitter"
 const httpForwardedHeader string = "X-Forwarded-By"
 const httpDuplicateHeader string = "X-Duplicate-By"
+const httpBodyChecksumHeader string = "X-Duplicate-Body-Sha256"
+const httpBodyLengthHeader string = "X-Duplicate-Body-Length"
 const DefaultMorfUriBase string = "/api/"
+const DefaultMorfMethodPercent int = 10
 
 //
 // test options
@@ -47,6 +47,45 @@ type TestOptions struct {
    MorfUri     bool
    MorfHeader  bool
    MorfUriBase string
+
+   // morf URI and headers with valid but tricky unicode and percent-encoding
+   // variants instead of random bytes
+   MorfUnicode bool
+
+   // change the method of some staging copies; GET->DELETE only on the safe prefixes
+   MorfMethod             bool
+   MorfMethodPercent      int
+   MorfMethodSafePrefixes []string
+
+   // change or truncate a cookie value of the staging copies; never the sessionKey
+   MorfCookie bool
+
+   // percent of the staging copies sent malformed over a raw connection
+   ProtoFuzzPercent int
+
+   // security payload injection: dictionaries (sqli, xss, traversal, crlf),
+   // the parameters to inject (empty for any) and the percent of copies (0 for all)
+   InjectPayloads []string
+   InjectParams   []string
+   InjectPercent  int
+
+   // guided fuzzing: staging coverage endpoint, asked with ?request=<X-Fork-Fuzz-Id>
+   // for the coverage of one fuzzed request, and the corpus directory (pruned by
+   // RetainSec and RetainBytes)
+   FeedbackUrl string
+   CorpusDir   string
+
+   // directory of the minimized reproducers of staging failures caused by morfed
+   // requests; pruned by RetainSec and RetainBytes
+   TriageDir string
+
+   // network fault injection: percent of the staging copies with a fault of
+   // one of FaultKinds (reset, truncate, stall; empty for all); production
+   // requests only with FaultProduction
+   FaultPercent    int
+   FaultKinds      []string
+   FaultStallMs    int
+   FaultProduction bool
 }
 
 //
@@ -55,6 +94,12 @@ type StagKeys struct {
    sessionKey, sessionTtl string
    csrfToken              string
    Expiration             int64
+
+   // a synthetic session lent until staging sets one of its own
+   synthetic bool
+
+   // Domain/Path scope of the cached cookies, by lower case cookie name
+   scopes map[string]*http.Cookie
 }
 
 // heap of session tokens expiration
@@ -104,10 +149,32 @@ func (teq *tokenExpirationQueue) update(item *tokenExpiration, token string, tim
 // queued request to send to staging
 type PendingRequest struct {
    req        *http.Request
-   body       io.ReadCloser
+   target     *stagingTarget
+   body       []byte
+   trailer    http.Header
+   reproId    string
+   exchange   *exchange
    requestKey string
    sessionKey string
    keyExpires int64
+
+   // experiment the copy was mirrored for; "" for none
+   experiment string
+
+   // id of the flow the copy belongs to; "" for none
+   scenario string
+
+   // payload injected into the staging copy; nil for none
+   injection *injection
+
+   // test mutations applied to the staging copy
+   morfs []string
+
+   // failed deliveries so far
+   attempts int
+
+   // last push to the queue; zero once sent
+   queuedAt time.Time
 }
 
 //
@@ -119,41 +186,263 @@ type RequestManager struct {
    DestProduction *httputil.ReverseProxy
 
    // staging
-   UrlStaging  *url.URL
-   DestStaging *http.Client
-
-   // ping manager
-   pingManager ping.Manger
+   // - StagingIpMode is the address family DestStaging dials (see IpNetwork); the
+   //   destinations with their own get a copy of DestStaging dialing theirs
+   UrlStaging      *url.URL
+   DestStaging     *http.Client
+   StagingIpMode   string
+   targetsLock     sync.RWMutex
+   targets         []*stagingTarget
+   webhookTemplate *template.Template
+
+   // ping manager; reports the queue health
+   PingManager *ping.Manger
+
+   // instance identity and peers
+   started time.Time
+   redis   *RedisClient
 
    // test scenarios
    TestOptions
 
+   // mirroring behavior
+   MirrorOptions
+
+   // response capture for comparison
+   // - OnResponses is called with both captured responses of a mirrored request
+   CaptureOptions
+   OnResponses func(req *http.Request, prod, stag *ResponseCapture)
+
+   // time and random sources; default to the wall clock and crypto random
+   Clock Clock
+   Rand  Rand
+
    // staging cached keys
+   // - cacheLock protects CacheData and tokensExpirationList
    cacheId       int64
    forwardPrefix string
+   cacheLock     sync.Mutex
    CacheData     map[string]*StagKeys
+   sessionSalt   []byte
 
    tokensExpirationList tokenExpirationQueue
 
-   // pending requests to send to staging
-   PendingRequests chan *PendingRequest
+   // imported session mappings by KeyHash, not seen yet; protected by cacheLock
+   importedSessions map[string]*StagKeys
+
+   // next synthetic session lent; protected by cacheLock
+   syntheticNext int
+
+   // pending requests to send to staging; QueueBackend selects the queue
+   // unless one is set, QueueSize defaults to DefaultQueueSize
+   Queue      Queue
+   QueueSize  int
+   queued     queuedExchanges
+   lanes      []chan *PendingRequest
+   shards     []Queue
+   delivering int32
+
+   // time the copies spent queued
+   queueLatency latencyWindow
+
+   // latency the fork added to the production exchanges
+   overhead latencyWindow
+
+   // client retry detection
+   retries retryFilter
+
+   // staging clients of the route timeouts
+   routeClients routeClients
+
+   // client TLS fingerprints when the fork terminates TLS
+   fingerprints tlsFingerprints
+
+   // key signing the staging copies; empty for unsigned copies
+   signingKey []byte
+
+   // production to staging accounts; nil when not mapped
+   accounts map[string]string
+
+   // key of the identifier pseudonyms; nil when none are configured
+   pseudonymKey []byte
+
+   // GeoIP database; nil when the clients are not located
+   geoDb geoDatabase
+
+   // OpenAPI spec of production; nil when the requests are not classified by it
+   apiSpec     *apiSpec
+   schemaDrift schemaDrift
+
+   // staging body transformations
+   bodyTransforms []BodyTransform
+
+   // production response middlewares, in order
+   responseMiddlewares []namedMiddleware
+
+   // experiment id of the mirrored traffic
+   experiment experimentLabel
+
+   // multi-request flows of the clients
+   scenarios scenarioTracker
+
+   // networks allowed to send operator headers
+   operatorNets []*net.IPNet
+
+   // production origins of the response bodies and their replacements; nil when not rewritten
+   bodyUrlPattern *regexp.Regexp
+   bodyUrlPairs   map[string]string
+
+   // body normalization before comparison
+   normalizers []normalizer
+
+   // JSON pointers ignored by the comparison, split in their tokens
+   diffIgnore [][]string
+
+   // byte rates and canary analysis
+   rates  rateSampler
+   canary canaryAnalysis
+
+   // mismatched requests kept for replay
+   mismatches mismatchLog
+
+   // staging copies that could not be delivered
+   deadLetters deadLetterLog
+
+   // staging copies waiting to be posted in a batch
+   batch batcher
+
+   // operating mode, an index of modeNames
+   mode int32
+
+   // responses flagged by the injection mode
+   findings findingLog
+
+   // guided fuzzing and triage of the failures it causes
+   fuzz   fuzzer
+   triage triageLog
+
+   // chaos experiments and the effect of the morfs
+   chaos       chaosScheduler
+   morfEffects morfEffects
+
+   // requests never morfed
+   noMorfFilter captureFilter
+
+   // User-Agents of the bots; nil when they are not filtered
+   botPattern *regexp.Regexp
+
+   // requests mirrored; nil mirrors all
+   mirrorFilter captureFilter
+
+   // traffic recording
+   captureFilter captureFilter
+   recording     recorder
+
+   // mismatch reports: MismatchFile and the reports waiting for MismatchWebhook
+   mismatchReports recorder
+   mismatchHooks   chan []byte
+
+   // encodings of the queued and the captured requests
+   queueEncoder   RequestEncoder
+   captureEncoder RequestEncoder
+
+   // metrics and error reporting
+   // - OnError is optional; it is called for every classified failure
+   Metrics      *Metrics
+   OnError      func(err error)
+   recentErrors errorLog
 }
 
 //
 // initialize the request manager
-// - set path handlers and response handler
+// - set the response handler; the request manager is the http.Handler of the traffic
 func (reqMgr *RequestManager) Init() {
+   if reqMgr.Clock == nil {
+      reqMgr.Clock = realClock{}
+   }
+   if reqMgr.Rand == nil {
+      reqMgr.Rand = cryptoRand{}
+   }
+   if reqMgr.Metrics == nil {
+      reqMgr.Metrics = NewMetrics()
+   }
+
+   reqMgr.initTargets()
+   reqMgr.initWebhooks()
+   reqMgr.initBodyTransforms()
+   reqMgr.initTranslations()
+   reqMgr.initResponseMiddlewares()
+   reqMgr.initBodyUrls()
+   reqMgr.initAccounts()
+   reqMgr.initPseudonyms()
+   reqMgr.initGeoIp()
+   reqMgr.initNormalizers()
+   reqMgr.initDiffIgnore()
+   reqMgr.initCaptureFilter()
+   reqMgr.initMirrorFilter()
+   reqMgr.initScenarios()
+   reqMgr.initNoMorf()
+   reqMgr.initBots()
+   reqMgr.initOperators()
+   reqMgr.initEncoders()
+   reqMgr.initSigning()
+   reqMgr.initStubs()
+   reqMgr.initOpenApi()
+   reqMgr.initCompression()
+   reqMgr.initMode()
+   reqMgr.SetExperiment(reqMgr.ExperimentId)
+
    reqMgr.cacheId = 0
+   reqMgr.sessionSalt = newSessionSalt()
    i64rand, _ := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-   reqMgr.forwardPrefix = strconv.FormatUint(i64rand.Uint64()+uint64(time.Now().UnixNano()), 16) + "-"
-
-   http.HandleFunc("/", reqMgr.handleRequest)
+   reqMgr.forwardPrefix = strconv.FormatUint(i64rand.Uint64()+uint64(reqMgr.Clock.Now().UnixNano()), 16) + "-"
+   if reqMgr.InstanceId == "" {
+      reqMgr.InstanceId = reqMgr.defaultInstanceId()
+   }
+   reqMgr.started = reqMgr.Clock.Now()
+   reqMgr.Metrics.Set("forktraffic_instance_info", 1, "instance", reqMgr.InstanceId)
+   if reqMgr.PingManager == nil {
+      reqMgr.PingManager = &ping.Manger{}
+   }
+   reqMgr.PingManager.InstanceId = reqMgr.InstanceId
 
    reqMgr.DestProduction.ModifyResponse = reqMgr.respHandler
+   reqMgr.DestProduction.ErrorHandler = reqMgr.proxyErrorHandler
    reqMgr.DestProduction.FlushInterval = 0
+   reqMgr.initResponseCache()
 
    reqMgr.tokensExpirationList = make(tokenExpirationQueue, 0)
    heap.Init(&reqMgr.tokensExpirationList)
+
+   reqMgr.initQueue()
+   reqMgr.loadDeadLetters()
+   reqMgr.startPeers()
+   reqMgr.startRates()
+   reqMgr.startCanary()
+   reqMgr.startJanitor()
+   reqMgr.startMismatchHooks()
+   reqMgr.startProfiles()
+   reqMgr.startJetStreamSource()
+   reqMgr.startWarmup()
+   reqMgr.startFuzzer()
+   reqMgr.startChaos()
+}
+
+// current time in milliseconds
+func (reqMgr *RequestManager) nowMs() int64 {
+   return UnixMs(reqMgr.Clock.Now())
+}
+
+//
+// report a classified failure: log, count, keep for the admin API
+func (reqMgr *RequestManager) reportError(err error) {
+   class := ErrorClass(err)
+   log.Printf("error: %v", err)
+   reqMgr.Metrics.Inc("forktraffic_errors_total", "class", class)
+   reqMgr.recentErrors.add(errorRecord{Time: reqMgr.Clock.Now(), Class: class, Error: err.Error()})
+   if reqMgr.OnError != nil {
+      reqMgr.OnError(err)
+   }
 }
 
 // update the unique id
@@ -163,13 +452,19 @@ func (reqMgr *RequestManager) createReqId() string {
 }
 
 // cache the response keys
-func (reqMgr *RequestManager) cacheResponse(prodSessionKey string, resp *http.Response, prodKeyExpiration int64) {
+func (reqMgr *RequestManager) cacheResponse(target *stagingTarget, prodSessionKey string, resp *http.Response, prodKeyExpiration int64) {
 
    // update the staging keys data base
    if prodSessionKey == "" || resp.StatusCode >= http.StatusBadRequest { // 400
       return
    }
 
+   rawSessionKey := prodSessionKey
+   prodSessionKey = target.cacheKey(prodSessionKey)
+
+   reqMgr.cacheLock.Lock()
+   defer reqMgr.cacheLock.Unlock()
+
    // find our key
    var stagKey *StagKeys
    var newKey bool = false
@@ -188,11 +483,20 @@ func (reqMgr *RequestManager) cacheResponse(prodSessionKey string, resp *http.Re
             stagKey.csrfToken = cc.Value
          } else if strings.EqualFold(cc.Name, "sessionKey") {
             stagKey.sessionKey = cc.Value
+            stagKey.synthetic = false
             stagKeyExpiration = UnixMs(cc.Expires)
             stagKeyMaxAge = cc.MaxAge
          } else if strings.EqualFold(cc.Name, "sessionTtl") {
             stagKey.sessionTtl = cc.Value
+         } else {
+            continue
+         }
+
+         // keep the cookie scope
+         if stagKey.scopes == nil {
+            stagKey.scopes = make(map[string]*http.Cookie)
          }
+         stagKey.scopes[strings.ToLower(cc.Name)] = reqMgr.scopeCookie(cc)
       }
    }
 
@@ -200,13 +504,13 @@ func (reqMgr *RequestManager) cacheResponse(prodSessionKey string, resp *http.Re
    if prodKeyExpiration != 0 && stagKey.Expiration != prodKeyExpiration {
       stagKey.Expiration = prodKeyExpiration
    } else if stagKey.Expiration == 0 {
-      stagKey.Expiration = UnixMs(time.Now()) + 60*20000
+      stagKey.Expiration = reqMgr.nowMs() + 60*20000
    }
 
    // logout, delete the session
-   tNow := UnixMs(time.Now())
+   tNow := reqMgr.nowMs()
    if stagKey.sessionKey == "" && !(stagKeyExpiration > tNow || stagKeyMaxAge > 0) {
-      log.Printf("stagKeyExpiration: %+v", stagKeyExpiration)
+      log.Printf("session %v logged out; stagKeyExpiration: %+v", reqMgr.SessionHash(rawSessionKey), stagKeyExpiration)
       delete(reqMgr.CacheData, prodSessionKey)
       return
    }
@@ -251,52 +555,263 @@ func (reqMgr *RequestManager) cacheResponse(prodSessionKey string, resp *http.Re
    }
 }
 
+//
+// get a copy of the cached staging keys of a production session
+func (reqMgr *RequestManager) cachedKeys(prodSessionKey string) *StagKeys {
+   reqMgr.cacheLock.Lock()
+   defer reqMgr.cacheLock.Unlock()
+   stagKey := reqMgr.CacheData[prodSessionKey]
+   if stagKey == nil {
+      stagKey = reqMgr.adoptImportedSession(prodSessionKey)
+   }
+   if stagKey == nil {
+      return nil
+   }
+   keyCopy := *stagKey
+   keyCopy.scopes = make(map[string]*http.Cookie, len(stagKey.scopes))
+   for name, scope := range stagKey.scopes {
+      keyCopy.scopes[name] = scope
+   }
+   return &keyCopy
+}
+
+//
+// serve the traffic; mount on "/" of a dedicated ServeMux or use as the server handler
+func (reqMgr *RequestManager) ServeHTTP(respw http.ResponseWriter, req *http.Request) {
+   reqMgr.handleRequest(respw, req)
+}
+
 //
 // this is the main request handler for "/" path
 // reverse proxy to production and store POST data to forward to staging
 //
 func (reqMgr *RequestManager) handleRequest(respw http.ResponseWriter, req *http.Request) {
+   received := reqMgr.Clock.Now()
 
-   var bodyReader io.ReadCloser = nil
-   if reqMgr.UrlStaging.Scheme != "" && strings.EqualFold(req.Method, "POST") && req.Body != nil {
-      // copy the request body
-      bodyBuf, _ := ioutil.ReadAll(req.Body)
+   // proxy loop protection; both copies carry our instance id
+   if !reqMgr.stampForwarded(respw, req) {
+      return
+   }
+   op := reqMgr.operatorRequest(req)
+   if reqMgr.handleStub(respw, req) {
+      return
+   }
+   if reqMgr.handleMode(respw, req) {
+      return
+   }
+   if !reqMgr.withinLimits(respw, req) {
+      return
+   }
+   if !reqMgr.validRequest(respw, req) {
+      return
+   }
+   reqMgr.stampFingerprint(req)
+   reqMgr.tagGeo(req)
+   reqMgr.Metrics.Inc("forktraffic_production_requests_total")
+
+   // copies made by a fork are never mirrored again
+   shadow := reqMgr.isShadow(req)
+   if shadow {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "shadow_marker")
+   }
 
-      bodyReader = ioutil.NopCloser(bytes.NewBuffer(bodyBuf))
+   // sampling; the body of a request left out is not copied unless captured
+   sampled := shadow || op.forceMirror || reqMgr.mirrorSampled()
+
+   var bodyBuf []byte = nil
+   var tee *bodyTee = nil
+   copyBody := !shadow && ((reqMgr.mirroring() && sampled) || reqMgr.ReproDir != "" || reqMgr.RecordFile != "") && reqMgr.mirrorBody(req)
+   if copyBody && expectsContinue(req) {
+      // copy the body as production reads it
+      tee = &bodyTee{ReadCloser: req.Body}
+      req.Body = tee
+   } else if copyBody {
+      // copy the request body
+      var err error
+      bodyBuf, err = ioutil.ReadAll(req.Body)
+      if reqMgr.tooLarge(respw, err) {
+         return
+      }
+      if err != nil {
+         reqMgr.requestAborted(req, bodyBuf, err, op, sampled, received)
+         return
+      }
 
       // Restore the io.ReadCloser to its original state
       req.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBuf))
    }
 
-   // morf the request URI
-   if reqMgr.MorfUri {
-      morfUri(req, reqMgr.MorfUriBase)
+   // morf the request URI; a running chaos experiment may select its own profile
+   // and the no-morf requests are left alone
+   tests := reqMgr.morfTests(req)
+   if op.noMorf {
+      tests = &noMorfTests
+   }
+   var morfs []string = nil
+   prevUri := req.URL.EscapedPath()
+   if tests.MorfUri && tests.MorfUnicode {
+      morfUriUnicode(req, tests.MorfUriBase, reqMgr.Rand)
+   } else if tests.MorfUri {
+      morfUri(req, tests.MorfUriBase, reqMgr.Rand)
+   }
+   if req.URL.EscapedPath() != prevUri {
+      morfs = append(morfs, "uri")
    }
 
    // morf a request header
-   if reqMgr.MorfHeader {
-      morfHeader(req)
+   if tests.MorfHeader && len(req.Header) > 0 {
+      morfs = append(morfs, "header")
+   }
+   if tests.MorfHeader && tests.MorfUnicode {
+      morfHeaderUnicode(req, reqMgr.Rand)
+   } else if tests.MorfHeader {
+      morfHeader(req, reqMgr.Rand)
    }
 
    // send the request to production
+   req, ex := withExchange(req)
+   ex.tee = tee
+   ex.morfs = morfs
+   ex.tests = tests
+   ex.operator = op
+   ex.experiment = reqMgr.Experiment()
+   ex.clientHost = req.Host
+   ex.received = received
+   ex.apiOp, ex.operation = reqMgr.operationOf(req)
    req.Host = reqMgr.UrlProduction.Host
-   reqMgr.DestProduction.ServeHTTP(respw, req)
+   prodReq, traceDone := reqMgr.traceUpstream(req, "production")
+   defer traceDone()
+   if reqMgr.UserAgentProduction {
+      prodReq.Header = prodReq.Header.Clone()
+      reqMgr.suffixUserAgent(prodReq)
+   }
+   prodReq, ex.fault = reqMgr.injectFault(prodReq, tests, "production", true)
+   defer ex.fault.done()
+   prodStart := reqMgr.Clock.Now()
+   defer reqMgr.productionAborted(respw, req, ex, bodyBuf, shadow, sampled, prodStart)
+   reqMgr.DestProduction.ServeHTTP(respw, prodReq)
+   ex.prodLatency = reqMgr.Clock.Now().Sub(prodStart)
+   reqMgr.chaos.observeProduction(ex)
+   reqMgr.productionDone(respw, req, ex, bodyBuf, shadow, sampled)
+}
+
+//
+// account a production exchange, record it and mirror it
+// - runs after production answered, or after the proxy aborted the response
+func (reqMgr *RequestManager) productionDone(respw http.ResponseWriter, req *http.Request, ex *exchange, bodyBuf []byte, shadow, sampled bool) {
+   // the body of a 100-continue request; production may have refused it unread
+   bodyComplete := true
+   if ex.tee != nil {
+      bodyBuf, bodyComplete = ex.tee.body()
+   }
+
+   // production accounting
+   gqlOp := reqMgr.graphqlOf(req, bodyBuf)
+   ex.route = reqMgr.routeLabel(req, gqlOp, ex.operation)
+   reqMgr.countBytes("production", "out", ex.route, requestSize(req, bodyBuf))
+   if ex.prodBody != nil {
+      reqMgr.countBytes("production", "in", ex.route, atomic.LoadInt64(&ex.prodBody.count))
+   }
+   if gqlOp != nil {
+      reqMgr.Metrics.Inc("forktraffic_graphql_requests_total", "type", gqlOp.Type)
+   }
+   if ex.operation != "" {
+      reqMgr.Metrics.Inc("forktraffic_operation_requests_total", "operation", ex.operation)
+   }
+   reqMgr.validateProduction(ex)
+
+   if shadow {
+      return
+   }
+   reqMgr.tagScenario(req, ex)
+   reqMgr.recordExchange(req, bodyBuf, ex)
+
+   if ex.clientAbort && !reqMgr.MirrorAbortedRequests {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "client_abort")
+      return
+   }
+
+   if ex.bodyTooLarge {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "body_too_large")
+      return
+   }
+
+   if !bodyComplete && !ex.clientAbort {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "body_not_sent")
+      return
+   }
+
+   // capture production failures; the replay replaces the regular copy
+   if ex.status() >= http.StatusInternalServerError && reqMgr.ReproDir != "" && reqMgr.captureAccepts(req, ex.status()) {
+      reproId := reqMgr.captureRepro(req, bodyBuf, ex.status())
+      if reqMgr.ReproReplay {
+         ex.reproId = reproId
+      }
+   }
+
+   reqMgr.mirrorFilteredRequest(req, respw.Header(), bodyBuf, ex, gqlOp, sampled)
+}
+
+//
+// mirror a request unless one of the mirror filters leaves it out: sampling,
+// production status, GraphQL operation, bot, location, header and retry filters
+func (reqMgr *RequestManager) mirrorFilteredRequest(req *http.Request, respHdr http.Header, bodyBuf []byte, ex *exchange, gqlOp *graphqlOperation, sampled bool) {
+   op := ex.operator
+   if !sampled && ex.reproId == "" {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "sampled_out")
+      return
+   }
+
+   // the production response decides if the request is mirrored
+   if !reqMgr.mirrorStatus(ex.status()) && ex.reproId == "" && !op.forceMirror {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "status")
+      return
+   }
+
+   // GraphQL operation filter
+   if !reqMgr.mirrorGraphql(gqlOp) && !op.forceMirror {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "graphql")
+      return
+   }
+
+   // bot filter
+   if !reqMgr.mirrorBot(req) && !op.forceMirror {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "bot")
+      return
+   }
+
+   // location filter; data residency, never forced
+   if !reqMgr.mirrorGeo(req) {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "geo")
+      return
+   }
+
+   // header and cookie filter, e.g. the opted-in users
+   if !reqMgr.mirrorFiltered(req, ex.status()) && !op.forceMirror {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "filter")
+      return
+   }
+
+   // forward a single copy of retried requests
+   if !op.forceMirror && reqMgr.suppressRetry(req, bodyBuf) {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "retry")
+      return
+   }
 
    // send to staging
-   respHdr := respw.Header()
-   reqMgr.forwardHandler(req, respHdr, bodyReader)
+   reqMgr.forwardHandler(req, respHdr, bodyBuf)
 }
 
 //
 // morf the request URI
 // replace one character from ui-web-service request
 //
-func morfUri(req *http.Request, morfUriBase string) {
+func morfUri(req *http.Request, morfUriBase string, rnd Rand) {
    l := len(req.URL.Path)
    if l > len(morfUriBase) && req.URL.Path[:len(morfUriBase)] == morfUriBase {
       b := []byte(req.URL.Path)
-      iCh := randInt(l - len(morfUriBase))
-      b[len(morfUriBase)+iCh] = byte(randInt(256))
+      iCh := rnd.Intn(l - len(morfUriBase))
+      b[len(morfUriBase)+iCh] = byte(rnd.Intn(256))
       req.URL.Path = string(b)
    }
 }
@@ -305,22 +820,22 @@ func morfUri(req *http.Request, morfUriBase string) {
 // morf a request header
 // change one character in one value of the headers
 //
-func morfHeader(req *http.Request) {
+func morfHeader(req *http.Request, rnd Rand) {
    // get a header number to morf
-   iHdr := randInt(len(req.Header))
+   iHdr := rnd.Intn(len(req.Header))
 
    // go over the headers
    for key, vals := range req.Header {
       // we count down til we get to the required header
       if iHdr == 0 {
          // get a value to update
-         iVals := randInt(len(vals))
+         iVals := rnd.Intn(len(vals))
          for iv := range vals {
             val := vals[iv]
-            if iv == iVals {
-               iVal := randInt(len(val))
+            if iv == iVals && len(val) > 0 {
+               iVal := rnd.Intn(len(val))
                b := []byte(val)
-               b[iVal] = byte(randInt(256))
+               b[iVal] = byte(rnd.Intn(256))
                val = string(b)
             }
 
@@ -337,6 +852,72 @@ func morfHeader(req *http.Request) {
    }
 }
 
+//
+// morf a cookie of a staging copy
+// change one character of a random cookie value or truncate it
+// the sessionKey is left alone so the request stays in its staging session
+//
+func morfCookie(stagReq *http.Request, rnd Rand) bool {
+   cookies := stagReq.Cookies()
+   var candidates []*http.Cookie
+   for _, cc := range cookies {
+      if !strings.EqualFold(cc.Name, "sessionKey") && cc.Value != "" {
+         candidates = append(candidates, cc)
+      }
+   }
+   if len(candidates) == 0 {
+      return false
+   }
+
+   cc := candidates[rnd.Intn(len(candidates))]
+   pos := rnd.Intn(len(cc.Value))
+   if rnd.Intn(2) == 0 {
+      cc.Value = cc.Value[:pos]
+   } else {
+      b := []byte(cc.Value)
+      const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+      b[pos] = chars[rnd.Intn(len(chars))]
+      cc.Value = string(b)
+   }
+
+   // rebuild the Cookie header
+   stagReq.Header.Del("Cookie")
+   for _, c := range cookies {
+      stagReq.AddCookie(c)
+   }
+   return true
+}
+
+//
+// morf the method of a staging copy
+// change the method of one in MorfMethodPercent copies (POST->PUT, PUT->POST, PATCH->PUT, GET->HEAD)
+// GET->DELETE only on the MorfMethodSafePrefixes routes
+//
+func (reqMgr *RequestManager) morfMethod(tests *TestOptions, method, path string) string {
+   percent := tests.MorfMethodPercent
+   if percent <= 0 {
+      percent = DefaultMorfMethodPercent
+   }
+   if reqMgr.Rand.Intn(100) >= percent {
+      return method
+   }
+
+   switch strings.ToUpper(method) {
+   case "POST", "PATCH":
+      return "PUT"
+   case "PUT":
+      return "POST"
+   case "GET":
+      for _, prefix := range tests.MorfMethodSafePrefixes {
+         if strings.HasPrefix(path, prefix) {
+            return "DELETE"
+         }
+      }
+      return "HEAD"
+   }
+   return method
+}
+
 //
 // prepare response with http error + error information
 //
@@ -344,13 +925,43 @@ func ResponseHttpError(respw http.ResponseWriter, httpStatus int, message string
    http.Error(respw, http.StatusText(httpStatus)+message, httpStatus)
 }
 
+//
+// status class label: "2xx", "5xx", ...
+func statusClass(status int) string {
+   return strconv.Itoa(status/100) + "xx"
+}
+
+//
+// size of a request body: the copied body, else the announced length
+func requestSize(req *http.Request, body []byte) int64 {
+   if body != nil {
+      return int64(len(body))
+   }
+   if req.ContentLength > 0 {
+      return req.ContentLength
+   }
+   return 0
+}
+
 //
 // response handler; update the response before it is sent to the client
+// - the response middlewares run between the exchange accounting and the compression
 //
 func (reqMgr *RequestManager) respHandler(resp *http.Response) error {
 
-   if (resp.StatusCode / 100) == 4 {
-      // log.Printf("%+v; %+v", resp.Request, resp)
+   // keep the production outcome for the mirror decision
+   if ex := exchangeOf(resp.Request); ex != nil {
+      ex.prodStatus = resp.StatusCode
+      resp.Body = ex.fault.wrap(resp.Body, resp.ContentLength)
+      ex.prodBody = &countingReader{ReadCloser: resp.Body}
+      resp.Body = ex.prodBody
+   }
+   if err := reqMgr.runResponseMiddlewares(resp); err != nil {
+      return err
+   }
+   reqMgr.compressResponse(resp)
+   if ex := exchangeOf(resp.Request); ex != nil {
+      reqMgr.observeOverhead(ex)
    }
 
    return nil
@@ -359,11 +970,11 @@ func (reqMgr *RequestManager) respHandler(resp *http.Response) error {
 //
 // queue the request to forward to the staging server
 //
-func (reqMgr *RequestManager) forwardHandler(req *http.Request, respHdr http.Header, stagBody io.ReadCloser) {
+func (reqMgr *RequestManager) forwardHandler(req *http.Request, respHdr http.Header, stagBody []byte) {
 
    // do we have a staging server
-   if reqMgr.UrlStaging.Scheme == "" ||
-      reqMgr.UrlStaging.Host == "" {
+   if !reqMgr.mirroring() {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "no_staging")
       return
    }
 
@@ -371,16 +982,58 @@ func (reqMgr *RequestManager) forwardHandler(req *http.Request, respHdr http.Hea
    updateSessionKey, updateKeyExpires := getRespSessionKey(cookies)
    prodSessionKey, _ := getSessionKey(req.Cookies())
 
-   // prepare a request to queue
-   sendReq := new(PendingRequest)
-   sendReq.req = req
-   sendReq.body = stagBody
-   sendReq.requestKey = prodSessionKey
-   sendReq.sessionKey = updateSessionKey
-   sendReq.keyExpires = updateKeyExpires
+   // request trailers are known once the body was read to the end
+   var trailer http.Header = nil
+   if len(req.Trailer) > 0 {
+      trailer = req.Trailer.Clone()
+   }
+
+   // a body the staging transformations cannot be applied to is not mirrored
+   if !reqMgr.transformable(req, stagBody) {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "undecodable_body")
+      return
+   }
+   if !reqMgr.pseudonymizable(req, stagBody) {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "unpseudonymizable_body")
+      return
+   }
+
+   // an operator may have named a single target
+   targets := reqMgr.requestTargets(req)
+   if len(targets) == 0 {
+      reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "unknown_target")
+      return
+   }
+
+   // prepare a request to queue for every staging target
+   reqMgr.Metrics.Inc("forktraffic_mirrored_requests_total")
+   reqMgr.stampReceived(req)
+   for _, target := range targets {
+      if target.warmingUp() {
+         reqMgr.Metrics.Inc("forktraffic_mirror_skipped_total", "reason", "warmup")
+         continue
+      }
+      reqMgr.Metrics.Inc("forktraffic_mirror_copies_total")
+      sendReq := new(PendingRequest)
+      sendReq.req = req
+      sendReq.target = target
+      sendReq.body = stagBody
+      sendReq.trailer = trailer
+      sendReq.requestKey = prodSessionKey
+      sendReq.sessionKey = updateSessionKey
+      sendReq.keyExpires = updateKeyExpires
+      if ex := exchangeOf(req); ex != nil {
+         sendReq.reproId = ex.reproId
+         sendReq.exchange = ex
+         sendReq.experiment = ex.experiment
+         sendReq.scenario = ex.scenarioId()
+         reqMgr.correlate(req, ex)
+      }
+      reqMgr.countExperiment(sendReq, "forktraffic_experiment_copies_total")
 
-   // forward to staging
-   go reqMgr.sendStaging(sendReq)
+      // forward to staging
+      go reqMgr.sendStaging(sendReq)
+   }
 }
 
 //
@@ -424,43 +1077,66 @@ func getSessionKey(cookies []*http.Cookie) (string, int64) {
 }
 
 //
-// push the new request to the PendingRequests channel (queue)
+// push the new request to the pending requests queue
 // - typicaly this function is called asynchronously
+// - a queue with less than its headroom free (see queueHeadroom) drops its oldest
+//   request for the new one and the ping reports unhealthy; the drop never waits,
+//   so production traffic is not held by a full or an empty queue
 //
 func (reqMgr *RequestManager) sendStaging(sendReq *PendingRequest) {
 
-   // handle full queue
-   if len(reqMgr.PendingRequests) < 100 {
-      reqMgr.pingManager.Set(false)
+   // handle full queue; a sharded queue drops from the shard of the request
+   queue, shard := reqMgr.queueOf(sendReq)
+   if queue.Cap()-queue.Len() < queueHeadroom(queue) {
+      reqMgr.PingManager.Set(false)
 
       // remove the oldest request, and add the new one
-      delReq := <-reqMgr.PendingRequests
-
-      // log the removed URI path (limit to 80 chars)
-      l := len(delReq.req.URL.Path)
-      if l > 80 {
-         l = 80
+      if delReq := queue.DropOldest(); delReq != nil {
+         reqMgr.Metrics.Inc("forktraffic_mirror_dropped_total", "reason", "queue_full")
+         // report the removed URI path (limit to 80 chars)
+         l := len(delReq.req.URL.Path)
+         if l > 80 {
+            l = 80
+         }
+         reqMgr.reportError(&ForwardError{Class: ErrQueueFull, Path: delReq.req.URL.Path[:l]})
       }
-      log.Printf("error: pending requests overflow! removing: %+v", delReq.req.URL.Path[:l])
-   } else {
-      reqMgr.pingManager.Set(true)
+   } else if reqMgr.queuesHealthy() {
+      reqMgr.PingManager.Set(true)
    }
 
-   reqMgr.PendingRequests <- sendReq
+   sendReq.queuedAt = reqMgr.Clock.Now()
+   if err := queue.Push(sendReq); err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrQueue, Path: sendReq.req.URL.Path, Err: err})
+   }
+   if shard >= 0 {
+      reqMgr.Metrics.Set("forktraffic_queue_shard_depth", int64(queue.Len()), "shard", strconv.Itoa(shard))
+   } else if tq := sendReq.target.queue; tq != nil {
+      reqMgr.Metrics.Set("forktraffic_queue_target_depth", int64(queue.Len()), "region", tq.region)
+   }
 }
 
 //
-// this function handles the PendingRequests channel (queue)
+// this function handles the pending requests queue
 // and delivers the request in the same order they are queued
 // - this function runs asynchronously
 //
 func (reqMgr *RequestManager) StagingHandler() {
-   for true {
-      sendReq := <-reqMgr.PendingRequests
-
-      reqSend := reqMgr.buildForwardRequest(sendReq.req, sendReq.requestKey, sendReq.body)
+   // sharded queue; every shard has its own sender
+   if len(reqMgr.shards) > 0 {
+      reqMgr.startShards()
+      return
+   }
+   if reqMgr.OrderedLanes > 0 {
+      reqMgr.startLanes()
+   }
 
-      go reqMgr.sendRequest(reqSend, sendReq)
+   // a queue per target; every target has its own sender
+   atomic.StoreInt32(&reqMgr.delivering, 1)
+   if reqMgr.TargetQueues {
+      reqMgr.startTargetQueues()
+   }
+   if reqMgr.Queue != nil {
+      reqMgr.deliver(reqMgr.Queue, func() bool { return false })
    }
 }
 
@@ -468,37 +1144,105 @@ func (reqMgr *RequestManager) StagingHandler() {
 // send the request
 //
 func (reqMgr *RequestManager) sendRequest(reqSend *http.Request, sendReq *PendingRequest) {
-   resp, err := reqMgr.DestStaging.Do(reqSend)
+   if sendReq.target.sink != nil {
+      reqMgr.writeFileCopy(reqSend, sendReq)
+      return
+   }
+   if sendReq.target.hook != nil {
+      reqMgr.postWebhook(reqSend, sendReq)
+      return
+   }
+   if sendReq.target.jet != nil {
+      reqMgr.publishJetStream(reqSend, sendReq)
+      return
+   }
+
+   // protocol fuzzing; the copy is sent malformed instead
+   tests := reqMgr.testsOf(sendReq)
+   if reqMgr.protoFuzz(tests) {
+      var body []byte = nil
+      if reqSend.Body != nil {
+         body, _ = ioutil.ReadAll(reqSend.Body)
+      }
+      reqMgr.sendMalformed(reqSend, reqMgr.targetNetwork(sendReq.target), body)
+      return
+   }
+   if tests != &noMorfTests {
+      reqMgr.offerSeed(reqSend)
+   }
+
+   reqSend, traceDone := reqMgr.traceUpstream(reqSend, sendReq.target.label())
+   defer traceDone()
+   reqSend, fault := reqMgr.injectFault(reqSend, tests, sendReq.target.label(), false)
+   defer fault.done()
+   stagStart := reqMgr.Clock.Now()
+   resp, err := reqMgr.stagingClient(sendReq).Do(reqSend)
+   if err == nil {
+      resp.Body = fault.wrap(resp.Body, resp.ContentLength)
+   }
+   obs := canaryObservation{stagLatency: reqMgr.Clock.Now().Sub(stagStart)}
+   if ex := sendReq.exchange; ex != nil {
+      obs.prodStatus = ex.status()
+      obs.prodLatency = ex.prodLatency
+   }
    if err != nil {
-      log.Printf("error sending message to staging: %+v", err)
+      obs.failed = true
+      reqMgr.canary.observe(sendReq.target.label(), obs)
+      reqMgr.chaos.observeStaging(sendReq, obs)
+      reqMgr.countMorfs(sendReq, "error", false)
+      reqMgr.Metrics.Inc("forktraffic_staging_failures_total", "region", sendReq.target.label())
+      reqMgr.countExperiment(sendReq, "forktraffic_experiment_responses_total", "class", "error")
+      reqMgr.observeScenario(sendReq, "error")
+      reqMgr.reportError(&ForwardError{Class: ErrStagingUnavailable, Path: reqSend.URL.Path, Err: err})
+      if len(sendReq.morfs) > 0 && fault == nil {
+         reqMgr.triageFailure(sendReq.target, entryOf(reqSend), sendReq.morfs, 0, nil, err)
+      }
+      if fault == nil {
+         reqMgr.forwardFailed(sendReq, err)
+      }
    } else {
-      reqMgr.cacheResponse(sendReq.sessionKey, resp, sendReq.keyExpires)
+      reqMgr.cacheResponse(sendReq.target, sendReq.sessionKey, resp, sendReq.keyExpires)
+      reqMgr.Metrics.Inc("forktraffic_staging_responses_total", "region", sendReq.target.label(), "class", statusClass(resp.StatusCode))
+      reqMgr.countExperiment(sendReq, "forktraffic_experiment_responses_total", "class", statusClass(resp.StatusCode))
+      reqMgr.observeScenario(sendReq, statusClass(resp.StatusCode))
+      reqMgr.checkAssertions(sendReq, resp.StatusCode)
+      buf, size, bodyDiff := reqMgr.readStaging(resp, sendReq.exchange)
+      obs.stagStatus = resp.StatusCode
+      obs.bodyDiff = bodyDiff
+      headerDiff := reqMgr.diffHeaders(sendReq, resp.Header)
+      var stagCapture *ResponseCapture = nil
+      if ex := sendReq.exchange; ex != nil && ex.prodCapture != nil {
+         stagCapture = reqMgr.captureStaging(resp, buf.Bytes())
+      }
+      obs.diffs = reqMgr.diffExchange(sendReq, resp, stagCapture)
+      obs.mismatch = sendReq.exchange != nil && (obs.prodStatus != obs.stagStatus || headerDiff || bodyDiff != "" || len(obs.diffs) > 0)
+      reqMgr.canary.observe(sendReq.target.label(), obs)
+      reqMgr.chaos.observeStaging(sendReq, obs)
+      reqMgr.countMorfs(sendReq, statusClass(resp.StatusCode), obs.mismatch)
+      if obs.mismatch {
+         rec := reqMgr.recordMismatch(sendReq, reqSend, obs)
+         reqMgr.reportMismatch(rec, sendReq, resp, stagCapture)
+      }
 
       // log the response
-      buf := new(bytes.Buffer)
-      buf.ReadFrom(resp.Body)
-      newStr := buf.String()
-      var isGraphic bool = true
-      lng := len(newStr)
-      if lng > 70 {
-         lng = 70
-         newStr = newStr[:70]
-      }
-      runes := []rune(newStr)
-      for i := 0; i < lng; i++ {
-         if !unicode.IsGraphic(runes[i]) {
-            isGraphic = false
-            break
-         }
+      reqMgr.checkInjection(sendReq, resp.StatusCode, buf.Bytes())
+      if len(sendReq.morfs) > 0 && resp.StatusCode >= http.StatusInternalServerError {
+         reqMgr.triageFailure(sendReq.target, entryOf(reqSend), sendReq.morfs, resp.StatusCode, buf.Bytes(), nil)
       }
-      if !isGraphic {
-         newStr = base64.StdEncoding.EncodeToString([]byte(newStr))
+      if ex := sendReq.exchange; ex != nil {
+         reqMgr.countBytes(sendReq.target.label(), "out", ex.route, int64(len(sendReq.body)))
+         reqMgr.countBytes(sendReq.target.label(), "in", ex.route, size)
       }
-      mx := len(reqSend.URL.Path)
-      if mx > 70 {
-         mx = 70
+
+      // hand both responses to the comparison
+      if ex := sendReq.exchange; ex != nil && ex.prodCapture != nil && reqMgr.OnResponses != nil {
+         if stagCapture != nil {
+            prod := reqMgr.translateCapture(sendReq.req, ex.prodCapture, false)
+            stag := reqMgr.translateCapture(sendReq.req, stagCapture, true)
+            reqMgr.OnResponses(sendReq.req, reqMgr.normalizeCapture(sendReq.req, prod), reqMgr.normalizeCapture(sendReq.req, stag))
+         }
       }
-      log.Printf("%v: %+v", reqSend.URL.Path[:mx], newStr)
+      reqMgr.logStagingResponse(sendReq, reqSend, resp, buf.Bytes(), obs.stagLatency)
 
       // cleanup
       resp.Body.Close()
@@ -508,20 +1252,49 @@ func (reqMgr *RequestManager) sendRequest(reqSend *http.Request, sendReq *Pendin
 //
 // build the forward request
 //
-func (reqMgr *RequestManager) buildForwardRequest(req *http.Request, prodSessionKey string, stagBody io.ReadCloser) *http.Request {
+func (reqMgr *RequestManager) buildForwardRequest(sendReq *PendingRequest) (*http.Request, error) {
+   req := sendReq.req
+   target := sendReq.target
+   reqMgr.observeQueued(sendReq)
+
    // prepare request for staging
-   stagReq, err := http.NewRequest(req.Method, req.URL.Path, stagBody)
+   var stagBody io.Reader = nil
+   body := sendReq.body
+   if body != nil {
+      body = reqMgr.stagingBody(req, body)
+      stagBody = bytes.NewReader(body)
+   }
+   if sendReq.exchange != nil {
+      sendReq.morfs = append([]string(nil), sendReq.exchange.morfs...)
+   }
+   tests := reqMgr.testsOf(sendReq)
+   method := req.Method
+   if tests.MorfMethod {
+      method = reqMgr.morfMethod(tests, method, req.URL.Path)
+      if method != req.Method {
+         sendReq.morfs = append(sendReq.morfs, "method")
+      }
+   }
+   stagReq, err := http.NewRequest(method, req.URL.Path, stagBody)
 
    if err != nil {
-      log.Print("error creating new request: ", err)
-      return nil
+      return nil, &ForwardError{Class: ErrBuildRequest, Path: req.URL.Path, Err: err}
    } else {
-      stagReq.URL = reqMgr.UrlStaging
-      stagReq.URL.Path = req.URL.Path
-      stagReq.Host = reqMgr.UrlStaging.Host
+      stagUrl := *target.url
+      stagReq.URL = &stagUrl
+      stagReq.URL.Path, stagReq.URL.RawPath = req.URL.Path, req.URL.RawPath
+      stagReq.URL.RawQuery = stagingQuery(target.url, req)
+      stagReq.Host = target.url.Host
+      if len(tests.InjectPayloads) > 0 {
+         body = reqMgr.injectPayload(tests, sendReq, stagReq, body)
+      }
 
       // copy headers from production request to staging
-      StagKeys := reqMgr.CacheData[prodSessionKey]
+      StagKeys := reqMgr.cachedKeys(target.cacheKey(sendReq.requestKey))
+      if StagKeys == nil {
+         StagKeys = reqMgr.syntheticKeys(target, sendReq)
+      }
+      reqMgr.countSessionLookup(sendReq, StagKeys)
       for key, vals := range req.Header {
          if !strings.EqualFold(key, httpForwardedHeader) {
             for i := range vals {
@@ -531,6 +1304,7 @@ func (reqMgr *RequestManager) buildForwardRequest(req *http.Request, prodSession
                if StagKeys != nil {
                   if strings.EqualFold(key, "X-Csrf-Token") && StagKeys.csrfToken != "" {
                      val = StagKeys.csrfToken
+                     reqMgr.countSubstitution(sendReq, "X-Csrf-Token")
                   }
                }
 
@@ -547,20 +1321,72 @@ func (reqMgr *RequestManager) buildForwardRequest(req *http.Request, prodSession
          for _, cc := range req.Cookies() {
             if strings.EqualFold(cc.Name, "csrfToken") {
                cc.Value = StagKeys.csrfToken
+               reqMgr.countSubstitution(sendReq, "csrfToken")
             } else if strings.EqualFold(cc.Name, "sessionKey") {
                cc.Value = StagKeys.sessionKey
+               reqMgr.countSubstitution(sendReq, "sessionKey")
             } else if strings.EqualFold(cc.Name, "sessionTtl") {
                cc.Value = StagKeys.sessionTtl
+               reqMgr.countSubstitution(sendReq, "sessionTtl")
             }
-            // if we have a cookie value add it to the request
-            if cc.Value != "" {
+            // if we have a cookie value in scope of the staging request add it
+            scope := StagKeys.scopes[strings.ToLower(cc.Name)]
+            if cc.Value != "" && reqMgr.cookieInScope(scope, target, req, reqMgr.translatedPath(req)) {
                stagReq.AddCookie(cc)
             }
          }
       }
+
+      // morf a cookie value
+      if tests.MorfCookie && morfCookie(stagReq, reqMgr.Rand) {
+         sendReq.morfs = append(sendReq.morfs, "cookie")
+      }
+   }
+
+   reqMgr.remapAccounts(stagReq)
+   reqMgr.translateRequest(req, stagReq)
+   reqMgr.pseudonymizeRequest(stagReq)
+   reqMgr.markShadow(stagReq)
+   reqMgr.suffixUserAgent(stagReq)
+   reqMgr.stampSent(stagReq)
+   stagReq.Header.Set(httpForwardedHeader, req.Header.Get(httpForwardedHeader))
+
+   // trailers are only sent with a chunked body
+   if len(sendReq.trailer) > 0 && body != nil {
+      stagReq.Trailer = sendReq.trailer.Clone()
+      stagReq.ContentLength = -1
    }
 
-   stagReq.Header.Add(httpDuplicateHeader, httpNameHeader)
+   // integrity of the mirrored body; lets staging detect truncated copies
+   if body != nil {
+      sum := sha256.Sum256(body)
+      stagReq.Header.Set(httpBodyChecksumHeader, hex.EncodeToString(sum[:]))
+      stagReq.Header.Set(httpBodyLengthHeader, strconv.Itoa(len(body)))
+   }
+   if target.region != "" {
+      stagReq.Header.Set(httpRegionHeader, target.region)
+   }
+   if sendReq.experiment != "" {
+      stagReq.Header.Set(httpExperimentHeader, sendReq.experiment)
+   }
+   if sendReq.scenario != "" {
+      stagReq.Header.Set(httpScenarioHeader, sendReq.scenario)
+   }
+   if ex := sendReq.exchange; ex != nil && ex.correlationId != "" {
+      stagReq.Header.Set(httpCorrelationHeader, ex.correlationId)
+   }
+   if sendReq.reproId != "" {
+      stagReq.Header.Set(httpDebugHeader, "repro")
+      stagReq.Header.Set(httpReproIdHeader, sendReq.reproId)
+   }
+   if reqMgr.EnvoyShadow {
+      envoyShadow(stagReq, req)
+   }
+   if reqMgr.TracePropagation {
+      linkTrace(stagReq, req, reqMgr.Rand)
+   }
+   reqMgr.validateCopy(sendReq, stagReq, body)
+   reqMgr.signRequest(stagReq, body)
 
-   return stagReq
+   return stagReq, nil
 }
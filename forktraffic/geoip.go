@@ -0,0 +1,414 @@
+package forktraffic
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "io/ioutil"
+   "log"
+   "math"
+   "net"
+   "net/http"
+   "os"
+   "strings"
+)
+
+// location headers attached to both copies
+const httpGeoCountryHeader string = "X-Geo-Country"
+const httpGeoRegionHeader string = "X-Geo-Region"
+
+var errGeoIpFormat = errors.New("not a MaxMind database")
+
+// location of a client address
+type geoLocation struct {
+   Country string
+   Region  string
+}
+
+//
+// local GeoIP database
+// - a MaxMind DB (".mmdb", GeoIP2/GeoLite2 Country or City): the country ISO code
+//   and the continent code as region
+// - or CSV lines "network,country[,region]", e.g. "2.16.0.0/13,DE,EU"
+type geoDatabase interface {
+   lookup(ip net.IP) (geoLocation, bool)
+}
+
+func openGeoDatabase(file string) (geoDatabase, error) {
+   if strings.HasSuffix(strings.ToLower(file), ".mmdb") {
+      return openMmdb(file)
+   }
+   return openGeoCsv(file)
+}
+
+//
+// set up the GeoIP tagging
+// - an unreadable database disables it; with mirror filters nothing is mirrored then
+func (reqMgr *RequestManager) initGeoIp() {
+   if reqMgr.GeoIpDatabase == "" {
+      return
+   }
+   db, err := openGeoDatabase(reqMgr.GeoIpDatabase)
+   if err != nil {
+      log.Printf("Warning - GeoIP database %v: %v; requests are not located", reqMgr.GeoIpDatabase, err)
+      return
+   }
+   reqMgr.geoDb = db
+}
+
+// the client address; the first X-Forwarded-For address when GeoIpForwardedFor is set
+func (reqMgr *RequestManager) clientIp(req *http.Request) net.IP {
+   if reqMgr.GeoIpForwardedFor {
+      if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+         if ip := net.ParseIP(strings.TrimSpace(strings.Split(xff, ",")[0])); ip != nil {
+            return ip
+         }
+      }
+   }
+   host, _, err := net.SplitHostPort(req.RemoteAddr)
+   if err != nil {
+      host = req.RemoteAddr
+   }
+   return net.ParseIP(host)
+}
+
+//
+// attach the client location to a request; it replaces location headers sent by the client
+func (reqMgr *RequestManager) tagGeo(req *http.Request) {
+   if reqMgr.geoDb == nil && len(reqMgr.MirrorCountries) == 0 && len(reqMgr.MirrorRegions) == 0 {
+      return
+   }
+   req.Header.Del(httpGeoCountryHeader)
+   req.Header.Del(httpGeoRegionHeader)
+   ip := reqMgr.clientIp(req)
+   if reqMgr.geoDb == nil || ip == nil {
+      return
+   }
+   loc, ok := reqMgr.geoDb.lookup(ip)
+   if !ok {
+      reqMgr.Metrics.Inc("forktraffic_geo_requests_total", "country", "unknown")
+      return
+   }
+   if loc.Country != "" {
+      req.Header.Set(httpGeoCountryHeader, loc.Country)
+   }
+   if loc.Region != "" {
+      req.Header.Set(httpGeoRegionHeader, loc.Region)
+   }
+   reqMgr.Metrics.Inc("forktraffic_geo_requests_total", "country", loc.Country)
+}
+
+//
+// is the request mirrored given its location
+// - MirrorCountries and MirrorRegions list the accepted locations; a request of an
+//   unknown location is accepted only when no list is set
+func (reqMgr *RequestManager) mirrorGeo(req *http.Request) bool {
+   if len(reqMgr.MirrorCountries) == 0 && len(reqMgr.MirrorRegions) == 0 {
+      return true
+   }
+   country, region := req.Header.Get(httpGeoCountryHeader), req.Header.Get(httpGeoRegionHeader)
+   for _, c := range reqMgr.MirrorCountries {
+      if country != "" && strings.EqualFold(c, country) {
+         return true
+      }
+   }
+   for _, r := range reqMgr.MirrorRegions {
+      if region != "" && strings.EqualFold(r, region) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// CSV database; networks by prefix length, the longest prefix wins
+type geoCsv struct {
+   bits     []int
+   networks map[int]map[string]geoLocation
+}
+
+func openGeoCsv(file string) (*geoCsv, error) {
+   f, err := os.Open(file)
+   if err != nil {
+      return nil, err
+   }
+   defer f.Close()
+
+   db := &geoCsv{networks: make(map[int]map[string]geoLocation)}
+   scanner := bufio.NewScanner(f)
+   for scanner.Scan() {
+      fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+      if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+         continue
+      }
+      _, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+      if err != nil {
+         continue
+      }
+      loc := geoLocation{Country: strings.TrimSpace(fields[1])}
+      if len(fields) > 2 {
+         loc.Region = strings.TrimSpace(fields[2])
+      }
+      ones, size := network.Mask.Size()
+      if size == 32 {
+         ones += 96
+      }
+      if db.networks[ones] == nil {
+         db.networks[ones] = make(map[string]geoLocation)
+         db.bits = append(db.bits, ones)
+      }
+      db.networks[ones][string(network.IP.To16().Mask(net.CIDRMask(ones, 128)))] = loc
+   }
+   // longest prefixes first
+   for i := 1; i < len(db.bits); i++ {
+      for j := i; j > 0 && db.bits[j] > db.bits[j-1]; j-- {
+         db.bits[j], db.bits[j-1] = db.bits[j-1], db.bits[j]
+      }
+   }
+   return db, scanner.Err()
+}
+
+func (db *geoCsv) lookup(ip net.IP) (geoLocation, bool) {
+   ip = ip.To16()
+   for _, ones := range db.bits {
+      if loc, ok := db.networks[ones][string(ip.Mask(net.CIDRMask(ones, 128)))]; ok {
+         return loc, true
+      }
+   }
+   return geoLocation{}, false
+}
+
+//
+// MaxMind DB reader; the search tree and the data section of the format
+type mmdb struct {
+   buf        []byte
+   nodeCount  uint
+   recordSize uint
+   ipVersion  uint
+   dataStart  uint
+}
+
+// metadata marker, searched from the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMmdb(file string) (*mmdb, error) {
+   buf, err := ioutil.ReadFile(file)
+   if err != nil {
+      return nil, err
+   }
+   at := bytes.LastIndex(buf, mmdbMetadataMarker)
+   if at < 0 {
+      return nil, errGeoIpFormat
+   }
+   start := uint(at + len(mmdbMetadataMarker))
+   meta, _, err := (&mmdb{buf: buf[start:]}).decode(0)
+   if err != nil {
+      return nil, err
+   }
+   fields, ok := meta.(map[string]interface{})
+   if !ok {
+      return nil, errGeoIpFormat
+   }
+   db := &mmdb{
+      buf:        buf,
+      nodeCount:  mmdbUint(fields["node_count"]),
+      recordSize: mmdbUint(fields["record_size"]),
+      ipVersion:  mmdbUint(fields["ip_version"]),
+   }
+   if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+      return nil, errGeoIpFormat
+   }
+   db.dataStart = db.nodeCount*db.recordSize/4 + 16
+   if db.dataStart > start {
+      return nil, errGeoIpFormat
+   }
+   return db, nil
+}
+
+func mmdbUint(v interface{}) uint {
+   n, _ := v.(uint64)
+   return uint(n)
+}
+
+// the left or the right record of a node
+func (db *mmdb) record(node uint, right bool) uint {
+   b := db.buf[node*db.recordSize/4:]
+   switch db.recordSize {
+   case 24:
+      if right {
+         b = b[3:]
+      }
+      return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+   case 28:
+      if right {
+         return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+      }
+      return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+   default:
+      if right {
+         b = b[4:]
+      }
+      return uint(binary.BigEndian.Uint32(b))
+   }
+}
+
+func (db *mmdb) lookup(ip net.IP) (geoLocation, bool) {
+   // IPv4 addresses are at ::a.b.c.d of an IPv6 tree
+   var bits []byte
+   ip4 := ip.To4()
+   if ip4 != nil && db.ipVersion == 4 {
+      bits = ip4
+   } else if ip4 != nil && db.ipVersion == 6 {
+      bits = append(make([]byte, 12), ip4...)
+   } else if db.ipVersion == 6 {
+      bits = ip.To16()
+   } else {
+      return geoLocation{}, false
+   }
+
+   node := uint(0)
+   for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+      node = db.record(node, bits[i/8]&(0x80>>uint(i%8)) != 0)
+   }
+   if node <= db.nodeCount {
+      return geoLocation{}, false
+   }
+
+   data := &mmdb{buf: db.buf[db.dataStart:]}
+   rec, _, err := data.decode(node - db.nodeCount - 16)
+   if err != nil {
+      return geoLocation{}, false
+   }
+   var loc geoLocation
+   if fields, ok := rec.(map[string]interface{}); ok {
+      loc.Country = mmdbString(fields, "country", "iso_code")
+      if loc.Country == "" {
+         loc.Country = mmdbString(fields, "registered_country", "iso_code")
+      }
+      loc.Region = mmdbString(fields, "continent", "code")
+   }
+   return loc, loc.Country != "" || loc.Region != ""
+}
+
+func mmdbString(fields map[string]interface{}, name, key string) string {
+   inner, _ := fields[name].(map[string]interface{})
+   s, _ := inner[key].(string)
+   return s
+}
+
+//
+// decode the data field at offset of the section; returns it and the next offset
+// - pointers are relative to the section; unsigned integers decode to uint64
+func (db *mmdb) decode(offset uint) (interface{}, uint, error) {
+   if offset >= uint(len(db.buf)) {
+      return nil, 0, errGeoIpFormat
+   }
+   ctrl := db.buf[offset]
+   offset++
+   kind := uint(ctrl >> 5)
+
+   if kind == 1 {
+      // pointer
+      ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+      if offset+ss+1 > uint(len(db.buf)) {
+         return nil, 0, errGeoIpFormat
+      }
+      var ptr uint
+      b := db.buf[offset:]
+      switch ss {
+      case 0:
+         ptr = vvv<<8 | uint(b[0])
+      case 1:
+         ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+      case 2:
+         ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+      default:
+         ptr = uint(binary.BigEndian.Uint32(b))
+      }
+      v, _, err := db.decode(ptr)
+      return v, offset + ss + 1, err
+   }
+   if kind == 0 {
+      if offset >= uint(len(db.buf)) {
+         return nil, 0, errGeoIpFormat
+      }
+      kind = 7 + uint(db.buf[offset])
+      offset++
+   }
+
+   size := uint(ctrl & 0x1f)
+   if size >= 29 {
+      n := size - 28
+      if offset+n > uint(len(db.buf)) {
+         return nil, 0, errGeoIpFormat
+      }
+      ext := uint(0)
+      for _, b := range db.buf[offset : offset+n] {
+         ext = ext<<8 | uint(b)
+      }
+      size = [...]uint{29, 285, 65821}[n-1] + ext
+      offset += n
+   }
+
+   switch kind {
+   case 7: // map
+      m := make(map[string]interface{}, size)
+      for i := uint(0); i < size; i++ {
+         key, next, err := db.decode(offset)
+         if err != nil {
+            return nil, 0, err
+         }
+         val, next, err := db.decode(next)
+         if err != nil {
+            return nil, 0, err
+         }
+         name, _ := key.(string)
+         m[name], offset = val, next
+      }
+      return m, offset, nil
+   case 11: // array
+      a := make([]interface{}, 0, size)
+      for i := uint(0); i < size; i++ {
+         val, next, err := db.decode(offset)
+         if err != nil {
+            return nil, 0, err
+         }
+         a, offset = append(a, val), next
+      }
+      return a, offset, nil
+   case 14: // boolean; the size is the value
+      return size != 0, offset, nil
+   }
+
+   if offset+size > uint(len(db.buf)) {
+      return nil, 0, errGeoIpFormat
+   }
+   b := db.buf[offset : offset+size]
+   offset += size
+   switch kind {
+   case 2: // string
+      return string(b), offset, nil
+   case 3: // double
+      if size != 8 {
+         return nil, 0, errGeoIpFormat
+      }
+      return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+   case 15: // float
+      if size != 4 {
+         return nil, 0, errGeoIpFormat
+      }
+      return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+   case 5, 6, 8, 9: // uint16, uint32, int32, uint64
+      n := uint64(0)
+      for _, c := range b {
+         n = n<<8 | uint64(c)
+      }
+      if kind == 8 {
+         return int64(int32(n)), offset, nil
+      }
+      return n, offset, nil
+   default: // bytes, uint128 and the containers are kept raw
+      return b, offset, nil
+   }
+}
@@ -0,0 +1,149 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "mime"
+   "net/http"
+   "regexp"
+   "strings"
+)
+
+// default GraphQL endpoint
+const DefaultGraphqlPath string = "/graphql"
+
+//
+// GraphQL operation of a request
+// - Type is "unknown" for a document that cannot be classified: unparseable,
+//   batched, or several operations without an operationName
+type graphqlOperation struct {
+   Type string // query, mutation, subscription or unknown
+   Name string // operation name; "anonymous" if none
+}
+
+const graphqlUnknown string = "unknown"
+
+var graphqlDefinition = regexp.MustCompile(`^(query|mutation|subscription|fragment)\b\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+//
+// parse the operation of a GraphQL document
+// - only the top level definitions are read; strings, block strings and comments
+//   are skipped, fragment definitions are not operations
+// - operationName selects among several operations in the document
+func parseGraphqlDocument(query, operationName string) *graphqlOperation {
+   unknown := &graphqlOperation{Type: graphqlUnknown, Name: "anonymous"}
+   var ops []graphqlOperation
+   depth, opened := 0, true // opened: the last definition has its selection set
+   for i := 0; i < len(query); i++ {
+      c := query[i]
+      switch {
+      case c == '#':
+         for i < len(query) && query[i] != '\n' {
+            i++
+         }
+      case strings.HasPrefix(query[i:], `"""`):
+         end := strings.Index(query[i+3:], `"""`)
+         if end < 0 {
+            return unknown
+         }
+         i += end + 5
+      case c == '"':
+         for i++; i < len(query) && query[i] != '"'; i++ {
+            if query[i] == '\\' {
+               i++
+            }
+         }
+         if i >= len(query) {
+            return unknown
+         }
+      case c == '{' || c == '(' || c == '[':
+         if c == '{' && depth == 0 {
+            if opened {
+               ops = append(ops, graphqlOperation{Type: "query"}) // shorthand "{ ... }"
+            }
+            opened = true
+         }
+         depth++
+      case c == '}' || c == ')' || c == ']':
+         if depth--; depth < 0 {
+            return unknown
+         }
+      case depth == 0 && opened && (c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'):
+         m := graphqlDefinition.FindStringSubmatch(query[i:])
+         if m == nil {
+            return unknown
+         }
+         if m[1] != "fragment" {
+            ops = append(ops, graphqlOperation{Type: m[1], Name: m[2]})
+         }
+         i, opened = i+len(m[0])-1, false
+      }
+   }
+   if depth != 0 || !opened {
+      return unknown
+   }
+
+   var op *graphqlOperation = nil
+   for i := range ops {
+      if (operationName == "" && len(ops) == 1) || (operationName != "" && ops[i].Name == operationName) {
+         op = &ops[i]
+      }
+   }
+   if op == nil {
+      return unknown
+   }
+   if op.Name == "" {
+      op.Name = "anonymous"
+   }
+   return op
+}
+
+//
+// get the GraphQL operation of a request; nil if it is not a GraphQL request
+func (reqMgr *RequestManager) graphqlOf(req *http.Request, body []byte) *graphqlOperation {
+   path := reqMgr.GraphqlPath
+   if path == "" {
+      path = DefaultGraphqlPath
+   }
+   if req.URL.Path != path {
+      return nil
+   }
+
+   // GET: the document is in the query string
+   if strings.EqualFold(req.Method, "GET") {
+      q := req.URL.Query()
+      return parseGraphqlDocument(q.Get("query"), q.Get("operationName"))
+   }
+
+   plain, ok := decodeBody(body, req.Header.Get("Content-Encoding"))
+   if !ok {
+      return &graphqlOperation{Type: graphqlUnknown, Name: "anonymous"}
+   }
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if mediaType == "application/graphql" {
+      return parseGraphqlDocument(string(plain), "")
+   }
+   var gqlReq struct {
+      Query         string
+      OperationName string
+   }
+   if json.Unmarshal(plain, &gqlReq) != nil {
+      return &graphqlOperation{Type: graphqlUnknown, Name: "anonymous"} // batched or invalid
+   }
+   return parseGraphqlDocument(gqlReq.Query, gqlReq.OperationName)
+}
+
+//
+// should a GraphQL operation be mirrored
+// - GraphqlMirrorTypes lists the mirrored operation types; empty mirrors all
+// - an unknown operation is only mirrored when "unknown" is listed
+func (reqMgr *RequestManager) mirrorGraphql(op *graphqlOperation) bool {
+   if op == nil || len(reqMgr.GraphqlMirrorTypes) == 0 {
+      return true
+   }
+   for _, opType := range reqMgr.GraphqlMirrorTypes {
+      if strings.EqualFold(opType, op.Type) {
+         return true
+      }
+   }
+   return false
+}
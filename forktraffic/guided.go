@@ -0,0 +1,370 @@
+package forktraffic
+
+import (
+   "bytes"
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/json"
+   "io/ioutil"
+   "log"
+   "mime"
+   "net/http"
+   "net/url"
+   "os"
+   "path/filepath"
+   "strings"
+   "sync"
+)
+
+// seeds waiting for the guided fuzzer; further offers are dropped
+const fuzzSeedQueue int = 100
+
+// corpus entries kept; the least productive one goes for a new one
+const corpusLimit int = 1000
+
+// feedback signals remembered; the oldest are forgotten first
+const fuzzSeenLimit int = 10000
+
+// header identifying a fuzzed request to the feedback endpoint
+const httpFuzzIdHeader string = "X-Fork-Fuzz-Id"
+
+//
+// input of the guided fuzzer; kept in the corpus when it reached new behavior
+type corpusEntry struct {
+   Id       string
+   Method   string
+   Path     string
+   RawQuery string
+   Header   http.Header
+   Body     []byte
+   Picks    int // times the entry was mutated
+   Finds    int // mutations of the entry that reached new behavior
+}
+
+//
+// guided fuzzing state
+type fuzzer struct {
+   lock     sync.Mutex
+   seeds    chan *corpusEntry
+   corpus   []*corpusEntry
+   seen     map[string]bool
+   seenKeys []string
+}
+
+//
+// start the guided fuzzing loop when a feedback endpoint is configured
+// - staging copies are offered as seeds; a single worker mutates a seed or a
+//   corpus entry, sends it to staging and asks FeedbackUrl for the coverage signal
+//   of that request
+// - inputs reaching new behavior join the corpus, persisted to CorpusDir; both
+//   are capped at corpusLimit and CorpusDir is pruned like the other artifacts
+func (reqMgr *RequestManager) startFuzzer() {
+   if reqMgr.FeedbackUrl == "" || !reqMgr.mirroring() {
+      return
+   }
+   reqMgr.fuzz.seeds = make(chan *corpusEntry, fuzzSeedQueue)
+   reqMgr.fuzz.seen = make(map[string]bool)
+   reqMgr.loadCorpus()
+   go func() {
+      for seed := range reqMgr.fuzz.seeds {
+         reqMgr.fuzzOnce(seed)
+      }
+   }()
+}
+
+//
+// the entry of a staging request; the body is read again through GetBody
+func entryOf(stagReq *http.Request) *corpusEntry {
+   entry := &corpusEntry{
+      Method:   stagReq.Method,
+      Path:     stagReq.URL.EscapedPath(),
+      RawQuery: stagReq.URL.RawQuery,
+      Header:   stagReq.Header.Clone(),
+   }
+   if stagReq.GetBody != nil {
+      if rd, err := stagReq.GetBody(); err == nil {
+         entry.Body, _ = ioutil.ReadAll(rd)
+      }
+   }
+   return entry
+}
+
+//
+// offer a staging copy to the guided fuzzer
+func (reqMgr *RequestManager) offerSeed(stagReq *http.Request) {
+   if reqMgr.fuzz.seeds == nil {
+      return
+   }
+   select {
+   case reqMgr.fuzz.seeds <- entryOf(stagReq):
+   default:
+   }
+}
+
+//
+// pick the input to mutate: a corpus entry, favoring the productive and
+// rarely picked ones, or else the fresh seed
+func (reqMgr *RequestManager) pickInput(seed *corpusEntry) *corpusEntry {
+   fz := &reqMgr.fuzz
+   fz.lock.Lock()
+   defer fz.lock.Unlock()
+   if len(fz.corpus) == 0 || reqMgr.Rand.Intn(2) == 0 {
+      return seed
+   }
+   best := fz.corpus[reqMgr.Rand.Intn(len(fz.corpus))]
+   for i := 0; i < 3; i++ {
+      cand := fz.corpus[reqMgr.Rand.Intn(len(fz.corpus))]
+      if (cand.Finds+1)*(best.Picks+1) > (best.Finds+1)*(cand.Picks+1) {
+         best = cand
+      }
+   }
+   best.Picks++
+   return best
+}
+
+//
+// mutate an input; returns the mutant and the mutation name
+func (reqMgr *RequestManager) mutate(in *corpusEntry) (*corpusEntry, string) {
+   out := *in
+   out.Id, out.Picks, out.Finds = "", 0, 0
+   out.Header = in.Header.Clone()
+   out.Body = append([]byte(nil), in.Body...)
+   rnd := reqMgr.Rand
+
+   switch kind := rnd.Intn(5); {
+   case kind == 0 && len(out.Path) > 1:
+      i := 1 + rnd.Intn(len(out.Path)-1)
+      variants := encodingVariants(out.Path[i])
+      out.Path = out.Path[:i] + variants[rnd.Intn(len(variants))] + out.Path[i+1:]
+      return &out, "path_encoding"
+   case kind == 1 && out.RawQuery != "":
+      query, _ := url.ParseQuery(out.RawQuery)
+      for name := range query {
+         query.Set(name, insertUnicode(query.Get(name), rnd))
+         break
+      }
+      out.RawQuery = query.Encode()
+      return &out, "query_unicode"
+   case kind == 2 && len(out.Body) > 0:
+      out.Body[rnd.Intn(len(out.Body))] = byte(rnd.Intn(256))
+      return &out, "body_byte"
+   case kind == 3 && len(out.Body) > 1:
+      out.Body = out.Body[:rnd.Intn(len(out.Body))]
+      return &out, "body_truncate"
+   }
+   var names []string
+   for name := range out.Header {
+      if !strings.EqualFold(name, "Cookie") {
+         names = append(names, name)
+      }
+   }
+   if len(names) > 0 {
+      name := names[rnd.Intn(len(names))]
+      out.Header.Set(name, insertUnicode(out.Header.Get(name), rnd))
+   }
+   return &out, "header_unicode"
+}
+
+//
+// one round of the guided fuzzer
+func (reqMgr *RequestManager) fuzzOnce(seed *corpusEntry) {
+   var target *stagingTarget
+   for _, t := range reqMgr.stagingTargets() {
+      if t.proxied() {
+         target = t
+         break
+      }
+   }
+   if target == nil {
+      return
+   }
+   input := reqMgr.pickInput(seed)
+   mutant, mutation := reqMgr.mutate(input)
+
+   status := "error"
+   mutant.Id = reqMgr.createReqId()
+   code, body, err := reqMgr.sendEntry(target, mutant, "fuzz")
+   if err == nil {
+      status = statusClass(code)
+   }
+   reqMgr.Metrics.Inc("forktraffic_fuzz_requests_total", "mutation", mutation, "status", status)
+   if err != nil || code >= http.StatusInternalServerError {
+      reqMgr.triageFailure(target, mutant, []string{"fuzz:" + mutation}, code, body, err)
+   }
+
+   if reqMgr.newBehavior(mutant.Id, status) {
+      if input != seed {
+         reqMgr.fuzz.lock.Lock()
+         input.Finds++
+         reqMgr.fuzz.lock.Unlock()
+      }
+      reqMgr.addCorpus(mutant)
+      reqMgr.Metrics.Inc("forktraffic_fuzz_new_behavior_total", "mutation", mutation)
+   }
+}
+
+//
+// send an entry to a staging target, marked with the debug header
+// - returns the response status and body
+func (reqMgr *RequestManager) sendEntry(target *stagingTarget, entry *corpusEntry, debug string) (int, []byte, error) {
+   dest := *target.url
+   dest.Path, dest.RawPath, dest.RawQuery = "", entry.Path, entry.RawQuery
+   if unescaped, err := url.PathUnescape(entry.Path); err == nil {
+      dest.Path = unescaped
+   } else {
+      dest.Path, dest.RawPath = entry.Path, ""
+   }
+   req, err := http.NewRequest(entry.Method, dest.String(), bytes.NewReader(entry.Body))
+   if err != nil {
+      return 0, nil, err
+   }
+   req.Header = entry.Header.Clone()
+   req.Header.Set(httpDebugHeader, debug)
+   if entry.Id != "" {
+      req.Header.Set(httpFuzzIdHeader, entry.Id)
+   }
+   req.ContentLength = int64(len(entry.Body))
+   reqMgr.markShadow(req)
+
+   resp, err := reqMgr.DestStaging.Do(req)
+   if err != nil {
+      return 0, nil, err
+   }
+   defer resp.Body.Close()
+   body, err := ioutil.ReadAll(resp.Body)
+   return resp.StatusCode, body, err
+}
+
+//
+// read the feedback signal of a fuzzed request; true when it shows behavior not
+// seen before
+// - FeedbackUrl is asked with ?request=<id>, the X-Fork-Fuzz-Id the request
+//   carried, for the coverage of that request alone (e.g. its covered edges)
+// - the signal is new when its content, with the response status, was not seen
+//   before; the last fuzzSeenLimit signals are remembered
+func (reqMgr *RequestManager) newBehavior(id, status string) bool {
+   feedback, err := url.Parse(reqMgr.FeedbackUrl)
+   if err != nil {
+      return false
+   }
+   query := feedback.Query()
+   query.Set("request", id)
+   feedback.RawQuery = query.Encode()
+   resp, err := reqMgr.DestStaging.Get(feedback.String())
+   if err != nil {
+      return false
+   }
+   body, _ := ioutil.ReadAll(resp.Body)
+   resp.Body.Close()
+   if resp.StatusCode != http.StatusOK {
+      return false
+   }
+
+   fz := &reqMgr.fuzz
+   fz.lock.Lock()
+   defer fz.lock.Unlock()
+   sum := sha256.Sum256(append([]byte(status+"|"), bytes.TrimSpace(body)...))
+   key := hex.EncodeToString(sum[:])
+   if fz.seen[key] {
+      return false
+   }
+   fz.seen[key] = true
+   fz.seenKeys = append(fz.seenKeys, key)
+   if len(fz.seenKeys) > fuzzSeenLimit {
+      delete(fz.seen, fz.seenKeys[0])
+      fz.seenKeys = fz.seenKeys[1:]
+   }
+   return true
+}
+
+//
+// add an input to the corpus and persist it
+// - over corpusLimit the least productive entry is dropped, with its file
+// - persisted entries are redacted like captures; one whose body cannot be
+//   redacted is only kept in memory
+func (reqMgr *RequestManager) addCorpus(entry *corpusEntry) {
+   if entry.Id == "" {
+      entry.Id = reqMgr.createReqId()
+   }
+   fz := &reqMgr.fuzz
+   fz.lock.Lock()
+   fz.corpus = append(fz.corpus, entry)
+   var dropped *corpusEntry = nil
+   if len(fz.corpus) > corpusLimit {
+      worst := 0
+      for i, cand := range fz.corpus[:len(fz.corpus)-1] {
+         best := fz.corpus[worst]
+         if (cand.Finds+1)*(best.Picks+1) < (best.Finds+1)*(cand.Picks+1) {
+            worst = i
+         }
+      }
+      dropped = fz.corpus[worst]
+      fz.corpus = append(fz.corpus[:worst], fz.corpus[worst+1:]...)
+   }
+   reqMgr.Metrics.Set("forktraffic_fuzz_corpus_size", int64(len(fz.corpus)))
+   fz.lock.Unlock()
+
+   if reqMgr.CorpusDir == "" {
+      return
+   }
+   if dropped != nil && dropped.Id != "" {
+      os.Remove(filepath.Join(reqMgr.CorpusDir, dropped.Id+".json"))
+   }
+   stored := *entry
+   stored.RawQuery = reqMgr.redactQuery(entry.RawQuery)
+   stored.Header = reqMgr.redactHeader(entry.Header)
+   for _, name := range []string{"Cookie", "Authorization"} {
+      stored.Header.Del(name)
+   }
+   stored.Body = reqMgr.redactBody(entry.Body, entry.Header.Get("Content-Encoding"))
+   if len(entry.Body) > 0 && (stored.Body == nil || !reqMgr.redactable(entry)) {
+      return
+   }
+   buf, err := json.MarshalIndent(stored, "", "  ")
+   if err == nil {
+      err = os.MkdirAll(reqMgr.CorpusDir, 0755)
+   }
+   if err == nil {
+      err = ioutil.WriteFile(filepath.Join(reqMgr.CorpusDir, entry.Id+".json"), buf, 0600)
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: entry.Path, Err: err})
+   }
+}
+
+//
+// can the RedactBodyFields of an entry be redacted; a mutated JSON body that no
+// longer parses cannot
+func (reqMgr *RequestManager) redactable(entry *corpusEntry) bool {
+   mediaType, _, _ := mime.ParseMediaType(entry.Header.Get("Content-Type"))
+   if len(reqMgr.RedactBodyFields) == 0 || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+      return true
+   }
+   plain, ok := decodeBody(entry.Body, entry.Header.Get("Content-Encoding"))
+   return ok && json.Valid(plain)
+}
+
+//
+// load the persisted corpus, up to corpusLimit entries
+func (reqMgr *RequestManager) loadCorpus() {
+   if reqMgr.CorpusDir == "" {
+      return
+   }
+   names, _ := filepath.Glob(filepath.Join(reqMgr.CorpusDir, "*.json"))
+   for _, name := range names {
+      if len(reqMgr.fuzz.corpus) >= corpusLimit {
+         break
+      }
+      buf, err := ioutil.ReadFile(name)
+      if err != nil {
+         continue
+      }
+      entry := new(corpusEntry)
+      if json.Unmarshal(buf, entry) != nil || entry.Method == "" {
+         log.Printf("Warning - invalid corpus entry %v", name)
+         continue
+      }
+      reqMgr.fuzz.corpus = append(reqMgr.fuzz.corpus, entry)
+   }
+   reqMgr.Metrics.Set("forktraffic_fuzz_corpus_size", int64(len(reqMgr.fuzz.corpus)))
+}
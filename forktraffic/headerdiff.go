@@ -0,0 +1,54 @@
+package forktraffic
+
+import (
+   "net/http"
+)
+
+//
+// keep the production values of the compared headers
+func (reqMgr *RequestManager) keepDiffHeaders(resp *http.Response, ex *exchange) {
+   if len(reqMgr.DiffHeaders) == 0 {
+      return
+   }
+   ex.prodHeader = make(http.Header, len(reqMgr.DiffHeaders))
+   for _, name := range reqMgr.DiffHeaders {
+      if vals := resp.Header.Values(name); len(vals) > 0 {
+         ex.prodHeader[http.CanonicalHeaderKey(name)] = append([]string(nil), vals...)
+      }
+   }
+}
+
+// are two header values the same
+func sameValues(a, b []string) bool {
+   if len(a) != len(b) {
+      return false
+   }
+   for i := range a {
+      if a[i] != b[i] {
+         return false
+      }
+   }
+   return true
+}
+
+//
+// compare the DiffHeaders of the production and staging responses
+// - counts comparisons and divergences per route; returns true if any header differs
+func (reqMgr *RequestManager) diffHeaders(sendReq *PendingRequest, stagHeader http.Header) bool {
+   ex := sendReq.exchange
+   if len(reqMgr.DiffHeaders) == 0 || ex == nil || ex.prodHeader == nil {
+      return false
+   }
+
+   region := sendReq.target.label()
+   reqMgr.Metrics.Inc("forktraffic_header_comparisons_total", "region", region, "route", ex.route)
+   differs := false
+   for _, name := range reqMgr.DiffHeaders {
+      name = http.CanonicalHeaderKey(name)
+      if !sameValues(ex.prodHeader[name], stagHeader.Values(name)) {
+         reqMgr.Metrics.Inc("forktraffic_header_diffs_total", "region", region, "route", ex.route, "header", name)
+         differs = true
+      }
+   }
+   return differs
+}
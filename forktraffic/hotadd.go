@@ -0,0 +1,107 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "log"
+   "net/http"
+   "net/url"
+   "time"
+)
+
+//
+// handle "/admin/staging"; the staging destinations
+// - GET lists them
+// - POST {"Region": "", "Url": "http://staging/", "IpMode": "ipv6"} adds one; an
+//   empty region is the primary staging destination, IpMode is optional; "file:///path" writes the copies to a file,
+//   "webhook+https://host/hook" posts their summaries, "nats://host:4222/subject"
+//   publishes them to JetStream
+// - DELETE ?region=name removes one; no region removes the primary destination
+// - a process started production only can begin a shadowing session without a restart
+func (reqMgr *RequestManager) adminStaging(w http.ResponseWriter, r *http.Request) {
+   switch r.Method {
+   case "GET":
+   case "POST":
+      var dest StagingRegion
+      if err := json.NewDecoder(r.Body).Decode(&dest); err != nil {
+         ResponseHttpError(w, http.StatusBadRequest, ": "+err.Error())
+         return
+      }
+      if err := reqMgr.AddStaging(dest.Region, dest.Url, dest.IpMode); err != nil {
+         ResponseHttpError(w, http.StatusBadRequest, ": "+err.Error())
+         return
+      }
+   case "DELETE":
+      if !reqMgr.RemoveStaging(r.URL.Query().Get("region")) {
+         ResponseHttpError(w, http.StatusNotFound, "")
+         return
+      }
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+      return
+   }
+
+   var dests []StagingRegion
+   for _, target := range reqMgr.stagingTargets() {
+      dests = append(dests, StagingRegion{Region: target.region, Url: target.url.String(), IpMode: target.ipMode})
+   }
+   writeJson(w, dests)
+}
+
+//
+// add (or replace) a staging destination at runtime
+// - ipMode is its address family; "" for StagingIpMode
+func (reqMgr *RequestManager) AddStaging(region, rawUrl, ipMode string) error {
+   dest, err := url.Parse(rawUrl)
+   if err != nil {
+      return err
+   }
+   if !validStagingUrl(dest) || IpNetwork(ipMode) == "" {
+      return &url.Error{Op: "parse", URL: rawUrl, Err: errInvalidDestination}
+   }
+
+   reqMgr.targetsLock.Lock()
+   if reqMgr.DestStaging == nil {
+      reqMgr.DestStaging = &http.Client{Timeout: 60 * time.Second}
+   }
+   added := newStagingTarget(region, dest)
+   reqMgr.setIpMode(added, ipMode)
+   targets := make([]*stagingTarget, 0, len(reqMgr.targets)+1)
+   var replaced *stagingTarget = nil
+   for _, target := range reqMgr.targets {
+      if target.region != region {
+         targets = append(targets, target)
+      } else {
+         replaced = target
+      }
+   }
+   if reqMgr.TargetQueues {
+      reqMgr.openTargetQueue(added, replaced)
+   }
+   reqMgr.targets = append(targets, added)
+   reqMgr.targetsLock.Unlock()
+   reqMgr.warmTarget(added)
+
+   log.Printf("staging destination added: %q %v", region, userinfoRedacted(dest))
+   return nil
+}
+
+//
+// remove a staging destination at runtime; false if there is none for the region
+func (reqMgr *RequestManager) RemoveStaging(region string) bool {
+   reqMgr.targetsLock.Lock()
+   defer reqMgr.targetsLock.Unlock()
+   targets := make([]*stagingTarget, 0, len(reqMgr.targets))
+   for _, target := range reqMgr.targets {
+      if target.region != region {
+         targets = append(targets, target)
+      } else if target.queue != nil {
+         target.queue.stop()
+      }
+   }
+   if len(targets) == len(reqMgr.targets) {
+      return false
+   }
+   reqMgr.targets = targets
+   log.Printf("staging destination removed: %q", region)
+   return true
+}
@@ -0,0 +1,33 @@
+package forktraffic
+
+//
+// per-session ordered delivery
+// - requests are hashed by session into a fixed number of lanes
+// - each lane builds and sends its requests one at a time, in queue order
+const laneQueueSize int = 1000
+
+// pick the lane of a pending request
+func (reqMgr *RequestManager) laneOf(sendReq *PendingRequest) int {
+   return int(sessionHash(sendReq) % uint32(len(reqMgr.lanes)))
+}
+
+// start the lane workers
+func (reqMgr *RequestManager) startLanes() {
+   reqMgr.lanes = make([]chan *PendingRequest, reqMgr.OrderedLanes)
+   for i := range reqMgr.lanes {
+      reqMgr.lanes[i] = make(chan *PendingRequest, laneQueueSize)
+      go reqMgr.laneHandler(reqMgr.lanes[i])
+   }
+}
+
+// deliver the requests of a single lane sequentially
+func (reqMgr *RequestManager) laneHandler(lane chan *PendingRequest) {
+   for sendReq := range lane {
+      reqSend, err := reqMgr.buildForwardRequest(sendReq)
+      if err != nil {
+         reqMgr.reportError(err)
+         continue
+      }
+      reqMgr.sendRequest(reqSend, sendReq)
+   }
+}
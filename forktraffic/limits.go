@@ -0,0 +1,68 @@
+package forktraffic
+
+import (
+   "errors"
+   "io"
+   "net/http"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+//
+// request body cut at MaxBodyBytes; used when the length is not announced
+type limitedBody struct {
+   io.ReadCloser
+   left int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+   if lb.left < 0 {
+      return 0, errBodyTooLarge
+   }
+   if int64(len(p)) > lb.left+1 {
+      p = p[:lb.left+1]
+   }
+   n, err := lb.ReadCloser.Read(p)
+   lb.left -= int64(n)
+   if lb.left < 0 {
+      return n, errBodyTooLarge
+   }
+   return n, err
+}
+
+//
+// enforce the request limits of production's edge
+// - a request URI longer than MaxUriBytes is answered 414
+// - a body longer than MaxBodyBytes is answered 413; a body of unknown length is
+//   cut where it passes the limit, and answered 413 by tooLarge
+// - the header size is limited by the server (MaxHeaderKb, answered 431)
+func (reqMgr *RequestManager) withinLimits(respw http.ResponseWriter, req *http.Request) bool {
+   if reqMgr.MaxUriBytes > 0 && len(req.RequestURI) > reqMgr.MaxUriBytes {
+      reqMgr.Metrics.Inc("forktraffic_limits_rejected_total", "limit", "uri")
+      ResponseHttpError(respw, http.StatusRequestURITooLong, "")
+      return false
+   }
+   if reqMgr.MaxBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+      return true
+   }
+   if req.ContentLength > reqMgr.MaxBodyBytes {
+      reqMgr.Metrics.Inc("forktraffic_limits_rejected_total", "limit", "body")
+      ResponseHttpError(respw, http.StatusRequestEntityTooLarge, "")
+      return false
+   }
+   if req.ContentLength < 0 {
+      req.Body = &limitedBody{ReadCloser: req.Body, left: reqMgr.MaxBodyBytes}
+   }
+   return true
+}
+
+//
+// answer 413 when reading the body failed on its limit
+func (reqMgr *RequestManager) tooLarge(respw http.ResponseWriter, err error) bool {
+   if !errors.Is(err, errBodyTooLarge) {
+      return false
+   }
+   reqMgr.Metrics.Inc("forktraffic_limits_rejected_total", "limit", "body")
+   ResponseHttpError(respw, http.StatusRequestEntityTooLarge, "")
+   return true
+}
@@ -0,0 +1,99 @@
+package forktraffic
+
+import (
+   "net"
+   "net/http"
+   "net/url"
+   "strings"
+)
+
+// host and port of an absolute URL; the port defaults by scheme
+func hostPort(scheme, host string) string {
+   host = strings.ToLower(host)
+   if _, _, err := net.SplitHostPort(host); err == nil {
+      return host
+   }
+   if strings.EqualFold(scheme, "https") {
+      return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+   }
+   return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+//
+// is this a host production names itself by: the production URL's or one of ProductionHosts
+// - a host without a port matches on the default port of its scheme
+func (reqMgr *RequestManager) productionHost(scheme, host string) bool {
+   hp := hostPort(scheme, host)
+   if reqMgr.UrlProduction != nil && hp == hostPort(reqMgr.UrlProduction.Scheme, reqMgr.UrlProduction.Host) {
+      return true
+   }
+   for _, other := range reqMgr.ProductionHosts {
+      if hp == hostPort(scheme, other) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// scheme and host the client reached the fork by
+// - the route's PublicUrl, else PublicUrl, else the Host the client addressed over
+//   the protocol it used; nil when unknown
+func (reqMgr *RequestManager) publicUrl(resp *http.Response) *url.URL {
+   if resp.Request == nil {
+      return nil
+   }
+   public := reqMgr.PublicUrl
+   if route := reqMgr.routeOf(resp.Request); route != nil && route.PublicUrl != "" {
+      public = route.PublicUrl
+   }
+   if public != "" {
+      u, err := url.Parse(public)
+      if err != nil || u.Host == "" {
+         return nil
+      }
+      return &url.URL{Scheme: u.Scheme, Host: u.Host}
+   }
+   ex := exchangeOf(resp.Request)
+   if ex == nil || ex.clientHost == "" {
+      return nil
+   }
+   if receivedHttps(resp.Request) {
+      return &url.URL{Scheme: "https", Host: ex.clientHost}
+   }
+   return &url.URL{Scheme: "http", Host: ex.clientHost}
+}
+
+//
+// point the Location and Content-Location headers of a production response that name
+// production back to the fork's public host; relative ones are left alone
+func (reqMgr *RequestManager) rewriteLocation(resp *http.Response) error {
+   if !reqMgr.RewriteLocation {
+      return nil
+   }
+   for _, name := range []string{"Location", "Content-Location"} {
+      loc := resp.Header.Get(name)
+      if loc == "" {
+         continue
+      }
+      u, err := url.Parse(loc)
+      if err != nil || u.Host == "" {
+         continue
+      }
+      scheme := u.Scheme
+      if scheme == "" {
+         scheme = reqMgr.UrlProduction.Scheme
+      }
+      if !reqMgr.productionHost(scheme, u.Host) {
+         continue
+      }
+      public := reqMgr.publicUrl(resp)
+      if public == nil {
+         return nil
+      }
+      u.Scheme, u.Host = public.Scheme, public.Host
+      resp.Header.Set(name, u.String())
+      reqMgr.Metrics.Inc("forktraffic_locations_rewritten_total", "header", name)
+   }
+   return nil
+}
@@ -0,0 +1,51 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+)
+
+// default limit of forks a request may pass through
+const DefaultMaxHops int = 5
+
+//
+// forks the request already passed through, from the X-Forwarded-By header
+func forwardedBy(req *http.Request) []string {
+   var hops []string
+   for _, val := range req.Header[http.CanonicalHeaderKey(httpForwardedHeader)] {
+      for _, hop := range strings.Split(val, ",") {
+         if hop = strings.TrimSpace(hop); hop != "" {
+            hops = append(hops, hop)
+         }
+      }
+   }
+   return hops
+}
+
+//
+// check the request for a proxy loop and stamp it with our instance id
+// - false when the request already passed through this instance or too many forks;
+//   the client gets 508 Loop Detected
+func (reqMgr *RequestManager) stampForwarded(respw http.ResponseWriter, req *http.Request) bool {
+   hops := forwardedBy(req)
+   maxHops := reqMgr.MaxHops
+   if maxHops <= 0 {
+      maxHops = DefaultMaxHops
+   }
+
+   for _, hop := range hops {
+      if hop == reqMgr.InstanceId {
+         reqMgr.Metrics.Inc("forktraffic_loops_rejected_total", "reason", "instance")
+         ResponseHttpError(respw, http.StatusLoopDetected, ": request already forwarded by "+reqMgr.InstanceId)
+         return false
+      }
+   }
+   if len(hops) >= maxHops {
+      reqMgr.Metrics.Inc("forktraffic_loops_rejected_total", "reason", "hops")
+      ResponseHttpError(respw, http.StatusLoopDetected, ": too many forwarding hops")
+      return false
+   }
+
+   req.Header.Set(httpForwardedHeader, strings.Join(append(hops, reqMgr.InstanceId), ", "))
+   return true
+}
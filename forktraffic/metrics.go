@@ -0,0 +1,90 @@
+package forktraffic
+
+import (
+   "fmt"
+   "net/http"
+   "sort"
+   "strings"
+   "sync"
+)
+
+//
+// simple metrics registry
+// - a metric is identified by its name and optional label pairs
+// - served in the Prometheus text format on "/metrics"
+type Metrics struct {
+   lock   sync.Mutex
+   values map[string]int64
+}
+
+func NewMetrics() *Metrics {
+   return &Metrics{values: make(map[string]int64)}
+}
+
+// build the metric key: name{label="value",...}
+func metricKey(name string, labels []string) string {
+   if len(labels) < 2 {
+      return name
+   }
+   parts := make([]string, 0, len(labels)/2)
+   for i := 0; i+1 < len(labels); i += 2 {
+      parts = append(parts, labels[i]+"=\""+strings.Replace(labels[i+1], "\"", "'", -1)+"\"")
+   }
+   return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+// increment a counter
+func (m *Metrics) Inc(name string, labels ...string) {
+   m.Add(name, 1, labels...)
+}
+
+// add to a counter
+func (m *Metrics) Add(name string, n int64, labels ...string) {
+   key := metricKey(name, labels)
+   m.lock.Lock()
+   m.values[key] += n
+   m.lock.Unlock()
+}
+
+// set a gauge
+func (m *Metrics) Set(name string, v int64, labels ...string) {
+   key := metricKey(name, labels)
+   m.lock.Lock()
+   m.values[key] = v
+   m.lock.Unlock()
+}
+
+// get a single value
+func (m *Metrics) Get(name string, labels ...string) int64 {
+   key := metricKey(name, labels)
+   m.lock.Lock()
+   defer m.lock.Unlock()
+   return m.values[key]
+}
+
+// copy of all values
+func (m *Metrics) Snapshot() map[string]int64 {
+   m.lock.Lock()
+   defer m.lock.Unlock()
+   snap := make(map[string]int64, len(m.values))
+   for k, v := range m.values {
+      snap[k] = v
+   }
+   return snap
+}
+
+//
+// handle "/metrics" path
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+   snap := m.Snapshot()
+   keys := make([]string, 0, len(snap))
+   for k := range snap {
+      keys = append(keys, k)
+   }
+   sort.Strings(keys)
+
+   w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+   for _, k := range keys {
+      fmt.Fprintf(w, "%s %d\n", k, snap[k])
+   }
+}
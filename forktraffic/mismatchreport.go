@@ -0,0 +1,133 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "net/http"
+   "time"
+)
+
+// reports waiting to be posted to MismatchWebhook; more are dropped
+const mismatchHooksQueued int = 256
+
+//
+// structured report of a request production and staging answered differently
+// - headers and bodies are redacted like reproduction bundles; the bodies are the
+//   captured ones, decoded, and absent when not captured
+// - Diffs summarizes the differences (see DiffResponses); BodyDiff is the chunk
+//   comparison of large bodies
+type MismatchReport struct {
+   Id            string
+   CorrelationId string
+   Time          time.Time
+   Region        string
+   Route         string
+   RequestLine   string
+   RequestHeader http.Header
+   ProdStatus    int
+   ProdHeader    http.Header
+   ProdBody      string
+   StagStatus    int
+   StagHeader    http.Header
+   StagBody      string
+   Diffs         []string
+   BodyDiff      string
+   Experiment    string
+   Scenario      string
+}
+
+//
+// start posting the mismatch reports to MismatchWebhook
+func (reqMgr *RequestManager) startMismatchHooks() {
+   if reqMgr.MismatchWebhook == "" {
+      return
+   }
+   reqMgr.mismatchHooks = make(chan []byte, mismatchHooksQueued)
+   go func() {
+      client := &http.Client{Timeout: 10 * time.Second}
+      for buf := range reqMgr.mismatchHooks {
+         resp, err := client.Post(reqMgr.MismatchWebhook, "application/json", bytes.NewReader(buf))
+         if err == nil {
+            resp.Body.Close()
+            if resp.StatusCode >= http.StatusBadRequest {
+               err = errors.New(resp.Status)
+            }
+         }
+         reqMgr.Metrics.Inc("forktraffic_mismatch_reports_total", "sink", "webhook", "ok", fmt.Sprint(err == nil))
+         if err != nil {
+            reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: reqMgr.MismatchWebhook, Err: err})
+         }
+      }
+   }()
+}
+
+//
+// write the report of a mismatch to MismatchFile and queue it for MismatchWebhook
+// - forktraffic_mismatch_reports_total counts the reports, by sink and "ok"; the
+//   reports the webhook cannot keep up with are counted as not ok
+func (reqMgr *RequestManager) reportMismatch(rec *mismatchRecord, sendReq *PendingRequest, resp *http.Response, stag *ResponseCapture) {
+   if reqMgr.MismatchFile == "" && reqMgr.mismatchHooks == nil {
+      return
+   }
+   req := sendReq.req
+   report := &MismatchReport{
+      Id:            rec.Id,
+      CorrelationId: rec.CorrelationId,
+      Time:          rec.Time,
+      Region:        rec.Region,
+      Route:         sendReq.route(),
+      RequestLine:   req.Method + " " + reqMgr.redactUrl(req.URL, true) + " " + req.Proto,
+      RequestHeader: reqMgr.redactHeader(req.Header),
+      ProdStatus:    rec.ProdStatus,
+      StagStatus:    rec.StagStatus,
+      StagHeader:    reqMgr.redactHeader(resp.Header),
+      StagBody:      reqMgr.reportBody(stag),
+      Diffs:         rec.Diffs,
+      BodyDiff:      rec.BodyDiff,
+      Experiment:    rec.Experiment,
+      Scenario:      rec.Scenario,
+   }
+   if ex := sendReq.exchange; ex != nil {
+      if ex.prodCapture != nil {
+         report.ProdHeader = reqMgr.redactHeader(ex.prodCapture.Header)
+         report.ProdBody = reqMgr.reportBody(ex.prodCapture)
+      } else if ex.prodHeader != nil {
+         report.ProdHeader = reqMgr.redactHeader(ex.prodHeader)
+      }
+   }
+   buf, err := json.Marshal(report)
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: req.URL.Path, Err: err})
+      return
+   }
+
+   if reqMgr.MismatchFile != "" {
+      err := reqMgr.appendFile(&reqMgr.mismatchReports, reqMgr.MismatchFile, append(buf, '\n'))
+      reqMgr.Metrics.Inc("forktraffic_mismatch_reports_total", "sink", "file", "ok", fmt.Sprint(err == nil))
+      if err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: reqMgr.MismatchFile, Err: err})
+      }
+   }
+   if reqMgr.mismatchHooks != nil {
+      select {
+      case reqMgr.mismatchHooks <- buf:
+      default:
+         reqMgr.Metrics.Inc("forktraffic_mismatch_reports_total", "sink", "webhook", "ok", "false")
+      }
+   }
+}
+
+// the redacted, decoded body of a captured response; "" when not captured
+func (reqMgr *RequestManager) reportBody(capture *ResponseCapture) string {
+   if capture == nil || len(capture.Body) == 0 {
+      return ""
+   }
+   encoding := capture.Header.Get("Content-Encoding")
+   body := reqMgr.redactBody(capture.Body, encoding)
+   if plain, ok := decodeBody(body, encoding); ok {
+      body = plain
+   }
+   return reqMgr.loggableBody(capture.Header.Get("Content-Type"), body, len(body))
+}
@@ -0,0 +1,120 @@
+package forktraffic
+
+import (
+   "errors"
+   "log"
+   "net/http"
+   "strconv"
+   "sync/atomic"
+)
+
+// operating modes of the traffic listener
+const ModeNormal string = "normal"
+const ModeBypass string = "bypass"           // pure reverse proxy; nothing is captured or mirrored
+const ModeMaintenance string = "maintenance" // every request gets the maintenance response
+
+// default status of the maintenance response
+const DefaultMaintenanceStatus int = http.StatusServiceUnavailable
+
+var errModeUnknown = errors.New("unknown mode")
+
+// modes by their index in reqMgr.mode
+var modeNames = []string{ModeNormal, ModeBypass, ModeMaintenance}
+
+const (
+   modeNormal int32 = iota
+   modeBypass
+   modeMaintenance
+)
+
+//
+// set the operating mode at start; an unknown Mode starts in the normal mode
+func (reqMgr *RequestManager) initMode() {
+   mode := reqMgr.Mode
+   if mode == "" {
+      mode = ModeNormal
+   }
+   if err := reqMgr.SetMode(mode); err != nil {
+      log.Printf("Warning - %v %q; starting in the %v mode", err, mode, ModeNormal)
+      reqMgr.SetMode(ModeNormal)
+   }
+}
+
+//
+// switch the operating mode; takes effect with the next request
+func (reqMgr *RequestManager) SetMode(name string) error {
+   for i, mode := range modeNames {
+      if mode == name {
+         prev := atomic.SwapInt32(&reqMgr.mode, int32(i))
+         if int(prev) != i {
+            log.Printf("mode %v -> %v", modeNames[prev], name)
+         }
+         for j, other := range modeNames {
+            active := int64(0)
+            if i == j {
+               active = 1
+            }
+            reqMgr.Metrics.Set("forktraffic_mode", active, "mode", other)
+         }
+         return nil
+      }
+   }
+   return errModeUnknown
+}
+
+// the operating mode
+func (reqMgr *RequestManager) CurrentMode() string {
+   return modeNames[atomic.LoadInt32(&reqMgr.mode)]
+}
+
+//
+// handle a request outside of the normal mode; false in the normal mode
+// - bypass: straight to production, without exchange, capture or mirroring
+// - maintenance: MaintenanceStatus (default DefaultMaintenanceStatus) with
+//   MaintenanceHeaders and MaintenanceBody, production is not contacted
+func (reqMgr *RequestManager) handleMode(respw http.ResponseWriter, req *http.Request) bool {
+   switch atomic.LoadInt32(&reqMgr.mode) {
+   case modeBypass:
+      reqMgr.Metrics.Inc("forktraffic_mode_requests_total", "mode", ModeBypass)
+      req.Host = reqMgr.UrlProduction.Host
+      reqMgr.DestProduction.ServeHTTP(respw, req)
+      return true
+   case modeMaintenance:
+      reqMgr.Metrics.Inc("forktraffic_mode_requests_total", "mode", ModeMaintenance)
+      status := reqMgr.MaintenanceStatus
+      if status == 0 {
+         status = DefaultMaintenanceStatus
+      }
+      for name, val := range reqMgr.MaintenanceHeaders {
+         respw.Header().Set(name, val)
+      }
+      if reqMgr.MaintenanceBody == "" {
+         ResponseHttpError(respw, status, "")
+         return true
+      }
+      respw.Header().Set("Content-Length", strconv.Itoa(len(reqMgr.MaintenanceBody)))
+      respw.WriteHeader(status)
+      respw.Write([]byte(reqMgr.MaintenanceBody))
+      return true
+   }
+   return false
+}
+
+//
+// handle "/admin/mode"; the operating mode, POST "?mode=normal|bypass|maintenance" switches it
+func (reqMgr *RequestManager) adminMode(w http.ResponseWriter, r *http.Request) {
+   switch r.Method {
+   case "GET":
+   case "POST":
+      if err := reqMgr.SetMode(r.URL.Query().Get("mode")); err != nil {
+         ResponseHttpError(w, http.StatusBadRequest, ": "+err.Error())
+         return
+      }
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+      return
+   }
+   writeJson(w, struct {
+      Mode string
+   }{reqMgr.CurrentMode()})
+}
@@ -0,0 +1,103 @@
+package forktraffic
+
+import (
+   "net/http"
+   "sort"
+   "strconv"
+   "sync"
+)
+
+// label of the staging copies sent without a morf
+const unmorfed string = "none"
+
+// status classes of staging answers; "error" when staging could not be reached
+var morfClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx", "error"}
+
+//
+// effect of one morf on the staging answers
+// - ErrorRate counts 5xx and unreachable staging; Lift is the error rate
+//   relative to the unmorfed copies (0 without a baseline)
+// - Divergent counts the copies answered unlike production (status class or compared headers)
+type MorfEffect struct {
+   Morf          string
+   Requests      int64
+   Classes       map[string]int64
+   ErrorRate     float64
+   Lift          float64
+   Divergent     int64
+   DivergentRate float64
+}
+
+// the morfs seen so far; the metric labels to report
+type morfEffects struct {
+   lock sync.Mutex
+   seen map[string]bool
+}
+
+//
+// count the staging answer of a copy per applied morf
+// - copies without a morf are counted as "none", the baseline of the comparison
+func (reqMgr *RequestManager) countMorfs(sendReq *PendingRequest, class string, divergent bool) {
+   morfs := sendReq.morfs
+   if len(morfs) == 0 {
+      morfs = []string{unmorfed}
+   }
+   reqMgr.morfEffects.lock.Lock()
+   if reqMgr.morfEffects.seen == nil {
+      reqMgr.morfEffects.seen = make(map[string]bool)
+   }
+   for _, morf := range morfs {
+      reqMgr.morfEffects.seen[morf] = true
+   }
+   reqMgr.morfEffects.lock.Unlock()
+
+   morfed := len(sendReq.morfs) > 0
+   reqMgr.Metrics.Inc("forktraffic_morfed_requests_total", "morfed", strconv.FormatBool(morfed), "class", class)
+   for _, morf := range morfs {
+      reqMgr.Metrics.Inc("forktraffic_morf_requests_total", "morf", morf, "class", class)
+      if divergent {
+         reqMgr.Metrics.Inc("forktraffic_morf_divergent_total", "morf", morf)
+      }
+   }
+}
+
+// effect of one morf from the metrics
+func (reqMgr *RequestManager) morfEffect(morf string) MorfEffect {
+   effect := MorfEffect{Morf: morf, Classes: make(map[string]int64)}
+   for _, class := range morfClasses {
+      if n := reqMgr.Metrics.Get("forktraffic_morf_requests_total", "morf", morf, "class", class); n > 0 {
+         effect.Classes[class] = n
+         effect.Requests += n
+      }
+   }
+   effect.Divergent = reqMgr.Metrics.Get("forktraffic_morf_divergent_total", "morf", morf)
+   if effect.Requests > 0 {
+      n := float64(effect.Requests)
+      effect.ErrorRate = float64(effect.Classes["5xx"]+effect.Classes["error"]) / n
+      effect.DivergentRate = float64(effect.Divergent) / n
+   }
+   return effect
+}
+
+//
+// handle "/admin/morfs"; the effect of every morf against the unmorfed copies
+func (reqMgr *RequestManager) adminMorfs(w http.ResponseWriter, r *http.Request) {
+   reqMgr.morfEffects.lock.Lock()
+   var morfs []string
+   for morf := range reqMgr.morfEffects.seen {
+      morfs = append(morfs, morf)
+   }
+   reqMgr.morfEffects.lock.Unlock()
+   sort.Strings(morfs)
+
+   baseline := reqMgr.morfEffect(unmorfed)
+   effects := make([]MorfEffect, 0, len(morfs))
+   for _, morf := range morfs {
+      effect := reqMgr.morfEffect(morf)
+      if baseline.ErrorRate > 0 {
+         effect.Lift = effect.ErrorRate / baseline.ErrorRate
+      }
+      effects = append(effects, effect)
+   }
+   writeJson(w, effects)
+}
@@ -0,0 +1,107 @@
+package forktraffic
+
+import (
+   "bytes"
+   "io"
+   "io/ioutil"
+   "mime"
+   "mime/multipart"
+   "net/http"
+   "strings"
+)
+
+//
+// register the built in staging body transformations
+func (reqMgr *RequestManager) initBodyTransforms() {
+   if len(reqMgr.ScrubFields) > 0 {
+      reqMgr.AddBodyTransform(reqMgr.scrubJson)
+   }
+   if len(reqMgr.ScrubFields) > 0 || reqMgr.MultipartMaxFileBytes > 0 {
+      reqMgr.AddBodyTransform(reqMgr.filterMultipart)
+   }
+}
+
+// is this a field to scrub
+func (reqMgr *RequestManager) scrubField(name string) bool {
+   for _, field := range reqMgr.ScrubFields {
+      if strings.EqualFold(name, field) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// scrub the configured fields of a JSON staging body
+func (reqMgr *RequestManager) scrubJson(req *http.Request, plain []byte) []byte {
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+      return plain
+   }
+   return redactJsonFields(plain, reqMgr.ScrubFields)
+}
+
+//
+// rebuild a multipart/form-data staging body
+// - form fields named in ScrubFields are redacted
+// - file parts larger than MultipartMaxFileBytes are dropped; form fields are kept
+// - the boundary is kept so the Content-Type header stays valid
+func (reqMgr *RequestManager) filterMultipart(req *http.Request, plain []byte) []byte {
+   return rewriteMultipart(req, plain, func(part *multipart.Part, data []byte) ([]byte, bool) {
+      if part.FileName() != "" {
+         if reqMgr.MultipartMaxFileBytes > 0 && int64(len(data)) > reqMgr.MultipartMaxFileBytes {
+            reqMgr.Metrics.Inc("forktraffic_multipart_parts_dropped_total")
+            return nil, false
+         }
+      } else if reqMgr.scrubField(part.FormName()) {
+         return []byte(redactedValue), true
+      }
+      return data, true
+   })
+}
+
+//
+// rebuild a multipart/form-data body, part by part
+// - rewrite returns the new content of a part, false to drop it
+// - other bodies, and malformed ones, are kept as is
+func rewriteMultipart(req *http.Request, plain []byte, rewrite func(part *multipart.Part, data []byte) ([]byte, bool)) []byte {
+   mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+      return plain
+   }
+
+   rd := multipart.NewReader(bytes.NewReader(plain), params["boundary"])
+   var out bytes.Buffer
+   wr := multipart.NewWriter(&out)
+   if wr.SetBoundary(params["boundary"]) != nil {
+      return plain
+   }
+
+   for {
+      part, err := rd.NextRawPart()
+      if err == io.EOF {
+         break
+      } else if err != nil {
+         // malformed body; forward it untouched
+         return plain
+      }
+      data, err := ioutil.ReadAll(part)
+      if err != nil {
+         return plain
+      }
+      data, keep := rewrite(part, data)
+      if !keep {
+         continue
+      }
+
+      pw, err := wr.CreatePart(part.Header)
+      if err != nil {
+         return plain
+      }
+      pw.Write(data)
+   }
+   if wr.Close() != nil {
+      return plain
+   }
+   return out.Bytes()
+}
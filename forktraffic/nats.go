@@ -0,0 +1,265 @@
+package forktraffic
+
+import (
+   "bufio"
+   "crypto/rand"
+   "encoding/hex"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "io"
+   "net"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// NATS network timeout
+const natsTimeout time.Duration = 5 * time.Second
+
+var errNatsTimeout = errors.New("nats: timeout")
+var errNatsClosed = errors.New("nats: connection closed")
+
+//
+// message received from NATS
+// - Status is the status of a header message ("503", "404", ...); "" otherwise
+type natsMsg struct {
+   Subject string
+   Reply   string
+   Status  string
+   Data    []byte
+}
+
+//
+// minimal NATS client, enough for JetStream publishing and pull consumers
+// - requests are answered on a single wildcard inbox subscription
+// - the connection is re-dialed on the next request after an error
+type NatsClient struct {
+   Addr     string
+   User     string
+   Password string
+
+   lock    sync.Mutex
+   conn    net.Conn
+   inbox   string
+   next    int64
+   replies map[string]chan *natsMsg
+}
+
+func NewNatsClient(addr, user, password string) *NatsClient {
+   return &NatsClient{Addr: addr, User: user, Password: password}
+}
+
+//
+// connect, authenticate and subscribe to the inbox
+// - the server greets with INFO; CONNECT is confirmed with a PING/PONG
+func (nc *NatsClient) dial() error {
+   conn, err := net.DialTimeout("tcp", nc.Addr, natsTimeout)
+   if err != nil {
+      return err
+   }
+   conn.SetDeadline(time.Now().Add(natsTimeout))
+   rd := bufio.NewReader(conn)
+   if line, err := natsLine(rd); err != nil || !strings.HasPrefix(line, "INFO ") {
+      conn.Close()
+      if err == nil {
+         err = fmt.Errorf("nats: unexpected greeting %q", line)
+      }
+      return err
+   }
+
+   id := make([]byte, 8)
+   rand.Read(id)
+   inbox := "_INBOX." + hex.EncodeToString(id)
+   connect, _ := json.Marshal(map[string]interface{}{
+      "verbose": false, "pedantic": false, "name": "forktraffic", "lang": "go",
+      "headers": true, "no_responders": true, "user": nc.User, "pass": nc.Password,
+   })
+   if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, inbox); err != nil {
+      conn.Close()
+      return err
+   }
+   for {
+      line, err := natsLine(rd)
+      if err != nil {
+         conn.Close()
+         return err
+      }
+      if line == "PONG" {
+         break
+      }
+      if strings.HasPrefix(line, "-ERR") {
+         conn.Close()
+         return errors.New("nats: " + line)
+      }
+   }
+   conn.SetDeadline(time.Time{})
+
+   nc.conn, nc.inbox = conn, inbox
+   nc.replies = make(map[string]chan *natsMsg)
+   go nc.readLoop(conn, rd)
+   return nil
+}
+
+func natsLine(rd *bufio.Reader) (string, error) {
+   line, err := rd.ReadString('\n')
+   if err != nil {
+      return "", err
+   }
+   return strings.TrimRight(line, "\r\n"), nil
+}
+
+//
+// dispatch the replies of the inbox; answer the server's PINGs
+func (nc *NatsClient) readLoop(conn net.Conn, rd *bufio.Reader) {
+   for {
+      msg, err := nc.readMsg(conn, rd)
+      if err != nil {
+         nc.lock.Lock()
+         if nc.conn == conn {
+            nc.conn = nil
+            for _, reply := range nc.replies {
+               close(reply)
+            }
+            nc.replies = nil
+         }
+         nc.lock.Unlock()
+         conn.Close()
+         return
+      }
+      if msg == nil {
+         continue
+      }
+      nc.lock.Lock()
+      if reply, found := nc.replies[msg.Subject]; found {
+         delete(nc.replies, msg.Subject)
+         reply <- msg
+      }
+      nc.lock.Unlock()
+   }
+}
+
+//
+// read the next protocol line; nil for the lines that are not messages
+// - MSG subject sid [reply] size
+// - HMSG subject sid [reply] header-size total-size; the header starts with
+//   "NATS/1.0 status"
+func (nc *NatsClient) readMsg(conn net.Conn, rd *bufio.Reader) (*natsMsg, error) {
+   line, err := natsLine(rd)
+   if err != nil {
+      return nil, err
+   }
+   fields := strings.Fields(line)
+   if len(fields) == 0 {
+      return nil, nil
+   }
+   switch fields[0] {
+   case "PING":
+      nc.lock.Lock()
+      _, err = io.WriteString(conn, "PONG\r\n")
+      nc.lock.Unlock()
+      return nil, err
+   case "MSG", "HMSG":
+   default:
+      return nil, nil
+   }
+
+   msg := &natsMsg{Subject: fields[1]}
+   sizes := fields[3:]
+   if (fields[0] == "MSG" && len(sizes) == 2) || (fields[0] == "HMSG" && len(sizes) == 3) {
+      msg.Reply, sizes = sizes[0], sizes[1:]
+   }
+   hdrSize := 0
+   if fields[0] == "HMSG" && len(sizes) == 2 {
+      if hdrSize, err = strconv.Atoi(sizes[0]); err != nil {
+         return nil, err
+      }
+      sizes = sizes[1:]
+   }
+   if len(sizes) != 1 {
+      return nil, fmt.Errorf("nats: malformed message %q", line)
+   }
+   total, err := strconv.Atoi(sizes[0])
+   if err != nil || hdrSize > total {
+      return nil, fmt.Errorf("nats: malformed message %q", line)
+   }
+   data := make([]byte, total+2)
+   if _, err := io.ReadFull(rd, data); err != nil {
+      return nil, err
+   }
+   if hdrSize > 0 {
+      status := strings.Fields(strings.SplitN(string(data[:hdrSize]), "\r\n", 2)[0])
+      if len(status) > 1 {
+         msg.Status = status[1]
+      }
+   }
+   msg.Data = data[hdrSize:total]
+   return msg, nil
+}
+
+//
+// publish a message, without waiting for a reply
+func (nc *NatsClient) Publish(subject, reply string, data []byte) error {
+   nc.lock.Lock()
+   defer nc.lock.Unlock()
+   if nc.conn == nil {
+      if err := nc.dial(); err != nil {
+         return err
+      }
+   }
+   return nc.publish(subject, reply, data)
+}
+
+func (nc *NatsClient) publish(subject, reply string, data []byte) error {
+   head := "PUB " + subject + " "
+   if reply != "" {
+      head += reply + " "
+   }
+   nc.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+   _, err := nc.conn.Write(append([]byte(head+strconv.Itoa(len(data))+"\r\n"), append(data, '\r', '\n')...))
+   if err != nil {
+      nc.conn.Close()
+      nc.conn = nil
+   }
+   return err
+}
+
+//
+// publish a message and wait for its reply up to timeout (natsTimeout when 0)
+func (nc *NatsClient) Request(subject string, data []byte, timeout time.Duration) (*natsMsg, error) {
+   if timeout <= 0 {
+      timeout = natsTimeout
+   }
+   nc.lock.Lock()
+   if nc.conn == nil {
+      if err := nc.dial(); err != nil {
+         nc.lock.Unlock()
+         return nil, err
+      }
+   }
+   nc.next++
+   inbox := nc.inbox + "." + strconv.FormatInt(nc.next, 36)
+   reply := make(chan *natsMsg, 1)
+   nc.replies[inbox] = reply
+   err := nc.publish(subject, inbox, data)
+   nc.lock.Unlock()
+   if err != nil {
+      return nil, err
+   }
+
+   timer := time.NewTimer(timeout)
+   defer timer.Stop()
+   select {
+   case msg, ok := <-reply:
+      if !ok {
+         return nil, errNatsClosed
+      }
+      return msg, nil
+   case <-timer.C:
+      nc.lock.Lock()
+      delete(nc.replies, inbox)
+      nc.lock.Unlock()
+      return nil, errNatsTimeout
+   }
+}
@@ -0,0 +1,61 @@
+package forktraffic
+
+import (
+   "log"
+   "net/http"
+   "strings"
+)
+
+// routes never morfed unless NoMorfPrefixes is set
+var DefaultNoMorfPrefixes = []string{"/auth", "/login", "/logout", "/oauth", "/token", "/payment", "/billing", "/checkout", "/webhook"}
+
+// test options of the requests that are never morfed; all modes off
+var noMorfTests TestOptions
+
+// filter in place of an invalid no-morf expression
+type filterAll struct{}
+
+func (filterAll) match(req *http.Request, status int) bool { return true }
+
+//
+// set up the no-morf filter
+// - an invalid expression keeps every request from being morfed
+func (reqMgr *RequestManager) initNoMorf() {
+   if reqMgr.NoMorfPrefixes == nil {
+      reqMgr.NoMorfPrefixes = DefaultNoMorfPrefixes
+   }
+   filter, err := parseCaptureFilter(reqMgr.NoMorfFilter)
+   if err != nil {
+      log.Printf("Warning - invalid no-morf filter: %v; no request is morfed", err)
+      filter = filterAll{}
+   }
+   reqMgr.noMorfFilter = filter
+}
+
+//
+// is a request kept from every morf, fault and fuzzing mode
+// - path prefixes compare case insensitive; the filter sees no status yet
+func (reqMgr *RequestManager) noMorf(req *http.Request) bool {
+   path := strings.ToLower(req.URL.Path)
+   for _, prefix := range reqMgr.NoMorfPrefixes {
+      if strings.HasPrefix(path, strings.ToLower(prefix)) {
+         return true
+      }
+   }
+   return reqMgr.noMorfFilter != nil && reqMgr.noMorfFilter.match(req, 0)
+}
+
+//
+// test options of a new request
+// - none for the no-morf requests and the bots, whatever the test options or the running experiment
+func (reqMgr *RequestManager) morfTests(req *http.Request) *TestOptions {
+   if reqMgr.noMorf(req) {
+      reqMgr.Metrics.Inc("forktraffic_no_morf_requests_total")
+      return &noMorfTests
+   }
+   if reqMgr.isBot(req) {
+      reqMgr.Metrics.Inc("forktraffic_bot_requests_total", "filter", reqMgr.BotFilter)
+      return &noMorfTests
+   }
+   return reqMgr.chaosTests()
+}
@@ -0,0 +1,197 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "log"
+   "net/http"
+   "regexp"
+   "sort"
+   "strings"
+)
+
+//
+// normalization of response bodies before comparison
+// - Regex replaces every match with Replace
+// - JsonPath selects fields of a JSON body ("$.items[*].id", "meta.generatedAt")
+//   and Action is applied to them: "zero" (default), "remove" or "sort" (arrays)
+// - PathPrefix limits the rule to requests under the prefix; empty applies to all
+type NormalizeRule struct {
+   PathPrefix string
+   Regex      string
+   Replace    string
+   JsonPath   string
+   Action     string
+}
+
+// a rule ready to apply
+type normalizer struct {
+   rule  NormalizeRule
+   regex *regexp.Regexp
+   path  []string
+}
+
+//
+// compile the configured normalization rules; invalid rules are skipped
+func (reqMgr *RequestManager) initNormalizers() {
+   reqMgr.normalizers = nil
+   for _, rule := range reqMgr.NormalizeRules {
+      norm := normalizer{rule: rule}
+      if rule.Regex != "" {
+         regex, err := regexp.Compile(rule.Regex)
+         if err != nil {
+            log.Printf("Warning - invalid normalize regex %q: %v", rule.Regex, err)
+            continue
+         }
+         norm.regex = regex
+      }
+      if rule.JsonPath != "" {
+         norm.path = splitJsonPath(rule.JsonPath)
+         switch rule.Action {
+         case "", "zero", "remove", "sort":
+         default:
+            log.Printf("Warning - invalid normalize action %q", rule.Action)
+            continue
+         }
+      }
+      if norm.regex == nil && norm.path == nil {
+         log.Printf("Warning - normalize rule without Regex or JsonPath")
+         continue
+      }
+      reqMgr.normalizers = append(reqMgr.normalizers, norm)
+   }
+}
+
+// split "$.a.b[*].c" into a, b, *, c
+func splitJsonPath(path string) []string {
+   path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+   path = strings.Replace(path, "[*]", ".*", -1)
+   var steps []string
+   for _, step := range strings.Split(path, ".") {
+      if step != "" {
+         steps = append(steps, step)
+      }
+   }
+   return steps
+}
+
+//
+// normalized copy of a captured response
+// - the body is decoded from its Content-Encoding so both sides compare as plain text
+func (reqMgr *RequestManager) normalizeCapture(req *http.Request, capture *ResponseCapture) *ResponseCapture {
+   if len(reqMgr.normalizers) == 0 || capture == nil {
+      return capture
+   }
+   norm := *capture
+   norm.Header = capture.Header.Clone()
+   if plain, ok := decodeBody(capture.Body, capture.Header.Get("Content-Encoding")); ok {
+      norm.Body = plain
+      norm.Header.Del("Content-Encoding")
+   }
+   norm.Body = reqMgr.normalizeBody(req.URL.Path, norm.Body)
+   return &norm
+}
+
+// apply the rules of a path to a plain body
+func (reqMgr *RequestManager) normalizeBody(path string, body []byte) []byte {
+   for _, norm := range reqMgr.normalizers {
+      if !strings.HasPrefix(path, norm.rule.PathPrefix) {
+         continue
+      }
+      if norm.path != nil {
+         var doc interface{}
+         if json.Unmarshal(body, &doc) == nil {
+            doc = normalizeJson(doc, norm.path, norm.rule.Action)
+            if out, err := json.Marshal(doc); err == nil {
+               body = out
+            }
+         }
+      }
+      if norm.regex != nil {
+         body = norm.regex.ReplaceAll(body, []byte(norm.rule.Replace))
+      }
+   }
+   return body
+}
+
+//
+// apply an action to the fields of a document selected by path
+func normalizeJson(doc interface{}, path []string, action string) interface{} {
+   if len(path) == 0 {
+      switch action {
+      case "sort":
+         return sortJson(doc)
+      default:
+         return zeroJson(doc)
+      }
+   }
+
+   step, rest := path[0], path[1:]
+   switch v := doc.(type) {
+   case map[string]interface{}:
+      for key, val := range v {
+         if step != "*" && key != step {
+            continue
+         }
+         if len(rest) == 0 && action == "remove" {
+            delete(v, key)
+         } else {
+            v[key] = normalizeJson(val, rest, action)
+         }
+      }
+   case []interface{}:
+      if step != "*" {
+         return doc
+      }
+      if len(rest) == 0 && action == "remove" {
+         return []interface{}{}
+      }
+      for i := range v {
+         v[i] = normalizeJson(v[i], rest, action)
+      }
+   }
+   return doc
+}
+
+// zero value of a JSON value's type
+func zeroJson(val interface{}) interface{} {
+   switch val.(type) {
+   case string:
+      return ""
+   case float64:
+      return float64(0)
+   case bool:
+      return false
+   case map[string]interface{}:
+      return map[string]interface{}{}
+   case []interface{}:
+      return []interface{}{}
+   }
+   return nil
+}
+
+// sort an array by the encoding of its elements; other values are kept
+func sortJson(val interface{}) interface{} {
+   arr, ok := val.([]interface{})
+   if !ok {
+      return val
+   }
+   keys := make([][]byte, len(arr))
+   for i := range arr {
+      keys[i], _ = json.Marshal(arr[i])
+   }
+   sort.Sort(jsonSorter{arr, keys})
+   return arr
+}
+
+type jsonSorter struct {
+   arr  []interface{}
+   keys [][]byte
+}
+
+func (js jsonSorter) Len() int           { return len(js.arr) }
+func (js jsonSorter) Less(i, j int) bool { return bytes.Compare(js.keys[i], js.keys[j]) < 0 }
+func (js jsonSorter) Swap(i, j int) {
+   js.arr[i], js.arr[j] = js.arr[j], js.arr[i]
+   js.keys[i], js.keys[j] = js.keys[j], js.keys[i]
+}
@@ -0,0 +1,627 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "io/ioutil"
+   "log"
+   "math"
+   "mime"
+   "net/http"
+   "net/url"
+   "reflect"
+   "regexp"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+   "unicode/utf8"
+)
+
+// operation label of requests matching no operation of the spec
+const unknownOperation string = "unknown"
+
+// schema violations reported of one message
+const schemaViolationsLimit int = 20
+
+// nested $ref resolutions before a schema is taken as a loop
+const schemaRefDepth int = 32
+
+// operations of a path item; its other fields are not operations
+var apiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+var apiPathParam = regexp.MustCompile(`\{[^/{}]+\}`)
+
+//
+// parameter of an API operation
+type apiParam struct {
+   name     string
+   in       string // path, query or header
+   required bool
+   schema   map[string]interface{}
+}
+
+//
+// operation of the OpenAPI spec
+type apiOperation struct {
+   // operationId; "METHOD path" when the spec names none
+   Id string
+
+   method  string
+   pattern *regexp.Regexp
+   names   []string
+   params  []apiParam
+
+   // literal characters of the path template; the most literal match wins
+   literal int
+
+   // schema of a JSON request body; nil when not validated
+   body    map[string]interface{}
+   bodyReq bool
+
+   // JSON body schemas of the documented responses, by status ("200", "2XX",
+   // "default"); nil for a response without a JSON body
+   responses map[string]map[string]interface{}
+}
+
+//
+// schema violation of a request or response
+type schemaViolation struct {
+   Path string // JSON path of the value; "header.X", "query.x" or "path.x" for parameters
+   Rule string // type, required, enum, format, pattern, minimum ... or json when unparsable
+}
+
+//
+// operations and schemas of the OpenAPI spec of production
+type apiSpec struct {
+   root     map[string]interface{}
+   basePath string
+   ops      []*apiOperation
+
+   // compiled schema patterns, by pattern; nil when not RE2
+   patterns sync.Map
+}
+
+//
+// load an OpenAPI spec, version 3 or Swagger 2, in JSON
+// - the path of the first server url (basePath in Swagger 2) prefixes the paths
+func loadApiSpec(file string) (*apiSpec, error) {
+   buf, err := ioutil.ReadFile(file)
+   if err != nil {
+      return nil, err
+   }
+   spec := &apiSpec{}
+   if err := json.Unmarshal(buf, &spec.root); err != nil {
+      return nil, err
+   }
+   if base, ok := spec.root["basePath"].(string); ok {
+      spec.basePath = base
+   }
+   if servers, ok := spec.root["servers"].([]interface{}); ok && len(servers) > 0 {
+      if server, ok := servers[0].(map[string]interface{}); ok {
+         if u, err := url.Parse(asString(server["url"])); err == nil {
+            spec.basePath = u.Path
+         }
+      }
+   }
+   spec.basePath = strings.TrimSuffix(spec.basePath, "/")
+
+   paths, _ := spec.root["paths"].(map[string]interface{})
+   for template, item := range paths {
+      pathItem := spec.object(item)
+      if pathItem == nil {
+         continue
+      }
+      shared := spec.params(pathItem["parameters"], nil)
+      for method, raw := range pathItem {
+         opItem, ok := raw.(map[string]interface{})
+         if !ok || !apiMethod(method) {
+            continue
+         }
+         op := spec.operation(strings.ToUpper(method), spec.basePath+template, opItem, shared)
+         if op != nil {
+            spec.ops = append(spec.ops, op)
+         }
+      }
+   }
+   sort.Slice(spec.ops, func(i, j int) bool { return spec.ops[i].literal > spec.ops[j].literal })
+   return spec, nil
+}
+
+func (spec *apiSpec) operation(method, template string, item map[string]interface{}, shared []apiParam) *apiOperation {
+   expr := "^"
+   literal := 0
+   last := 0
+   for _, loc := range apiPathParam.FindAllStringIndex(template, -1) {
+      expr += regexp.QuoteMeta(template[last:loc[0]]) + "([^/]+)"
+      literal += loc[0] - last
+      last = loc[1]
+   }
+   expr += regexp.QuoteMeta(template[last:]) + "$"
+   literal += len(template) - last
+   pattern, err := regexp.Compile(expr)
+   if err != nil {
+      return nil
+   }
+
+   op := &apiOperation{Id: asString(item["operationId"]), method: method, pattern: pattern, literal: literal}
+   op.names = apiPathParam.FindAllString(template, -1)
+   if op.Id == "" {
+      op.Id = method + " " + template
+   }
+   op.params = spec.params(item["parameters"], shared)
+   for _, param := range op.params {
+      if param.in == "body" {
+         op.body, op.bodyReq = param.schema, param.required
+      }
+   }
+   if reqBody := spec.object(item["requestBody"]); reqBody != nil {
+      op.body = spec.jsonSchema(reqBody["content"])
+      op.bodyReq, _ = reqBody["required"].(bool)
+   }
+   if responses, ok := item["responses"].(map[string]interface{}); ok {
+      op.responses = make(map[string]map[string]interface{})
+      for status, raw := range responses {
+         resp := spec.object(raw)
+         if resp == nil {
+            continue
+         }
+         if schema := spec.object(resp["schema"]); schema != nil {
+            op.responses[strings.ToUpper(status)] = schema
+         } else {
+            op.responses[strings.ToUpper(status)] = spec.jsonSchema(resp["content"])
+         }
+      }
+   }
+   return op
+}
+
+//
+// parameters of an operation; they override the shared parameters of their path
+// - Swagger 2 parameters carry their schema themselves
+func (spec *apiSpec) params(raw interface{}, shared []apiParam) []apiParam {
+   list, _ := raw.([]interface{})
+   params := append([]apiParam(nil), shared...)
+   for _, item := range list {
+      obj := spec.object(item)
+      if obj == nil {
+         continue
+      }
+      param := apiParam{name: asString(obj["name"]), in: asString(obj["in"])}
+      param.required, _ = obj["required"].(bool)
+      if param.schema = spec.object(obj["schema"]); param.schema == nil {
+         param.schema = obj
+      }
+      if param.in == "header" {
+         param.name = http.CanonicalHeaderKey(param.name)
+      }
+      replaced := false
+      for i := range params {
+         if params[i].name == param.name && params[i].in == param.in {
+            params[i], replaced = param, true
+         }
+      }
+      if !replaced {
+         params = append(params, param)
+      }
+   }
+   return params
+}
+
+// JSON schema of a content map; nil when it has no JSON media type
+func (spec *apiSpec) jsonSchema(raw interface{}) map[string]interface{} {
+   content, _ := raw.(map[string]interface{})
+   for mediaType, item := range content {
+      if jsonMediaType(mediaType) || mediaType == "*/*" {
+         if media := spec.object(item); media != nil {
+            return spec.object(media["schema"])
+         }
+      }
+   }
+   return nil
+}
+
+func apiMethod(name string) bool {
+   for _, method := range apiMethods {
+      if name == method {
+         return true
+      }
+   }
+   return false
+}
+
+func jsonMediaType(mediaType string) bool {
+   mediaType = strings.ToLower(mediaType)
+   return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func asString(v interface{}) string {
+   s, _ := v.(string)
+   return s
+}
+
+//
+// an object of the spec, following $ref pointers into the spec
+func (spec *apiSpec) object(v interface{}) map[string]interface{} {
+   obj, _ := v.(map[string]interface{})
+   for depth := 0; obj != nil && depth < schemaRefDepth; depth++ {
+      ref, ok := obj["$ref"].(string)
+      if !ok {
+         return obj
+      }
+      obj = spec.pointer(ref)
+   }
+   return obj
+}
+
+// the object at a local JSON pointer "#/a/b"; nil when there is none
+func (spec *apiSpec) pointer(ref string) map[string]interface{} {
+   if !strings.HasPrefix(ref, "#/") {
+      return nil
+   }
+   var node interface{} = spec.root
+   for _, token := range strings.Split(ref[2:], "/") {
+      token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+      obj, ok := node.(map[string]interface{})
+      if !ok {
+         return nil
+      }
+      node = obj[token]
+   }
+   obj, _ := node.(map[string]interface{})
+   return obj
+}
+
+//
+// match a request to its operation; nil when none matches
+func (spec *apiSpec) match(req *http.Request) (*apiOperation, []string) {
+   for _, op := range spec.ops {
+      if op.method != req.Method {
+         continue
+      }
+      if m := op.pattern.FindStringSubmatch(req.URL.Path); m != nil {
+         return op, m[1:]
+      }
+   }
+   return nil, nil
+}
+
+//
+// set up the OpenAPI classification of the requests
+// - an unreadable spec leaves the requests classified by route
+func (reqMgr *RequestManager) initOpenApi() {
+   if reqMgr.OpenApiSpec == "" {
+      return
+   }
+   spec, err := loadApiSpec(reqMgr.OpenApiSpec)
+   if err != nil {
+      log.Printf("Warning - OpenAPI spec %v: %v; the requests are classified by route", reqMgr.OpenApiSpec, err)
+      return
+   }
+   log.Printf("OpenAPI spec %v: %d operations", reqMgr.OpenApiSpec, len(spec.ops))
+   reqMgr.apiSpec = spec
+}
+
+//
+// operation of a request and its label; "" when there is no spec
+// - gRPC requests are labelled by their method, "grpc:package.Service/Method"
+func (reqMgr *RequestManager) operationOf(req *http.Request) (*apiOperation, string) {
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if strings.HasPrefix(mediaType, "application/grpc") && strings.Count(req.URL.Path, "/") == 2 {
+      return nil, "grpc:" + req.URL.Path[1:]
+   }
+   if reqMgr.apiSpec == nil {
+      return nil, ""
+   }
+   if op, _ := reqMgr.apiSpec.match(req); op != nil {
+      return op, op.Id
+   }
+   return nil, unknownOperation
+}
+
+//
+// validate a staging copy against the operation of its production request
+// - violations are counted by operation and rule; copies with test mutations
+//   are counted apart, their violations are expected
+func (reqMgr *RequestManager) validateCopy(sendReq *PendingRequest, stagReq *http.Request, body []byte) {
+   spec := reqMgr.apiSpec
+   if spec == nil || !reqMgr.OpenApiValidate {
+      return
+   }
+   op, values := spec.match(sendReq.req)
+   if op == nil {
+      return
+   }
+   violations := spec.validateRequest(op, values, stagReq, body)
+   morfed := strconv.FormatBool(len(sendReq.morfs) > 0)
+   reqMgr.Metrics.Inc("forktraffic_openapi_validations_total", "operation", op.Id, "valid", strconv.FormatBool(len(violations) == 0), "morfed", morfed)
+   for _, v := range violations {
+      reqMgr.Metrics.Inc("forktraffic_openapi_violations_total", "operation", op.Id, "where", "request", "rule", v.Rule, "morfed", morfed)
+   }
+}
+
+//
+// validate the parameters and the JSON body of a request
+// - values are the path parameters matched by the path template
+func (spec *apiSpec) validateRequest(op *apiOperation, values []string, req *http.Request, body []byte) []schemaViolation {
+   var out []schemaViolation
+   query := req.URL.Query()
+   for _, param := range op.params {
+      var raw []string
+      switch param.in {
+      case "path":
+         for i, name := range op.names {
+            if name == "{"+param.name+"}" && i < len(values) {
+               raw = []string{values[i]}
+            }
+         }
+      case "query":
+         raw = query[param.name]
+      case "header":
+         raw = req.Header.Values(param.name)
+      default:
+         continue
+      }
+      at := param.in + "." + param.name
+      if len(raw) == 0 {
+         if param.required || param.in == "path" {
+            out = append(out, schemaViolation{Path: at, Rule: "required"})
+         }
+         continue
+      }
+      spec.validate(param.schema, paramValue(spec.object(param.schema), raw), at, &out, 0)
+   }
+
+   if op.body == nil {
+      return out
+   }
+   plain, ok := decodeBody(body, req.Header.Get("Content-Encoding"))
+   if !ok {
+      return out
+   }
+   if len(plain) == 0 {
+      if op.bodyReq {
+         out = append(out, schemaViolation{Path: "$", Rule: "required"})
+      }
+      return out
+   }
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if mediaType != "" && !jsonMediaType(mediaType) {
+      return out
+   }
+   var value interface{}
+   if err := json.Unmarshal(plain, &value); err != nil {
+      return append(out, schemaViolation{Path: "$", Rule: "json"})
+   }
+   spec.validate(op.body, value, "$", &out, 0)
+   return out
+}
+
+//
+// typed value of a parameter by its schema; an unconvertible value stays a string
+// - arrays take the repeated values, or the comma separated ones of a single value
+func paramValue(schema map[string]interface{}, raw []string) interface{} {
+   convert := func(typ, s string) interface{} {
+      switch typ {
+      case "integer", "number":
+         if f, err := strconv.ParseFloat(s, 64); err == nil {
+            return f
+         }
+      case "boolean":
+         if b, err := strconv.ParseBool(s); err == nil {
+            return b
+         }
+      }
+      return s
+   }
+   if schemaType(schema) != "array" {
+      return convert(schemaType(schema), raw[0])
+   }
+   if len(raw) == 1 {
+      raw = strings.Split(raw[0], ",")
+   }
+   items, _ := schema["items"].(map[string]interface{})
+   list := make([]interface{}, len(raw))
+   for i, s := range raw {
+      list[i] = convert(schemaType(items), s)
+   }
+   return list
+}
+
+// the first non-null type of a schema; "" when untyped
+func schemaType(schema map[string]interface{}) string {
+   switch typ := schema["type"].(type) {
+   case string:
+      return typ
+   case []interface{}:
+      for _, t := range typ {
+         if s, _ := t.(string); s != "null" {
+            return s
+         }
+      }
+   }
+   return ""
+}
+
+func schemaAllows(schema map[string]interface{}, typ string) bool {
+   switch t := schema["type"].(type) {
+   case string:
+      return t == typ
+   case []interface{}:
+      for _, s := range t {
+         if s == typ {
+            return true
+         }
+      }
+   }
+   return false
+}
+
+//
+// JSON type name of a decoded value
+func jsonType(value interface{}) string {
+   switch v := value.(type) {
+   case nil:
+      return "null"
+   case bool:
+      return "boolean"
+   case float64:
+      if v == math.Trunc(v) {
+         return "integer"
+      }
+      return "number"
+   case string:
+      return "string"
+   case []interface{}:
+      return "array"
+   case map[string]interface{}:
+      return "object"
+   }
+   return ""
+}
+
+func (spec *apiSpec) violate(out *[]schemaViolation, at, rule string) {
+   if len(*out) < schemaViolationsLimit {
+      *out = append(*out, schemaViolation{Path: at, Rule: rule})
+   }
+}
+
+//
+// validate a decoded JSON value against a schema
+// - the keywords checked are type, nullable, enum, required, properties,
+//   additionalProperties, items, min/maxItems, min/maxLength, pattern,
+//   minimum/maximum (exclusive in both the 3.0 and 3.1 forms), allOf, anyOf
+//   and oneOf (taken as anyOf); formats are not checked
+func (spec *apiSpec) validate(raw map[string]interface{}, value interface{}, at string, out *[]schemaViolation, depth int) {
+   schema := spec.object(raw)
+   if schema == nil || depth > schemaRefDepth || len(*out) >= schemaViolationsLimit {
+      return
+   }
+
+   for _, sub := range asList(schema["allOf"]) {
+      spec.validate(spec.object(sub), value, at, out, depth+1)
+   }
+   for _, key := range []string{"anyOf", "oneOf"} {
+      alternatives := asList(schema[key])
+      if len(alternatives) == 0 {
+         continue
+      }
+      matched := false
+      for _, sub := range alternatives {
+         var trial []schemaViolation
+         spec.validate(spec.object(sub), value, at, &trial, depth+1)
+         matched = matched || len(trial) == 0
+      }
+      if !matched {
+         spec.violate(out, at, key)
+      }
+   }
+
+   actual := jsonType(value)
+   if actual == "null" {
+      if nullable, _ := schema["nullable"].(bool); !nullable && schemaType(schema) != "" && !schemaAllows(schema, "null") {
+         spec.violate(out, at, "type")
+      }
+      return
+   }
+   if typ := schemaType(schema); typ != "" && !schemaAllows(schema, actual) && !(actual == "integer" && schemaAllows(schema, "number")) {
+      spec.violate(out, at, "type")
+      return
+   }
+   if enum := asList(schema["enum"]); len(enum) > 0 {
+      found := false
+      for _, allowed := range enum {
+         found = found || reflect.DeepEqual(allowed, value)
+      }
+      if !found {
+         spec.violate(out, at, "enum")
+      }
+   }
+
+   switch v := value.(type) {
+   case string:
+      n := float64(utf8.RuneCountInString(v))
+      if min, ok := schema["minLength"].(float64); ok && n < min {
+         spec.violate(out, at, "minLength")
+      }
+      if max, ok := schema["maxLength"].(float64); ok && n > max {
+         spec.violate(out, at, "maxLength")
+      }
+      if pattern, ok := schema["pattern"].(string); ok {
+         if re := spec.pattern(pattern); re != nil && !re.MatchString(v) {
+            spec.violate(out, at, "pattern")
+         }
+      }
+   case float64:
+      if min, ok := schema["minimum"].(float64); ok {
+         if exclusive, _ := schema["exclusiveMinimum"].(bool); v < min || exclusive && v == min {
+            spec.violate(out, at, "minimum")
+         }
+      }
+      if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+         spec.violate(out, at, "minimum")
+      }
+      if max, ok := schema["maximum"].(float64); ok {
+         if exclusive, _ := schema["exclusiveMaximum"].(bool); v > max || exclusive && v == max {
+            spec.violate(out, at, "maximum")
+         }
+      }
+      if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+         spec.violate(out, at, "maximum")
+      }
+   case []interface{}:
+      n := float64(len(v))
+      if min, ok := schema["minItems"].(float64); ok && n < min {
+         spec.violate(out, at, "minItems")
+      }
+      if max, ok := schema["maxItems"].(float64); ok && n > max {
+         spec.violate(out, at, "maxItems")
+      }
+      if items := spec.object(schema["items"]); items != nil {
+         for i, item := range v {
+            spec.validate(items, item, at+"["+strconv.Itoa(i)+"]", out, depth+1)
+         }
+      }
+   case map[string]interface{}:
+      for _, name := range asList(schema["required"]) {
+         if key, _ := name.(string); key != "" {
+            if _, ok := v[key]; !ok {
+               spec.violate(out, at+"."+key, "required")
+            }
+         }
+      }
+      props, _ := schema["properties"].(map[string]interface{})
+      additional := schema["additionalProperties"]
+      keys := make([]string, 0, len(v))
+      for key := range v {
+         keys = append(keys, key)
+      }
+      sort.Strings(keys)
+      for _, key := range keys {
+         if prop, ok := props[key]; ok {
+            spec.validate(spec.object(prop), v[key], at+"."+key, out, depth+1)
+         } else if allowed, ok := additional.(bool); ok && !allowed {
+            spec.violate(out, at+"."+key, "additionalProperties")
+         } else if extra := spec.object(additional); extra != nil {
+            spec.validate(extra, v[key], at+"."+key, out, depth+1)
+         }
+      }
+   }
+}
+
+func asList(v interface{}) []interface{} {
+   list, _ := v.([]interface{})
+   return list
+}
+
+// compiled schema pattern; nil when it is not valid RE2
+func (spec *apiSpec) pattern(expr string) *regexp.Regexp {
+   if re, ok := spec.patterns.Load(expr); ok {
+      return re.(*regexp.Regexp)
+   }
+   re, err := regexp.Compile(expr)
+   if err != nil {
+      re = nil
+   }
+   spec.patterns.Store(expr, re)
+   return re
+}
@@ -0,0 +1,94 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "log"
+   "mime"
+   "net/http"
+   "strconv"
+   "sync"
+)
+
+// default largest production body validated; larger bodies are only checked by status
+const DefaultOpenApiResponseMaxBytes int = 1024 * 1024
+
+//
+// operation and rule pairs of the production responses seen violating the spec;
+// the first violation of each is logged
+type schemaDrift struct {
+   seen sync.Map
+}
+
+//
+// keep a production response of a classified request for its validation
+// - runs as the response middleware "schema", before the response is changed
+func (reqMgr *RequestManager) watchProductionSchema(resp *http.Response) error {
+   if reqMgr.apiSpec == nil || !reqMgr.OpenApiValidateResponses {
+      return nil
+   }
+   ex := exchangeOf(resp.Request)
+   if ex == nil || ex.apiOp == nil {
+      return nil
+   }
+   limit := reqMgr.OpenApiResponseMaxBytes
+   if limit <= 0 {
+      limit = DefaultOpenApiResponseMaxBytes
+   }
+   ex.prodSchema = &ResponseCapture{Status: resp.StatusCode, Header: resp.Header.Clone()}
+   if resp.Body != nil && resp.Body != http.NoBody {
+      resp.Body = &captureReader{ReadCloser: resp.Body, capture: ex.prodSchema, limit: limit}
+   }
+   return nil
+}
+
+//
+// response schema of a status: the exact status, its class ("2XX"), then "default"
+func (op *apiOperation) responseSchema(status int) (map[string]interface{}, bool) {
+   code := strconv.Itoa(status)
+   for _, key := range []string{code, code[:1] + "XX", "DEFAULT"} {
+      if schema, ok := op.responses[key]; ok {
+         return schema, true
+      }
+   }
+   return nil, false
+}
+
+//
+// validate a production response against its operation once it was sent to the client
+// - an undocumented status is a "status" violation; JSON bodies are validated when
+//   the status documents a schema, truncated bodies are only checked by status
+// - the first violation of each operation and rule is logged as contract drift
+func (reqMgr *RequestManager) validateProduction(ex *exchange) {
+   capture := ex.prodSchema
+   if capture == nil {
+      return
+   }
+   ex.prodSchema = nil
+   spec, op := reqMgr.apiSpec, ex.apiOp
+
+   var violations []schemaViolation
+   schema, documented := op.responseSchema(capture.Status)
+   if !documented && len(op.responses) > 0 {
+      violations = append(violations, schemaViolation{Path: "status", Rule: "status"})
+   }
+   mediaType, _, _ := mime.ParseMediaType(capture.Header.Get("Content-Type"))
+   if schema != nil && !capture.Truncated && len(capture.Body) > 0 && jsonMediaType(mediaType) {
+      if plain, ok := decodeBody(capture.Body, capture.Header.Get("Content-Encoding")); ok {
+         var value interface{}
+         if err := json.Unmarshal(plain, &value); err != nil {
+            violations = append(violations, schemaViolation{Path: "$", Rule: "json"})
+         } else {
+            spec.validate(schema, value, "$", &violations, 0)
+         }
+      }
+   }
+
+   morfed := strconv.FormatBool(len(ex.morfs) > 0)
+   reqMgr.Metrics.Inc("forktraffic_openapi_responses_total", "operation", op.Id, "valid", strconv.FormatBool(len(violations) == 0), "morfed", morfed)
+   for _, v := range violations {
+      reqMgr.Metrics.Inc("forktraffic_openapi_violations_total", "operation", op.Id, "where", "response", "rule", v.Rule, "morfed", morfed)
+      if _, seen := reqMgr.schemaDrift.seen.LoadOrStore(op.Id+" "+v.Rule, true); !seen {
+         log.Printf("Warning - production response of %v violates the OpenAPI spec: %v (%v, status %d)", op.Id, v.Rule, v.Path, capture.Status)
+      }
+   }
+}
@@ -0,0 +1,105 @@
+package forktraffic
+
+import (
+   "log"
+   "net"
+   "net/http"
+   "strings"
+)
+
+// operator headers; honored from the OperatorNetworks only, never sent on
+const httpForceMirrorHeader string = "X-Fork-Force-Mirror"
+const httpNoMorfHeader string = "X-Fork-No-Morf"
+const httpTargetHeader string = "X-Fork-Target"
+
+//
+// steering of a request by its operator headers
+// - forceMirror mirrors it whatever the status, GraphQL, bot, header and retry filters;
+//   the location filter (data residency) still applies
+// - noMorf keeps it from every morf, fault and fuzzing mode
+// - target sends it to that staging target only (a region, or "default")
+type operatorFlags struct {
+   forceMirror bool
+   noMorf      bool
+   target      string
+}
+
+//
+// parse the networks allowed to send operator headers; plain addresses are single hosts
+func (reqMgr *RequestManager) initOperators() {
+   reqMgr.operatorNets = nil
+   for _, entry := range reqMgr.OperatorNetworks {
+      cidr := entry
+      if !strings.Contains(cidr, "/") {
+         if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+            cidr += "/32"
+         } else {
+            cidr += "/128"
+         }
+      }
+      _, network, err := net.ParseCIDR(cidr)
+      if err != nil {
+         log.Printf("Warning - invalid operator network %q", entry)
+         continue
+      }
+      reqMgr.operatorNets = append(reqMgr.operatorNets, network)
+   }
+}
+
+// is a header value set and not "0", "false", "no" or "off"
+func headerTrue(val string) bool {
+   switch strings.ToLower(strings.TrimSpace(val)) {
+   case "", "0", "false", "no", "off":
+      return false
+   }
+   return true
+}
+
+//
+// take the operator headers off a request and honor them when it comes from an OperatorNetworks address
+// - the peer address decides; X-Forwarded-For is not trusted here
+func (reqMgr *RequestManager) operatorRequest(req *http.Request) operatorFlags {
+   flags := operatorFlags{
+      forceMirror: headerTrue(req.Header.Get(httpForceMirrorHeader)),
+      noMorf:      headerTrue(req.Header.Get(httpNoMorfHeader)),
+      target:      strings.TrimSpace(req.Header.Get(httpTargetHeader)),
+   }
+   req.Header.Del(httpForceMirrorHeader)
+   req.Header.Del(httpNoMorfHeader)
+   req.Header.Del(httpTargetHeader)
+   if flags == (operatorFlags{}) {
+      return flags
+   }
+
+   host, _, err := net.SplitHostPort(req.RemoteAddr)
+   if err != nil {
+      host = req.RemoteAddr
+   }
+   ip := net.ParseIP(host)
+   for _, network := range reqMgr.operatorNets {
+      if ip != nil && network.Contains(ip) {
+         reqMgr.Metrics.Inc("forktraffic_operator_requests_total", "result", "honored")
+         log.Printf("operator request %v %v from %v: force mirror %v, no morf %v, target %q",
+            req.Method, req.URL.Path, host, flags.forceMirror, flags.noMorf, flags.target)
+         return flags
+      }
+   }
+   reqMgr.Metrics.Inc("forktraffic_operator_requests_total", "result", "denied")
+   return operatorFlags{}
+}
+
+//
+// the staging targets of a request; only the operator's target when it named one
+func (reqMgr *RequestManager) requestTargets(req *http.Request) []*stagingTarget {
+   targets := reqMgr.stagingTargets()
+   ex := exchangeOf(req)
+   if ex == nil || ex.operator.target == "" {
+      return targets
+   }
+   for _, target := range targets {
+      if strings.EqualFold(target.label(), ex.operator.target) {
+         return []*stagingTarget{target}
+      }
+   }
+   return nil
+}
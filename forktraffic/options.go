@@ -0,0 +1,392 @@
+package forktraffic
+
+//
+// mirroring options
+type MirrorOptions struct {
+   // number of per-session ordered delivery lanes; 0 sends every request concurrently
+   OrderedLanes int
+
+   // split the pending requests queue in shards by session, each sending its requests
+   // in order with its own sender and dropping its own oldest when full; replaces the lanes
+   QueueShards int
+
+   // give every staging destination its own pending requests queue of QueueSize and
+   // its own sender; a slow destination only drops its own copies. replaces the shards
+   TargetQueues bool
+
+   // additional staging destinations; each receives a region tagged copy
+   // - IpMode ("ipv4", "ipv6", "dual") overrides the staging address family
+   StagingRegions []StagingRegion
+
+   // translations of the staging copies for an API version skew: path prefix
+   // rewrites, default headers and JSON field renames
+   RequestTranslations []RequestTranslation
+
+   // mark staging copies the way Envoy marks shadowed traffic
+   EnvoyShadow bool
+
+   // link staging copies to the production trace (W3C traceparent and B3)
+   TracePropagation bool
+
+   // production to staging cookie scope, for matching the cached staging cookies
+   // - a production cookie domain to its staging domain (e.g. "example.com": "staging.example.net")
+   // - a production path prefix to its staging prefix (e.g. "/app/": "/app-staging/"),
+   //   applied to the path of the staging copy
+   CookieDomainMap map[string]string
+   CookiePathMap   map[string]string
+
+   // send Secure cookies to a plaintext (http://) staging instead of dropping them
+   StripSecureCookies bool
+
+   // send SameSite=Strict cookies with cross-site requests
+   IgnoreSameSite bool
+
+   // pre-provisioned staging sessions lent round-robin to the production sessions
+   // staging has never seen, so their copies run authenticated
+   SyntheticSessions []SyntheticSession
+
+   // mirror only when production answered with one of these status classes
+   // (2 for 2xx, 5 for 5xx, ...); empty mirrors every request
+   MirrorStatusClasses []int
+
+   // mirror only the requests matching this filter expression (see CaptureFilter),
+   // e.g. 'header[X-Shadow] == true or cookie[beta] == yes'; empty mirrors all
+   MirrorFilter string
+
+   // methods whose request body is copied to staging; empty copies the body of
+   // any request having one
+   BodyMethods []string
+
+   // mirror this percent of the requests, decided before the body is read so the
+   // others are only proxied; 0 (default) mirrors every request
+   MirrorPercent int
+
+   // write a reproduction bundle of every request production answered with 5xx
+   // - ReproReplay also sends it to staging right away with debug headers
+   ReproDir    string
+   ReproReplay bool
+
+   // redaction of captured requests; headers default to the auth headers, query
+   // parameters to the common credential names (token, code, signature, ...)
+   // - the RedactBodyFields are also redacted from the query
+   // - a body whose Content-Encoding cannot be decoded is not kept
+   RedactHeaders     []string
+   RedactBodyFields  []string
+   RedactQueryParams []string
+
+   // mirror one copy of client retries seen within this window; 0 mirrors every retry
+   RetryWindowMs int
+
+   // fields redacted in staging copies (JSON and multipart form fields)
+   // - a request whose body cannot be decoded (e.g. br) is not mirrored
+   ScrubFields []string
+
+   // drop multipart file parts above this size from staging copies; 0 keeps all
+   MultipartMaxFileBytes int64
+
+   // GraphQL endpoint (default "/graphql") and the mirrored operation types
+   // (e.g. ["query"] never mirrors mutations); empty mirrors all; batched and
+   // unparseable documents are of type "unknown"
+   GraphqlPath        string
+   GraphqlMirrorTypes []string
+
+   // mirror requests whose client went away; the captured portion of the body is sent
+   // through the regular mirror filters, which see no production status (502)
+   MirrorAbortedRequests bool
+
+   // expectations on staging responses, per route
+   AssertionRules []AssertionRule
+
+   // shadow marker header (default "X-Duplicate-By: Http-Splitter") and
+   // optional query parameter added to staging copies
+   ShadowHeader     string
+   ShadowValue      string
+   ShadowQueryParam string
+
+   // marker appended to the User-Agent of the staging copies, e.g. "+forktraffic/1.4 shadow",
+   // so staging logs and WAFs tell the shadow traffic apart; UserAgentProduction
+   // also appends it to the requests proxied to production, untouched by default
+   UserAgentSuffix     string
+   UserAgentProduction bool
+
+   // id of this instance in headers, logs, metrics and ping (default: host name
+   // and a per run suffix) and the limit of forks a request may pass through
+   // (default DefaultMaxHops)
+   InstanceId string
+   MaxHops    int
+
+   // response headers compared between production and staging
+   DiffHeaders []string
+
+   // record production exchanges to this file, one JSON document per line
+   RecordFile string
+
+   // report every mismatch of production and staging to this file, one JSON document
+   // per line, and POST it to MismatchWebhook; see MismatchReport
+   MismatchFile    string
+   MismatchWebhook string
+
+   // replaying a mismatch also sends a GET or HEAD to production, without its
+   // credentials; otherwise only staging is replayed
+   ReplayProduction bool
+
+   // rotate RecordFile, MismatchFile and file destinations past this size in bytes or
+   // age in seconds; 0 never rotates
+   RecordRotateBytes int64
+   RecordRotateSec   int
+
+   // gzip rotated recordings, mismatch reports, file destinations and reproduction bundles
+   CompressArtifacts bool
+
+   // retention of rotated recordings, mismatch reports, file destinations and reproduction
+   // bundles: maximum age in seconds and total size in bytes; the oldest are pruned first; 0 keeps all
+   RetainSec   int
+   RetainBytes int64
+
+   // heap and goroutine profile snapshots written to ProfileDir every
+   // ProfileIntervalSec (default 300); the ProfileRetain (default 24) newest of
+   // each profile are kept
+   ProfileDir         string
+   ProfileIntervalSec int
+   ProfileRetain      int
+
+   // capture filter expression limiting the recording and the reproduction bundles
+   // e.g. method == POST and path ~ "^/api/" and status == 5xx
+   CaptureFilter string
+
+   // body normalization rules applied to both responses before comparison
+   NormalizeRules []NormalizeRule
+
+   // requests run against every staging target, hot-added ones too, before it is
+   // mirrored to; production traffic and readiness do not wait for them
+   WarmupRequests []WarmupRequest
+
+   // pause in seconds between failed warm-up rounds (default DefaultWarmupRetrySec)
+   WarmupRetrySec int
+
+   // canary analysis interval in seconds (default DefaultCanaryIntervalSec)
+   CanaryIntervalSec int
+
+   // requests never morfed, faulted or fuzzed by any test option or chaos experiment:
+   // path prefixes (default DefaultNoMorfPrefixes; an empty list has none) and a
+   // filter expression on method, path, host and headers (e.g. header[Stripe-Signature] ~ ".")
+   NoMorfPrefixes []string
+   NoMorfFilter   string
+
+   // chaos experiments and the URL their summaries are posted to
+   ChaosExperiments []ChaosExperiment
+   ChaosSummaryUrl  string
+
+   // staging copies that could not be delivered are retried ForwardRetries times,
+   // pausing ForwardRetryMs (default DefaultForwardRetryMs) doubled on every retry;
+   // then they go to the dead letters, kept redacted in DeadLetterDir when set
+   ForwardRetries int
+   ForwardRetryMs int
+   DeadLetterDir  string
+
+   // post the staging copies in batches to this ingestion endpoint instead of
+   // sending them one by one; BatchFormat "records" (default) in CaptureEncoding or "multipart",
+   // up to BatchSize (default DefaultBatchSize) copies per batch, a partial
+   // batch waits at most BatchWaitMs (default DefaultBatchWaitMs)
+   BatchUrl    string
+   BatchFormat string
+   BatchSize   int
+   BatchWaitMs int
+
+   // queue of the staging copies: "memory" (default), "disk" with one file per
+   // request in QueueDir, or "redis" as the stream QueueRedisKey (default
+   // DefaultQueueRedisKey) on RedisAddr; the durable queues hold unredacted requests
+   QueueBackend  string
+   QueueDir      string
+   QueueRedisKey string
+
+   // encoding of the requests in the durable queues and of the recording and the
+   // record batches: "json" (default), "protobuf" or "har"
+   QueueEncoding   string
+   CaptureEncoding string
+
+   // request limits, like production's edge: header size in KB (431, default
+   // MaxHeaderKb of the server), request URI length (414) and body size (413)
+   // in bytes; 0 leaves the URI and the body unlimited
+   MaxHeaderKb  int
+   MaxUriBytes  int
+   MaxBodyBytes int64
+
+   // validation of the inbound requests: Waf "block" rejects the malformed ones
+   // before proxying, "report" only counts them by rule; WafMethods are the accepted
+   // methods (default DefaultWafMethods), the others limit the header count, a
+   // header value, the query parameter count and a path segment
+   Waf                string
+   WafMethods         []string
+   WafMaxHeaders      int
+   WafMaxHeaderBytes  int
+   WafMaxParams       int
+   WafMaxSegmentBytes int
+
+   // terminate TLS with this certificate and key; the JA3 fingerprint of the
+   // clients is sent in FingerprintHeader (default DefaultFingerprintHeader)
+   TlsCertFile       string
+   TlsKeyFile        string
+   FingerprintHeader string
+
+   // sign the staging copies (X-Fork-Signature, HMAC-SHA256) with SigningKey, or
+   // with the key read from the Vault secret SigningKeyVaultUrl ("#field" selects
+   // the field, default DefaultSigningKeyField; the token is VAULT_TOKEN)
+   SigningKey         string
+   SigningKeyVaultUrl string
+
+   // key of the session mapping hashes; instances handing their sessions over
+   // share it (see SessionMapping); without it the mapping is not exported
+   SessionExportKey string
+
+   // map the production accounts of the staging copies to the seeded staging
+   // accounts of AccountMapFile; in the AccountHeaders, the path segment after
+   // one of the AccountPathPrefixes and the AccountFields of JSON bodies
+   AccountMapFile      string
+   AccountHeaders      []string
+   AccountPathPrefixes []string
+   AccountFields       []string
+
+   // replace the identifiers of the staging copies with keyed pseudonyms (HMAC
+   // with PseudonymKey), consistent across requests and fork instances: the
+   // PseudonymFields of query strings and of JSON, form-urlencoded and multipart
+   // bodies, and the PseudonymHeaders
+   // - with PseudonymFields, a request with another kind of body is not mirrored
+   PseudonymKey     string
+   PseudonymFields  []string
+   PseudonymHeaders []string
+
+   // locate the clients in the GeoIP database GeoIpDatabase (MaxMind DB or CSV
+   // "network,country[,region]") by their address, or the first X-Forwarded-For
+   // address when GeoIpForwardedFor is set; both copies carry X-Geo-Country and
+   // X-Geo-Region; MirrorCountries or MirrorRegions mirror only those locations
+   GeoIpDatabase     string
+   GeoIpForwardedFor bool
+   MirrorCountries   []string
+   MirrorRegions     []string
+
+   // bot traffic, by User-Agent (DefaultBotPatterns, BotPatterns and the patterns
+   // of the crawler list BotListFile, one per line): BotFilter "mirror" neither
+   // mirrors nor morfs or fuzzes it, "fuzz" mirrors it but never morfs or fuzzes it
+   BotFilter   string
+   BotPatterns []string
+   BotListFile string
+
+   // operating mode at start, switched at /admin/mode: "normal" (default), "bypass"
+   // (a pure reverse proxy) or "maintenance", answering every request with
+   // MaintenanceStatus (default DefaultMaintenanceStatus), MaintenanceHeaders and MaintenanceBody
+   Mode               string
+   MaintenanceStatus  int
+   MaintenanceHeaders map[string]string
+   MaintenanceBody    string
+
+   // in-memory cache of the production GET responses honoring Cache-Control, up to
+   // ResponseCacheBytes (0 disables it) and ResponseCacheEntryBytes per response
+   // (default DefaultResponseCacheEntryBytes)
+   // - a request with a Cookie is only answered from public or s-maxage responses
+   ResponseCacheBytes      int64
+   ResponseCacheEntryBytes int64
+
+   // security headers of the responses to the clients (HSTS on HTTPS only):
+   // SecurityHeaders "add" sets them when production did not, "override" always;
+   // SecurityHeaderValues change DefaultSecurityHeaders, an empty value leaves one out
+   SecurityHeaders      string
+   SecurityHeaderValues map[string]string
+
+   // Set-Cookie attributes of the responses to the clients, for a public host other
+   // than production's: ClientCookieDomainMap maps production domains to public ones
+   // ("" makes the cookies host-only), ClientCookiePathMap maps path prefixes,
+   // ClientCookieSecure "add" or "remove" changes Secure and ClientCookieSameSite
+   // (Lax, Strict, None) replaces SameSite
+   ClientCookieDomainMap map[string]string
+   ClientCookiePathMap   map[string]string
+   ClientCookieSecure    string
+   ClientCookieSameSite  string
+
+   // RewriteLocation points the redirects of production to its own host (the production
+   // URL's or one of ProductionHosts) back to PublicUrl, by default the host the client
+   // addressed over the protocol it used
+   RewriteLocation bool
+   ProductionHosts []string
+   PublicUrl       string
+
+   // RewriteBodyUrls replaces the absolute production URLs of the response bodies of
+   // the RewriteBodyTypes (default DefaultRewriteBodyTypes) up to RewriteBodyMaxBytes
+   // (default DefaultRewriteBodyMaxBytes): the RewriteBodyHosts origin pairs, else the
+   // origins of production's hosts by the public URL
+   RewriteBodyUrls     bool
+   RewriteBodyTypes    []string
+   RewriteBodyMaxBytes int64
+   RewriteBodyHosts    map[string]string
+
+   // headers set on every production response; an empty value removes the header
+   ResponseHeaders map[string]string
+
+   // compress the production responses to the clients with the first Compression
+   // encoding ("gzip", "deflate") they accept: responses of the CompressTypes (default
+   // DefaultCompressTypes) of at least CompressMinBytes (default DefaultCompressMinBytes)
+   // not compressed by production; CompressLevel 1-9 (default 6)
+   Compression      []string
+   CompressTypes    []string
+   CompressMinBytes int64
+   CompressLevel    int
+
+   // addresses and networks (CIDR) whose requests may steer themselves with the
+   // operator headers X-Fork-Force-Mirror, X-Fork-No-Morf and X-Fork-Target; the
+   // headers are taken off every request
+   OperatorNetworks []string
+
+   // experiment id of the mirrored traffic at start, changed at /admin/experiment;
+   // sent to staging in X-Fork-Experiment, kept with the captures and mismatches and
+   // counted by the forktraffic_experiment_* metrics
+   ExperimentId string
+
+   // multi-request flows (login, actions, logout, ...) to detect; their requests are
+   // sent to staging with the flow id in X-Fork-Scenario, kept with the captures and
+   // mismatches and counted by the forktraffic_scenario* metrics
+   ScenarioRules []ScenarioRule
+
+   // stamp the staging copies with the production arrival time in X-Fork-Received-At
+   // and their send time in X-Fork-Sent-At (RFC 3339, UTC, milliseconds)
+   TimestampHeaders bool
+
+   // OpenAPI spec of production (version 3 or Swagger 2, JSON): the requests are
+   // classified by operationId, counted by operation and grouped by it in the metrics
+   // and comparisons; OpenApiValidate validates the parameters and JSON bodies of the
+   // staging copies against it; OpenApiValidateResponses validates the production
+   // responses by status and JSON body up to OpenApiResponseMaxBytes (default
+   // DefaultOpenApiResponseMaxBytes), counting the violations by operation
+   OpenApiSpec              string
+   OpenApiValidate          bool
+   OpenApiValidateResponses bool
+   OpenApiResponseMaxBytes  int
+
+   // how the logs show binary bodies: "base64" (default), "hex", or "omit" for their
+   // size only; the bodies sent to staging are never changed
+   LogBinaryBodies string
+
+   // staging responses in the log: "status" (default), "headers", "body" for the
+   // first StagingLogBytes (default DefaultStagingLogBytes) of the body too, or "off"
+   StagingLog      string
+   StagingLogBytes int
+
+   // latency the fork may add to a production exchange; the exchanges over it are
+   // counted and forktraffic_overhead_within_budget tells whether the 99th
+   // percentile keeps to it; 0 for no budget
+   OverheadBudgetMs int
+
+   // text/template of the JSON summary posted to the "webhook+" destinations, of a
+   // WebhookSummary; DefaultWebhookTemplate when empty
+   WebhookTemplate string
+
+   // replay the requests of a JetStream subject to the staging targets:
+   // nats://[user:pass@]host:port/subject?stream=NAME[&durable=NAME]
+   JetStreamSource string
+
+   // per route configuration blocks; the stub routes are answered in every mode
+   Routes []RouteConfig
+
+   // Redis shared by the fork instances; registers this instance as a peer
+   RedisAddr     string
+   RedisPassword string
+}
@@ -0,0 +1,59 @@
+package forktraffic
+
+import (
+   "net/http"
+   "time"
+)
+
+//
+// account the latency the fork added to a production exchange: the time from
+// the arrival of the request to its response headers, less the production round trip
+// - exchanges production did not answer itself (cached, failed) are not counted
+func (reqMgr *RequestManager) observeOverhead(ex *exchange) {
+   if ex.received.IsZero() || ex.upstreamStart.IsZero() || ex.upstreamFirstByte.IsZero() {
+      return
+   }
+   overhead := reqMgr.Clock.Now().Sub(ex.received) - ex.upstreamFirstByte.Sub(ex.upstreamStart)
+   if overhead < 0 {
+      overhead = 0
+   }
+   reqMgr.overhead.observe(overhead)
+   reqMgr.Metrics.Add("forktraffic_overhead_ms_sum", overhead.Milliseconds())
+   reqMgr.Metrics.Inc("forktraffic_overhead_ms_count")
+   if budget := reqMgr.overheadBudget(); budget > 0 && overhead > budget {
+      reqMgr.Metrics.Inc("forktraffic_overhead_budget_exceeded_total")
+   }
+}
+
+// the OverheadBudgetMs; 0 for none
+func (reqMgr *RequestManager) overheadBudget() time.Duration {
+   return time.Duration(reqMgr.OverheadBudgetMs) * time.Millisecond
+}
+
+//
+// publish the overhead percentiles as gauges; sampled with the byte rates
+// - forktraffic_overhead_within_budget is 1 while the 99th percentile is within
+//   OverheadBudgetMs, 0 otherwise
+func (reqMgr *RequestManager) sampleOverhead() {
+   report := reqMgr.overhead.report()
+   reqMgr.publishLatency("forktraffic_overhead_ms", report)
+   if budget := reqMgr.OverheadBudgetMs; budget > 0 {
+      within := int64(0)
+      if report.P99Ms <= float64(budget) {
+         within = 1
+      }
+      reqMgr.Metrics.Set("forktraffic_overhead_budget_ms", int64(budget))
+      reqMgr.Metrics.Set("forktraffic_overhead_within_budget", within)
+   }
+}
+
+//
+// handle "/admin/overhead"; the latency the fork adds and its budget
+func (reqMgr *RequestManager) adminOverhead(w http.ResponseWriter, r *http.Request) {
+   report := reqMgr.overhead.report()
+   writeJson(w, struct {
+      BudgetMs     int
+      WithinBudget bool
+      Overhead     LatencyReport
+   }{reqMgr.OverheadBudgetMs, reqMgr.OverheadBudgetMs <= 0 || report.P99Ms <= float64(reqMgr.OverheadBudgetMs), report})
+}
@@ -0,0 +1,233 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "io"
+   "io/ioutil"
+   "log"
+   "mime"
+   "net/http"
+   "net/url"
+   "sort"
+   "sync"
+   "time"
+)
+
+//
+// bundled payload dictionaries of the injection mode
+var payloadDictionaries = map[string][]string{
+   "sqli": {
+      "' OR '1'='1",
+      "1; DROP TABLE users--",
+      "' UNION SELECT NULL,NULL--",
+      "1' AND SLEEP(5)--",
+      "\") OR (\"a\"=\"a",
+   },
+   "xss": {
+      "<script>alert(1)</script>",
+      "\"><img src=x onerror=alert(1)>",
+      "javascript:alert(1)",
+      "<svg/onload=alert(1)>",
+   },
+   "traversal": {
+      "../../../../etc/passwd",
+      "..%2f..%2f..%2fetc%2fpasswd",
+      "....//....//etc/passwd",
+      "..\\..\\..\\windows\\win.ini",
+   },
+   "crlf": {
+      "%0d%0aSet-Cookie:%20injected=1",
+      "\r\nX-Injected: 1",
+      "%E5%98%8A%E5%98%8DX-Injected:%201",
+   },
+}
+
+// payload injected into a staging copy
+type injection struct {
+   Dictionary string
+   Param      string
+   Payload    string
+}
+
+//
+// response flagged by the injection mode
+type injectionFinding struct {
+   Time       time.Time
+   Method     string
+   Path       string
+   injection
+   ProdStatus int
+   StagStatus int
+   Reason     string // "5xx", "status" (differs from production) or "reflected"
+}
+
+const findingsLimit int = 100
+
+type findingLog struct {
+   lock     sync.Mutex
+   findings []injectionFinding
+}
+
+func (fl *findingLog) add(finding injectionFinding) {
+   fl.lock.Lock()
+   fl.findings = append(fl.findings, finding)
+   if len(fl.findings) > findingsLimit {
+      fl.findings = fl.findings[len(fl.findings)-findingsLimit:]
+   }
+   fl.lock.Unlock()
+}
+
+func (fl *findingLog) list() []injectionFinding {
+   fl.lock.Lock()
+   defer fl.lock.Unlock()
+   return append([]injectionFinding(nil), fl.findings...)
+}
+
+//
+// inject a payload into one parameter of a staging copy
+// - candidates are the query parameters, the fields of a form body and the
+//   top level string fields of a JSON body; InjectParams limits them by name
+// - one copy in InjectPercent (default all) is injected; returns the new body
+func (reqMgr *RequestManager) injectPayload(tests *TestOptions, sendReq *PendingRequest, stagReq *http.Request, body []byte) []byte {
+   if tests.InjectPercent > 0 && reqMgr.Rand.Intn(100) >= tests.InjectPercent {
+      return body
+   }
+   var dicts []string
+   for _, name := range tests.InjectPayloads {
+      if len(payloadDictionaries[name]) > 0 {
+         dicts = append(dicts, name)
+      }
+   }
+   if len(dicts) == 0 {
+      return body
+   }
+
+   query := stagReq.URL.Query()
+   var form url.Values = nil
+   var doc map[string]interface{} = nil
+   mediaType, _, _ := mime.ParseMediaType(stagReq.Header.Get("Content-Type"))
+   if mediaType == "" {
+      mediaType, _, _ = mime.ParseMediaType(sendReq.req.Header.Get("Content-Type"))
+   }
+   plainBody := body != nil && sendReq.req.Header.Get("Content-Encoding") == ""
+   if plainBody && mediaType == "application/x-www-form-urlencoded" {
+      form, _ = url.ParseQuery(string(body))
+   } else if plainBody && mediaType == "application/json" {
+      json.Unmarshal(body, &doc)
+   }
+
+   // the injectable parameters, in a stable order
+   var params []string
+   for name := range query {
+      params = append(params, "query:"+name)
+   }
+   for name := range form {
+      params = append(params, "form:"+name)
+   }
+   for name, val := range doc {
+      if _, ok := val.(string); ok {
+         params = append(params, "json:"+name)
+      }
+   }
+   params = injectable(params, tests.InjectParams)
+   if len(params) == 0 {
+      return body
+   }
+
+   param := params[reqMgr.Rand.Intn(len(params))]
+   dict := dicts[reqMgr.Rand.Intn(len(dicts))]
+   payload := payloadDictionaries[dict][reqMgr.Rand.Intn(len(payloadDictionaries[dict]))]
+   sendReq.injection = &injection{Dictionary: dict, Param: param, Payload: payload}
+   sendReq.morfs = append(sendReq.morfs, "payload:"+dict)
+   reqMgr.Metrics.Inc("forktraffic_injections_total", "dictionary", dict)
+
+   switch kind, name := splitParam(param); kind {
+   case "query":
+      stagReq.URL.RawQuery = setRawParam(stagReq.URL.RawQuery, name, payload)
+      return body
+   case "form":
+      body = []byte(setRawParam(string(body), name, payload))
+   default:
+      doc[name] = payload
+      body, _ = json.Marshal(doc)
+   }
+   stagReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+   stagReq.ContentLength = int64(len(body))
+   stagReq.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+   return body
+}
+
+// split "kind:name"
+func splitParam(param string) (string, string) {
+   for i := range param {
+      if param[i] == ':' {
+         return param[:i], param[i+1:]
+      }
+   }
+   return "", param
+}
+
+// the parameters selected by InjectParams, sorted
+func injectable(params, wanted []string) []string {
+   var selected []string
+   for _, param := range params {
+      _, name := splitParam(param)
+      if len(wanted) == 0 {
+         selected = append(selected, param)
+         continue
+      }
+      for _, want := range wanted {
+         if name == want {
+            selected = append(selected, param)
+            break
+         }
+      }
+   }
+   sort.Strings(selected)
+   return selected
+}
+
+//
+// flag the staging answer to an injected copy
+// - a 5xx, a status class different from production or the payload reflected in the body
+func (reqMgr *RequestManager) checkInjection(sendReq *PendingRequest, stagStatus int, stagBody []byte) {
+   inj := sendReq.injection
+   if inj == nil {
+      return
+   }
+   prodStatus := 0
+   if sendReq.exchange != nil {
+      prodStatus = sendReq.exchange.status()
+   }
+
+   reason := ""
+   if stagStatus >= http.StatusInternalServerError {
+      reason = "5xx"
+   } else if prodStatus != 0 && prodStatus/100 != stagStatus/100 {
+      reason = "status"
+   } else if bytes.Contains(stagBody, []byte(inj.Payload)) {
+      reason = "reflected"
+   }
+   if reason == "" {
+      return
+   }
+
+   reqMgr.Metrics.Inc("forktraffic_injection_findings_total", "dictionary", inj.Dictionary, "reason", reason)
+   reqMgr.findings.add(injectionFinding{
+      Time:       reqMgr.Clock.Now(),
+      Method:     sendReq.req.Method,
+      Path:       sendReq.req.URL.Path,
+      injection:  *inj,
+      ProdStatus: prodStatus,
+      StagStatus: stagStatus,
+      Reason:     reason,
+   })
+   log.Printf("injection finding %v: %v %v %v=%q", reason, sendReq.req.Method, sendReq.req.URL.Path, inj.Param, inj.Payload)
+}
+
+//
+// handle "/admin/findings"; the latest responses flagged by the injection mode
+func (reqMgr *RequestManager) adminFindings(w http.ResponseWriter, r *http.Request) {
+   writeJson(w, reqMgr.findings.list())
+}
@@ -0,0 +1,119 @@
+package forktraffic
+
+import (
+   "encoding/json"
+   "log"
+   "net/http"
+   "os"
+   "strconv"
+   "time"
+)
+
+// peer registry in Redis
+const peerKeyPrefix string = "forktraffic:peer:"
+const peerHeartbeat time.Duration = 10 * time.Second
+
+//
+// description of a fork instance
+type peerInfo struct {
+   InstanceId string
+   Production string
+   Staging    []string
+   Started    time.Time
+   Seen       time.Time
+}
+
+//
+// derive the default instance id: host name and a per run suffix
+func (reqMgr *RequestManager) defaultInstanceId() string {
+   suffix := reqMgr.forwardPrefix
+   if len(suffix) > 8 {
+      suffix = suffix[:8]
+   }
+   host, err := os.Hostname()
+   if err != nil || host == "" {
+      return suffix
+   }
+   return host + "-" + suffix
+}
+
+// this instance
+func (reqMgr *RequestManager) selfInfo() peerInfo {
+   info := peerInfo{InstanceId: reqMgr.InstanceId, Started: reqMgr.started, Seen: reqMgr.Clock.Now()}
+   if reqMgr.UrlProduction != nil {
+      info.Production = reqMgr.UrlProduction.String()
+   }
+   for _, target := range reqMgr.stagingTargets() {
+      info.Staging = append(info.Staging, target.url.String())
+   }
+   return info
+}
+
+//
+// register this instance in Redis and keep it alive
+func (reqMgr *RequestManager) startPeers() {
+   if reqMgr.RedisAddr == "" {
+      return
+   }
+   reqMgr.redis = NewRedisClient(reqMgr.RedisAddr, reqMgr.RedisPassword)
+   go func() {
+      for {
+         buf, _ := json.Marshal(reqMgr.selfInfo())
+         ttl := strconv.Itoa(int(3 * peerHeartbeat / time.Second))
+         if _, err := reqMgr.redis.Do("SET", peerKeyPrefix+reqMgr.InstanceId, string(buf), "EX", ttl); err != nil {
+            log.Printf("Warning - peer registration: %v", err)
+         }
+         time.Sleep(peerHeartbeat)
+      }
+   }()
+}
+
+//
+// list the registered instances
+func (reqMgr *RequestManager) listPeers() ([]peerInfo, error) {
+   if reqMgr.redis == nil {
+      return []peerInfo{reqMgr.selfInfo()}, nil
+   }
+
+   var peers []peerInfo
+   cursor := "0"
+   for {
+      reply, err := reqMgr.redis.Do("SCAN", cursor, "MATCH", peerKeyPrefix+"*", "COUNT", "100")
+      if err != nil {
+         return nil, err
+      }
+      page, ok := reply.([]interface{})
+      if !ok || len(page) != 2 {
+         return peers, nil
+      }
+      keys, _ := page[1].([]interface{})
+      for _, key := range keys {
+         val, err := reqMgr.redis.Do("GET", redisString(key))
+         if err != nil {
+            return nil, err
+         }
+         var peer peerInfo
+         if json.Unmarshal([]byte(redisString(val)), &peer) == nil {
+            peers = append(peers, peer)
+         }
+      }
+      cursor = redisString(page[0])
+      if cursor == "0" || cursor == "" {
+         return peers, nil
+      }
+   }
+}
+
+//
+// handle "/admin/peers"; the fork instances sharing our Redis
+func (reqMgr *RequestManager) adminPeers(w http.ResponseWriter, r *http.Request) {
+   peers, err := reqMgr.listPeers()
+   if err != nil {
+      ResponseHttpError(w, http.StatusBadGateway, ": "+err.Error())
+      return
+   }
+   writeJson(w, struct {
+      Self  string
+      Peers []peerInfo
+   }{reqMgr.InstanceId, peers})
+}
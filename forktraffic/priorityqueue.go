@@ -0,0 +1,154 @@
+package forktraffic
+
+import (
+   "container/heap"
+   "sync"
+   "sync/atomic"
+)
+
+//
+// queue giving the routes of a positive Priority precedence
+// - their copies wait in memory, higher priority first then in arrival order,
+//   and are taken before those of the backend queue
+// - a full queue drops the regular copies first
+type priorityQueue struct {
+   reqMgr  *RequestManager
+   backend Queue
+
+   lock    sync.Mutex
+   express expressHeap
+   seq     int64
+   wake    chan struct{}
+
+   // the backend is read ahead by one request; closed once the queue is closed
+   // and the backend drained
+   regular chan poppedRequest
+   ahead   int32
+   closed  int32
+}
+
+type poppedRequest struct {
+   sendReq *PendingRequest
+   err     error
+}
+
+type expressItem struct {
+   sendReq  *PendingRequest
+   priority int
+   seq      int64
+}
+
+type expressHeap []expressItem
+
+func (eh expressHeap) Len() int { return len(eh) }
+func (eh expressHeap) Less(i, j int) bool {
+   if eh[i].priority != eh[j].priority {
+      return eh[i].priority > eh[j].priority
+   }
+   return eh[i].seq < eh[j].seq
+}
+func (eh expressHeap) Swap(i, j int)       { eh[i], eh[j] = eh[j], eh[i] }
+func (eh *expressHeap) Push(x interface{}) { *eh = append(*eh, x.(expressItem)) }
+func (eh *expressHeap) Pop() interface{} {
+   old := *eh
+   item := old[len(old)-1]
+   *eh = old[:len(old)-1]
+   return item
+}
+
+func newPriorityQueue(reqMgr *RequestManager, backend Queue) *priorityQueue {
+   pq := &priorityQueue{
+      reqMgr:  reqMgr,
+      backend: backend,
+      wake:    make(chan struct{}, 1),
+      regular: make(chan poppedRequest),
+   }
+   go func() {
+      for {
+         sendReq, err := backend.Pop()
+         if sendReq != nil || err != nil {
+            atomic.StoreInt32(&pq.ahead, 1)
+            pq.regular <- poppedRequest{sendReq, err}
+            atomic.StoreInt32(&pq.ahead, 0)
+         }
+         if atomic.LoadInt32(&pq.closed) != 0 && backend.Len() == 0 {
+            close(pq.regular)
+            return
+         }
+      }
+   }()
+   return pq
+}
+
+func (pq *priorityQueue) Push(sendReq *PendingRequest) error {
+   priority := pq.reqMgr.priorityOf(sendReq)
+   if priority <= 0 {
+      return pq.backend.Push(sendReq)
+   }
+   pq.lock.Lock()
+   pq.seq++
+   heap.Push(&pq.express, expressItem{sendReq: sendReq, priority: priority, seq: pq.seq})
+   pq.lock.Unlock()
+   select {
+   case pq.wake <- struct{}{}:
+   default:
+   }
+   return nil
+}
+
+func (pq *priorityQueue) Pop() (*PendingRequest, error) {
+   for {
+      pq.lock.Lock()
+      if pq.express.Len() > 0 {
+         item := heap.Pop(&pq.express).(expressItem)
+         pq.lock.Unlock()
+         return item.sendReq, nil
+      }
+      pq.lock.Unlock()
+
+      select {
+      case <-pq.wake:
+      case popped, ok := <-pq.regular:
+         if !ok {
+            return nil, nil
+         }
+         return popped.sendReq, popped.err
+      }
+   }
+}
+
+func (pq *priorityQueue) DropOldest() *PendingRequest {
+   if sendReq := pq.backend.DropOldest(); sendReq != nil {
+      return sendReq
+   }
+   pq.lock.Lock()
+   defer pq.lock.Unlock()
+   if pq.express.Len() == 0 {
+      return nil
+   }
+   // the lowest priority, latest arrival
+   last := 0
+   for i := range pq.express {
+      if pq.express.Less(last, i) {
+         last = i
+      }
+   }
+   return heap.Remove(&pq.express, last).(expressItem).sendReq
+}
+
+func (pq *priorityQueue) Close() {
+   atomic.StoreInt32(&pq.closed, 1)
+   pq.backend.Close()
+   select {
+   case pq.wake <- struct{}{}:
+   default:
+   }
+}
+
+func (pq *priorityQueue) Len() int {
+   pq.lock.Lock()
+   defer pq.lock.Unlock()
+   return pq.backend.Len() + pq.express.Len() + int(atomic.LoadInt32(&pq.ahead))
+}
+
+func (pq *priorityQueue) Cap() int { return pq.backend.Cap() }
@@ -0,0 +1,88 @@
+package forktraffic
+
+import (
+   "os"
+   "path/filepath"
+   "runtime/pprof"
+   "sort"
+   "time"
+)
+
+// default interval and retention of the profile snapshots
+const DefaultProfileIntervalSec int = 300
+const DefaultProfileRetain int = 24
+
+// profiles written at every snapshot
+var snapshotProfiles = []string{"heap", "goroutine"}
+
+//
+// write one snapshot of every profile to ProfileDir as <profile>-<time>.pprof
+func (reqMgr *RequestManager) snapshotProfiles() {
+   stamp := reqMgr.Clock.Now().UTC().Format("20060102T150405Z")
+   for _, name := range snapshotProfiles {
+      file := filepath.Join(reqMgr.ProfileDir, name+"-"+stamp+".pprof")
+      if err := writeProfile(name, file); err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: file, Err: err})
+         continue
+      }
+      reqMgr.Metrics.Inc("forktraffic_profile_snapshots_total", "profile", name)
+   }
+}
+
+func writeProfile(name, file string) error {
+   out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+   if err != nil {
+      return err
+   }
+   err = pprof.Lookup(name).WriteTo(out, 0)
+   if closeErr := out.Close(); err == nil {
+      err = closeErr
+   }
+   if err != nil {
+      os.Remove(file)
+   }
+   return err
+}
+
+//
+// keep the ProfileRetain (default DefaultProfileRetain) newest snapshots of every profile
+func (reqMgr *RequestManager) pruneProfiles() {
+   retain := reqMgr.ProfileRetain
+   if retain <= 0 {
+      retain = DefaultProfileRetain
+   }
+   for _, name := range snapshotProfiles {
+      files, _ := filepath.Glob(filepath.Join(reqMgr.ProfileDir, name+"-*.pprof"))
+      sort.Strings(files)
+      for len(files) > retain {
+         if err := os.Remove(files[0]); err != nil {
+            reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: files[0], Err: err})
+         }
+         files = files[1:]
+      }
+   }
+}
+
+//
+// snapshot the heap and goroutine profiles every ProfileIntervalSec (default
+// DefaultProfileIntervalSec) for post-mortem analysis of memory growth
+func (reqMgr *RequestManager) startProfiles() {
+   if reqMgr.ProfileDir == "" {
+      return
+   }
+   if err := os.MkdirAll(reqMgr.ProfileDir, 0700); err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: reqMgr.ProfileDir, Err: err})
+      return
+   }
+   interval := time.Duration(reqMgr.ProfileIntervalSec) * time.Second
+   if interval <= 0 {
+      interval = time.Duration(DefaultProfileIntervalSec) * time.Second
+   }
+   go func() {
+      for {
+         time.Sleep(interval)
+         reqMgr.snapshotProfiles()
+         reqMgr.pruneProfiles()
+      }
+   }()
+}
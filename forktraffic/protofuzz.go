@@ -0,0 +1,117 @@
+package forktraffic
+
+import (
+   "bufio"
+   "bytes"
+   "crypto/tls"
+   "fmt"
+   "log"
+   "net"
+   "net/http"
+   "strings"
+   "time"
+)
+
+// malformed request kinds
+var protoFuzzKinds = []string{"bad_chunk", "folded_header", "long_header", "bare_lf", "double_length"}
+
+// deadline of a malformed exchange
+const protoFuzzTimeout time.Duration = 10 * time.Second
+
+//
+// should a staging copy be sent malformed
+func (reqMgr *RequestManager) protoFuzz(tests *TestOptions) bool {
+   return tests.ProtoFuzzPercent > 0 && reqMgr.Rand.Intn(100) < tests.ProtoFuzzPercent
+}
+
+//
+// serialize a request with one protocol defect
+// - bad_chunk: chunked body with an invalid chunk size
+// - folded_header: a header continued on an obs-fold line
+// - long_header: a 64KB header line
+// - bare_lf: lines ended by LF only
+// - double_length: two conflicting Content-Length headers
+func malformedRequest(req *http.Request, body []byte, kind string) []byte {
+   var buf bytes.Buffer
+   fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+   fmt.Fprintf(&buf, "Host: %s\r\n", req.Host)
+   for key, vals := range req.Header {
+      for _, val := range vals {
+         fmt.Fprintf(&buf, "%s: %s\r\n", key, val)
+      }
+   }
+   buf.WriteString("Connection: close\r\n")
+
+   switch kind {
+   case "bad_chunk":
+      buf.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+      fmt.Fprintf(&buf, "%x;ext\r\n", len(body)+7)
+      buf.Write(body)
+      buf.WriteString("\r\nzz\r\n\r\n")
+      return buf.Bytes()
+   case "folded_header":
+      buf.WriteString("X-Folded: first\r\n \tsecond\r\n")
+   case "long_header":
+      buf.WriteString("X-Long: " + strings.Repeat("a", 64*1024) + "\r\n")
+   case "double_length":
+      fmt.Fprintf(&buf, "Content-Length: %d\r\nContent-Length: %d\r\n\r\n", len(body), len(body)+1)
+      buf.Write(body)
+      return buf.Bytes()
+   }
+   fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(body))
+   buf.Write(body)
+
+   if kind == "bare_lf" {
+      head := bytes.Index(buf.Bytes(), []byte("\r\n\r\n")) + 4
+      out := bytes.Replace(buf.Bytes()[:head], []byte("\r\n"), []byte("\n"), -1)
+      return append(out, buf.Bytes()[head:]...)
+   }
+   return buf.Bytes()
+}
+
+//
+// send a staging copy malformed over a raw connection, bypassing http.Client
+// - network is the dial network of the target (see targetNetwork)
+// - counts the staging answer per defect: status class, "closed" or "error"
+func (reqMgr *RequestManager) sendMalformed(stagReq *http.Request, network string, body []byte) {
+   kind := protoFuzzKinds[reqMgr.Rand.Intn(len(protoFuzzKinds))]
+   result := reqMgr.rawExchange(stagReq, network, malformedRequest(stagReq, body, kind))
+   reqMgr.Metrics.Inc("forktraffic_protofuzz_requests_total", "kind", kind, "result", result)
+   log.Printf("protocol fuzz %v %v: %v", kind, stagReq.URL.Path, result)
+}
+
+// write raw bytes to the request's host and classify the answer
+func (reqMgr *RequestManager) rawExchange(stagReq *http.Request, network string, raw []byte) string {
+   addr := stagReq.URL.Host
+   if stagReq.URL.Port() == "" {
+      if stagReq.URL.Scheme == "https" {
+         addr = net.JoinHostPort(stagReq.URL.Hostname(), "443")
+      } else {
+         addr = net.JoinHostPort(stagReq.URL.Hostname(), "80")
+      }
+   }
+
+   var conn net.Conn
+   var err error
+   dialer := &net.Dialer{Timeout: protoFuzzTimeout}
+   if stagReq.URL.Scheme == "https" {
+      conn, err = tls.DialWithDialer(dialer, network, addr, &tls.Config{InsecureSkipVerify: true})
+   } else {
+      conn, err = dialer.Dial(network, addr)
+   }
+   if err != nil {
+      return "error"
+   }
+   defer conn.Close()
+   conn.SetDeadline(time.Now().Add(protoFuzzTimeout))
+
+   if _, err := conn.Write(raw); err != nil {
+      return "closed"
+   }
+   resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+   if err != nil {
+      return "closed"
+   }
+   resp.Body.Close()
+   return statusClass(resp.StatusCode)
+}
@@ -0,0 +1,184 @@
+package forktraffic
+
+import (
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/json"
+   "log"
+   "mime"
+   "mime/multipart"
+   "net/http"
+   "net/url"
+   "regexp"
+   "strings"
+)
+
+// shape of a UUID; its pseudonym keeps it
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+//
+// set up the pseudonymization of the identifiers of the staging copies
+// - without PseudonymKey a random key is used; the pseudonyms are then only
+//   consistent within this process
+func (reqMgr *RequestManager) initPseudonyms() {
+   if len(reqMgr.PseudonymFields) == 0 && len(reqMgr.PseudonymHeaders) == 0 {
+      return
+   }
+   reqMgr.pseudonymKey = []byte(reqMgr.PseudonymKey)
+   if len(reqMgr.pseudonymKey) == 0 {
+      log.Printf("Warning - no PseudonymKey; the pseudonyms change with every restart")
+      reqMgr.pseudonymKey = make([]byte, 32)
+      rand.Read(reqMgr.pseudonymKey)
+   }
+   if len(reqMgr.PseudonymFields) > 0 {
+      reqMgr.AddBodyTransform(reqMgr.pseudonymizeBody)
+   }
+}
+
+//
+// keyed pseudonym of an identifier; the same value always gets the same pseudonym
+// - emails stay emails (on example.com), digits stay digits of the same length,
+//   UUIDs stay UUIDs; other values become hex of their length (at least 8)
+func (reqMgr *RequestManager) pseudonym(value string) string {
+   mac := hmac.New(sha256.New, reqMgr.pseudonymKey)
+   mac.Write([]byte(value))
+   sum := mac.Sum(nil)
+   digest := hex.EncodeToString(sum)
+
+   if at := strings.LastIndex(value, "@"); at > 0 {
+      return "u" + digest[:15] + "@example.com"
+   }
+   if uuidPattern.MatchString(value) {
+      return digest[:8] + "-" + digest[8:12] + "-4" + digest[13:16] + "-8" + digest[17:20] + "-" + digest[20:32]
+   }
+   digits := value != ""
+   for _, ch := range value {
+      digits = digits && ch >= '0' && ch <= '9'
+   }
+   if digits {
+      out := make([]byte, len(value))
+      for i := range out {
+         out[i] = '0' + sum[i%len(sum)]%10
+      }
+      if value[0] != '0' && out[0] == '0' {
+         out[0] = '1'
+      }
+      return string(out)
+   }
+
+   n := len(value)
+   if n < 8 {
+      n = 8
+   } else if n > len(digest) {
+      n = len(digest)
+   }
+   return digest[:n]
+}
+
+func (reqMgr *RequestManager) pseudonymField(name string) bool {
+   for _, field := range reqMgr.PseudonymFields {
+      if strings.EqualFold(name, field) {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// pseudonymize the PseudonymFields of a staging body: JSON (at any depth),
+// form-urlencoded and the form fields of multipart/form-data
+func (reqMgr *RequestManager) pseudonymizeBody(req *http.Request, plain []byte) []byte {
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   switch mediaType {
+   case "application/x-www-form-urlencoded":
+      form, _ := reqMgr.pseudonymizeQuery(string(plain), "form")
+      return []byte(form)
+   case "multipart/form-data":
+      return rewriteMultipart(req, plain, func(part *multipart.Part, data []byte) ([]byte, bool) {
+         if part.FileName() == "" && reqMgr.pseudonymField(part.FormName()) {
+            reqMgr.Metrics.Inc("forktraffic_pseudonyms_total", "where", "form")
+            return []byte(reqMgr.pseudonym(string(data))), true
+         }
+         return data, true
+      })
+   }
+   return rewriteJsonFields(req, plain, reqMgr.pseudonymField, func(id string) (string, bool) {
+      reqMgr.Metrics.Inc("forktraffic_pseudonyms_total", "where", "body")
+      return reqMgr.pseudonym(id), true
+   })
+}
+
+//
+// can the PseudonymFields of a request body be pseudonymized; a body that
+// cannot be is not mirrored
+// - JSON, form-urlencoded and multipart/form-data bodies can; empty bodies too
+// - a JSON body that does not parse cannot
+func (reqMgr *RequestManager) pseudonymizable(req *http.Request, body []byte) bool {
+   if reqMgr.pseudonymKey == nil || len(reqMgr.PseudonymFields) == 0 || len(body) == 0 {
+      return true
+   }
+   mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   switch {
+   case mediaType == "application/x-www-form-urlencoded":
+      return true
+   case mediaType == "multipart/form-data":
+      return params["boundary"] != ""
+   case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+      plain, ok := decodeBody(body, req.Header.Get("Content-Encoding"))
+      return ok && json.Valid(plain)
+   }
+   return false
+}
+
+//
+// pseudonymize the PseudonymFields of a query string (or form body); true when changed
+// - the other parameters are kept as they were sent, in order and escaping
+func (reqMgr *RequestManager) pseudonymizeQuery(raw, where string) (string, bool) {
+   pairs := strings.Split(raw, "&")
+   changed := false
+   for i, pair := range pairs {
+      eq := strings.IndexByte(pair, '=')
+      if eq < 0 {
+         continue
+      }
+      name, err := url.QueryUnescape(pair[:eq])
+      if err != nil || !reqMgr.pseudonymField(name) {
+         continue
+      }
+      value, err := url.QueryUnescape(pair[eq+1:])
+      if err != nil {
+         continue
+      }
+      pairs[i] = pair[:eq+1] + url.QueryEscape(reqMgr.pseudonym(value))
+      reqMgr.Metrics.Inc("forktraffic_pseudonyms_total", "where", where)
+      changed = true
+   }
+   if !changed {
+      return raw, false
+   }
+   return strings.Join(pairs, "&"), true
+}
+
+//
+// pseudonymize the PseudonymHeaders and the PseudonymFields query parameters of a staging copy
+func (reqMgr *RequestManager) pseudonymizeRequest(stagReq *http.Request) {
+   if reqMgr.pseudonymKey == nil {
+      return
+   }
+   for _, name := range reqMgr.PseudonymHeaders {
+      vals := stagReq.Header.Values(name)
+      for i := range vals {
+         vals[i] = reqMgr.pseudonym(vals[i])
+         reqMgr.Metrics.Inc("forktraffic_pseudonyms_total", "where", "header")
+      }
+   }
+
+   if stagReq.URL.RawQuery == "" || len(reqMgr.PseudonymFields) == 0 {
+      return
+   }
+   if query, changed := reqMgr.pseudonymizeQuery(stagReq.URL.RawQuery, "query"); changed {
+      stagReq.URL.RawQuery = query
+   }
+}
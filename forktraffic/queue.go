@@ -0,0 +1,246 @@
+package forktraffic
+
+import (
+   "log"
+   "net/http"
+   "path/filepath"
+   "sync"
+)
+
+// default size of the pending requests queue
+const DefaultQueueSize int = 10000
+
+//
+// queue of the requests waiting to be sent to staging
+// - selected by QueueBackend: "memory" (default), "disk" or "redis"
+// - the durable backends serialize the requests; the production side of an
+//   exchange (comparison, morfs) is only kept while this process holds it
+type Queue interface {
+   // add a request at the end of the queue
+   Push(sendReq *PendingRequest) error
+
+   // take the oldest request; blocks while the queue is empty
+   // - nil without an error when the request cannot be sent anymore
+   Pop() (*PendingRequest, error)
+
+   // drop the oldest request; nil when there is none
+   DropOldest() *PendingRequest
+
+   // stop waiting for requests: once closed, a Pop of an empty queue returns nil
+   // without an error so its reader can leave; pushes are still taken
+   Close()
+
+   Len() int
+   Cap() int
+}
+
+//
+// in-memory queue; a buffered channel
+type memoryQueue chan *PendingRequest
+
+func (mq memoryQueue) Push(sendReq *PendingRequest) error {
+   mq <- sendReq
+   return nil
+}
+
+func (mq memoryQueue) Pop() (*PendingRequest, error) {
+   return <-mq, nil
+}
+
+func (mq memoryQueue) DropOldest() *PendingRequest {
+   select {
+   case sendReq := <-mq:
+      return sendReq
+   default:
+      return nil
+   }
+}
+
+// wake a reader waiting on the empty queue; a full queue has no reader waiting
+func (mq memoryQueue) Close() {
+   select {
+   case mq <- nil:
+   default:
+   }
+}
+
+func (mq memoryQueue) Len() int { return len(mq) }
+func (mq memoryQueue) Cap() int { return cap(mq) }
+
+//
+// set up the queue of the configured backend, its QueueShards shards or a queue per target
+// - a backend that cannot start falls back to memory
+func (reqMgr *RequestManager) initQueue() {
+   if reqMgr.Queue != nil {
+      return
+   }
+   if reqMgr.QueueSize <= 0 {
+      reqMgr.QueueSize = DefaultQueueSize
+   }
+   reqMgr.queued.init(reqMgr.QueueSize)
+
+   if reqMgr.TargetQueues {
+      reqMgr.initTargetQueues()
+      return
+   }
+   if reqMgr.QueueShards > 1 {
+      reqMgr.initShards()
+      return
+   }
+   reqMgr.Queue = reqMgr.openQueue("", reqMgr.QueueSize)
+}
+
+//
+// open a queue of the configured backend
+// - shard names the shard: a subdirectory of QueueDir, a suffix of QueueRedisKey
+func (reqMgr *RequestManager) openQueue(shard string, size int) Queue {
+   var queue Queue = nil
+   var err error = nil
+   switch reqMgr.QueueBackend {
+   case "", "memory":
+   case "disk":
+      dir := reqMgr.QueueDir
+      if shard != "" && dir != "" {
+         dir = filepath.Join(dir, shard)
+      }
+      queue, err = newDiskQueue(reqMgr, dir, size)
+   case "redis":
+      key := reqMgr.QueueRedisKey
+      if key == "" {
+         key = DefaultQueueRedisKey
+      }
+      if shard != "" {
+         key += ":" + shard
+      }
+      queue, err = newRedisQueue(reqMgr, key, size)
+   default:
+      err = errUnknownQueue
+   }
+   if err != nil {
+      log.Printf("Warning - %v queue: %v; the queue is kept in memory", reqMgr.QueueBackend, err)
+      queue = nil
+   }
+   if queue == nil {
+      queue = make(memoryQueue, size)
+   }
+
+   // routes with a priority go ahead of the queue
+   for _, route := range reqMgr.Routes {
+      if route.Priority > 0 {
+         return newPriorityQueue(reqMgr, queue)
+      }
+   }
+   return queue
+}
+
+//
+// exchanges of the requests this process queued, by queued request id
+// - bounded to the queue size; the oldest are forgotten first
+type queuedExchanges struct {
+   lock sync.Mutex
+   byId map[string]*exchange
+   ring []string
+   next int
+}
+
+func (qe *queuedExchanges) init(size int) {
+   qe.byId = make(map[string]*exchange)
+   qe.ring = make([]string, size)
+}
+
+func (qe *queuedExchanges) put(id string, ex *exchange) {
+   qe.lock.Lock()
+   defer qe.lock.Unlock()
+   if old := qe.ring[qe.next]; old != "" {
+      delete(qe.byId, old)
+   }
+   qe.ring[qe.next] = id
+   qe.next = (qe.next + 1) % len(qe.ring)
+   qe.byId[id] = ex
+}
+
+func (qe *queuedExchanges) take(id string) *exchange {
+   qe.lock.Lock()
+   defer qe.lock.Unlock()
+   ex := qe.byId[id]
+   delete(qe.byId, id)
+   return ex
+}
+
+//
+// serialize a pending request for a durable queue, in QueueEncoding
+func (reqMgr *RequestManager) encodePending(sendReq *PendingRequest) ([]byte, error) {
+   req := sendReq.req
+   qr := &RequestRecord{
+      Id:         reqMgr.createReqId(),
+      Time:       reqMgr.Clock.Now(),
+      Region:     sendReq.target.region,
+      Method:     req.Method,
+      Url:        req.URL.RequestURI(),
+      Host:       req.Host,
+      RemoteAddr: req.RemoteAddr,
+      Header:     req.Header,
+      Trailer:    sendReq.trailer,
+      Body:       sendReq.body,
+      ReproId:    sendReq.reproId,
+      RequestKey: sendReq.requestKey,
+      SessionKey: sendReq.sessionKey,
+      KeyExpires: sendReq.keyExpires,
+      Attempts:   sendReq.attempts,
+      Experiment: sendReq.experiment,
+      Scenario:   sendReq.scenario,
+   }
+   if ex := sendReq.exchange; ex != nil {
+      qr.ProdStatus, qr.Route = ex.status(), ex.route
+      reqMgr.queued.put(qr.Id, ex)
+   }
+   return reqMgr.queueEncoder.Encode(qr)
+}
+
+//
+// rebuild a pending request from a durable queue
+// - nil when its staging destination was removed meanwhile
+func (reqMgr *RequestManager) decodePending(buf []byte) (*PendingRequest, error) {
+   qr, err := reqMgr.queueEncoder.Decode(buf)
+   if err != nil {
+      return nil, err
+   }
+   ex := reqMgr.queued.take(qr.Id)
+
+   var target *stagingTarget = nil
+   for _, t := range reqMgr.stagingTargets() {
+      if t.region == qr.Region {
+         target = t
+      }
+   }
+   if target == nil {
+      reqMgr.Metrics.Inc("forktraffic_mirror_dropped_total", "reason", "target_removed")
+      return nil, nil
+   }
+
+   req, err := http.NewRequest(qr.Method, qr.Url, nil)
+   if err != nil {
+      return nil, err
+   }
+   req.Header = qr.Header
+   if req.Header == nil {
+      req.Header = http.Header{}
+   }
+   req.Host, req.RemoteAddr = qr.Host, qr.RemoteAddr
+   req.RequestURI = qr.Url
+   return &PendingRequest{
+      req:        req,
+      target:     target,
+      body:       qr.Body,
+      trailer:    qr.Trailer,
+      reproId:    qr.ReproId,
+      exchange:   ex,
+      requestKey: qr.RequestKey,
+      sessionKey: qr.SessionKey,
+      keyExpires: qr.KeyExpires,
+      attempts:   qr.Attempts,
+      experiment: qr.Experiment,
+      scenario:   qr.Scenario,
+      queuedAt:   qr.Time,
+   }, nil
+}
@@ -0,0 +1,113 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strconv"
+   "sync"
+   "time"
+)
+
+// latest latencies the percentiles are computed of
+const latencyWindowSize int = 1000
+
+//
+// latest latencies of a kind, e.g. the time the staging copies spent queued
+type latencyWindow struct {
+   lock    sync.Mutex
+   samples []time.Duration
+   next    int
+}
+
+func (ql *latencyWindow) observe(d time.Duration) {
+   ql.lock.Lock()
+   defer ql.lock.Unlock()
+   if len(ql.samples) < latencyWindowSize {
+      ql.samples = append(ql.samples, d)
+      return
+   }
+   ql.samples[ql.next] = d
+   ql.next = (ql.next + 1) % latencyWindowSize
+}
+
+//
+// latency percentiles in ms over the latest latencyWindowSize samples
+type LatencyReport struct {
+   Samples int
+   P50Ms   float64
+   P95Ms   float64
+   P99Ms   float64
+   MaxMs   float64
+}
+
+func (ql *latencyWindow) report() LatencyReport {
+   ql.lock.Lock()
+   samples := append([]time.Duration(nil), ql.samples...)
+   ql.lock.Unlock()
+   return latencyReport(samples)
+}
+
+func latencyReport(samples []time.Duration) LatencyReport {
+   return LatencyReport{
+      Samples: len(samples),
+      P50Ms:   percentileMs(samples, 0.50),
+      P95Ms:   percentileMs(samples, 0.95),
+      P99Ms:   percentileMs(samples, 0.99),
+      MaxMs:   percentileMs(samples, 1),
+   }
+}
+
+//
+// account the time a staging copy spent queued, once per push
+func (reqMgr *RequestManager) observeQueued(sendReq *PendingRequest) {
+   if sendReq.queuedAt.IsZero() {
+      return
+   }
+   d := reqMgr.Clock.Now().Sub(sendReq.queuedAt)
+   sendReq.queuedAt = time.Time{}
+   reqMgr.queueLatency.observe(d)
+   reqMgr.Metrics.Add("forktraffic_queue_latency_ms_sum", d.Milliseconds())
+   reqMgr.Metrics.Inc("forktraffic_queue_latency_ms_count")
+}
+
+//
+// publish the queue latency percentiles as gauges; sampled with the byte rates
+func (reqMgr *RequestManager) sampleQueueLatency() {
+   reqMgr.publishLatency("forktraffic_queue_latency_ms", reqMgr.queueLatency.report())
+}
+
+// set a gauge of latency percentiles, by "quantile"
+func (reqMgr *RequestManager) publishLatency(name string, report LatencyReport) {
+   for _, q := range []struct {
+      label string
+      ms    float64
+   }{{"0.5", report.P50Ms}, {"0.95", report.P95Ms}, {"0.99", report.P99Ms}, {"1", report.MaxMs}} {
+      reqMgr.Metrics.Set(name, int64(q.ms), "quantile", q.label)
+   }
+}
+
+//
+// handle "/admin/queue"; queue depth, shards, target queues and queue latency
+func (reqMgr *RequestManager) adminQueue(w http.ResponseWriter, r *http.Request) {
+   depth, targets := make(map[string]int), make(map[string]int)
+   length, capacity := 0, 0
+   if reqMgr.Queue != nil {
+      length, capacity = reqMgr.Queue.Len(), reqMgr.Queue.Cap()
+   }
+   for i, shard := range reqMgr.shards {
+      depth[strconv.Itoa(i)] = shard.Len()
+      length, capacity = length+shard.Len(), capacity+shard.Cap()
+   }
+   for _, target := range reqMgr.stagingTargets() {
+      if tq := target.queue; tq != nil {
+         targets[tq.region] = tq.Len()
+         length, capacity = length+tq.Len(), capacity+tq.Cap()
+      }
+   }
+   writeJson(w, struct {
+      Len     int
+      Cap     int
+      Shards  map[string]int `json:",omitempty"`
+      Targets map[string]int `json:",omitempty"`
+      Latency LatencyReport
+   }{length, capacity, depth, targets, reqMgr.queueLatency.report()})
+}
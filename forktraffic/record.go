@@ -0,0 +1,100 @@
+package forktraffic
+
+import (
+   "log"
+   "net/http"
+   "os"
+   "sync"
+   "time"
+)
+
+// filter in place of an invalid expression
+type captureNothing struct{}
+
+func (captureNothing) match(req *http.Request, status int) bool { return false }
+
+// the recording file
+type recorder struct {
+   lock   sync.Mutex
+   file   *os.File
+   size   int64
+   opened time.Time
+}
+
+//
+// set up the capture filter shared by the recording and the reproduction bundles
+// - an invalid filter captures nothing rather than everything
+func (reqMgr *RequestManager) initCaptureFilter() {
+   filter, err := parseCaptureFilter(reqMgr.CaptureFilter)
+   if err != nil {
+      log.Printf("Warning - invalid capture filter: %v; nothing is captured", err)
+      filter = captureNothing{}
+   }
+   reqMgr.captureFilter = filter
+}
+
+// does the capture filter accept an exchange
+func (reqMgr *RequestManager) captureAccepts(req *http.Request, status int) bool {
+   if reqMgr.captureFilter == nil {
+      return true
+   }
+   return reqMgr.captureFilter.match(req, status)
+}
+
+//
+// append a production exchange accepted by the capture filter to RecordFile
+// - one RequestRecord in CaptureEncoding, framed for a stream
+// - query, headers and body are redacted like reproduction bundles
+func (reqMgr *RequestManager) recordExchange(req *http.Request, body []byte, ex *exchange) {
+   if reqMgr.RecordFile == "" || !reqMgr.captureAccepts(req, ex.status()) {
+      return
+   }
+   buf, err := reqMgr.captureEncoder.Encode(&RequestRecord{
+      Time:       reqMgr.Clock.Now(),
+      Method:     req.Method,
+      Url:        reqMgr.redactUrl(req.URL, false),
+      Header:     reqMgr.redactHeader(req.Header),
+      Body:       reqMgr.redactBody(body, req.Header.Get("Content-Encoding")),
+      ProdStatus: ex.status(),
+      Route:      ex.route,
+      Experiment: ex.experiment,
+      Scenario:   ex.scenarioId(),
+   })
+   if err == nil {
+      err = reqMgr.writeRecord(reqMgr.captureEncoder.Frame(nil, buf))
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: req.URL.Path, Err: err})
+      return
+   }
+   reqMgr.Metrics.Inc("forktraffic_recorded_requests_total")
+}
+
+// append a framed record to RecordFile, opening or rotating it as needed
+func (reqMgr *RequestManager) writeRecord(line []byte) error {
+   return reqMgr.appendFile(&reqMgr.recording, reqMgr.RecordFile, line)
+}
+
+// append to a recording, opening or rotating it as needed
+func (reqMgr *RequestManager) appendFile(rec *recorder, name string, line []byte) error {
+   rec.lock.Lock()
+   defer rec.lock.Unlock()
+   if reqMgr.rotationDue(rec, len(line)) {
+      if err := reqMgr.rotateFile(rec, name); err != nil {
+         return err
+      }
+   }
+   if rec.file == nil {
+      file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+      if err != nil {
+         return err
+      }
+      rec.file, rec.size, rec.opened = file, 0, reqMgr.Clock.Now()
+      if info, err := file.Stat(); err == nil {
+         rec.size = info.Size()
+      }
+   }
+   n, err := rec.file.Write(line)
+   rec.size += int64(n)
+   return err
+}
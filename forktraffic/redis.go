@@ -0,0 +1,150 @@
+package forktraffic
+
+import (
+   "bufio"
+   "errors"
+   "fmt"
+   "io"
+   "net"
+   "strconv"
+   "sync"
+   "time"
+)
+
+// Redis network timeout
+const redisTimeout time.Duration = 5 * time.Second
+
+//
+// minimal Redis client (RESP2) over a single connection
+// - commands are serialized; the connection is re-dialed after an error
+type RedisClient struct {
+   Addr     string
+   Password string
+
+   lock sync.Mutex
+   conn net.Conn
+   rd   *bufio.Reader
+}
+
+func NewRedisClient(addr, password string) *RedisClient {
+   return &RedisClient{Addr: addr, Password: password}
+}
+
+// connect and authenticate
+func (rc *RedisClient) dial() error {
+   conn, err := net.DialTimeout("tcp", rc.Addr, redisTimeout)
+   if err != nil {
+      return err
+   }
+   rc.conn = conn
+   rc.rd = bufio.NewReader(conn)
+   if rc.Password != "" {
+      if _, err := rc.roundTrip([]string{"AUTH", rc.Password}); err != nil {
+         rc.close()
+         return err
+      }
+   }
+   return nil
+}
+
+func (rc *RedisClient) close() {
+   if rc.conn != nil {
+      rc.conn.Close()
+      rc.conn = nil
+   }
+}
+
+//
+// run a command
+// - replies are string, int64, nil, or []interface{} of those
+func (rc *RedisClient) Do(args ...string) (interface{}, error) {
+   rc.lock.Lock()
+   defer rc.lock.Unlock()
+
+   if rc.conn == nil {
+      if err := rc.dial(); err != nil {
+         return nil, err
+      }
+   }
+   reply, err := rc.roundTrip(args)
+   if err != nil {
+      if _, isRedisErr := err.(redisError); !isRedisErr {
+         rc.close()
+      }
+   }
+   return reply, err
+}
+
+// error reply of the server
+type redisError string
+
+func (re redisError) Error() string { return "redis: " + string(re) }
+
+func (rc *RedisClient) roundTrip(args []string) (interface{}, error) {
+   rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+   buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+   for _, arg := range args {
+      buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+   }
+   if _, err := rc.conn.Write(buf); err != nil {
+      return nil, err
+   }
+   return rc.readReply()
+}
+
+func (rc *RedisClient) readLine() (string, error) {
+   line, err := rc.rd.ReadString('\n')
+   if err != nil {
+      return "", err
+   }
+   if len(line) < 3 || line[len(line)-2] != '\r' {
+      return "", errors.New("redis: malformed reply")
+   }
+   return line[:len(line)-2], nil
+}
+
+func (rc *RedisClient) readReply() (interface{}, error) {
+   line, err := rc.readLine()
+   if err != nil {
+      return nil, err
+   }
+   switch line[0] {
+   case '+':
+      return line[1:], nil
+   case '-':
+      return nil, redisError(line[1:])
+   case ':':
+      return strconv.ParseInt(line[1:], 10, 64)
+   case '$':
+      n, err := strconv.Atoi(line[1:])
+      if err != nil || n < 0 {
+         return nil, err
+      }
+      data := make([]byte, n+2)
+      if _, err := io.ReadFull(rc.rd, data); err != nil {
+         return nil, err
+      }
+      return string(data[:n]), nil
+   case '*':
+      n, err := strconv.Atoi(line[1:])
+      if err != nil || n < 0 {
+         return nil, err
+      }
+      items := make([]interface{}, n)
+      for i := range items {
+         if items[i], err = rc.readReply(); err != nil {
+            if _, isRedisErr := err.(redisError); !isRedisErr {
+               return nil, err
+            }
+         }
+      }
+      return items, nil
+   }
+   return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
+
+// string reply helper
+func redisString(reply interface{}) string {
+   s, _ := reply.(string)
+   return s
+}
@@ -0,0 +1,138 @@
+package forktraffic
+
+import (
+   "strings"
+   "sync/atomic"
+)
+
+// default stream of the Redis queue
+const DefaultQueueRedisKey string = "forktraffic:queue"
+
+// consumer group shared by the fork instances reading the stream
+const redisQueueGroup string = "forktraffic"
+
+// milliseconds a read waits for a new entry
+const redisQueueBlockMs string = "2000"
+
+//
+// Redis stream queue on RedisAddr
+// - the instances share the stream through one consumer group; an entry is
+//   acknowledged and deleted as soon as it is read (at most once delivery)
+// - pushes and reads use their own connections; a read blocks its connection
+type redisQueue struct {
+   reqMgr    *RequestManager
+   key       string
+   consumer  string
+   capacity  int
+   push, pop *RedisClient
+   closed    int32
+}
+
+func newRedisQueue(reqMgr *RequestManager, key string, capacity int) (*redisQueue, error) {
+   if reqMgr.RedisAddr == "" {
+      return nil, errNoQueueRedis
+   }
+   if key == "" {
+      key = DefaultQueueRedisKey
+   }
+   rq := &redisQueue{
+      reqMgr:   reqMgr,
+      key:      key,
+      consumer: reqMgr.InstanceId,
+      capacity: capacity,
+      push:     NewRedisClient(reqMgr.RedisAddr, reqMgr.RedisPassword),
+      pop:      NewRedisClient(reqMgr.RedisAddr, reqMgr.RedisPassword),
+   }
+   _, err := rq.push.Do("XGROUP", "CREATE", key, redisQueueGroup, "0", "MKSTREAM")
+   if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+      return nil, err
+   }
+   return rq, nil
+}
+
+func (rq *redisQueue) Push(sendReq *PendingRequest) error {
+   buf, err := rq.reqMgr.encodePending(sendReq)
+   if err != nil {
+      return err
+   }
+   _, err = rq.push.Do("XADD", rq.key, "*", "req", string(buf))
+   return err
+}
+
+// the id and the "req" field of the first entry of a stream reply
+func redisEntry(entries interface{}) (string, string) {
+   list, _ := entries.([]interface{})
+   if len(list) == 0 {
+      return "", ""
+   }
+   entry, _ := list[0].([]interface{})
+   if len(entry) < 2 {
+      return "", ""
+   }
+   fields, _ := entry[1].([]interface{})
+   for i := 0; i+1 < len(fields); i += 2 {
+      if redisString(fields[i]) == "req" {
+         return redisString(entry[0]), redisString(fields[i+1])
+      }
+   }
+   return redisString(entry[0]), ""
+}
+
+func (rq *redisQueue) Pop() (*PendingRequest, error) {
+   for {
+      reply, err := rq.pop.Do("XREADGROUP", "GROUP", redisQueueGroup, rq.consumer,
+         "COUNT", "1", "BLOCK", redisQueueBlockMs, "STREAMS", rq.key, ">")
+      if err != nil {
+         return nil, err
+      }
+      streams, _ := reply.([]interface{})
+      if len(streams) == 0 {
+         // a read timed out; a closed queue leaves and frees its read connection
+         if atomic.LoadInt32(&rq.closed) != 0 {
+            rq.pop.close()
+            return nil, nil
+         }
+         continue
+      }
+      stream, _ := streams[0].([]interface{})
+      if len(stream) < 2 {
+         continue
+      }
+      id, data := redisEntry(stream[1])
+      if id == "" {
+         continue
+      }
+      rq.pop.Do("XACK", rq.key, redisQueueGroup, id)
+      rq.pop.Do("XDEL", rq.key, id)
+      return rq.reqMgr.decodePending([]byte(data))
+   }
+}
+
+func (rq *redisQueue) DropOldest() *PendingRequest {
+   reply, err := rq.push.Do("XRANGE", rq.key, "-", "+", "COUNT", "1")
+   if err != nil {
+      return nil
+   }
+   id, data := redisEntry(reply)
+   if id == "" {
+      return nil
+   }
+   if n, _ := rq.push.Do("XDEL", rq.key, id); n != int64(1) {
+      return nil // read by a consumer meanwhile
+   }
+   sendReq, _ := rq.reqMgr.decodePending([]byte(data))
+   return sendReq
+}
+
+// the waiting Pop leaves at the end of its read (redisQueueBlockMs)
+func (rq *redisQueue) Close() {
+   atomic.StoreInt32(&rq.closed, 1)
+}
+
+func (rq *redisQueue) Len() int {
+   n, _ := rq.push.Do("XLEN", rq.key)
+   length, _ := n.(int64)
+   return int(length)
+}
+
+func (rq *redisQueue) Cap() int { return rq.capacity }
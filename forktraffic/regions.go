@@ -0,0 +1,158 @@
+package forktraffic
+
+import (
+   "context"
+   "log"
+   "net"
+   "net/http"
+   "net/url"
+   "time"
+)
+
+// region tag added to every staging copy of a named region
+const httpRegionHeader string = "X-Fork-Region"
+
+//
+// staging region configuration
+type StagingRegion struct {
+   Region string
+   Url    string
+   IpMode string `json:",omitempty"`
+}
+
+//
+// dial network of an address family: "ipv4", "ipv6", or "dual" (and "") for both
+// families with happy eyeballs fallback; "" for an unknown family
+func IpNetwork(ipMode string) string {
+   switch ipMode {
+   case "", "dual":
+      return "tcp"
+   case "ipv4":
+      return "tcp4"
+   case "ipv6":
+      return "tcp6"
+   }
+   return ""
+}
+
+//
+// a destination receiving a copy of every mirrored request
+// - the primary staging destination has no region name
+// - a "file" destination has a sink the copies are written to instead, a
+//   "webhook+" destination a hook their summaries are posted to and a "nats"
+//   destination the JetStream subject they are published to
+type stagingTarget struct {
+   region string
+   url    *url.URL
+   sink   *fileSink
+   hook   *webhookSink
+   jet    *jetStreamSink
+   queue  *targetQueue
+
+   // address family of the target and the client dialing it; nil for DestStaging
+   ipMode string
+   client *http.Client
+
+   // staging warm-up running; 1 while the copies to the target are not mirrored
+   warming int32
+}
+
+//
+// build the staging target list: the primary staging destination and the regions
+func (reqMgr *RequestManager) initTargets() {
+   var targets []*stagingTarget
+   if reqMgr.UrlStaging != nil && validStagingUrl(reqMgr.UrlStaging) {
+      targets = append(targets, newStagingTarget("", reqMgr.UrlStaging))
+   }
+
+   for _, region := range reqMgr.StagingRegions {
+      dest, err := url.Parse(region.Url)
+      if err != nil || !validStagingUrl(dest) || region.Region == "" || IpNetwork(region.IpMode) == "" {
+         log.Printf("Warning - invalid staging region %q: %q %q", region.Region, LoggableUrl(region.Url), region.IpMode)
+         continue
+      }
+      target := newStagingTarget(region.Region, dest)
+      reqMgr.setIpMode(target, region.IpMode)
+      targets = append(targets, target)
+   }
+   reqMgr.setTargets(targets)
+}
+
+//
+// the staging targets
+// - the list is replaced, never modified, so callers may keep iterating it
+func (reqMgr *RequestManager) stagingTargets() []*stagingTarget {
+   reqMgr.targetsLock.RLock()
+   defer reqMgr.targetsLock.RUnlock()
+   return reqMgr.targets
+}
+
+func (reqMgr *RequestManager) setTargets(targets []*stagingTarget) {
+   reqMgr.targetsLock.Lock()
+   reqMgr.targets = targets
+   reqMgr.targetsLock.Unlock()
+}
+
+// do we have any staging destination
+func (reqMgr *RequestManager) mirroring() bool {
+   return len(reqMgr.stagingTargets()) > 0
+}
+
+//
+// session cache key of a target
+// - every region keeps its own staging session per production session
+func (target *stagingTarget) cacheKey(prodSessionKey string) string {
+   if target.region == "" || prodSessionKey == "" {
+      return prodSessionKey
+   }
+   return target.region + "|" + prodSessionKey
+}
+
+// is the target sent the staging copies themselves (not a file, webhook or stream)
+func (target *stagingTarget) proxied() bool {
+   return target.sink == nil && target.hook == nil && target.jet == nil
+}
+
+//
+// dial network of a target: its own address family, else StagingIpMode
+func (reqMgr *RequestManager) targetNetwork(target *stagingTarget) string {
+   if network := IpNetwork(target.ipMode); target.ipMode != "" && network != "" {
+      return network
+   }
+   if network := IpNetwork(reqMgr.StagingIpMode); network != "" {
+      return network
+   }
+   return "tcp"
+}
+
+//
+// give a target its own address family; its copies are then sent by a client of
+// their own, a copy of DestStaging dialing that family
+func (reqMgr *RequestManager) setIpMode(target *stagingTarget, ipMode string) {
+   target.ipMode = ipMode
+   if ipMode == "" || !target.proxied() || reqMgr.DestStaging == nil {
+      return
+   }
+   client := *reqMgr.DestStaging
+   var tr *http.Transport
+   if base, ok := client.Transport.(*http.Transport); ok {
+      tr = base.Clone()
+   } else {
+      tr = http.DefaultTransport.(*http.Transport).Clone()
+   }
+   network := IpNetwork(ipMode)
+   dialer := &net.Dialer{Timeout: client.Timeout, KeepAlive: client.Timeout, FallbackDelay: 300 * time.Millisecond}
+   tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+      return dialer.DialContext(ctx, network, addr)
+   }
+   client.Transport = tr
+   target.client = &client
+}
+
+// metric label of a target
+func (target *stagingTarget) label() string {
+   if target.region == "" {
+      return "default"
+   }
+   return target.region
+}
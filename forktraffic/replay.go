@@ -0,0 +1,268 @@
+package forktraffic
+
+import (
+   "bytes"
+   "context"
+   "io/ioutil"
+   "net/http"
+   "sync"
+   "time"
+)
+
+// mismatched requests kept for replay
+const mismatchesLimit int = 100
+
+// time a replayed production request may take
+const replayProductionTimeout time.Duration = 60 * time.Second
+
+//
+// a request production and staging answered differently
+type mismatchRecord struct {
+   Id         string
+   Time       time.Time
+   Region     string
+   Method     string
+   Url        string
+   ProdStatus int
+   StagStatus int
+   BodyDiff   string
+   Experiment string
+   Scenario   string
+
+   // correlation id and differences found by DiffResponses
+   CorrelationId string
+   Diffs         []string
+
+   // the staging copy as it was sent, replayed on demand; it carries what staging
+   // was sent, with the staging session in place of the production cookies
+   replay     *http.Request
+   replayBody []byte
+
+   // the production response, redacted; compared with the replayed staging copy
+   prodCapture *ResponseCapture
+
+   // the production request without its credentials; only kept for a GET or HEAD
+   // with ReplayProduction
+   prodReplay *http.Request
+}
+
+type mismatchLog struct {
+   lock    sync.Mutex
+   records []*mismatchRecord
+}
+
+func (ml *mismatchLog) add(rec *mismatchRecord) {
+   ml.lock.Lock()
+   ml.records = append(ml.records, rec)
+   if len(ml.records) > mismatchesLimit {
+      ml.records = ml.records[len(ml.records)-mismatchesLimit:]
+   }
+   ml.lock.Unlock()
+}
+
+func (ml *mismatchLog) list() []mismatchRecord {
+   ml.lock.Lock()
+   defer ml.lock.Unlock()
+   recs := make([]mismatchRecord, len(ml.records))
+   for i, rec := range ml.records {
+      recs[i] = *rec
+   }
+   return recs
+}
+
+func (ml *mismatchLog) find(id string) *mismatchRecord {
+   ml.lock.Lock()
+   defer ml.lock.Unlock()
+   for _, rec := range ml.records {
+      if rec.Id == id {
+         return rec
+      }
+   }
+   return nil
+}
+
+//
+// keep a mismatched request for replay
+// - stagReq is the staging copy as sent
+func (reqMgr *RequestManager) recordMismatch(sendReq *PendingRequest, stagReq *http.Request, obs canaryObservation) *mismatchRecord {
+   req := sendReq.req
+   rec := &mismatchRecord{
+      Id:         reqMgr.createReqId(),
+      Time:       reqMgr.Clock.Now(),
+      Region:     sendReq.target.label(),
+      Method:     req.Method,
+      Url:        reqMgr.redactUrl(req.URL, false),
+      ProdStatus: obs.prodStatus,
+      StagStatus: obs.stagStatus,
+      BodyDiff:   obs.bodyDiff,
+      Experiment: sendReq.experiment,
+      Scenario:   sendReq.scenario,
+      Diffs:      obs.diffs,
+      replay:     stagReq.Clone(context.Background()),
+   }
+   if stagReq.GetBody != nil {
+      if body, err := stagReq.GetBody(); err == nil {
+         rec.replayBody, _ = ioutil.ReadAll(body)
+      }
+   }
+   rec.prodCapture = &ResponseCapture{Status: obs.prodStatus}
+   if ex := sendReq.exchange; ex != nil && ex.prodCapture == nil && ex.prodHeader != nil {
+      rec.prodCapture.Header = reqMgr.redactHeader(ex.prodHeader)
+   } else if ex != nil && ex.prodCapture != nil {
+      rec.prodCapture = &ResponseCapture{
+         Status:    ex.prodCapture.Status,
+         Header:    reqMgr.redactHeader(ex.prodCapture.Header),
+         Body:      reqMgr.redactBody(ex.prodCapture.Body, ex.prodCapture.Header.Get("Content-Encoding")),
+         Truncated: ex.prodCapture.Truncated,
+      }
+   }
+   if reqMgr.ReplayProduction && (req.Method == "GET" || req.Method == "HEAD") {
+      rec.prodReplay = reqMgr.anonymousRequest(req)
+   }
+   if ex := sendReq.exchange; ex != nil {
+      rec.CorrelationId = ex.correlationId
+   }
+   reqMgr.mismatches.add(rec)
+   reqMgr.Metrics.Inc("forktraffic_mismatches_total", "region", sendReq.target.label())
+   reqMgr.countExperiment(sendReq, "forktraffic_experiment_mismatches_total")
+   if ex := sendReq.exchange; ex != nil && ex.operation != "" {
+      reqMgr.Metrics.Inc("forktraffic_operation_mismatches_total", "operation", ex.operation)
+   }
+   return rec
+}
+
+//
+// outcome of replaying a mismatched request to both environments
+type replayResult struct {
+   Id          string
+   Production  *ResponseCapture
+   Staging     *ResponseCapture
+   ProdMs      float64
+   StagMs      float64
+   ProdError   string
+   StagError   string
+   Reproduces  bool
+   Differences []string
+}
+
+//
+// send a request and capture the whole response, up to the capture limit
+func (reqMgr *RequestManager) replaySend(client *http.Client, req *http.Request) (*ResponseCapture, time.Duration, error) {
+   start := reqMgr.Clock.Now()
+   resp, err := client.Do(req)
+   if err != nil {
+      return nil, reqMgr.Clock.Now().Sub(start), err
+   }
+   defer resp.Body.Close()
+   body, err := ioutil.ReadAll(resp.Body)
+   elapsed := reqMgr.Clock.Now().Sub(start)
+   capture := &ResponseCapture{Status: resp.StatusCode, Header: resp.Header.Clone()}
+   if limit := reqMgr.captureLimit(); len(body) > limit {
+      body = body[:limit]
+      capture.Truncated = true
+   }
+   capture.Body = body
+   return capture, elapsed, err
+}
+
+//
+// a production request without the headers RedactHeaders names
+func (reqMgr *RequestManager) anonymousRequest(req *http.Request) *http.Request {
+   anon := req.Clone(context.Background())
+   anon.RequestURI = ""
+   anon.Body = nil
+   anon.ContentLength = 0
+   for key, vals := range reqMgr.redactHeader(req.Header) {
+      if len(vals) > 0 && vals[0] == redactedValue {
+         anon.Header.Del(key)
+      }
+   }
+   return anon
+}
+
+//
+// re-send a stored mismatched request to staging
+// - the staging copy is sent again as it was mirrored and compared with the
+//   production response of the time
+// - with ReplayProduction a GET or HEAD is also sent to production, without its
+//   credentials, and compared with that response instead
+// - the copies carry the X-Fork-Debug header; the responses are captured in full
+func (reqMgr *RequestManager) replayMismatch(rec *mismatchRecord) *replayResult {
+   result := &replayResult{Id: rec.Id, Production: rec.prodCapture}
+
+   // production, through the proxy director
+   if rec.prodReplay != nil {
+      prodReq := rec.prodReplay.Clone(context.Background())
+      prodReq.Header.Set(httpDebugHeader, "replay")
+      reqMgr.DestProduction.Director(prodReq)
+      prodReq.Host = reqMgr.UrlProduction.Host
+      prodClient := &http.Client{Transport: reqMgr.DestProduction.Transport, Timeout: replayProductionTimeout}
+      prodCapture, prodTime, err := reqMgr.replaySend(prodClient, prodReq)
+      result.Production, result.ProdMs = prodCapture, float64(prodTime)/float64(time.Millisecond)
+      if err != nil {
+         result.ProdError = err.Error()
+      }
+   }
+
+   // staging, the copy as it was mirrored
+   stagReq := rec.replay.Clone(context.Background())
+   stagReq.Header.Set(httpDebugHeader, "replay")
+   if rec.replayBody != nil {
+      stagReq.Body = ioutil.NopCloser(bytes.NewReader(rec.replayBody))
+      stagReq.ContentLength = int64(len(rec.replayBody))
+   }
+   stagCapture, stagTime, err := reqMgr.replaySend(reqMgr.DestStaging, stagReq)
+   result.Staging, result.StagMs = stagCapture, float64(stagTime)/float64(time.Millisecond)
+   if err != nil {
+      result.StagError = err.Error()
+   }
+
+   // the stored production response is redacted; so is what it is compared with
+   if rec.prodReplay == nil && stagCapture != nil {
+      stagCapture.Header = reqMgr.redactHeader(stagCapture.Header)
+      stagCapture.Body = reqMgr.redactBody(stagCapture.Body, stagCapture.Header.Get("Content-Encoding"))
+   }
+
+   result.Differences = reqMgr.compareReplay(rec.replay, result)
+   result.Reproduces = len(result.Differences) > 0
+   if result.Reproduces {
+      reqMgr.Metrics.Inc("forktraffic_replays_total", "reproduces", "yes")
+   } else {
+      reqMgr.Metrics.Inc("forktraffic_replays_total", "reproduces", "no")
+   }
+   return result
+}
+
+//
+// differences between the replayed responses, as the live comparison finds them
+func (reqMgr *RequestManager) compareReplay(req *http.Request, result *replayResult) []string {
+   prod, stag := result.Production, result.Staging
+   if prod == nil || stag == nil {
+      if (prod == nil) != (stag == nil) {
+         return []string{"one environment did not answer"}
+      }
+      return nil
+   }
+   return reqMgr.diffResponses(req, prod, stag)
+}
+
+//
+// handle "/admin/mismatches"; the stored mismatched requests
+func (reqMgr *RequestManager) adminMismatches(w http.ResponseWriter, r *http.Request) {
+   writeJson(w, reqMgr.mismatches.list())
+}
+
+//
+// handle "/admin/replay"; POST ?id=mismatch replays a stored request (see replayMismatch)
+func (reqMgr *RequestManager) adminReplay(w http.ResponseWriter, r *http.Request) {
+   if r.Method != "POST" {
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+      return
+   }
+   rec := reqMgr.mismatches.find(r.URL.Query().Get("id"))
+   if rec == nil {
+      ResponseHttpError(w, http.StatusNotFound, "")
+      return
+   }
+   writeJson(w, reqMgr.replayMismatch(rec))
+}
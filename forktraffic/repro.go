@@ -0,0 +1,308 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "io/ioutil"
+   "mime"
+   "net/http"
+   "os"
+   "net/url"
+   "path/filepath"
+   "strings"
+   "time"
+)
+
+// debug headers of a replayed reproduction
+const httpDebugHeader string = "X-Fork-Debug"
+const httpReproIdHeader string = "X-Fork-Repro-Id"
+
+// headers redacted when no RedactHeaders are configured
+var defaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Csrf-Token"}
+
+// query parameters redacted when no RedactQueryParams are configured
+var defaultRedactQueryParams = []string{"access_token", "api_key", "apikey", "code", "id_token", "key",
+   "password", "refresh_token", "secret", "session", "sig", "signature", "token"}
+
+const redactedValue string = "[redacted]"
+
+//
+// reproduction bundle of a request production failed on
+type reproBundle struct {
+   Id         string
+   Time       time.Time
+   ProdStatus int
+   Method     string
+   Url        string
+   Proto      string
+   Header     http.Header
+   Body       []byte
+}
+
+//
+// redact the configured headers
+func (reqMgr *RequestManager) redactHeader(header http.Header) http.Header {
+   names := reqMgr.RedactHeaders
+   if len(names) == 0 {
+      names = defaultRedactHeaders
+   }
+   redacted := make(http.Header, len(header))
+   for key, vals := range header {
+      redacted[key] = append([]string(nil), vals...)
+   }
+   for _, name := range names {
+      if vals, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+         for i := range vals {
+            vals[i] = redactedValue
+         }
+      }
+   }
+   return redacted
+}
+
+//
+// redact the values of the configured query parameters and of the RedactBodyFields
+// - the other parameters are kept as they were sent, in order and escaping
+func (reqMgr *RequestManager) redactQuery(raw string) string {
+   if raw == "" {
+      return raw
+   }
+   names := reqMgr.RedactQueryParams
+   if len(names) == 0 {
+      names = defaultRedactQueryParams
+   }
+   names = append(append([]string(nil), names...), reqMgr.RedactBodyFields...)
+   pairs := strings.Split(raw, "&")
+   for i, pair := range pairs {
+      eq := strings.IndexByte(pair, '=')
+      if eq < 0 {
+         continue
+      }
+      name, err := url.QueryUnescape(pair[:eq])
+      if err != nil {
+         name = pair[:eq]
+      }
+      for _, redact := range names {
+         if strings.EqualFold(name, redact) {
+            pairs[i] = pair[:eq+1] + redactedValue
+            break
+         }
+      }
+   }
+   return strings.Join(pairs, "&")
+}
+
+//
+// the URL of a request with its query redacted, for captures
+// - requestUri selects the request URI over the full URL
+func (reqMgr *RequestManager) redactUrl(u *url.URL, requestUri bool) string {
+   redacted := *u
+   redacted.RawQuery = reqMgr.redactQuery(u.RawQuery)
+   if requestUri {
+      return redacted.RequestURI()
+   }
+   return redacted.String()
+}
+
+//
+// a URL for the logs: the secrets of its userinfo are masked
+// - user:password keeps the user (url.URL.Redacted); a lone user, like a NATS
+//   token, is masked whole
+func userinfoRedacted(u *url.URL) string {
+   if u.User == nil {
+      return u.String()
+   }
+   if _, ok := u.User.Password(); ok {
+      return u.Redacted()
+   }
+   redacted := *u
+   redacted.User = url.User("xxxxx")
+   return redacted.String()
+}
+
+//
+// a configured URL for the logs, with its userinfo masked
+// - a URL that does not parse is not logged
+func LoggableUrl(raw string) string {
+   u, err := url.Parse(raw)
+   if err != nil {
+      return "[invalid url]"
+   }
+   return userinfoRedacted(u)
+}
+
+// the reason a URL did not parse, without the URL
+func urlParseError(err error) error {
+   if uerr, ok := err.(*url.Error); ok {
+      return uerr.Err
+   }
+   return err
+}
+
+//
+// redact the configured fields of a JSON body; other bodies are kept as is
+// - compressed bodies are redacted inside their Content-Encoding; a body that cannot
+//   be decoded is dropped (nil) and counted in forktraffic_undecodable_bodies_total
+func (reqMgr *RequestManager) redactBody(body []byte, encoding string) []byte {
+   if len(reqMgr.RedactBodyFields) == 0 || len(body) == 0 {
+      return body
+   }
+   redacted, ok := transformBody(body, encoding, func(plain []byte) []byte {
+      return redactJsonFields(plain, reqMgr.RedactBodyFields)
+   })
+   if !ok {
+      reqMgr.Metrics.Inc("forktraffic_undecodable_bodies_total", "use", "capture")
+      return nil
+   }
+   return redacted
+}
+
+//
+// redact the named fields of a JSON document; other documents are kept as is
+func redactJsonFields(body []byte, fields []string) []byte {
+   var doc interface{}
+   if json.Unmarshal(body, &doc) != nil {
+      return body
+   }
+   doc = redactJson(doc, fields)
+   redacted, err := json.Marshal(doc)
+   if err != nil {
+      return body
+   }
+   return redacted
+}
+
+//
+// rewrite the values of the matching fields of a JSON body, at any depth
+// - a value is an id or a list of ids; numeric ids stay numbers when the new
+//   value is a number
+// - non JSON bodies and documents without a rewritten value are kept as is
+func rewriteJsonFields(req *http.Request, plain []byte, field func(name string) bool, rewrite func(id string) (string, bool)) []byte {
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+      return plain
+   }
+   dec := json.NewDecoder(bytes.NewReader(plain))
+   dec.UseNumber()
+   var doc interface{}
+   if dec.Decode(&doc) != nil {
+      return plain
+   }
+
+   changed := false
+   var value func(val interface{}) interface{}
+   var walk func(doc interface{}) interface{}
+   value = func(val interface{}) interface{} {
+      switch id := val.(type) {
+      case string:
+         if rewritten, ok := rewrite(id); ok {
+            changed = true
+            return rewritten
+         }
+      case json.Number:
+         if rewritten, ok := rewrite(id.String()); ok {
+            changed = true
+            if _, err := json.Number(rewritten).Float64(); err == nil {
+               return json.Number(rewritten)
+            }
+            return rewritten
+         }
+      case []interface{}:
+         for i := range id {
+            id[i] = value(id[i])
+         }
+      default:
+         return walk(val)
+      }
+      return val
+   }
+   walk = func(doc interface{}) interface{} {
+      switch v := doc.(type) {
+      case map[string]interface{}:
+         for key, val := range v {
+            if field(key) {
+               v[key] = value(val)
+            } else {
+               v[key] = walk(val)
+            }
+         }
+      case []interface{}:
+         for i := range v {
+            v[i] = walk(v[i])
+         }
+      }
+      return doc
+   }
+   doc = walk(doc)
+
+   if !changed {
+      return plain
+   }
+   rewritten, err := json.Marshal(doc)
+   if err != nil {
+      return plain
+   }
+   return rewritten
+}
+
+// replace the values of the named fields at any depth
+func redactJson(doc interface{}, fields []string) interface{} {
+   switch v := doc.(type) {
+   case map[string]interface{}:
+      for key, val := range v {
+         redact := false
+         for _, field := range fields {
+            if strings.EqualFold(key, field) {
+               redact = true
+               break
+            }
+         }
+         if redact {
+            v[key] = redactedValue
+         } else {
+            v[key] = redactJson(val, fields)
+         }
+      }
+   case []interface{}:
+      for i := range v {
+         v[i] = redactJson(v[i], fields)
+      }
+   }
+   return doc
+}
+
+//
+// write a reproduction bundle of a failed production request
+// - returns the bundle id; "" if nothing was written
+func (reqMgr *RequestManager) captureRepro(req *http.Request, body []byte, status int) string {
+   bundle := reproBundle{
+      Id:         reqMgr.createReqId(),
+      Time:       reqMgr.Clock.Now(),
+      ProdStatus: status,
+      Method:     req.Method,
+      Url:        reqMgr.redactUrl(req.URL, false),
+      Proto:      req.Proto,
+      Header:     reqMgr.redactHeader(req.Header),
+      Body:       reqMgr.redactBody(body, req.Header.Get("Content-Encoding")),
+   }
+
+   buf, err := json.MarshalIndent(bundle, "", "  ")
+   name := filepath.Join(reqMgr.ReproDir, bundle.Id+".json")
+   if err == nil && reqMgr.CompressArtifacts {
+      buf, err = encodeBody(buf, "gzip")
+      name += ".gz"
+   }
+   if err == nil {
+      err = os.MkdirAll(reqMgr.ReproDir, 0755)
+   }
+   if err == nil {
+      err = ioutil.WriteFile(name, buf, 0600)
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: req.URL.Path, Err: err})
+      return ""
+   }
+
+   reqMgr.Metrics.Inc("forktraffic_repro_bundles_total")
+   return bundle.Id
+}
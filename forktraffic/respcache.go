@@ -0,0 +1,305 @@
+package forktraffic
+
+import (
+   "bytes"
+   "container/list"
+   "io"
+   "io/ioutil"
+   "net/http"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// default size limit of a cached response body
+const DefaultResponseCacheEntryBytes int64 = 1 << 20
+
+// statuses a production response can be cached with
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// production response kept by the cache
+type cachedResponse struct {
+   url     string
+   key     string
+   status  int
+   header  http.Header
+   body    []byte
+   stored  time.Time
+   expires time.Time
+   shared  bool
+   elem    *list.Element
+}
+
+func (cr *cachedResponse) size() int64 {
+   return int64(len(cr.key) + len(cr.body))
+}
+
+// header names the cached responses of a URL vary by, and their count
+type cacheVariants struct {
+   names []string
+   count int
+}
+
+//
+// in-memory cache of the production GET responses, a transport in front of the production one
+// - only responses with an explicit freshness (s-maxage, max-age or Expires) are kept,
+//   never private, no-store, no-cache or Set-Cookie ones
+// - requests with an Authorization header or asking for no-cache bypass the cache
+// - requests with a Cookie are only answered with, and only add, public or
+//   s-maxage responses; the others may be personalized by the session
+// - the least recently used responses go when the cache exceeds its limit
+type responseCache struct {
+   next   http.RoundTripper
+   reqMgr *RequestManager
+
+   lock    sync.Mutex
+   entries map[string]*cachedResponse
+   vary    map[string]*cacheVariants
+   lru     *list.List
+   size    int64
+}
+
+//
+// put the response cache in front of the production transport when ResponseCacheBytes is set
+func (reqMgr *RequestManager) initResponseCache() {
+   if reqMgr.ResponseCacheBytes <= 0 {
+      return
+   }
+   next := reqMgr.DestProduction.Transport
+   if next == nil {
+      next = http.DefaultTransport
+   }
+   reqMgr.DestProduction.Transport = &responseCache{
+      next:    next,
+      reqMgr:  reqMgr,
+      entries: make(map[string]*cachedResponse),
+      vary:    make(map[string]*cacheVariants),
+      lru:     list.New(),
+   }
+}
+
+// parse a Cache-Control header; directive names are lower cased
+func cacheControl(header http.Header) map[string]string {
+   directives := make(map[string]string)
+   for _, line := range header.Values("Cache-Control") {
+      for _, part := range strings.Split(line, ",") {
+         name, val := strings.TrimSpace(part), ""
+         if i := strings.Index(name, "="); i >= 0 {
+            name, val = name[:i], strings.Trim(name[i+1:], `"`)
+         }
+         if name != "" {
+            directives[strings.ToLower(name)] = val
+         }
+      }
+   }
+   return directives
+}
+
+//
+// how long a production response stays fresh; 0 when it is not cacheable
+func freshness(resp *http.Response, now time.Time) time.Duration {
+   if !cacheableStatus[resp.StatusCode] || len(resp.Header.Values("Set-Cookie")) > 0 || resp.Header.Get("Vary") == "*" {
+      return 0
+   }
+   cc := cacheControl(resp.Header)
+   for _, directive := range []string{"no-store", "no-cache", "private"} {
+      if _, ok := cc[directive]; ok {
+         return 0
+      }
+   }
+   var ttl time.Duration
+   if val, ok := cc["s-maxage"]; ok {
+      secs, _ := strconv.Atoi(val)
+      ttl = time.Duration(secs) * time.Second
+   } else if val, ok := cc["max-age"]; ok {
+      secs, _ := strconv.Atoi(val)
+      ttl = time.Duration(secs) * time.Second
+   } else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+      date, err := http.ParseTime(resp.Header.Get("Date"))
+      if err != nil {
+         date = now
+      }
+      ttl = expires.Sub(date)
+   }
+   if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+      ttl -= time.Duration(age) * time.Second
+   }
+   return ttl
+}
+
+// may a response be shared by sessions: public or s-maxage
+func sharedResponse(resp *http.Response) bool {
+   cc := cacheControl(resp.Header)
+   _, public := cc["public"]
+   _, sMaxage := cc["s-maxage"]
+   return public || sMaxage
+}
+
+// names of the Vary header of a response, canonical and sorted
+func varyNames(header http.Header) []string {
+   var names []string
+   for _, line := range header.Values("Vary") {
+      for _, name := range strings.Split(line, ",") {
+         if name = strings.TrimSpace(name); name != "" {
+            names = append(names, http.CanonicalHeaderKey(name))
+         }
+      }
+   }
+   sort.Strings(names)
+   return names
+}
+
+// cache key of a request given the header names its URL varies by
+func cacheKey(url string, names []string, header http.Header) string {
+   key := url
+   for _, name := range names {
+      key += "\n" + name + ": " + strings.Join(header.Values(name), ",")
+   }
+   return key
+}
+
+func (rc *responseCache) RoundTrip(req *http.Request) (*http.Response, error) {
+   metrics := rc.reqMgr.Metrics
+   if req.Method != "GET" {
+      return rc.next.RoundTrip(req)
+   }
+   cc := cacheControl(req.Header)
+   _, noCache := cc["no-cache"]
+   _, noStore := cc["no-store"]
+   if noCache || noStore || req.Header.Get("Authorization") != "" || req.Header.Get("Pragma") == "no-cache" {
+      metrics.Inc("forktraffic_response_cache_requests_total", "result", "bypass")
+      return rc.next.RoundTrip(req)
+   }
+
+   url := req.URL.String()
+   now := rc.reqMgr.Clock.Now()
+   session := req.Header.Get("Cookie") != ""
+   if resp := rc.lookup(req, url, now, session); resp != nil {
+      metrics.Inc("forktraffic_response_cache_requests_total", "result", "hit")
+      return resp, nil
+   }
+   metrics.Inc("forktraffic_response_cache_requests_total", "result", "miss")
+
+   resp, err := rc.next.RoundTrip(req)
+   if err != nil {
+      return resp, err
+   }
+   ttl := freshness(resp, now)
+   shared := sharedResponse(resp)
+   if ttl <= 0 || (session && !shared) {
+      return resp, nil
+   }
+
+   // keep a body up to its limit; a larger or broken one goes to the client unkept
+   limit := rc.reqMgr.ResponseCacheEntryBytes
+   if limit <= 0 {
+      limit = DefaultResponseCacheEntryBytes
+   }
+   buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+   if err != nil || int64(len(buf)) > limit {
+      resp.Body = struct {
+         io.Reader
+         io.Closer
+      }{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+      return resp, nil
+   }
+   resp.Body.Close()
+   resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+
+   names := varyNames(resp.Header)
+   rc.store(&cachedResponse{
+      url:     url,
+      key:     cacheKey(url, names, req.Header),
+      status:  resp.StatusCode,
+      header:  resp.Header.Clone(),
+      body:    buf,
+      stored:  now,
+      expires: now.Add(ttl),
+      shared:  shared,
+   }, names)
+   return resp, nil
+}
+
+//
+// fresh cached response of a request; nil if there is none
+// - a request with a session only gets a shared response
+func (rc *responseCache) lookup(req *http.Request, url string, now time.Time, session bool) *http.Response {
+   rc.lock.Lock()
+   defer rc.lock.Unlock()
+   variants, ok := rc.vary[url]
+   if !ok {
+      return nil
+   }
+   entry, ok := rc.entries[cacheKey(url, variants.names, req.Header)]
+   if !ok {
+      return nil
+   }
+   if !now.Before(entry.expires) {
+      rc.remove(entry)
+      return nil
+   }
+   if session && !entry.shared {
+      return nil
+   }
+   rc.lru.MoveToFront(entry.elem)
+
+   header := entry.header.Clone()
+   header.Set("Age", strconv.Itoa(int(now.Sub(entry.stored)/time.Second)))
+   return &http.Response{
+      Status:        strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+      StatusCode:    entry.status,
+      Proto:         "HTTP/1.1",
+      ProtoMajor:    1,
+      ProtoMinor:    1,
+      Header:        header,
+      Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+      ContentLength: int64(len(entry.body)),
+      Request:       req,
+   }
+}
+
+//
+// keep a response, evicting the least recently used ones over ResponseCacheBytes
+// - the latest Vary of a URL replaces the previous one
+func (rc *responseCache) store(entry *cachedResponse, names []string) {
+   rc.lock.Lock()
+   defer rc.lock.Unlock()
+   if prev, ok := rc.entries[entry.key]; ok {
+      rc.remove(prev)
+   }
+   variants, ok := rc.vary[entry.url]
+   if !ok {
+      variants = new(cacheVariants)
+      rc.vary[entry.url] = variants
+   }
+   variants.names = names
+   variants.count++
+   entry.elem = rc.lru.PushFront(entry)
+   rc.entries[entry.key] = entry
+   rc.size += entry.size()
+   for rc.size > rc.reqMgr.ResponseCacheBytes && rc.lru.Len() > 0 {
+      rc.remove(rc.lru.Back().Value.(*cachedResponse))
+      rc.reqMgr.Metrics.Inc("forktraffic_response_cache_evictions_total")
+   }
+   rc.gauges()
+}
+
+// drop a cached response; the cache lock is held
+func (rc *responseCache) remove(entry *cachedResponse) {
+   rc.lru.Remove(entry.elem)
+   delete(rc.entries, entry.key)
+   if variants := rc.vary[entry.url]; variants != nil {
+      if variants.count--; variants.count <= 0 {
+         delete(rc.vary, entry.url)
+      }
+   }
+   rc.size -= entry.size()
+   rc.gauges()
+}
+
+func (rc *responseCache) gauges() {
+   rc.reqMgr.Metrics.Set("forktraffic_response_cache_bytes", rc.size)
+   rc.reqMgr.Metrics.Set("forktraffic_response_cache_entries", int64(rc.lru.Len()))
+}
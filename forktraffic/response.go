@@ -0,0 +1,117 @@
+package forktraffic
+
+import (
+   "net/http"
+)
+
+// built in response middlewares
+const MiddlewareCapture string = "capture"    // production side of the staging comparisons
+const MiddlewareSchema string = "schema"      // production responses kept for their OpenAPI validation
+const MiddlewareSecurity string = "security"  // security headers
+const MiddlewareCookies string = "cookies"    // Set-Cookie attributes for the fork's public host
+const MiddlewareLocation string = "location"  // redirects to production sent back to the fork
+const MiddlewareBodyUrls string = "body_urls" // absolute production URLs of the bodies
+const MiddlewareHeaders string = "headers"    // ResponseHeaders and the route's ResponseHeaders
+
+//
+// response middleware; changes a production response before it is sent to the client
+// - an error answers the client 502 instead
+type ResponseMiddleware func(resp *http.Response) error
+
+type namedMiddleware struct {
+   name string
+   fn   ResponseMiddleware
+}
+
+//
+// register a response middleware; middlewares run in registration order, unless the
+// route of the request lists its own (RouteConfig.ResponseMiddlewares)
+// - registering a name again replaces its middleware in place
+func (reqMgr *RequestManager) AddResponseMiddleware(name string, fn ResponseMiddleware) {
+   for i := range reqMgr.responseMiddlewares {
+      if reqMgr.responseMiddlewares[i].name == name {
+         reqMgr.responseMiddlewares[i].fn = fn
+         return
+      }
+   }
+   reqMgr.responseMiddlewares = append(reqMgr.responseMiddlewares, namedMiddleware{name, fn})
+}
+
+//
+// register the built in response middlewares
+// - the capture and schema middlewares come first to see the response as production sent it,
+//   the configured headers last to have the final word
+func (reqMgr *RequestManager) initResponseMiddlewares() {
+   reqMgr.AddResponseMiddleware(MiddlewareCapture, reqMgr.captureExchange)
+   reqMgr.AddResponseMiddleware(MiddlewareSchema, reqMgr.watchProductionSchema)
+   reqMgr.AddResponseMiddleware(MiddlewareSecurity, reqMgr.injectSecurityHeaders)
+   reqMgr.AddResponseMiddleware(MiddlewareCookies, reqMgr.rewriteCookies)
+   reqMgr.AddResponseMiddleware(MiddlewareLocation, reqMgr.rewriteLocation)
+   reqMgr.AddResponseMiddleware(MiddlewareBodyUrls, reqMgr.rewriteBodyUrls)
+   reqMgr.AddResponseMiddleware(MiddlewareHeaders, reqMgr.injectHeaders)
+}
+
+func (reqMgr *RequestManager) responseMiddleware(name string) ResponseMiddleware {
+   for _, mw := range reqMgr.responseMiddlewares {
+      if mw.name == name {
+         return mw.fn
+      }
+   }
+   return nil
+}
+
+//
+// run the response middlewares of a response's route; the first error stops them
+// - route middlewares that are not registered are skipped
+func (reqMgr *RequestManager) runResponseMiddlewares(resp *http.Response) error {
+   var route *RouteConfig = nil
+   if resp.Request != nil {
+      route = reqMgr.routeOf(resp.Request)
+   }
+   if route != nil && route.ResponseMiddlewares != nil {
+      for _, name := range route.ResponseMiddlewares {
+         if fn := reqMgr.responseMiddleware(name); fn != nil {
+            if err := fn(resp); err != nil {
+               return err
+            }
+         }
+      }
+      return nil
+   }
+   for _, mw := range reqMgr.responseMiddlewares {
+      if err := mw.fn(resp); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+//
+// keep the production side of the staging comparisons: body capture and digest, diff headers
+func (reqMgr *RequestManager) captureExchange(resp *http.Response) error {
+   if ex := exchangeOf(resp.Request); ex != nil {
+      reqMgr.captureProduction(resp, ex)
+      reqMgr.digestProduction(resp, ex)
+      reqMgr.keepDiffHeaders(resp, ex)
+   }
+   return nil
+}
+
+//
+// set the ResponseHeaders, then the ResponseHeaders of the route; an empty value removes a header
+func (reqMgr *RequestManager) injectHeaders(resp *http.Response) error {
+   headers := []map[string]string{reqMgr.ResponseHeaders}
+   if route := reqMgr.routeOf(resp.Request); route != nil {
+      headers = append(headers, route.ResponseHeaders)
+   }
+   for _, set := range headers {
+      for name, val := range set {
+         if val == "" {
+            resp.Header.Del(name)
+         } else {
+            resp.Header.Set(name, val)
+         }
+      }
+   }
+   return nil
+}
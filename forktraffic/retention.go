@@ -0,0 +1,177 @@
+package forktraffic
+
+import (
+   "compress/gzip"
+   "io"
+   "os"
+   "path/filepath"
+   "sort"
+   "time"
+)
+
+// how often rotation by age and pruning are checked
+const janitorInterval time.Duration = 30 * time.Second
+
+//
+// is an open recording due for rotation
+func (reqMgr *RequestManager) rotationDue(rec *recorder, add int) bool {
+   if rec.file == nil || rec.size == 0 {
+      return false
+   }
+   if reqMgr.RecordRotateBytes > 0 && rec.size+int64(add) > reqMgr.RecordRotateBytes {
+      return true
+   }
+   return reqMgr.RecordRotateSec > 0 && reqMgr.Clock.Now().Sub(rec.opened) >= time.Duration(reqMgr.RecordRotateSec)*time.Second
+}
+
+//
+// close a recording and move it aside as name.<time>; the caller holds the lock
+// - with CompressArtifacts the moved file is gzipped in the background
+func (reqMgr *RequestManager) rotateFile(rec *recorder, name string) error {
+   err := rec.file.Close()
+   rec.file = nil
+   if err != nil {
+      return err
+   }
+   rotated := name + "." + reqMgr.Clock.Now().UTC().Format("20060102T150405.000Z")
+   if err := os.Rename(name, rotated); err != nil {
+      return err
+   }
+   reqMgr.Metrics.Inc("forktraffic_artifacts_rotated_total")
+   if reqMgr.CompressArtifacts {
+      go func() {
+         if err := gzipFile(rotated); err != nil {
+            reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: rotated, Err: err})
+         }
+      }()
+   }
+   return nil
+}
+
+//
+// compress a file to name.gz and remove it
+func gzipFile(name string) error {
+   in, err := os.Open(name)
+   if err != nil {
+      return err
+   }
+   defer in.Close()
+   out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+   if err != nil {
+      return err
+   }
+   wr := gzip.NewWriter(out)
+   _, err = io.Copy(wr, in)
+   if err == nil {
+      err = wr.Close()
+   }
+   if closeErr := out.Close(); err == nil {
+      err = closeErr
+   }
+   if err != nil {
+      os.Remove(name + ".gz")
+      return err
+   }
+   return os.Remove(name)
+}
+
+// an artifact on disk
+type artifact struct {
+   name    string
+   size    int64
+   modTime time.Time
+}
+
+//
+// rotated recordings, mismatch reports, file destinations, reproduction bundles, the
+// fuzzing corpus and the triage reproducers; the open files are not included
+func (reqMgr *RequestManager) artifacts() []artifact {
+   var patterns []string
+   if reqMgr.RecordFile != "" {
+      patterns = append(patterns, reqMgr.RecordFile+".*")
+   }
+   if reqMgr.MismatchFile != "" {
+      patterns = append(patterns, reqMgr.MismatchFile+".*")
+   }
+   for _, target := range reqMgr.stagingTargets() {
+      if target.sink != nil {
+         patterns = append(patterns, target.sink.path+".*")
+      }
+   }
+   if reqMgr.ReproDir != "" {
+      patterns = append(patterns, filepath.Join(reqMgr.ReproDir, "*.json"), filepath.Join(reqMgr.ReproDir, "*.json.gz"))
+   }
+   if reqMgr.CorpusDir != "" {
+      patterns = append(patterns, filepath.Join(reqMgr.CorpusDir, "*.json"))
+   }
+   if reqMgr.TriageDir != "" {
+      patterns = append(patterns, filepath.Join(reqMgr.TriageDir, "*.json"))
+   }
+
+   var found []artifact
+   for _, pattern := range patterns {
+      names, _ := filepath.Glob(pattern)
+      for _, name := range names {
+         if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+            found = append(found, artifact{name, info.Size(), info.ModTime()})
+         }
+      }
+   }
+   sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+   return found
+}
+
+//
+// remove artifacts older than RetainSec, then the oldest ones until RetainBytes is met
+func (reqMgr *RequestManager) pruneArtifacts() {
+   found := reqMgr.artifacts()
+   var total int64
+   for _, art := range found {
+      total += art.size
+   }
+
+   now := reqMgr.Clock.Now()
+   for _, art := range found {
+      expired := reqMgr.RetainSec > 0 && now.Sub(art.modTime) > time.Duration(reqMgr.RetainSec)*time.Second
+      overBudget := reqMgr.RetainBytes > 0 && total > reqMgr.RetainBytes
+      if !expired && !overBudget {
+         continue
+      }
+      if err := os.Remove(art.name); err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: art.name, Err: err})
+         continue
+      }
+      total -= art.size
+      reqMgr.Metrics.Inc("forktraffic_artifacts_pruned_total")
+   }
+   reqMgr.Metrics.Set("forktraffic_artifacts_bytes", total)
+}
+
+//
+// rotate the recordings by age and prune artifacts periodically
+func (reqMgr *RequestManager) startJanitor() {
+   go func() {
+      for {
+         time.Sleep(janitorInterval)
+         reqMgr.rotateAged(&reqMgr.recording, reqMgr.RecordFile)
+         reqMgr.rotateAged(&reqMgr.mismatchReports, reqMgr.MismatchFile)
+         for _, target := range reqMgr.stagingTargets() {
+            if target.sink != nil {
+               reqMgr.rotateAged(&target.sink.rec, target.sink.path)
+            }
+         }
+         reqMgr.pruneArtifacts()
+      }
+   }()
+}
+
+// rotate a recording past its age
+func (reqMgr *RequestManager) rotateAged(rec *recorder, name string) {
+   rec.lock.Lock()
+   defer rec.lock.Unlock()
+   if reqMgr.rotationDue(rec, 0) {
+      if err := reqMgr.rotateFile(rec, name); err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: name, Err: err})
+      }
+   }
+}
@@ -0,0 +1,129 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+   "sync"
+   "time"
+)
+
+// route label of requests matching no configured route
+const otherRoute string = "other"
+
+//
+// per route configuration block
+// - Prefix selects the requests of the route; the longest matching prefix wins
+// - TimeoutSec overrides the staging request timeout; 0 keeps the staging client's
+// - Retries overrides ForwardRetries; 0 keeps it, -1 never retries
+// - Priority above 0 sends the staging copies ahead of the queued ones, higher first
+// - Stub answers the requests of the route without contacting production
+// - ResponseMiddlewares replaces the registered response middlewares, in its order
+//   (an empty list runs none); ResponseHeaders are set on the responses of the route
+// - PublicUrl overrides PublicUrl for the rewritten redirects of the route
+type RouteConfig struct {
+   Prefix              string
+   TimeoutSec          int
+   Retries             int
+   Priority            int
+   Stub                *StubResponse
+   ResponseMiddlewares []string
+   ResponseHeaders     map[string]string
+   PublicUrl           string
+}
+
+// staging clients of the route timeouts, by target client and timeout
+type routeClients struct {
+   lock    sync.Mutex
+   clients map[routeClientKey]*http.Client
+}
+
+type routeClientKey struct {
+   base    *http.Client
+   timeout int
+}
+
+//
+// get the configured route of a request; nil if none matches
+func (reqMgr *RequestManager) routeOf(req *http.Request) *RouteConfig {
+   var best *RouteConfig = nil
+   for i := range reqMgr.Routes {
+      route := &reqMgr.Routes[i]
+      if strings.HasPrefix(req.URL.Path, route.Prefix) && (best == nil || len(route.Prefix) > len(best.Prefix)) {
+         best = route
+      }
+   }
+   return best
+}
+
+//
+// route label of a request, used to group metrics and comparisons
+// - GraphQL requests are grouped by operation type (their names are chosen by the
+//   clients), then OpenAPI and gRPC requests by operation, others by configured route
+// - unconfigured paths share one label to keep the metrics bounded
+func (reqMgr *RequestManager) routeLabel(req *http.Request, op *graphqlOperation, operation string) string {
+   if op != nil {
+      return "graphql:" + op.Type
+   }
+   if operation != "" && operation != unknownOperation {
+      return operation
+   }
+   if route := reqMgr.routeOf(req); route != nil {
+      return route.Prefix
+   }
+   return otherRoute
+}
+
+//
+// staging client of a pending request; the route timeout overrides the client timeout
+// - the client of the target when it has its own address family, else DestStaging
+// - a longer timeout also lifts the response header timeout of the staging transport
+func (reqMgr *RequestManager) stagingClient(sendReq *PendingRequest) *http.Client {
+   base := reqMgr.DestStaging
+   if sendReq.target != nil && sendReq.target.client != nil {
+      base = sendReq.target.client
+   }
+   route := reqMgr.routeOf(sendReq.req)
+   if route == nil || route.TimeoutSec <= 0 {
+      return base
+   }
+
+   rc := &reqMgr.routeClients
+   rc.lock.Lock()
+   defer rc.lock.Unlock()
+   key := routeClientKey{base, route.TimeoutSec}
+   if client, ok := rc.clients[key]; ok {
+      return client
+   }
+   timeout := time.Duration(route.TimeoutSec) * time.Second
+   client := *base
+   client.Timeout = timeout
+   if tr, ok := client.Transport.(*http.Transport); ok && tr.ResponseHeaderTimeout > 0 && tr.ResponseHeaderTimeout < timeout {
+      tr = tr.Clone()
+      tr.ResponseHeaderTimeout = timeout
+      client.Transport = tr
+   }
+   if rc.clients == nil {
+      rc.clients = make(map[routeClientKey]*http.Client)
+   }
+   rc.clients[key] = &client
+   return &client
+}
+
+// forward retries of a pending request
+func (reqMgr *RequestManager) forwardRetries(sendReq *PendingRequest) int {
+   if route := reqMgr.routeOf(sendReq.req); route != nil && route.Retries != 0 {
+      if route.Retries < 0 {
+         return 0
+      }
+      return route.Retries
+   }
+   return reqMgr.ForwardRetries
+}
+
+// queue priority of a pending request
+func (reqMgr *RequestManager) priorityOf(sendReq *PendingRequest) int {
+   if route := reqMgr.routeOf(sendReq.req); route != nil {
+      return route.Priority
+   }
+   return 0
+}
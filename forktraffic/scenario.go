@@ -0,0 +1,229 @@
+package forktraffic
+
+import (
+   "log"
+   "net"
+   "net/http"
+   "strings"
+   "sync"
+   "time"
+)
+
+// scenario id of the staging copies
+const httpScenarioHeader string = "X-Fork-Scenario"
+
+// idle time after which an unfinished flow expires, unless TimeoutSec is set
+const DefaultScenarioTimeoutSec int = 300
+
+// time the staging copies of an ended flow have to answer before it is accounted
+const scenarioSettle time.Duration = 5 * time.Second
+
+//
+// multi-request flow of a client, e.g. login, actions, logout
+// - a flow starts with a request matching Start and ends with the request matching
+//   End, included, or expires after TimeoutSec (default DefaultScenarioTimeoutSec)
+//   without a request
+// - Start and End are filter expressions (see CaptureFilter), seeing the production status
+// - Key tells the clients apart: "header[Name]" or "cookie[Name]"; by default the
+//   client address and User-Agent, so a login without a session cookie yet is in
+//   the flow it starts
+type ScenarioRule struct {
+   Name       string
+   Start      string
+   End        string
+   Key        string
+   TimeoutSec int
+}
+
+// a rule ready to apply
+type scenarioRule struct {
+   ScenarioRule
+   start, end captureFilter
+   timeout    time.Duration
+}
+
+//
+// a flow in progress
+// - failed is set once a staging copy of the flow failed (5xx or no response)
+type scenarioFlow struct {
+   id       string
+   name     string
+   timeout  time.Duration
+   last     time.Time
+   ended    bool
+   requests int
+   failed   bool
+}
+
+//
+// flows in progress by scenario and client; the ended flows settle until their
+// staging copies had time to answer
+type scenarioTracker struct {
+   lock     sync.Mutex
+   rules    []*scenarioRule
+   flows    map[string]*scenarioFlow
+   settling []*scenarioFlow
+}
+
+//
+// compile the ScenarioRules; invalid rules are skipped
+func (reqMgr *RequestManager) initScenarios() {
+   st := &reqMgr.scenarios
+   st.rules, st.flows, st.settling = nil, make(map[string]*scenarioFlow), nil
+   for _, rule := range reqMgr.ScenarioRules {
+      sr := &scenarioRule{ScenarioRule: rule, timeout: time.Duration(rule.TimeoutSec) * time.Second}
+      if sr.timeout <= 0 {
+         sr.timeout = time.Duration(DefaultScenarioTimeoutSec) * time.Second
+      }
+      var err error
+      if rule.Name == "" || rule.Start == "" || rule.End == "" {
+         err = errScenarioRule
+      }
+      if err == nil {
+         sr.start, err = parseCaptureFilter(rule.Start)
+      }
+      if err == nil {
+         sr.end, err = parseCaptureFilter(rule.End)
+      }
+      if err != nil {
+         log.Printf("Warning - invalid scenario %q: %v", rule.Name, err)
+         continue
+      }
+      st.rules = append(st.rules, sr)
+   }
+}
+
+// id of the flow of an exchange; "" for none
+func (ex *exchange) scenarioId() string {
+   if ex.scenario == nil {
+      return ""
+   }
+   return ex.scenario.id
+}
+
+// the client of a request for a rule; "" when it has no such header or cookie
+func (sr *scenarioRule) clientKey(req *http.Request) string {
+   key := strings.ToLower(sr.Key)
+   if strings.HasPrefix(key, "header[") && strings.HasSuffix(key, "]") {
+      return req.Header.Get(sr.Key[len("header[") : len(sr.Key)-1])
+   }
+   if strings.HasPrefix(key, "cookie[") && strings.HasSuffix(key, "]") {
+      if cookie, err := req.Cookie(sr.Key[len("cookie[") : len(sr.Key)-1]); err == nil {
+         return cookie.Value
+      }
+      return ""
+   }
+   host, _, err := net.SplitHostPort(req.RemoteAddr)
+   if err != nil {
+      host = req.RemoteAddr
+   }
+   return host + "|" + req.UserAgent()
+}
+
+//
+// tag a production exchange with the flow it belongs to; the first rule with a
+// flow in progress or started by the request wins
+// - forktraffic_scenario_requests_total counts the requests of the flows, by scenario
+func (reqMgr *RequestManager) tagScenario(req *http.Request, ex *exchange) {
+   st := &reqMgr.scenarios
+   if len(st.rules) == 0 {
+      return
+   }
+   now := reqMgr.Clock.Now()
+   st.lock.Lock()
+   defer st.lock.Unlock()
+   for _, rule := range st.rules {
+      client := rule.clientKey(req)
+      if client == "" {
+         continue
+      }
+      key := rule.Name + "|" + client
+      flow := st.flows[key]
+      if flow != nil && flow.ended {
+         st.settling = append(st.settling, flow)
+         delete(st.flows, key)
+         flow = nil
+      } else if flow != nil && now.Sub(flow.last) > flow.timeout {
+         reqMgr.closeFlow(flow)
+         delete(st.flows, key)
+         flow = nil
+      }
+      if flow == nil {
+         if !rule.start.match(req, ex.status()) {
+            continue
+         }
+         flow = &scenarioFlow{id: rule.Name + "-" + reqMgr.createReqId(), name: rule.Name, timeout: rule.timeout}
+         st.flows[key] = flow
+         reqMgr.Metrics.Inc("forktraffic_scenarios_started_total", "scenario", rule.Name)
+      }
+      flow.last = now
+      flow.requests++
+      flow.ended = rule.end.match(req, ex.status())
+      ex.scenario = flow
+      reqMgr.Metrics.Inc("forktraffic_scenario_requests_total", "scenario", rule.Name)
+      return
+   }
+}
+
+//
+// account the response of a staging copy to its flow
+// - forktraffic_scenario_responses_total counts the staging responses, by scenario and class
+func (reqMgr *RequestManager) observeScenario(sendReq *PendingRequest, class string) {
+   ex := sendReq.exchange
+   if ex == nil || ex.scenario == nil {
+      return
+   }
+   flow := ex.scenario
+   reqMgr.Metrics.Inc("forktraffic_scenario_responses_total", "scenario", flow.name, "class", class)
+   if class == "error" || class == "5xx" {
+      reqMgr.scenarios.lock.Lock()
+      flow.failed = true
+      reqMgr.scenarios.lock.Unlock()
+   }
+}
+
+//
+// account the flows that ended (once their copies had time to answer) or expired;
+// sampled with the byte rates
+func (reqMgr *RequestManager) sweepScenarios() {
+   st := &reqMgr.scenarios
+   if len(st.rules) == 0 {
+      return
+   }
+   now := reqMgr.Clock.Now()
+   st.lock.Lock()
+   defer st.lock.Unlock()
+   for key, flow := range st.flows {
+      if flow.ended && now.Sub(flow.last) > scenarioSettle {
+         st.settling = append(st.settling, flow)
+         delete(st.flows, key)
+      } else if !flow.ended && now.Sub(flow.last) > flow.timeout {
+         reqMgr.closeFlow(flow)
+         delete(st.flows, key)
+      }
+   }
+   settling := st.settling[:0]
+   for _, flow := range st.settling {
+      if now.Sub(flow.last) > scenarioSettle {
+         reqMgr.closeFlow(flow)
+      } else {
+         settling = append(settling, flow)
+      }
+   }
+   st.settling = settling
+}
+
+//
+// account a flow that is over
+// - forktraffic_scenarios_total by scenario and outcome: "ok" when every staging
+//   copy answered without a server error, "failed" otherwise, "expired" when it never ended
+func (reqMgr *RequestManager) closeFlow(flow *scenarioFlow) {
+   outcome := "ok"
+   if !flow.ended {
+      outcome = "expired"
+   } else if flow.failed {
+      outcome = "failed"
+   }
+   reqMgr.Metrics.Inc("forktraffic_scenarios_total", "scenario", flow.name, "outcome", outcome)
+   reqMgr.Metrics.Add("forktraffic_scenario_flow_requests_total", int64(flow.requests), "scenario", flow.name, "outcome", outcome)
+}
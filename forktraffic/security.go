@@ -0,0 +1,55 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+)
+
+// security headers are set when production sent none
+const SecurityHeadersAdd string = "add"
+
+// security headers replace those of production
+const SecurityHeadersOverride string = "override"
+
+// security headers of the SecurityHeaders modes unless SecurityHeaderValues changes them
+var DefaultSecurityHeaders = map[string]string{
+   "Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+   "X-Content-Type-Options":    "nosniff",
+   "X-Frame-Options":           "SAMEORIGIN",
+   "Referrer-Policy":           "strict-origin-when-cross-origin",
+   "Content-Security-Policy":   "frame-ancestors 'self'",
+}
+
+//
+// was the request received over HTTPS, by the fork or by a proxy in front of it
+func receivedHttps(req *http.Request) bool {
+   return req.Context().Value(tlsConnKey) != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+//
+// inject the security headers: DefaultSecurityHeaders changed by SecurityHeaderValues
+// (an empty value leaves a header out)
+// - SecurityHeaders "add" keeps the headers production sent, "override" replaces them
+// - Strict-Transport-Security is only sent on responses to HTTPS requests
+func (reqMgr *RequestManager) injectSecurityHeaders(resp *http.Response) error {
+   if reqMgr.SecurityHeaders != SecurityHeadersAdd && reqMgr.SecurityHeaders != SecurityHeadersOverride {
+      return nil
+   }
+   https := resp.Request != nil && receivedHttps(resp.Request)
+   headers := make(map[string]string, len(DefaultSecurityHeaders))
+   for name, val := range DefaultSecurityHeaders {
+      headers[name] = val
+   }
+   for name, val := range reqMgr.SecurityHeaderValues {
+      headers[http.CanonicalHeaderKey(name)] = val
+   }
+   for name, val := range headers {
+      if val == "" || (!https && name == "Strict-Transport-Security") {
+         continue
+      }
+      if reqMgr.SecurityHeaders == SecurityHeadersOverride || resp.Header.Get(name) == "" {
+         resp.Header.Set(name, val)
+      }
+   }
+   return nil
+}
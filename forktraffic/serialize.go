@@ -0,0 +1,496 @@
+package forktraffic
+
+import (
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/json"
+   "errors"
+   "log"
+   "net/http"
+   "net/url"
+   "sort"
+   "strings"
+   "time"
+)
+
+//
+// serialized mirrored request; the schema shared by the queue spool, the
+// recording and the batch envelopes
+// - fields unknown to a subsystem stay empty (e.g. recordings have no Region)
+type RequestRecord struct {
+   Id         string
+   Time       time.Time
+   Region     string
+   Method     string
+   Url        string
+   Host       string
+   RemoteAddr string
+   Header     http.Header
+   Trailer    http.Header
+   Body       []byte
+   ProdStatus int
+   Route      string
+   ReproId    string
+   RequestKey string
+   SessionKey string
+   KeyExpires int64
+   Attempts   int
+   Experiment string
+   Scenario   string
+}
+
+//
+// encoder of request records
+// - "json": the RequestRecord document
+// - "protobuf": the RequestRecord message below
+// - "har": a HAR 1.2 entry; fields HAR has no place for are "_" prefixed
+type RequestEncoder interface {
+   Encode(rec *RequestRecord) ([]byte, error)
+   Decode(buf []byte) (*RequestRecord, error)
+
+   // append an encoded record to a stream of records; a line each, or
+   // length-delimited (varint size prefix) for protobuf
+   Frame(stream, encoded []byte) []byte
+
+   // content type of a stream of records
+   ContentType() string
+}
+
+var errUnknownEncoding = errors.New("unknown request encoding")
+
+var requestEncoders = map[string]RequestEncoder{
+   "json":     jsonEncoder{},
+   "protobuf": protobufEncoder{},
+   "har":      harEncoder{},
+}
+
+//
+// get a request encoder by name; "" is json
+func NewRequestEncoder(name string) (RequestEncoder, error) {
+   if name == "" {
+      name = "json"
+   }
+   if enc, ok := requestEncoders[strings.ToLower(name)]; ok {
+      return enc, nil
+   }
+   return nil, errUnknownEncoding
+}
+
+//
+// set up the encoders of the queues and the captures
+// - an unknown encoding falls back to json
+func (reqMgr *RequestManager) initEncoders() {
+   encoder := func(name string) RequestEncoder {
+      enc, err := NewRequestEncoder(name)
+      if err != nil {
+         log.Printf("Warning - %v %q; json is used", err, name)
+         return jsonEncoder{}
+      }
+      return enc
+   }
+   reqMgr.queueEncoder = encoder(reqMgr.QueueEncoding)
+   reqMgr.captureEncoder = encoder(reqMgr.CaptureEncoding)
+}
+
+// framing of the line based encodings
+func frameLine(stream, encoded []byte) []byte {
+   return append(append(stream, encoded...), '\n')
+}
+
+//
+// json encoding
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(rec *RequestRecord) ([]byte, error) { return json.Marshal(rec) }
+
+func (jsonEncoder) Decode(buf []byte) (*RequestRecord, error) {
+   rec := new(RequestRecord)
+   if err := json.Unmarshal(buf, rec); err != nil {
+      return nil, err
+   }
+   return rec, nil
+}
+
+func (jsonEncoder) Frame(stream, encoded []byte) []byte { return frameLine(stream, encoded) }
+func (jsonEncoder) ContentType() string                 { return "application/x-ndjson" }
+
+//
+// protobuf encoding
+//
+//   message Header { string name = 1; string value = 2; }
+//   message RequestRecord {
+//      string id = 1;           int64 time_unix_nano = 2;   string region = 3;
+//      string method = 4;       string url = 5;             string host = 6;
+//      string remote_addr = 7;  repeated Header header = 8; repeated Header trailer = 9;
+//      bytes body = 10;         int32 prod_status = 11;     string route = 12;
+//      string repro_id = 13;    string request_key = 14;    string session_key = 15;
+//      int64 key_expires = 16;  int32 attempts = 17;        string experiment = 18;
+//      string scenario = 19;
+//   }
+type protobufEncoder struct{}
+
+// protobuf wire types
+const pbVarint, pbBytes = 0, 2
+
+func pbAppendTag(buf []byte, field, wireType int) []byte {
+   return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func pbAppendInt(buf []byte, field int, v int64) []byte {
+   if v == 0 {
+      return buf
+   }
+   return binary.AppendUvarint(pbAppendTag(buf, field, pbVarint), uint64(v))
+}
+
+func pbAppendBytes(buf []byte, field int, v []byte) []byte {
+   if len(v) == 0 {
+      return buf
+   }
+   buf = binary.AppendUvarint(pbAppendTag(buf, field, pbBytes), uint64(len(v)))
+   return append(buf, v...)
+}
+
+// headers in a stable order: sorted names, values in their order
+func pbAppendHeader(buf []byte, field int, header http.Header) []byte {
+   names := make([]string, 0, len(header))
+   for name := range header {
+      names = append(names, name)
+   }
+   sort.Strings(names)
+   for _, name := range names {
+      for _, value := range header[name] {
+         entry := pbAppendBytes(pbAppendBytes(nil, 1, []byte(name)), 2, []byte(value))
+         buf = binary.AppendUvarint(pbAppendTag(buf, field, pbBytes), uint64(len(entry)))
+         buf = append(buf, entry...)
+      }
+   }
+   return buf
+}
+
+func (protobufEncoder) Encode(rec *RequestRecord) ([]byte, error) {
+   var buf []byte
+   buf = pbAppendBytes(buf, 1, []byte(rec.Id))
+   if !rec.Time.IsZero() {
+      buf = pbAppendInt(buf, 2, rec.Time.UnixNano())
+   }
+   buf = pbAppendBytes(buf, 3, []byte(rec.Region))
+   buf = pbAppendBytes(buf, 4, []byte(rec.Method))
+   buf = pbAppendBytes(buf, 5, []byte(rec.Url))
+   buf = pbAppendBytes(buf, 6, []byte(rec.Host))
+   buf = pbAppendBytes(buf, 7, []byte(rec.RemoteAddr))
+   buf = pbAppendHeader(buf, 8, rec.Header)
+   buf = pbAppendHeader(buf, 9, rec.Trailer)
+   buf = pbAppendBytes(buf, 10, rec.Body)
+   buf = pbAppendInt(buf, 11, int64(rec.ProdStatus))
+   buf = pbAppendBytes(buf, 12, []byte(rec.Route))
+   buf = pbAppendBytes(buf, 13, []byte(rec.ReproId))
+   buf = pbAppendBytes(buf, 14, []byte(rec.RequestKey))
+   buf = pbAppendBytes(buf, 15, []byte(rec.SessionKey))
+   buf = pbAppendInt(buf, 16, rec.KeyExpires)
+   buf = pbAppendInt(buf, 17, int64(rec.Attempts))
+   buf = pbAppendBytes(buf, 18, []byte(rec.Experiment))
+   buf = pbAppendBytes(buf, 19, []byte(rec.Scenario))
+   return buf, nil
+}
+
+var errProtobuf = errors.New("malformed protobuf record")
+
+//
+// walk the fields of a message; unknown fields are skipped
+func pbFields(buf []byte, field func(num, wireType int, v uint64, data []byte) error) error {
+   for len(buf) > 0 {
+      tag, n := binary.Uvarint(buf)
+      if n <= 0 {
+         return errProtobuf
+      }
+      buf = buf[n:]
+      num, wireType := int(tag>>3), int(tag&7)
+      switch wireType {
+      case pbVarint:
+         v, n := binary.Uvarint(buf)
+         if n <= 0 {
+            return errProtobuf
+         }
+         buf = buf[n:]
+         if err := field(num, wireType, v, nil); err != nil {
+            return err
+         }
+      case pbBytes:
+         size, n := binary.Uvarint(buf)
+         if n <= 0 || uint64(len(buf)-n) < size {
+            return errProtobuf
+         }
+         data := buf[n : n+int(size)]
+         buf = buf[n+int(size):]
+         if err := field(num, wireType, 0, data); err != nil {
+            return err
+         }
+      default:
+         return errProtobuf
+      }
+   }
+   return nil
+}
+
+func pbDecodeHeader(header http.Header, data []byte) (http.Header, error) {
+   var name, value string
+   err := pbFields(data, func(num, wireType int, v uint64, data []byte) error {
+      if num == 1 {
+         name = string(data)
+      } else if num == 2 {
+         value = string(data)
+      }
+      return nil
+   })
+   if header == nil {
+      header = http.Header{}
+   }
+   header[name] = append(header[name], value)
+   return header, err
+}
+
+func (protobufEncoder) Decode(buf []byte) (*RequestRecord, error) {
+   rec := new(RequestRecord)
+   err := pbFields(buf, func(num, wireType int, v uint64, data []byte) error {
+      var err error = nil
+      switch num {
+      case 1:
+         rec.Id = string(data)
+      case 2:
+         rec.Time = time.Unix(0, int64(v)).UTC()
+      case 3:
+         rec.Region = string(data)
+      case 4:
+         rec.Method = string(data)
+      case 5:
+         rec.Url = string(data)
+      case 6:
+         rec.Host = string(data)
+      case 7:
+         rec.RemoteAddr = string(data)
+      case 8:
+         rec.Header, err = pbDecodeHeader(rec.Header, data)
+      case 9:
+         rec.Trailer, err = pbDecodeHeader(rec.Trailer, data)
+      case 10:
+         rec.Body = append([]byte(nil), data...)
+      case 11:
+         rec.ProdStatus = int(v)
+      case 12:
+         rec.Route = string(data)
+      case 13:
+         rec.ReproId = string(data)
+      case 14:
+         rec.RequestKey = string(data)
+      case 15:
+         rec.SessionKey = string(data)
+      case 16:
+         rec.KeyExpires = int64(v)
+      case 17:
+         rec.Attempts = int(v)
+      case 18:
+         rec.Experiment = string(data)
+      case 19:
+         rec.Scenario = string(data)
+      }
+      return err
+   })
+   if err != nil {
+      return nil, err
+   }
+   return rec, nil
+}
+
+func (protobufEncoder) Frame(stream, encoded []byte) []byte {
+   return append(binary.AppendUvarint(stream, uint64(len(encoded))), encoded...)
+}
+
+func (protobufEncoder) ContentType() string { return "application/x-protobuf; delimited=true" }
+
+//
+// HAR entry encoding
+type harEncoder struct{}
+
+type harNameValue struct {
+   Name  string `json:"name"`
+   Value string `json:"value"`
+}
+
+type harPostData struct {
+   MimeType string `json:"mimeType"`
+   Text     string `json:"text"`
+   Encoding string `json:"encoding,omitempty"`
+}
+
+type harRequest struct {
+   Method      string         `json:"method"`
+   Url         string         `json:"url"`
+   HttpVersion string         `json:"httpVersion"`
+   Cookies     []harNameValue `json:"cookies"`
+   Headers     []harNameValue `json:"headers"`
+   QueryString []harNameValue `json:"queryString"`
+   PostData    *harPostData   `json:"postData,omitempty"`
+   HeadersSize int            `json:"headersSize"`
+   BodySize    int            `json:"bodySize"`
+   Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harResponse struct {
+   Status      int            `json:"status"`
+   StatusText  string         `json:"statusText"`
+   HttpVersion string         `json:"httpVersion"`
+   Cookies     []harNameValue `json:"cookies"`
+   Headers     []harNameValue `json:"headers"`
+   Content     struct {
+      Size     int    `json:"size"`
+      MimeType string `json:"mimeType"`
+   } `json:"content"`
+   RedirectURL string `json:"redirectURL"`
+   HeadersSize int    `json:"headersSize"`
+   BodySize    int    `json:"bodySize"`
+}
+
+// HAR 1.2 entry; "_" fields carry the record fields HAR has no place for
+type harEntry struct {
+   StartedDateTime time.Time   `json:"startedDateTime"`
+   Time            float64     `json:"time"`
+   Request         harRequest  `json:"request"`
+   Response        harResponse `json:"response"`
+   Cache           struct{}    `json:"cache"`
+   Timings         struct {
+      Send    float64 `json:"send"`
+      Wait    float64 `json:"wait"`
+      Receive float64 `json:"receive"`
+   } `json:"timings"`
+   Id         string `json:"_id,omitempty"`
+   Region     string `json:"_region,omitempty"`
+   Host       string `json:"_host,omitempty"`
+   RemoteAddr string `json:"_remoteAddr,omitempty"`
+   Route      string `json:"_route,omitempty"`
+   ReproId    string `json:"_reproId,omitempty"`
+   RequestKey string `json:"_requestKey,omitempty"`
+   SessionKey string `json:"_sessionKey,omitempty"`
+   KeyExpires int64  `json:"_keyExpires,omitempty"`
+   Attempts   int    `json:"_attempts,omitempty"`
+   Experiment string `json:"_experiment,omitempty"`
+   Scenario   string `json:"_scenario,omitempty"`
+}
+
+func harPairs(header http.Header) []harNameValue {
+   pairs := []harNameValue{}
+   names := make([]string, 0, len(header))
+   for name := range header {
+      names = append(names, name)
+   }
+   sort.Strings(names)
+   for _, name := range names {
+      for _, value := range header[name] {
+         pairs = append(pairs, harNameValue{name, value})
+      }
+   }
+   return pairs
+}
+
+func harHeader(pairs []harNameValue) http.Header {
+   if pairs == nil {
+      return nil
+   }
+   header := http.Header{}
+   for _, pair := range pairs {
+      header[pair.Name] = append(header[pair.Name], pair.Value)
+   }
+   return header
+}
+
+func (harEncoder) Encode(rec *RequestRecord) ([]byte, error) {
+   entry := harEntry{
+      StartedDateTime: rec.Time,
+      Id:              rec.Id,
+      Region:          rec.Region,
+      Host:            rec.Host,
+      RemoteAddr:      rec.RemoteAddr,
+      Route:           rec.Route,
+      ReproId:         rec.ReproId,
+      RequestKey:      rec.RequestKey,
+      SessionKey:      rec.SessionKey,
+      KeyExpires:      rec.KeyExpires,
+      Attempts:        rec.Attempts,
+      Experiment:      rec.Experiment,
+      Scenario:        rec.Scenario,
+   }
+   req := &entry.Request
+   req.Method, req.Url, req.HttpVersion = rec.Method, rec.Url, "HTTP/1.1"
+   req.Headers, req.Cookies, req.QueryString = harPairs(rec.Header), []harNameValue{}, []harNameValue{}
+   req.HeadersSize, req.BodySize = -1, len(rec.Body)
+   if len(rec.Trailer) > 0 {
+      req.Trailers = harPairs(rec.Trailer)
+   }
+   for _, cookie := range (&http.Request{Header: rec.Header}).Cookies() {
+      req.Cookies = append(req.Cookies, harNameValue{cookie.Name, cookie.Value})
+   }
+   if u, err := url.Parse(rec.Url); err == nil {
+      for name, values := range u.Query() {
+         for _, value := range values {
+            req.QueryString = append(req.QueryString, harNameValue{name, value})
+         }
+      }
+      sort.SliceStable(req.QueryString, func(i, j int) bool { return req.QueryString[i].Name < req.QueryString[j].Name })
+   }
+   if rec.Body != nil {
+      req.PostData = &harPostData{MimeType: rec.Header.Get("Content-Type"), Text: string(rec.Body)}
+      if binaryBody(rec.Header.Get("Content-Type"), rec.Body) {
+         req.PostData.Text, req.PostData.Encoding = base64.StdEncoding.EncodeToString(rec.Body), "base64"
+      }
+   }
+
+   resp := &entry.Response
+   resp.Status, resp.HttpVersion = rec.ProdStatus, "HTTP/1.1"
+   if rec.ProdStatus > 0 {
+      resp.StatusText = http.StatusText(rec.ProdStatus)
+   }
+   resp.Cookies, resp.Headers = []harNameValue{}, []harNameValue{}
+   resp.HeadersSize, resp.BodySize = -1, -1
+   return json.Marshal(&entry)
+}
+
+func (harEncoder) Decode(buf []byte) (*RequestRecord, error) {
+   var entry harEntry
+   if err := json.Unmarshal(buf, &entry); err != nil {
+      return nil, err
+   }
+   rec := &RequestRecord{
+      Id:         entry.Id,
+      Time:       entry.StartedDateTime,
+      Region:     entry.Region,
+      Method:     entry.Request.Method,
+      Url:        entry.Request.Url,
+      Host:       entry.Host,
+      RemoteAddr: entry.RemoteAddr,
+      Header:     harHeader(entry.Request.Headers),
+      Trailer:    harHeader(entry.Request.Trailers),
+      ProdStatus: entry.Response.Status,
+      Route:      entry.Route,
+      ReproId:    entry.ReproId,
+      RequestKey: entry.RequestKey,
+      SessionKey: entry.SessionKey,
+      KeyExpires: entry.KeyExpires,
+      Attempts:   entry.Attempts,
+      Experiment: entry.Experiment,
+      Scenario:   entry.Scenario,
+   }
+   if pd := entry.Request.PostData; pd != nil {
+      rec.Body = []byte(pd.Text)
+      if pd.Encoding == "base64" {
+         body, err := base64.StdEncoding.DecodeString(pd.Text)
+         if err != nil {
+            return nil, err
+         }
+         rec.Body = body
+      }
+   }
+   return rec, nil
+}
+
+func (harEncoder) Frame(stream, encoded []byte) []byte { return frameLine(stream, encoded) }
+func (harEncoder) ContentType() string                 { return "application/x-ndjson" }
@@ -0,0 +1,57 @@
+package forktraffic
+
+import (
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/hex"
+   "net/http"
+   "strings"
+)
+
+//
+// one way session identifiers
+// - raw session tokens stay inside the cache; logs, metrics and reports use
+//   a salted hash, the salt is random per run so hashes cannot be joined across runs
+func newSessionSalt() []byte {
+   salt := make([]byte, 32)
+   rand.Read(salt)
+   return salt
+}
+
+// hash of a session token; "" for no session
+func (reqMgr *RequestManager) SessionHash(sessionKey string) string {
+   if sessionKey == "" {
+      return ""
+   }
+   mac := hmac.New(sha256.New, reqMgr.sessionSalt)
+   mac.Write([]byte(sessionKey))
+   return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+//
+// handle "/admin/sessions"; cached sessions by hash with their expiration
+func (reqMgr *RequestManager) adminSessions(w http.ResponseWriter, r *http.Request) {
+   type sessionInfo struct {
+      Region     string
+      Session    string
+      Expiration int64
+      Staging    bool // a staging session is mapped
+   }
+
+   reqMgr.cacheLock.Lock()
+   sessions := make([]sessionInfo, 0, len(reqMgr.CacheData))
+   for key, stagKey := range reqMgr.CacheData {
+      if key == "" {
+         continue
+      }
+      region := ""
+      if i := strings.LastIndex(key, "|"); i >= 0 {
+         region, key = key[:i], key[i+1:]
+      }
+      sessions = append(sessions, sessionInfo{region, reqMgr.SessionHash(key), stagKey.Expiration, stagKey.sessionKey != ""})
+   }
+   reqMgr.cacheLock.Unlock()
+
+   writeJson(w, sessions)
+}
@@ -0,0 +1,147 @@
+package forktraffic
+
+import (
+   "container/heap"
+   "crypto/hmac"
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/json"
+   "net/http"
+)
+
+//
+// production to staging session mapping, exported to hand the sessions over
+// to another fork instance (blue/green replacement of the fork)
+// - KeyHash is the HMAC of the cache key (the region tagged production session
+//   token) with SessionExportKey; production tokens never leave the instance
+// - the staging session tokens are exported as is; keep the file private
+type SessionMapping struct {
+   KeyHash    string
+   SessionKey string
+   SessionTtl string
+   CsrfToken  string
+   Expiration int64
+   Scopes     map[string]*http.Cookie
+}
+
+// hash of a cache key shared by the instances configured with the same SessionExportKey
+func (reqMgr *RequestManager) exportHash(key string) string {
+   mac := hmac.New(sha256.New, []byte(reqMgr.SessionExportKey))
+   mac.Write([]byte(key))
+   return hex.EncodeToString(mac.Sum(nil))
+}
+
+//
+// the live session mappings; nil without a SessionExportKey
+func (reqMgr *RequestManager) ExportSessions() []SessionMapping {
+   if reqMgr.SessionExportKey == "" {
+      return nil
+   }
+   tNow := reqMgr.nowMs()
+   reqMgr.cacheLock.Lock()
+   defer reqMgr.cacheLock.Unlock()
+   mappings := make([]SessionMapping, 0, len(reqMgr.CacheData))
+   for key, stagKey := range reqMgr.CacheData {
+      if key == "" || stagKey.Expiration <= tNow {
+         continue
+      }
+      scopes := make(map[string]*http.Cookie, len(stagKey.scopes))
+      for name, scope := range stagKey.scopes {
+         scopes[name] = scope
+      }
+      mappings = append(mappings, SessionMapping{
+         KeyHash:    reqMgr.exportHash(key),
+         SessionKey: stagKey.sessionKey,
+         SessionTtl: stagKey.sessionTtl,
+         CsrfToken:  stagKey.csrfToken,
+         Expiration: stagKey.Expiration,
+         Scopes:     scopes,
+      })
+   }
+   return mappings
+}
+
+//
+// keep exported session mappings until their production sessions are seen; expired
+// ones are skipped
+// - a production session is matched by its hash on the first cache miss and moved
+//   to the cache; returns the number imported
+func (reqMgr *RequestManager) ImportSessions(mappings []SessionMapping) int {
+   if reqMgr.SessionExportKey == "" {
+      return 0
+   }
+   tNow := reqMgr.nowMs()
+   reqMgr.cacheLock.Lock()
+   defer reqMgr.cacheLock.Unlock()
+   if reqMgr.importedSessions == nil {
+      reqMgr.importedSessions = make(map[string]*StagKeys)
+   }
+   for hash, stagKey := range reqMgr.importedSessions {
+      if stagKey.Expiration <= tNow {
+         delete(reqMgr.importedSessions, hash)
+      }
+   }
+   imported := 0
+   for _, mapping := range mappings {
+      if mapping.KeyHash == "" || mapping.Expiration <= tNow {
+         continue
+      }
+      reqMgr.importedSessions[mapping.KeyHash] = &StagKeys{
+         sessionKey: mapping.SessionKey,
+         sessionTtl: mapping.SessionTtl,
+         csrfToken:  mapping.CsrfToken,
+         Expiration: mapping.Expiration,
+         scopes:     mapping.Scopes,
+      }
+      imported++
+   }
+   reqMgr.Metrics.Add("forktraffic_sessions_imported_total", int64(imported))
+   return imported
+}
+
+//
+// move the imported mapping of a production session to the cache; nil when none
+// - called with cacheLock held, on a cache miss
+func (reqMgr *RequestManager) adoptImportedSession(key string) *StagKeys {
+   if len(reqMgr.importedSessions) == 0 || key == "" {
+      return nil
+   }
+   hash := reqMgr.exportHash(key)
+   stagKey := reqMgr.importedSessions[hash]
+   if stagKey == nil {
+      return nil
+   }
+   delete(reqMgr.importedSessions, hash)
+   if stagKey.Expiration <= reqMgr.nowMs() {
+      return nil
+   }
+   reqMgr.CacheData[key] = stagKey
+   heap.Push(&reqMgr.tokensExpirationList, &tokenExpiration{time: stagKey.Expiration, token: key})
+   reqMgr.Metrics.Inc("forktraffic_sessions_adopted_total")
+   return stagKey
+}
+
+//
+// handle "/admin/sessions/mapping"; management listener only
+// - GET exports the session mappings
+// - POST imports an export of another instance
+// - both need the SessionExportKey the instances share
+func (reqMgr *RequestManager) adminSessionMapping(w http.ResponseWriter, r *http.Request) {
+   if reqMgr.SessionExportKey == "" {
+      ResponseHttpError(w, http.StatusConflict, ": no SessionExportKey")
+      return
+   }
+   switch r.Method {
+   case "GET":
+      writeJson(w, reqMgr.ExportSessions())
+   case "POST":
+      var mappings []SessionMapping
+      if err := json.NewDecoder(r.Body).Decode(&mappings); err != nil {
+         ResponseHttpError(w, http.StatusBadRequest, ": "+err.Error())
+         return
+      }
+      writeJson(w, struct{ Imported int }{reqMgr.ImportSessions(mappings)})
+   default:
+      ResponseHttpError(w, http.StatusMethodNotAllowed, "")
+   }
+}
@@ -0,0 +1,39 @@
+package forktraffic
+
+// route of a staging copy for its metrics
+func (sendReq *PendingRequest) route() string {
+   if sendReq.exchange == nil || sendReq.exchange.route == "" {
+      return otherRoute
+   }
+   return sendReq.exchange.route
+}
+
+//
+// count the session cache lookup of a staging copy, by route
+// - forktraffic_session_cache_total by result: "hit", "miss", "synthetic" (a lent
+//   synthetic session) or "no_session" (the request has no production session)
+// - forktraffic_unauthenticated_copies_total counts the copies sent without any
+//   staging credentials: no cached keys or no staging session in them
+func (reqMgr *RequestManager) countSessionLookup(sendReq *PendingRequest, stagKeys *StagKeys) {
+   result := "hit"
+   switch {
+   case sendReq.requestKey == "":
+      result = "no_session"
+   case stagKeys == nil:
+      result = "miss"
+   case stagKeys.synthetic:
+      result = "synthetic"
+   }
+   route := sendReq.route()
+   reqMgr.Metrics.Inc("forktraffic_session_cache_total", "route", route, "result", result)
+   if stagKeys == nil || stagKeys.sessionKey == "" {
+      reqMgr.Metrics.Inc("forktraffic_unauthenticated_copies_total", "route", route)
+   }
+}
+
+//
+// count a production credential replaced by its staging value, by route and
+// cookie or header name
+func (reqMgr *RequestManager) countSubstitution(sendReq *PendingRequest, what string) {
+   reqMgr.Metrics.Inc("forktraffic_session_substitutions_total", "route", sendReq.route(), "what", what)
+}
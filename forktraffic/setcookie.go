@@ -0,0 +1,82 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+)
+
+// Secure attribute changes of ClientCookieSecure
+const CookieSecureAdd string = "add"
+const CookieSecureRemove string = "remove"
+
+//
+// rewrite one Set-Cookie header; the name, value and unknown attributes stay as they are
+// - Domain: ClientCookieDomainMap maps a production domain to the public one, "" drops the
+//   attribute to make the cookie host-only
+// - Path: the longest ClientCookiePathMap prefix is replaced by its value
+// - ClientCookieSecure adds or removes Secure, ClientCookieSameSite sets SameSite (None adds Secure)
+func (reqMgr *RequestManager) rewriteCookie(line string) string {
+   parts := strings.Split(line, ";")
+   out := []string{strings.TrimSpace(parts[0])}
+   secure := false
+   for _, part := range parts[1:] {
+      attr := strings.TrimSpace(part)
+      name, val := attr, ""
+      if i := strings.Index(attr, "="); i >= 0 {
+         name, val = strings.TrimSpace(attr[:i]), strings.TrimSpace(attr[i+1:])
+      }
+      switch strings.ToLower(name) {
+      case "domain":
+         if mapped, ok := reqMgr.ClientCookieDomainMap[strings.TrimPrefix(strings.ToLower(val), ".")]; ok {
+            if mapped == "" {
+               continue
+            }
+            attr = name + "=" + mapped
+         }
+      case "path":
+         best := ""
+         for prefix := range reqMgr.ClientCookiePathMap {
+            if strings.HasPrefix(val, prefix) && len(prefix) > len(best) {
+               best = prefix
+            }
+         }
+         if best != "" {
+            attr = name + "=" + reqMgr.ClientCookiePathMap[best] + val[len(best):]
+         }
+      case "secure":
+         if reqMgr.ClientCookieSecure == CookieSecureRemove {
+            continue
+         }
+         secure = true
+      case "samesite":
+         if reqMgr.ClientCookieSameSite != "" {
+            continue
+         }
+      }
+      out = append(out, attr)
+   }
+
+   if reqMgr.ClientCookieSameSite != "" {
+      out = append(out, "SameSite="+reqMgr.ClientCookieSameSite)
+   }
+   if !secure && (reqMgr.ClientCookieSecure == CookieSecureAdd || strings.EqualFold(reqMgr.ClientCookieSameSite, "None")) {
+      out = append(out, "Secure")
+   }
+   return strings.Join(out, "; ")
+}
+
+//
+// rewrite the Set-Cookie headers of a production response for the fork's public host
+func (reqMgr *RequestManager) rewriteCookies(resp *http.Response) error {
+   if len(reqMgr.ClientCookieDomainMap) == 0 && len(reqMgr.ClientCookiePathMap) == 0 && reqMgr.ClientCookieSecure == "" && reqMgr.ClientCookieSameSite == "" {
+      return nil
+   }
+   cookies := resp.Header.Values("Set-Cookie")
+   for i := range cookies {
+      cookies[i] = reqMgr.rewriteCookie(cookies[i])
+   }
+   if len(cookies) > 0 {
+      reqMgr.Metrics.Add("forktraffic_cookies_rewritten_total", int64(len(cookies)))
+   }
+   return nil
+}
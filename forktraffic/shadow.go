@@ -0,0 +1,96 @@
+package forktraffic
+
+import (
+   "net/http"
+   "net/url"
+   "strings"
+)
+
+//
+// shadow marker of staging copies
+// - every staging copy carries the marker header (default "X-Duplicate-By: Http-Splitter")
+//   and, when ShadowQueryParam is set, the marker query parameter
+// - a request that already carries the marker is a copy made by another fork;
+//   it is proxied to production but never mirrored again
+func (reqMgr *RequestManager) shadowHeader() (string, string) {
+   name, value := reqMgr.ShadowHeader, reqMgr.ShadowValue
+   if name == "" {
+      name = httpDuplicateHeader
+   }
+   if value == "" {
+      value = httpNameHeader
+   }
+   return name, value
+}
+
+// does the request carry the shadow marker
+func (reqMgr *RequestManager) isShadow(req *http.Request) bool {
+   name, _ := reqMgr.shadowHeader()
+   if req.Header.Get(name) != "" {
+      return true
+   }
+   if reqMgr.ShadowQueryParam != "" {
+      if _, ok := req.URL.Query()[reqMgr.ShadowQueryParam]; ok {
+         return true
+      }
+   }
+   return false
+}
+
+// mark a staging copy
+func (reqMgr *RequestManager) markShadow(stagReq *http.Request) {
+   name, value := reqMgr.shadowHeader()
+   stagReq.Header.Set(name, value)
+   if reqMgr.ShadowQueryParam != "" {
+      stagReq.URL.RawQuery = setRawParam(stagReq.URL.RawQuery, reqMgr.ShadowQueryParam, "1")
+   }
+}
+
+//
+// append the UserAgentSuffix to the User-Agent of a request
+// - a User-Agent already ending with the suffix (e.g. chained forks) is kept
+func (reqMgr *RequestManager) suffixUserAgent(req *http.Request) {
+   suffix := strings.TrimSpace(reqMgr.UserAgentSuffix)
+   if suffix == "" {
+      return
+   }
+   agent := req.Header.Get("User-Agent")
+   if agent == "" {
+      req.Header.Set("User-Agent", suffix)
+   } else if !strings.HasSuffix(agent, suffix) {
+      req.Header.Set("User-Agent", agent+" "+suffix)
+   }
+}
+
+// the query string of a staging copy: the production query, then the target's own
+func stagingQuery(target *url.URL, req *http.Request) string {
+   if target.RawQuery == "" {
+      return req.URL.RawQuery
+   } else if req.URL.RawQuery == "" {
+      return target.RawQuery
+   }
+   return req.URL.RawQuery + "&" + target.RawQuery
+}
+
+//
+// set a parameter of a query string (or form body) without re-encoding the others
+// - the first occurrence of the parameter gets the value, else it is appended;
+//   the other parameters keep their order and escaping
+func setRawParam(raw, name, value string) string {
+   pair := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+   if raw == "" {
+      return pair
+   }
+   pairs := strings.Split(raw, "&")
+   for i, cur := range pairs {
+      key := cur
+      if eq := strings.IndexByte(cur, '='); eq >= 0 {
+         key = cur[:eq]
+      }
+      if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+         pairs[i] = pair
+         return strings.Join(pairs, "&")
+      }
+   }
+   return raw + "&" + pair
+}
@@ -0,0 +1,115 @@
+package forktraffic
+
+import (
+   "hash/fnv"
+   "strconv"
+   "time"
+)
+
+//
+// hash of the session of a pending request and its target
+// - the production session key, else the staging session key, else the client address
+func sessionHash(sendReq *PendingRequest) uint32 {
+   key := sendReq.requestKey
+   if key == "" {
+      key = sendReq.sessionKey
+   }
+   if key == "" {
+      key = sendReq.req.RemoteAddr
+   }
+   h := fnv.New32a()
+   h.Write([]byte(sendReq.target.region + "|" + key))
+   return h.Sum32()
+}
+
+//
+// split the pending requests queue in QueueShards shards of the queue size divided among them
+// - each shard has its own sender, delivering its requests one at a time, so the
+//   requests of a session keep their order and a slow session only holds its shard
+func (reqMgr *RequestManager) initShards() {
+   size := reqMgr.QueueSize / reqMgr.QueueShards
+   if size < 1 {
+      size = 1
+   }
+   reqMgr.shards = make([]Queue, reqMgr.QueueShards)
+   for i := range reqMgr.shards {
+      reqMgr.shards[i] = reqMgr.openQueue(strconv.Itoa(i), size)
+   }
+}
+
+// the queue of a pending request and its shard number; -1 when the queue is not sharded
+func (reqMgr *RequestManager) queueOf(sendReq *PendingRequest) (Queue, int) {
+   if tq := sendReq.target.queue; tq != nil {
+      return tq.Queue, -1
+   }
+   if len(reqMgr.shards) == 0 {
+      return reqMgr.Queue, -1
+   }
+   shard := int(sessionHash(sendReq) % uint32(len(reqMgr.shards)))
+   return reqMgr.shards[shard], shard
+}
+
+// free places kept in a queue: a tenth of it, at most 100; a fuller queue drops
+// its oldest requests
+func queueHeadroom(queue Queue) int {
+   if headroom := queue.Cap() / 10; headroom < 100 {
+      return headroom
+   }
+   return 100
+}
+
+// do all the queues have their headroom
+func (reqMgr *RequestManager) queuesHealthy() bool {
+   if reqMgr.TargetQueues {
+      for _, target := range reqMgr.stagingTargets() {
+         if tq := target.queue; tq != nil && tq.Cap()-tq.Len() < queueHeadroom(tq) {
+            return false
+         }
+      }
+      return true
+   }
+   if len(reqMgr.shards) == 0 {
+      return reqMgr.Queue.Cap()-reqMgr.Queue.Len() >= queueHeadroom(reqMgr.Queue)
+   }
+   for _, shard := range reqMgr.shards {
+      if shard.Cap()-shard.Len() < queueHeadroom(shard) {
+         return false
+      }
+   }
+   return true
+}
+
+//
+// start a sender for every shard
+func (reqMgr *RequestManager) startShards() {
+   for i, shard := range reqMgr.shards {
+      go reqMgr.shardSender(shard, strconv.Itoa(i))
+   }
+}
+
+//
+// deliver the requests of a shard sequentially, in queue order
+func (reqMgr *RequestManager) shardSender(shard Queue, name string) {
+   for {
+      sendReq, err := shard.Pop()
+      if err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrQueue, Err: err})
+         time.Sleep(time.Second)
+         continue
+      }
+      reqMgr.Metrics.Set("forktraffic_queue_shard_depth", int64(shard.Len()), "shard", name)
+      if sendReq == nil {
+         continue
+      }
+      if reqMgr.BatchUrl != "" {
+         reqMgr.batchRequest(sendReq)
+         continue
+      }
+      reqSend, err := reqMgr.buildForwardRequest(sendReq)
+      if err != nil {
+         reqMgr.reportError(err)
+         continue
+      }
+      reqMgr.sendRequest(reqSend, sendReq)
+   }
+}
@@ -0,0 +1,101 @@
+package forktraffic
+
+import (
+   "crypto/hmac"
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "os"
+   "strconv"
+   "strings"
+   "time"
+)
+
+// signature of the staging copies
+const httpSignatureHeader string = "X-Fork-Signature"
+
+// field of the Vault secret holding the signing key when the URL names none
+const DefaultSigningKeyField string = "signingKey"
+
+var errNoSigningKey = errors.New("signing key not found in the Vault secret")
+
+//
+// signature of a staging copy: "t=<unix seconds>,v1=<hex HMAC-SHA256>"
+// - the HMAC covers "<t>\n<METHOD>\n<request URI>\n<hex SHA-256 of the body>"; staging
+//   recomputes it with the shared key and rejects stale timestamps as replays
+func signature(key []byte, now time.Time, method, uri string, body []byte) string {
+   sum := sha256.Sum256(body)
+   t := strconv.FormatInt(now.Unix(), 10)
+   mac := hmac.New(sha256.New, key)
+   mac.Write([]byte(t + "\n" + strings.ToUpper(method) + "\n" + uri + "\n" + hex.EncodeToString(sum[:])))
+   return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign a staging copy with its final body
+func (reqMgr *RequestManager) signRequest(stagReq *http.Request, body []byte) {
+   if len(reqMgr.signingKey) == 0 {
+      return
+   }
+   stagReq.Header.Set(httpSignatureHeader, signature(reqMgr.signingKey, reqMgr.Clock.Now(), stagReq.Method, stagReq.URL.RequestURI(), body))
+}
+
+//
+// read a signing key from Vault
+// - url is the secret, KV version 1 or 2, "#field" selects its field (default
+//   DefaultSigningKeyField); the token is taken from VAULT_TOKEN
+func vaultSecret(url string) (string, error) {
+   field := DefaultSigningKeyField
+   if i := strings.LastIndex(url, "#"); i >= 0 {
+      url, field = url[:i], url[i+1:]
+   }
+   req, err := http.NewRequest("GET", url, nil)
+   if err != nil {
+      return "", err
+   }
+   req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+   client := &http.Client{Timeout: 10 * time.Second}
+   resp, err := client.Do(req)
+   if err != nil {
+      return "", err
+   }
+   defer resp.Body.Close()
+   buf, _ := ioutil.ReadAll(resp.Body)
+   if resp.StatusCode != http.StatusOK {
+      return "", fmt.Errorf("vault: %v", resp.Status)
+   }
+
+   var secret struct {
+      Data map[string]interface{}
+   }
+   if err := json.Unmarshal(buf, &secret); err != nil {
+      return "", err
+   }
+   data := secret.Data
+   if inner, ok := data["data"].(map[string]interface{}); ok {
+      data = inner
+   }
+   if key, ok := data[field].(string); ok && key != "" {
+      return key, nil
+   }
+   return "", errNoSigningKey
+}
+
+//
+// set up the signing key of the staging copies
+// - SigningKey, else the Vault secret SigningKeyVaultUrl; the copies stay unsigned
+//   when the key cannot be read
+func (reqMgr *RequestManager) initSigning() {
+   key := reqMgr.SigningKey
+   if key == "" && reqMgr.SigningKeyVaultUrl != "" {
+      var err error
+      if key, err = vaultSecret(reqMgr.SigningKeyVaultUrl); err != nil {
+         log.Printf("Warning - signing key: %v; the staging copies are not signed", err)
+      }
+   }
+   reqMgr.signingKey = []byte(key)
+}
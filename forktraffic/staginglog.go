@@ -0,0 +1,54 @@
+package forktraffic
+
+import (
+   "log/slog"
+   "net/http"
+   "strings"
+   "time"
+)
+
+// staging response logging
+const StagingLogOff string = "off"
+const StagingLogStatus string = "status"
+const StagingLogHeaders string = "headers"
+const StagingLogBody string = "body"
+
+// default body bytes logged of a staging response
+const DefaultStagingLogBytes int = 70
+
+//
+// log a staging response through the structured logger, as StagingLog says
+// - "status" (default) logs the copy and the status, "headers" adds the response
+//   headers, "body" also the first StagingLogBytes (default DefaultStagingLogBytes)
+//   of the body; "off" logs nothing
+// - RedactHeaders and RedactBodyFields are redacted; binary bodies are shown as
+//   LogBinaryBodies says
+func (reqMgr *RequestManager) logStagingResponse(sendReq *PendingRequest, reqSend *http.Request, resp *http.Response, body []byte, elapsed time.Duration) {
+   mode := strings.ToLower(reqMgr.StagingLog)
+   if mode == StagingLogOff {
+      return
+   }
+   attrs := []interface{}{
+      "region", sendReq.target.label(),
+      "method", reqSend.Method,
+      "path", reqSend.URL.Path,
+      "status", resp.StatusCode,
+      "ms", elapsed.Milliseconds(),
+   }
+   if mode == StagingLogHeaders || mode == StagingLogBody {
+      attrs = append(attrs, "header", reqMgr.redactHeader(resp.Header))
+   }
+   if mode == StagingLogBody {
+      limit := reqMgr.StagingLogBytes
+      if limit <= 0 {
+         limit = DefaultStagingLogBytes
+      }
+      encoding := resp.Header.Get("Content-Encoding")
+      redacted := reqMgr.redactBody(body, encoding)
+      if plain, ok := decodeBody(redacted, encoding); ok {
+         redacted = plain
+      }
+      attrs = append(attrs, "body", reqMgr.loggableBody(resp.Header.Get("Content-Type"), redacted, limit))
+   }
+   slog.Info("staging response", attrs...)
+}
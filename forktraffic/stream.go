@@ -0,0 +1,161 @@
+package forktraffic
+
+import (
+   "bytes"
+   "hash"
+   "hash/fnv"
+   "io"
+   "net/http"
+   "strconv"
+   "sync"
+)
+
+// default chunk of the streamed body comparison
+const DefaultStreamChunkBytes int = 64 * 1024
+
+//
+// hashes of the consecutive chunks of a body
+// - the bodies are compared chunk by chunk without keeping them; a difference is
+//   located to the chunk it falls in
+type bodyDigest struct {
+   lock   sync.Mutex
+   chunk  int
+   hash   hash.Hash64
+   filled int
+   size   int64
+   sums   []uint64
+}
+
+func newBodyDigest(chunk int) *bodyDigest {
+   return &bodyDigest{chunk: chunk, hash: fnv.New64a()}
+}
+
+func (bd *bodyDigest) Write(p []byte) (int, error) {
+   bd.lock.Lock()
+   defer bd.lock.Unlock()
+   n := len(p)
+   for len(p) > 0 {
+      part := bd.chunk - bd.filled
+      if part > len(p) {
+         part = len(p)
+      }
+      bd.hash.Write(p[:part])
+      bd.filled += part
+      p = p[part:]
+      if bd.filled == bd.chunk {
+         bd.sums = append(bd.sums, bd.hash.Sum64())
+         bd.hash.Reset()
+         bd.filled = 0
+      }
+   }
+   bd.size += int64(n)
+   return n, nil
+}
+
+// the chunk hashes, the last partial chunk included, and the body size
+func (bd *bodyDigest) result() ([]uint64, int64) {
+   bd.lock.Lock()
+   defer bd.lock.Unlock()
+   sums := append([]uint64(nil), bd.sums...)
+   if bd.filled > 0 {
+      sums = append(sums, bd.hash.Sum64())
+   }
+   return sums, bd.size
+}
+
+//
+// compare two digested bodies; "" when identical
+// - otherwise the approximate offset of the first difference: the start of the
+//   first differing chunk, or the end of the shorter body
+func diffDigests(prod, stag *bodyDigest) string {
+   prodSums, prodSize := prod.result()
+   stagSums, stagSize := stag.result()
+   for i := 0; i < len(prodSums) && i < len(stagSums); i++ {
+      if prodSums[i] != stagSums[i] {
+         return "differs at ~" + strconv.FormatInt(int64(i)*int64(prod.chunk), 10)
+      }
+   }
+   if prodSize != stagSize {
+      if stagSize < prodSize {
+         prodSize = stagSize
+      }
+      return "differs at ~" + strconv.FormatInt(prodSize, 10)
+   }
+   return ""
+}
+
+// body reader feeding a digest
+type digestReader struct {
+   io.ReadCloser
+   digest *bodyDigest
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+   n, err := dr.ReadCloser.Read(p)
+   if n > 0 {
+      dr.digest.Write(p[:n])
+   }
+   return n, err
+}
+
+func (co *CaptureOptions) streamChunk() int {
+   if co.StreamChunkBytes <= 0 {
+      return DefaultStreamChunkBytes
+   }
+   return co.StreamChunkBytes
+}
+
+//
+// digest a production response compared by chunks
+// - responses of StreamCompareBytes or more, and of unknown length
+func (reqMgr *RequestManager) digestProduction(resp *http.Response, ex *exchange) {
+   if reqMgr.StreamCompareBytes <= 0 || (resp.ContentLength >= 0 && resp.ContentLength < int64(reqMgr.StreamCompareBytes)) {
+      return
+   }
+   ex.prodDigest = newBodyDigest(reqMgr.streamChunk())
+   resp.Body = &digestReader{ReadCloser: resp.Body, digest: ex.prodDigest}
+}
+
+// writer keeping the first bytes written
+type prefixBuffer struct {
+   buf   *bytes.Buffer
+   limit int
+}
+
+func (pb *prefixBuffer) Write(p []byte) (int, error) {
+   if room := pb.limit - pb.buf.Len(); room > 0 {
+      if room > len(p) {
+         room = len(p)
+      }
+      pb.buf.Write(p[:room])
+   }
+   return len(p), nil
+}
+
+//
+// read a staging response body
+// - when the production body was digested only the first bytes are kept (one past
+//   the capture limit) and the bodies are compared by chunks; returns the body
+//   read, its full size and the comparison ("" for identical or not compared)
+func (reqMgr *RequestManager) readStaging(resp *http.Response, ex *exchange) (*bytes.Buffer, int64, string) {
+   buf := new(bytes.Buffer)
+   if ex == nil || ex.prodDigest == nil || ex.clientAbort {
+      buf.ReadFrom(resp.Body)
+      return buf, int64(buf.Len()), ""
+   }
+
+   digest := newBodyDigest(ex.prodDigest.chunk)
+   _, err := io.Copy(io.MultiWriter(&prefixBuffer{buf: buf, limit: reqMgr.captureLimit() + 1}, digest), resp.Body)
+   _, size := digest.result()
+   if err != nil {
+      reqMgr.Metrics.Inc("forktraffic_stream_compares_total", "result", "incomplete")
+      return buf, size, ""
+   }
+   diff := diffDigests(ex.prodDigest, digest)
+   if diff == "" {
+      reqMgr.Metrics.Inc("forktraffic_stream_compares_total", "result", "identical")
+   } else {
+      reqMgr.Metrics.Inc("forktraffic_stream_compares_total", "result", "differs")
+   }
+   return buf, size, diff
+}
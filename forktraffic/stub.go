@@ -0,0 +1,67 @@
+package forktraffic
+
+import (
+   "io/ioutil"
+   "log"
+   "net/http"
+   "strconv"
+)
+
+//
+// static response of a stub route
+// - Status defaults to 200; the body is Body, or the content of BodyFile
+type StubResponse struct {
+   Status   int
+   Headers  map[string]string
+   Body     string
+   BodyFile string
+
+   body []byte
+}
+
+//
+// load the bodies of the stub routes
+// - a stub whose BodyFile cannot be read answers 500 until restarted with the file in place
+func (reqMgr *RequestManager) initStubs() {
+   for i := range reqMgr.Routes {
+      stub := reqMgr.Routes[i].Stub
+      if stub == nil {
+         continue
+      }
+      if stub.Status == 0 {
+         stub.Status = http.StatusOK
+      }
+      stub.body = []byte(stub.Body)
+      if stub.BodyFile == "" {
+         continue
+      }
+      buf, err := ioutil.ReadFile(stub.BodyFile)
+      if err != nil {
+         log.Printf("Warning - stub route %v: %v", reqMgr.Routes[i].Prefix, err)
+         stub.Status, stub.body = http.StatusInternalServerError, nil
+         continue
+      }
+      stub.body = buf
+   }
+}
+
+//
+// answer a request of a stub route; false when its route has no stub
+// - neither production nor staging see the request
+func (reqMgr *RequestManager) handleStub(respw http.ResponseWriter, req *http.Request) bool {
+   route := reqMgr.routeOf(req)
+   if route == nil || route.Stub == nil {
+      return false
+   }
+   stub := route.Stub
+   reqMgr.Metrics.Inc("forktraffic_stub_responses_total", "route", route.Prefix)
+   for name, val := range stub.Headers {
+      respw.Header().Set(name, val)
+   }
+   respw.Header().Set("Content-Length", strconv.Itoa(len(stub.body)))
+   respw.WriteHeader(stub.Status)
+   if req.Method != "HEAD" {
+      respw.Write(stub.body)
+   }
+   return true
+}
@@ -0,0 +1,63 @@
+package forktraffic
+
+import (
+   "container/heap"
+)
+
+//
+// pre-provisioned staging test session
+// - Region limits the session to the staging target of that region; "" lends it
+//   to any target
+// - once lent, a production session keeps its synthetic session until it expires
+//   or staging sets it a session of its own
+type SyntheticSession struct {
+   Region     string
+   SessionKey string
+   SessionTtl string
+   CsrfToken  string
+}
+
+//
+// lend the next synthetic session to a production session staging has never seen
+// - the lent session is cached like a staging session; nil when no session applies
+// - forktraffic_synthetic_sessions_total counts the sessions lent, by region
+func (reqMgr *RequestManager) syntheticKeys(target *stagingTarget, sendReq *PendingRequest) *StagKeys {
+   if len(reqMgr.SyntheticSessions) == 0 || sendReq.requestKey == "" {
+      return nil
+   }
+   var pool []*SyntheticSession = nil
+   for i := range reqMgr.SyntheticSessions {
+      if ss := &reqMgr.SyntheticSessions[i]; ss.Region == "" || ss.Region == target.region {
+         pool = append(pool, ss)
+      }
+   }
+   if len(pool) == 0 {
+      return nil
+   }
+
+   key := target.cacheKey(sendReq.requestKey)
+   expiration := sendReq.keyExpires
+   if expiration <= reqMgr.nowMs() {
+      expiration = reqMgr.nowMs() + 60*20000
+   }
+   reqMgr.cacheLock.Lock()
+   defer reqMgr.cacheLock.Unlock()
+   if stagKey := reqMgr.CacheData[key]; stagKey != nil {
+      keyCopy := *stagKey
+      return &keyCopy
+   }
+   ss := pool[reqMgr.syntheticNext%len(pool)]
+   reqMgr.syntheticNext++
+   stagKey := &StagKeys{
+      sessionKey: ss.SessionKey,
+      sessionTtl: ss.SessionTtl,
+      csrfToken:  ss.CsrfToken,
+      Expiration: expiration,
+      synthetic:  true,
+   }
+   reqMgr.CacheData[key] = stagKey
+   heap.Push(&reqMgr.tokensExpirationList, &tokenExpiration{time: expiration, token: key})
+   reqMgr.Metrics.Inc("forktraffic_synthetic_sessions_total", "region", target.label())
+   keyCopy := *stagKey
+   return &keyCopy
+}
@@ -0,0 +1,105 @@
+package forktraffic
+
+import (
+   "log"
+   "sync/atomic"
+   "time"
+)
+
+//
+// pending requests queue of a single staging target (TargetQueues)
+// - a slow or unavailable target fills and drops from its own queue only,
+//   while the other targets keep receiving their copies
+// - the queue is kept when the target is replaced, stopped when it is removed
+type targetQueue struct {
+   Queue
+   region  string
+   stopped int32
+}
+
+func (tq *targetQueue) isStopped() bool {
+   return atomic.LoadInt32(&tq.stopped) != 0
+}
+
+//
+// stop the sender of a removed target; it leaves once the queue is drained
+// - the queue is closed so a sender waiting on it notices
+func (tq *targetQueue) stop() {
+   atomic.StoreInt32(&tq.stopped, 1)
+   tq.Queue.Close()
+}
+
+//
+// open the queue of every staging target, each of QueueSize
+func (reqMgr *RequestManager) initTargetQueues() {
+   if reqMgr.QueueShards > 1 {
+      log.Printf("Warning - QueueShards is ignored with TargetQueues")
+   }
+   for _, target := range reqMgr.stagingTargets() {
+      reqMgr.openTargetQueue(target, nil)
+   }
+}
+
+//
+// open the queue of a target; a target replacing another takes over its queue
+// - the queue is named after the target: a subdirectory of QueueDir, a suffix
+//   of QueueRedisKey
+func (reqMgr *RequestManager) openTargetQueue(target, replaced *stagingTarget) {
+   if replaced != nil && replaced.queue != nil {
+      target.queue = replaced.queue
+      return
+   }
+   name := "target-" + target.label()
+   target.queue = &targetQueue{Queue: reqMgr.openQueue(name, reqMgr.QueueSize), region: target.label()}
+   if atomic.LoadInt32(&reqMgr.delivering) != 0 {
+      go reqMgr.deliver(target.queue.Queue, target.queue.isStopped)
+   }
+}
+
+//
+// start a sender for the queue of every target
+func (reqMgr *RequestManager) startTargetQueues() {
+   for _, target := range reqMgr.stagingTargets() {
+      if target.queue != nil {
+         go reqMgr.deliver(target.queue.Queue, target.queue.isStopped)
+      }
+   }
+}
+
+//
+// deliver the requests of a queue until stopped
+// - in batch mode the copies are posted together to the ingestion endpoint
+// - in ordered mode the session lane builds and sends the request
+func (reqMgr *RequestManager) deliver(queue Queue, stopped func() bool) {
+   for !stopped() || queue.Len() > 0 {
+      sendReq, err := queue.Pop()
+      if err != nil {
+         reqMgr.reportError(&ForwardError{Class: ErrQueue, Err: err})
+         time.Sleep(time.Second)
+         continue
+      }
+      if sendReq == nil {
+         continue
+      }
+      if tq := sendReq.target.queue; tq != nil {
+         reqMgr.Metrics.Set("forktraffic_queue_target_depth", int64(queue.Len()), "region", tq.region)
+      }
+
+      if reqMgr.BatchUrl != "" {
+         reqMgr.batchRequest(sendReq)
+         continue
+      }
+      if reqMgr.lanes != nil {
+         reqMgr.lanes[reqMgr.laneOf(sendReq)] <- sendReq
+         continue
+      }
+
+      reqSend, err := reqMgr.buildForwardRequest(sendReq)
+      if err != nil {
+         reqMgr.reportError(err)
+         continue
+      }
+
+      go reqMgr.sendRequest(reqSend, sendReq)
+   }
+}
@@ -0,0 +1,33 @@
+package forktraffic
+
+import (
+   "net/http"
+)
+
+// production arrival and staging send times of a staging copy
+const httpReceivedAtHeader string = "X-Fork-Received-At"
+const httpSentAtHeader string = "X-Fork-Sent-At"
+
+// RFC 3339 in UTC with milliseconds
+const timestampLayout string = "2006-01-02T15:04:05.000Z07:00"
+
+//
+// stamp a mirrored request with its production arrival time; it is kept
+// through the queues and the retries of every staging copy
+func (reqMgr *RequestManager) stampReceived(req *http.Request) {
+   if !reqMgr.TimestampHeaders {
+      return
+   }
+   if ex := exchangeOf(req); ex != nil && !ex.received.IsZero() {
+      req.Header.Set(httpReceivedAtHeader, ex.received.UTC().Format(timestampLayout))
+   }
+}
+
+// stamp a staging copy with its send time
+func (reqMgr *RequestManager) stampSent(stagReq *http.Request) {
+   if !reqMgr.TimestampHeaders {
+      return
+   }
+   stagReq.Header.Set(httpSentAtHeader, reqMgr.Clock.Now().UTC().Format(timestampLayout))
+}
+
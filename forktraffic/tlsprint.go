@@ -0,0 +1,114 @@
+package forktraffic
+
+import (
+   "context"
+   "crypto/md5"
+   "crypto/tls"
+   "encoding/hex"
+   "net"
+   "net/http"
+   "strconv"
+   "strings"
+   "sync"
+)
+
+// default header carrying the client TLS fingerprint to production and staging
+const DefaultFingerprintHeader string = "X-Ja3-Fingerprint"
+
+// supported_versions extension; its clients send the TLS 1.2 legacy version
+const tlsExtSupportedVersions uint16 = 43
+
+type tlsConnKeyType int
+
+const tlsConnKey tlsConnKeyType = 0
+
+// client fingerprints of the open TLS connections, by underlying connection
+type tlsFingerprints struct {
+   conns sync.Map
+}
+
+// GREASE values (RFC 8701) are left out of the fingerprint
+func isGrease(v uint16) bool {
+   return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func ja3List(values []uint16) string {
+   parts := make([]string, 0, len(values))
+   for _, v := range values {
+      if !isGrease(v) {
+         parts = append(parts, strconv.Itoa(int(v)))
+      }
+   }
+   return strings.Join(parts, "-")
+}
+
+//
+// JA3 fingerprint of a ClientHello: the MD5 of
+// "version,ciphers,extensions,curves,point formats", GREASE left out
+// - the legacy version is 771 (TLS 1.2) for clients sending supported_versions
+func ja3(hello *tls.ClientHelloInfo) string {
+   version := uint16(tls.VersionTLS12)
+   supportedVersions := false
+   for _, ext := range hello.Extensions {
+      supportedVersions = supportedVersions || ext == tlsExtSupportedVersions
+   }
+   if !supportedVersions && len(hello.SupportedVersions) > 0 {
+      version = hello.SupportedVersions[0]
+   }
+   curves := make([]uint16, len(hello.SupportedCurves))
+   for i, curve := range hello.SupportedCurves {
+      curves[i] = uint16(curve)
+   }
+   points := make([]uint16, len(hello.SupportedPoints))
+   for i, point := range hello.SupportedPoints {
+      points[i] = uint16(point)
+   }
+
+   text := strconv.Itoa(int(version)) + "," + ja3List(hello.CipherSuites) + "," + ja3List(hello.Extensions) + "," +
+      ja3List(curves) + "," + ja3List(points)
+   sum := md5.Sum([]byte(text))
+   return hex.EncodeToString(sum[:])
+}
+
+//
+// fingerprint the clients of a TLS terminating server
+// - the JA3 fingerprint of every handshake is kept for its connection and sent
+//   to production and staging in FingerprintHeader (default DefaultFingerprintHeader)
+func (reqMgr *RequestManager) FingerprintTls(server *http.Server) {
+   if server.TLSConfig == nil {
+      server.TLSConfig = &tls.Config{}
+   }
+   server.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+      reqMgr.fingerprints.conns.Store(hello.Conn, ja3(hello))
+      return nil, nil
+   }
+   server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+      if tc, ok := c.(*tls.Conn); ok {
+         return context.WithValue(ctx, tlsConnKey, tc.NetConn())
+      }
+      return ctx
+   }
+   server.ConnState = func(c net.Conn, state http.ConnState) {
+      if tc, ok := c.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+         reqMgr.fingerprints.conns.Delete(tc.NetConn())
+      }
+   }
+}
+
+//
+// add the client TLS fingerprint to a request; it replaces a header sent by the client
+func (reqMgr *RequestManager) stampFingerprint(req *http.Request) {
+   conn := req.Context().Value(tlsConnKey)
+   if conn == nil {
+      return
+   }
+   fingerprint, ok := reqMgr.fingerprints.conns.Load(conn)
+   if !ok {
+      return
+   }
+   header := reqMgr.FingerprintHeader
+   if header == "" {
+      header = DefaultFingerprintHeader
+   }
+   req.Header.Set(header, fingerprint.(string))
+}
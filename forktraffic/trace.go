@@ -0,0 +1,97 @@
+package forktraffic
+
+import (
+   "net/http"
+   "strings"
+)
+
+// trace context headers
+const (
+   httpTraceParent  string = "Traceparent"
+   httpTraceState   string = "Tracestate"
+   httpBaggage      string = "Baggage"
+   httpB3Single     string = "B3"
+   httpB3TraceId    string = "X-B3-Traceid"
+   httpB3SpanId     string = "X-B3-Spanid"
+   httpB3ParentSpan string = "X-B3-Parentspanid"
+)
+
+// attribute marking the staging copy inside the trace
+const traceShadowAttribute string = "shadow=true"
+
+//
+// random lower case hex string of n digits
+func randHex(rnd Rand, n int) string {
+   const digits = "0123456789abcdef"
+   b := make([]byte, n)
+   for i := range b {
+      b[i] = digits[rnd.Intn(16)]
+   }
+   return string(b)
+}
+
+// is s a hex string of length n
+func isHex(s string, n int) bool {
+   if len(s) != n {
+      return false
+   }
+   for _, c := range s {
+      if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+         return false
+      }
+   }
+   return true
+}
+
+//
+// link the staging copy to the trace of the production request
+// - the production request keeps its trace headers untouched
+// - the staging copy gets a new span id whose parent is the production span
+// - the staging copy is marked with a "shadow" baggage/tracestate attribute
+func linkTrace(stagReq *http.Request, req *http.Request, rnd Rand) {
+   linked := false
+
+   // W3C traceparent: version-traceid-parentid-flags
+   parts := strings.Split(req.Header.Get(httpTraceParent), "-")
+   if len(parts) == 4 && isHex(parts[0], 2) && isHex(parts[1], 32) && isHex(parts[2], 16) && isHex(parts[3], 2) {
+      stagReq.Header.Set(httpTraceParent, strings.Join([]string{parts[0], parts[1], randHex(rnd, 16), parts[3]}, "-"))
+      state := "forktraffic=shadow"
+      if prev := req.Header.Get(httpTraceState); prev != "" {
+         state += "," + prev
+      }
+      stagReq.Header.Set(httpTraceState, state)
+      linked = true
+   }
+
+   // B3 single header: traceid-spanid[-sampled[-parentspanid]]
+   if b3 := req.Header.Get(httpB3Single); b3 != "" {
+      parts := strings.Split(b3, "-")
+      if len(parts) >= 2 && (isHex(parts[0], 16) || isHex(parts[0], 32)) && isHex(parts[1], 16) {
+         child := parts[0] + "-" + randHex(rnd, 16)
+         if len(parts) >= 3 {
+            child += "-" + parts[2]
+         } else {
+            child += "-1"
+         }
+         stagReq.Header.Set(httpB3Single, child+"-"+parts[1])
+         linked = true
+      }
+   }
+
+   // B3 multiple headers
+   traceId := req.Header.Get(httpB3TraceId)
+   spanId := req.Header.Get(httpB3SpanId)
+   if (isHex(traceId, 16) || isHex(traceId, 32)) && isHex(spanId, 16) {
+      stagReq.Header.Set(httpB3SpanId, randHex(rnd, 16))
+      stagReq.Header.Set(httpB3ParentSpan, spanId)
+      linked = true
+   }
+
+   if linked {
+      baggage := traceShadowAttribute
+      if prev := req.Header.Get(httpBaggage); prev != "" {
+         baggage = prev + "," + baggage
+      }
+      stagReq.Header.Set(httpBaggage, baggage)
+   }
+}
@@ -0,0 +1,96 @@
+package forktraffic
+
+import (
+   "io"
+   "net/http"
+   "strings"
+   "sync"
+   "sync/atomic"
+   "time"
+)
+
+// byte counters and the rate sampling interval
+const bytesMetric string = "forktraffic_bytes_total"
+const rateInterval time.Duration = 10 * time.Second
+
+//
+// body reader counting the bytes read
+// - err is the first read error other than io.EOF
+type countingReader struct {
+   io.ReadCloser
+   count int64
+   err   error
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+   n, err := cr.ReadCloser.Read(p)
+   atomic.AddInt64(&cr.count, int64(n))
+   if err != nil && err != io.EOF && cr.err == nil {
+      cr.err = err
+   }
+   return n, err
+}
+
+//
+// account bytes sent to ("out") or received from ("in") a destination
+func (reqMgr *RequestManager) countBytes(destination, direction, route string, n int64) {
+   if n > 0 {
+      reqMgr.Metrics.Add(bytesMetric, n, "destination", destination, "direction", direction, "route", route)
+   }
+}
+
+//
+// byte rates over the last sampling interval
+type rateSampler struct {
+   lock  sync.Mutex
+   prev  map[string]int64
+   rates map[string]float64
+}
+
+// sample the byte counters periodically
+func (reqMgr *RequestManager) startRates() {
+   go func() {
+      last := reqMgr.Clock.Now()
+      for {
+         time.Sleep(rateInterval)
+         now := reqMgr.Clock.Now()
+         reqMgr.rates.sample(reqMgr.Metrics.Snapshot(), now.Sub(last))
+         reqMgr.sampleQueueLatency()
+         reqMgr.sampleOverhead()
+         reqMgr.sweepScenarios()
+         last = now
+      }
+   }()
+}
+
+func (rs *rateSampler) sample(snap map[string]int64, elapsed time.Duration) {
+   rates := make(map[string]float64)
+   for key, val := range snap {
+      if strings.HasPrefix(key, bytesMetric) && elapsed > 0 {
+         rates[key] = float64(val-rs.prev[key]) / elapsed.Seconds()
+      }
+   }
+   rs.lock.Lock()
+   rs.prev = snap
+   rs.rates = rates
+   rs.lock.Unlock()
+}
+
+//
+// handle "/admin/traffic"; byte totals and rates (bytes/sec) per destination and route
+func (reqMgr *RequestManager) adminTraffic(w http.ResponseWriter, r *http.Request) {
+   totals := make(map[string]int64)
+   for key, val := range reqMgr.Metrics.Snapshot() {
+      if strings.HasPrefix(key, bytesMetric) {
+         totals[key] = val
+      }
+   }
+   reqMgr.rates.lock.Lock()
+   rates := reqMgr.rates.rates
+   reqMgr.rates.lock.Unlock()
+
+   writeJson(w, struct {
+      Totals map[string]int64
+      Rates  map[string]float64
+   }{totals, rates})
+}
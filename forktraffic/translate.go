@@ -0,0 +1,192 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "mime"
+   "net/http"
+   "strings"
+)
+
+//
+// translation of the staging copies of the requests under PathPrefix ("" for
+// all), so a staging build with a newer API can be exercised by current traffic
+// - RewritePrefix replaces PathPrefix in the path, e.g. "/v2/" to "/v3/"
+// - HeaderDefaults are set on the copies which have no such header
+// - JsonRenames rename the fields of a JSON body, at any depth
+// - every matching translation applies, in order; paths match as production sent them
+// - the response rules only apply to the comparison of the responses: ResponseRenames
+//   rename the JSON fields of the staging response back to their production names
+//   and ResponseIgnore (JSON paths, "$.meta.links") are removed from both responses,
+//   so the expected schema changes are not mismatches
+type RequestTranslation struct {
+   PathPrefix      string
+   RewritePrefix   string
+   HeaderDefaults  map[string]string
+   JsonRenames     map[string]string
+   ResponseRenames map[string]string
+   ResponseIgnore  []string
+}
+
+//
+// register the JSON field renames as a staging body transformation
+func (reqMgr *RequestManager) initTranslations() {
+   for _, tr := range reqMgr.RequestTranslations {
+      if len(tr.JsonRenames) > 0 {
+         reqMgr.AddBodyTransform(reqMgr.renameJsonFields)
+         return
+      }
+   }
+}
+
+// the translations of a production path
+func (reqMgr *RequestManager) translationsOf(path string) []*RequestTranslation {
+   var matches []*RequestTranslation = nil
+   for i := range reqMgr.RequestTranslations {
+      if tr := &reqMgr.RequestTranslations[i]; strings.HasPrefix(path, tr.PathPrefix) {
+         matches = append(matches, tr)
+      }
+   }
+   return matches
+}
+
+// the path of the staging copy of a request, once its translations rewrite it
+func (reqMgr *RequestManager) translatedPath(req *http.Request) string {
+   path := req.URL.Path
+   for _, tr := range reqMgr.translationsOf(req.URL.Path) {
+      if tr.RewritePrefix != "" && strings.HasPrefix(path, tr.PathPrefix) {
+         path = tr.RewritePrefix + path[len(tr.PathPrefix):]
+      }
+   }
+   return path
+}
+
+//
+// rewrite the path and set the default headers of a staging copy
+// - forktraffic_translations_total counts the translated copies, by "what"
+func (reqMgr *RequestManager) translateRequest(req, stagReq *http.Request) {
+   for _, tr := range reqMgr.translationsOf(req.URL.Path) {
+      if tr.RewritePrefix != "" && strings.HasPrefix(stagReq.URL.Path, tr.PathPrefix) {
+         stagReq.URL.Path = tr.RewritePrefix + stagReq.URL.Path[len(tr.PathPrefix):]
+         stagReq.URL.RawPath = ""
+         reqMgr.Metrics.Inc("forktraffic_translations_total", "what", "path")
+      }
+      for name, value := range tr.HeaderDefaults {
+         if stagReq.Header.Get(name) == "" {
+            stagReq.Header.Set(name, value)
+            reqMgr.Metrics.Inc("forktraffic_translations_total", "what", "header")
+         }
+      }
+   }
+}
+
+//
+// rename the fields of a JSON staging body
+// - a field is not renamed over an existing one
+// - non JSON bodies and documents without a renamed field are kept as is
+func (reqMgr *RequestManager) renameJsonFields(req *http.Request, plain []byte) []byte {
+   renames := make(map[string]string)
+   for _, tr := range reqMgr.translationsOf(req.URL.Path) {
+      for from, to := range tr.JsonRenames {
+         renames[from] = to
+      }
+   }
+   mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+   if len(renames) == 0 || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+      return plain
+   }
+   dec := json.NewDecoder(bytes.NewReader(plain))
+   dec.UseNumber()
+   var doc interface{}
+   if dec.Decode(&doc) != nil {
+      return plain
+   }
+
+   if !renameJson(doc, renames) {
+      return plain
+   }
+   renamed, err := json.Marshal(doc)
+   if err != nil {
+      return plain
+   }
+   reqMgr.Metrics.Inc("forktraffic_translations_total", "what", "json")
+   return renamed
+}
+
+//
+// rename the fields of a document at any depth; false when none was renamed
+// - a field is not renamed over an existing one
+func renameJson(doc interface{}, renames map[string]string) bool {
+   changed := false
+   switch v := doc.(type) {
+   case map[string]interface{}:
+      for from, to := range renames {
+         if val, found := v[from]; found {
+            if _, taken := v[to]; !taken {
+               delete(v, from)
+               v[to] = val
+               changed = true
+            }
+         }
+      }
+      for _, val := range v {
+         changed = renameJson(val, renames) || changed
+      }
+   case []interface{}:
+      for _, val := range v {
+         changed = renameJson(val, renames) || changed
+      }
+   }
+   return changed
+}
+
+//
+// translated copy of a captured response for its comparison
+// - the staging response has its ResponseRenames applied, both have their
+//   ResponseIgnore fields removed; non JSON bodies are kept as is
+func (reqMgr *RequestManager) translateCapture(req *http.Request, capture *ResponseCapture, staging bool) *ResponseCapture {
+   if capture == nil {
+      return capture
+   }
+   renames := make(map[string]string)
+   var ignore [][]string = nil
+   for _, tr := range reqMgr.translationsOf(req.URL.Path) {
+      if staging {
+         for from, to := range tr.ResponseRenames {
+            renames[from] = to
+         }
+      }
+      for _, path := range tr.ResponseIgnore {
+         ignore = append(ignore, splitJsonPath(path))
+      }
+   }
+   if len(renames) == 0 && len(ignore) == 0 {
+      return capture
+   }
+
+   plain, ok := decodeBody(capture.Body, capture.Header.Get("Content-Encoding"))
+   if !ok {
+      return capture
+   }
+   dec := json.NewDecoder(bytes.NewReader(plain))
+   dec.UseNumber()
+   var doc interface{}
+   if dec.Decode(&doc) != nil {
+      return capture
+   }
+   renameJson(doc, renames)
+   for _, path := range ignore {
+      doc = normalizeJson(doc, path, "remove")
+   }
+   body, err := json.Marshal(doc)
+   if err != nil {
+      return capture
+   }
+
+   translated := *capture
+   translated.Header = capture.Header.Clone()
+   translated.Header.Del("Content-Encoding")
+   translated.Body = body
+   reqMgr.Metrics.Inc("forktraffic_translations_total", "what", "response")
+   return &translated
+}
@@ -0,0 +1,184 @@
+package forktraffic
+
+import (
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/json"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "os"
+   "path/filepath"
+   "regexp"
+   "sort"
+   "strconv"
+   "sync"
+   "time"
+)
+
+// resends spent minimizing one reproducer
+const minimizeAttempts int = 30
+
+// volatile parts of failure bodies: long hex ids and numbers
+var volatileHex = regexp.MustCompile(`[0-9a-fA-F-]{8,}`)
+var volatileNum = regexp.MustCompile(`[0-9]+`)
+
+//
+// group of staging failures with the same signature
+type crashGroup struct {
+   Signature string
+   Status    int
+   Error     string
+   Count     int
+   First     time.Time
+   Last      time.Time
+   Morfs     map[string]int
+   Example   *corpusEntry // minimized reproducer
+}
+
+type triageLog struct {
+   lock   sync.Mutex
+   groups map[string]*crashGroup
+}
+
+//
+// signature of a failure: status and a hash of the body (or error) without volatile parts
+// - the same stack trace with another request id or timestamp gets the same signature
+func failureSignature(status int, body []byte, err error) string {
+   text := string(body)
+   if err != nil {
+      text = err.Error()
+   }
+   if len(text) > 4096 {
+      text = text[:4096]
+   }
+   text = volatileNum.ReplaceAllString(volatileHex.ReplaceAllString(text, "#"), "0")
+   sum := sha256.Sum256([]byte(text))
+   return strconv.Itoa(status) + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+//
+// group a staging failure caused by a morfed request
+// - the first failure of a signature is minimized and written to TriageDir
+func (reqMgr *RequestManager) triageFailure(target *stagingTarget, entry *corpusEntry, morfs []string, status int, body []byte, err error) {
+   sig := failureSignature(status, body, err)
+   now := reqMgr.Clock.Now()
+
+   tl := &reqMgr.triage
+   tl.lock.Lock()
+   if tl.groups == nil {
+      tl.groups = make(map[string]*crashGroup)
+   }
+   group := tl.groups[sig]
+   isNew := group == nil
+   if isNew {
+      group = &crashGroup{Signature: sig, Status: status, First: now, Morfs: make(map[string]int)}
+      if err != nil {
+         group.Error = err.Error()
+      }
+      tl.groups[sig] = group
+   }
+   group.Count++
+   group.Last = now
+   for _, morf := range morfs {
+      group.Morfs[morf]++
+   }
+   tl.lock.Unlock()
+
+   reqMgr.Metrics.Inc("forktraffic_triage_failures_total", "new", strconv.FormatBool(isNew))
+   if isNew {
+      reqMgr.Metrics.Set("forktraffic_triage_groups", int64(len(tl.groups)))
+      log.Printf("triage: new failure signature %v from %v %v", sig, entry.Method, entry.Path)
+      go reqMgr.minimize(target, group, entry)
+   }
+}
+
+//
+// shrink the reproducer of a group while staging still fails the same way
+// - drops headers one at a time, then halves the body
+func (reqMgr *RequestManager) minimize(target *stagingTarget, group *crashGroup, entry *corpusEntry) {
+   best := *entry
+   best.Header = entry.Header.Clone()
+   attempts := 0
+   same := func(cand *corpusEntry) bool {
+      attempts++
+      status, body, err := reqMgr.sendEntry(target, cand, "triage")
+      return failureSignature(status, body, err) == group.Signature
+   }
+
+   names := make([]string, 0, len(best.Header))
+   for name := range best.Header {
+      names = append(names, name)
+   }
+   sort.Strings(names)
+   for _, name := range names {
+      if attempts >= minimizeAttempts {
+         break
+      }
+      cand := best
+      cand.Header = best.Header.Clone()
+      cand.Header.Del(name)
+      if same(&cand) {
+         best = cand
+      }
+   }
+   for len(best.Body) > 1 && attempts < minimizeAttempts {
+      cand := best
+      cand.Body = best.Body[:len(best.Body)/2]
+      if !same(&cand) {
+         break
+      }
+      best = cand
+   }
+
+   reqMgr.triage.lock.Lock()
+   group.Example = &best
+   reqMgr.triage.lock.Unlock()
+   reqMgr.writeReproducer(group.Signature, &best)
+}
+
+//
+// write a minimized reproducer to TriageDir/<signature>.json
+// - RedactHeaders values are not written
+func (reqMgr *RequestManager) writeReproducer(sig string, entry *corpusEntry) {
+   if reqMgr.TriageDir == "" {
+      return
+   }
+   stored := *entry
+   stored.Header = reqMgr.redactHeader(entry.Header)
+   buf, err := json.MarshalIndent(stored, "", "  ")
+   if err == nil {
+      err = os.MkdirAll(reqMgr.TriageDir, 0755)
+   }
+   if err == nil {
+      err = ioutil.WriteFile(filepath.Join(reqMgr.TriageDir, sig+".json"), buf, 0600)
+   }
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrCapture, Path: entry.Path, Err: err})
+   }
+}
+
+//
+// handle "/admin/triage"; failure groups of morfed requests, most frequent first
+func (reqMgr *RequestManager) adminTriage(w http.ResponseWriter, r *http.Request) {
+   tl := &reqMgr.triage
+   tl.lock.Lock()
+   groups := make([]crashGroup, 0, len(tl.groups))
+   for _, group := range tl.groups {
+      copied := *group
+      copied.Morfs = make(map[string]int, len(group.Morfs))
+      for morf, n := range group.Morfs {
+         copied.Morfs[morf] = n
+      }
+      if group.Example != nil {
+         example := *group.Example
+         example.Header = reqMgr.redactHeader(group.Example.Header)
+         copied.Example = &example
+      }
+      groups = append(groups, copied)
+   }
+   tl.lock.Unlock()
+
+   sort.Slice(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+   writeJson(w, groups)
+}
@@ -0,0 +1,105 @@
+package forktraffic
+
+import (
+   "fmt"
+   "net/http"
+   "net/url"
+   "strings"
+   "unicode/utf8"
+)
+
+//
+// valid but tricky text inserted by the unicode mutators
+var unicodeInserts = []string{
+   "\u0301\u0301\u0301",  // stacked combining acute accents
+   "e\u0301",             // decomposed é; compares unequal to the composed form
+   "\u202e",              // right-to-left override
+   "\u200d",              // zero width joiner
+   "\ufeff",              // byte order mark
+   "\U0001f600",          // astral plane emoji
+   "\U0001d11e",          // astral plane musical symbol
+   "\U0010fffd",          // last private use rune
+   "\uff0f",              // fullwidth solidus, normalizes to "/"
+   "\u0130",              // dotted capital I; changes length when lower cased
+}
+
+//
+// percent-encoding variants of an URI character
+// - plain, lower case hex, double encoded, overlong UTF-8 (2 and 3 byte forms)
+func encodingVariants(ch byte) []string {
+   return []string{
+      fmt.Sprintf("%%%02X", ch),
+      fmt.Sprintf("%%%02x", ch),
+      fmt.Sprintf("%%25%02X", ch),
+      fmt.Sprintf("%%%02X%%%02X", 0xc0|ch>>6, 0x80|ch&0x3f),
+      fmt.Sprintf("%%E0%%%02X%%%02X", 0x80|ch>>6, 0x80|ch&0x3f),
+   }
+}
+
+//
+// insert a tricky rune sequence at a rune boundary of a string
+func insertUnicode(s string, rnd Rand) string {
+   var bounds []int
+   for i := range s {
+      bounds = append(bounds, i)
+   }
+   bounds = append(bounds, len(s))
+   pos := bounds[rnd.Intn(len(bounds))]
+   return s[:pos] + unicodeInserts[rnd.Intn(len(unicodeInserts))] + s[pos:]
+}
+
+//
+// morf the request URI with unicode and encoding mutations
+// after morfUriBase either insert a tricky rune sequence or re-encode one
+// ASCII character with a percent-encoding variant (kept raw in RawPath)
+//
+func morfUriUnicode(req *http.Request, morfUriBase string, rnd Rand) {
+   path := req.URL.Path
+   if len(path) <= len(morfUriBase) || !strings.HasPrefix(path, morfUriBase) {
+      return
+   }
+
+   if rnd.Intn(2) == 0 {
+      req.URL.Path = morfUriBase + insertUnicode(path[len(morfUriBase):], rnd)
+      req.URL.RawPath = ""
+      return
+   }
+
+   escaped := req.URL.EscapedPath()
+   var ascii []int
+   for i := len(morfUriBase); i < len(escaped); i++ {
+      if escaped[i] < utf8.RuneSelf && escaped[i] != '%' {
+         ascii = append(ascii, i)
+      }
+   }
+   if len(ascii) == 0 {
+      return
+   }
+   pos := ascii[rnd.Intn(len(ascii))]
+   variants := encodingVariants(escaped[pos])
+   raw := escaped[:pos] + variants[rnd.Intn(len(variants))] + escaped[pos+1:]
+   if unescaped, err := url.PathUnescape(raw); err == nil {
+      req.URL.Path, req.URL.RawPath = unescaped, raw
+   }
+}
+
+//
+// morf a request header with unicode mutations
+// insert a tricky rune sequence in one value of one header
+//
+func morfHeaderUnicode(req *http.Request, rnd Rand) {
+   if len(req.Header) == 0 {
+      return
+   }
+   keys := make([]string, 0, len(req.Header))
+   for key := range req.Header {
+      keys = append(keys, key)
+   }
+   key := keys[rnd.Intn(len(keys))]
+   vals := req.Header[key]
+   if len(vals) == 0 {
+      return
+   }
+   iv := rnd.Intn(len(vals))
+   vals[iv] = insertUnicode(vals[iv], rnd)
+}
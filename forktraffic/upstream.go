@@ -0,0 +1,59 @@
+package forktraffic
+
+import (
+   "net/http"
+   "net/http/httptrace"
+   "strconv"
+   "sync/atomic"
+   "time"
+)
+
+//
+// instrument a request to an upstream: production or a staging target
+// - forktraffic_upstream_inflight: requests sent and not completed
+// - forktraffic_upstream_active_connections: pool connections held by requests
+// - connections taken (new or reused) and the time spent waiting for one,
+//   which grows when the idle pool is exhausted
+// - the round trip of a production exchange is kept to measure the fork's overhead
+// - call done once the response body was consumed
+func (reqMgr *RequestManager) traceUpstream(req *http.Request, destination string) (*http.Request, func()) {
+   var gotConn int32
+   var waitStart time.Time
+   ex := exchangeOf(req)
+   trace := &httptrace.ClientTrace{
+      GetConn: func(hostPort string) {
+         waitStart = reqMgr.Clock.Now()
+         if ex != nil && ex.upstreamStart.IsZero() {
+            ex.upstreamStart = waitStart
+         }
+      },
+      GotFirstResponseByte: func() {
+         if ex != nil {
+            ex.upstreamFirstByte = reqMgr.Clock.Now()
+         }
+      },
+      GotConn: func(info httptrace.GotConnInfo) {
+         if atomic.CompareAndSwapInt32(&gotConn, 0, 1) {
+            reqMgr.Metrics.Add("forktraffic_upstream_active_connections", 1, "destination", destination)
+         }
+         reqMgr.Metrics.Inc("forktraffic_upstream_connections_total", "destination", destination, "reused", strconv.FormatBool(info.Reused))
+         if !waitStart.IsZero() {
+            wait := reqMgr.Clock.Now().Sub(waitStart)
+            reqMgr.Metrics.Add("forktraffic_upstream_conn_wait_ms_total", int64(wait/time.Millisecond), "destination", destination)
+         }
+      },
+   }
+
+   reqMgr.Metrics.Add("forktraffic_upstream_inflight", 1, "destination", destination)
+   var finished int32
+   done := func() {
+      if !atomic.CompareAndSwapInt32(&finished, 0, 1) {
+         return
+      }
+      reqMgr.Metrics.Add("forktraffic_upstream_inflight", -1, "destination", destination)
+      if atomic.LoadInt32(&gotConn) != 0 {
+         reqMgr.Metrics.Add("forktraffic_upstream_active_connections", -1, "destination", destination)
+      }
+   }
+   return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), done
+}
@@ -0,0 +1,140 @@
+package forktraffic
+
+import (
+   "net/http"
+   "net/url"
+   "strings"
+   "unicode/utf8"
+)
+
+// malformed requests are rejected before they are proxied
+const WafBlock string = "block"
+
+// malformed requests are only counted
+const WafReport string = "report"
+
+// methods accepted unless WafMethods is set
+var DefaultWafMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// component limits unless set
+const DefaultWafMaxHeaders int = 100
+const DefaultWafMaxHeaderBytes int = 8192
+const DefaultWafMaxParams int = 256
+const DefaultWafMaxSegmentBytes int = 1024
+
+// control characters other than tab, and DEL
+func hasControl(s string) bool {
+   for i := 0; i < len(s); i++ {
+      if (s[i] < 0x20 && s[i] != '\t') || s[i] == 0x7f {
+         return true
+      }
+   }
+   return false
+}
+
+func (reqMgr *RequestManager) wafMethods() []string {
+   if reqMgr.WafMethods == nil {
+      return DefaultWafMethods
+   }
+   return reqMgr.WafMethods
+}
+
+func orDefault(limit, def int) int {
+   if limit > 0 {
+      return limit
+   }
+   return def
+}
+
+//
+// the first validation rule a request breaks; "" when it is well formed
+// - method: not one of WafMethods (default DefaultWafMethods)
+// - encoding: an invalid percent-encoding of the query
+// - utf8: path, query or header values that are not UTF-8
+// - control: control characters in the decoded path or query
+// - header_count, header_size, param_count, segment_size: components over their limits
+func (reqMgr *RequestManager) wafRule(req *http.Request) string {
+   allowed := false
+   for _, method := range reqMgr.wafMethods() {
+      allowed = allowed || strings.EqualFold(method, req.Method)
+   }
+   if !allowed {
+      return "method"
+   }
+
+   query, err := url.ParseQuery(req.URL.RawQuery)
+   if err != nil {
+      return "encoding"
+   }
+   if !utf8.ValidString(req.URL.Path) {
+      return "utf8"
+   }
+   if hasControl(req.URL.Path) {
+      return "control"
+   }
+   params := 0
+   for name, vals := range query {
+      params += len(vals)
+      for _, val := range append([]string{name}, vals...) {
+         if !utf8.ValidString(val) {
+            return "utf8"
+         }
+         if hasControl(val) {
+            return "control"
+         }
+      }
+   }
+   if params > orDefault(reqMgr.WafMaxParams, DefaultWafMaxParams) {
+      return "param_count"
+   }
+   maxSegment := orDefault(reqMgr.WafMaxSegmentBytes, DefaultWafMaxSegmentBytes)
+   for _, segment := range strings.Split(req.URL.Path, "/") {
+      if len(segment) > maxSegment {
+         return "segment_size"
+      }
+   }
+
+   headers := 0
+   maxHeader := orDefault(reqMgr.WafMaxHeaderBytes, DefaultWafMaxHeaderBytes)
+   for _, vals := range req.Header {
+      headers += len(vals)
+      for _, val := range vals {
+         if !utf8.ValidString(val) {
+            return "utf8"
+         }
+         if len(val) > maxHeader {
+            return "header_size"
+         }
+      }
+   }
+   if headers > orDefault(reqMgr.WafMaxHeaders, DefaultWafMaxHeaders) {
+      return "header_count"
+   }
+   return ""
+}
+
+//
+// validate an inbound request, the inverse of the morfs
+// - Waf "block" answers a malformed request 400 (405 for a method) without
+//   proxying it; "report" only counts it
+func (reqMgr *RequestManager) validRequest(respw http.ResponseWriter, req *http.Request) bool {
+   if reqMgr.Waf == "" {
+      return true
+   }
+   rule := reqMgr.wafRule(req)
+   if rule == "" {
+      return true
+   }
+   if reqMgr.Waf != WafBlock {
+      reqMgr.Metrics.Inc("forktraffic_waf_requests_total", "rule", rule, "action", "reported")
+      return true
+   }
+   reqMgr.Metrics.Inc("forktraffic_waf_requests_total", "rule", rule, "action", "rejected")
+   if rule == "method" {
+      respw.Header().Set("Allow", strings.Join(reqMgr.wafMethods(), ", "))
+      ResponseHttpError(respw, http.StatusMethodNotAllowed, "")
+      return false
+   }
+   ResponseHttpError(respw, http.StatusBadRequest, "")
+   return false
+}
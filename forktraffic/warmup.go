@@ -0,0 +1,159 @@
+package forktraffic
+
+import (
+   "fmt"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "net/url"
+   "strconv"
+   "strings"
+   "sync/atomic"
+   "time"
+)
+
+// default pause between warm-up rounds
+const DefaultWarmupRetrySec int = 10
+
+//
+// request sent to every staging target before mirroring starts
+// - Path may carry a query; cookies set by a response are sent with the following requests
+// - ExpectStatus is the required status; 0 accepts any status below 400
+type WarmupRequest struct {
+   Method       string
+   Path         string
+   Header       map[string]string
+   Body         string
+   ExpectStatus int
+}
+
+//
+// is the warm-up of any staging target still running
+func (reqMgr *RequestManager) WarmingUp() bool {
+   for _, target := range reqMgr.stagingTargets() {
+      if target.warmingUp() {
+         return true
+      }
+   }
+   return false
+}
+
+// is the warm-up of a target running; its copies are not mirrored meanwhile
+func (target *stagingTarget) warmingUp() bool {
+   return atomic.LoadInt32(&target.warming) != 0
+}
+
+//
+// start the warm-up of the staging targets
+func (reqMgr *RequestManager) startWarmup() {
+   for _, target := range reqMgr.stagingTargets() {
+      reqMgr.warmTarget(target)
+   }
+}
+
+//
+// warm up a staging target; file, webhook and JetStream destinations need none
+// - only the mirroring to the target is paused; production traffic and the
+//   readiness (ping status) never wait for staging
+// - failed rounds are repeated every WarmupRetrySec until the target passes or
+//   is removed
+func (reqMgr *RequestManager) warmTarget(target *stagingTarget) {
+   if len(reqMgr.WarmupRequests) == 0 || !target.proxied() {
+      return
+   }
+   atomic.StoreInt32(&target.warming, 1)
+
+   retry := reqMgr.WarmupRetrySec
+   if retry <= 0 {
+      retry = DefaultWarmupRetrySec
+   }
+   go func() {
+      defer atomic.StoreInt32(&target.warming, 0)
+      for round := 1; ; round++ {
+         err := reqMgr.warmupTarget(target)
+         if err == nil {
+            log.Printf("staging warm-up of %v done after %d round(s)", target.label(), round)
+            return
+         }
+         reqMgr.reportError(err)
+         time.Sleep(time.Duration(retry) * time.Second)
+         if !reqMgr.hasTarget(target) {
+            return
+         }
+      }
+   }()
+}
+
+// is a target still one of the staging targets
+func (reqMgr *RequestManager) hasTarget(target *stagingTarget) bool {
+   for _, known := range reqMgr.stagingTargets() {
+      if known == target {
+         return true
+      }
+   }
+   return false
+}
+
+//
+// run the warm-up requests once against a staging target
+func (reqMgr *RequestManager) warmupTarget(target *stagingTarget) error {
+   cookies := make(map[string]*http.Cookie)
+   for _, warmup := range reqMgr.WarmupRequests {
+      status, err := reqMgr.warmupSend(target, warmup, cookies)
+      if err == nil && !warmupAccepts(warmup, status) {
+         err = fmt.Errorf("warm-up status %d", status)
+      }
+      reqMgr.Metrics.Inc("forktraffic_warmup_requests_total", "region", target.label(), "ok", strconv.FormatBool(err == nil))
+      if err != nil {
+         return &ForwardError{Class: ErrStagingUnavailable, Path: warmup.Path, Err: err}
+      }
+   }
+   return nil
+}
+
+// is the warm-up response status the expected one
+func warmupAccepts(warmup WarmupRequest, status int) bool {
+   if warmup.ExpectStatus != 0 {
+      return status == warmup.ExpectStatus
+   }
+   return status < http.StatusBadRequest
+}
+
+//
+// send one warm-up request; returns the response status
+func (reqMgr *RequestManager) warmupSend(target *stagingTarget, warmup WarmupRequest, cookies map[string]*http.Cookie) (int, error) {
+   ref, err := url.Parse(warmup.Path)
+   if err != nil {
+      return 0, err
+   }
+   dest := *target.url
+   dest.Path, dest.RawQuery = ref.Path, ref.RawQuery
+
+   method := warmup.Method
+   if method == "" {
+      method = "GET"
+   }
+   req, err := http.NewRequest(method, dest.String(), strings.NewReader(warmup.Body))
+   if err != nil {
+      return 0, err
+   }
+   for key, val := range warmup.Header {
+      req.Header.Set(key, val)
+   }
+   for _, cc := range cookies {
+      req.AddCookie(cc)
+   }
+   req.Header.Set(httpDebugHeader, "warmup")
+   reqMgr.markShadow(req)
+
+   resp, err := reqMgr.DestStaging.Do(req)
+   if err != nil {
+      return 0, err
+   }
+   defer resp.Body.Close()
+   ioutil.ReadAll(resp.Body)
+   for _, cc := range resp.Cookies() {
+      cookies[cc.Name] = &http.Cookie{Name: cc.Name, Value: cc.Value}
+   }
+   return resp.StatusCode, nil
+}
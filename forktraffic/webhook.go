@@ -0,0 +1,153 @@
+package forktraffic
+
+import (
+   "bytes"
+   "encoding/json"
+   "errors"
+   "io/ioutil"
+   "log"
+   "net/http"
+   "net/url"
+   "strings"
+   "text/template"
+   "time"
+)
+
+// scheme prefix of a staging destination receiving request summaries, e.g.
+// "webhook+https://audit.example.com/hook"
+const webhookSchemePrefix string = "webhook+"
+
+// summary posted when WebhookTemplate is not set
+const DefaultWebhookTemplate string = `{"time": {{json .Time}}, "region": {{json .Region}}, "method": {{json .Method}}, ` +
+   `"path": {{json .Path}}, "route": {{json .Route}}, "operation": {{json .Operation}}, ` +
+   `"prodStatus": {{.ProdStatus}}, "prodLatencyMs": {{.ProdLatencyMs}}, "bodyBytes": {{.BodyBytes}}, ` +
+   `"experiment": {{json .Experiment}}}`
+
+var errWebhookJson = errors.New("webhook template did not render a JSON document")
+
+//
+// summary of a mirrored request; the data of the WebhookTemplate
+// - Header is redacted like the recording (see RedactHeaders)
+type WebhookSummary struct {
+   Time          time.Time
+   Region        string
+   Method        string
+   Path          string
+   Query         string
+   Host          string
+   Header        http.Header
+   ContentType   string
+   BodyBytes     int
+   Route         string
+   Operation     string
+   ProdStatus    int
+   ProdLatencyMs int64
+   Experiment    string
+   Morfs         []string
+}
+
+//
+// staging destination posting a JSON summary of every mirrored request, not the
+// request itself, e.g. to audit the traffic or trigger a test pipeline
+type webhookSink struct {
+   url *url.URL
+}
+
+// the webhook url of a "webhook+" destination; nil for other destinations
+func webhookUrl(dest *url.URL) *url.URL {
+   if !strings.HasPrefix(dest.Scheme, webhookSchemePrefix) {
+      return nil
+   }
+   hook := *dest
+   hook.Scheme = strings.TrimPrefix(dest.Scheme, webhookSchemePrefix)
+   return &hook
+}
+
+//
+// parse the WebhookTemplate; an invalid template falls back to DefaultWebhookTemplate
+// - text/template; "json" renders a value as JSON, e.g. {{json .Path}}
+func (reqMgr *RequestManager) initWebhooks() {
+   funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+      buf, err := json.Marshal(v)
+      return string(buf), err
+   }}
+   source := reqMgr.WebhookTemplate
+   if source == "" {
+      source = DefaultWebhookTemplate
+   }
+   tmpl, err := template.New("webhook").Funcs(funcs).Parse(source)
+   if err != nil {
+      log.Printf("Warning - invalid webhook template: %v; the default summary is posted", err)
+      tmpl = template.Must(template.New("webhook").Funcs(funcs).Parse(DefaultWebhookTemplate))
+   }
+   reqMgr.webhookTemplate = tmpl
+}
+
+//
+// post the summary of a staging copy to its webhook in place of sending it
+// - the summary is of the copy: staging keys, shadow marker and morfs applied
+// - forktraffic_webhook_posts_total counts the posts, by region and status class
+func (reqMgr *RequestManager) postWebhook(reqSend *http.Request, sendReq *PendingRequest) {
+   bodyBytes := 0
+   if reqSend.Body != nil {
+      body, _ := ioutil.ReadAll(reqSend.Body)
+      reqSend.Body.Close()
+      bodyBytes = len(body)
+   }
+   summary := &WebhookSummary{
+      Time:        reqMgr.Clock.Now(),
+      Region:      sendReq.target.region,
+      Method:      reqSend.Method,
+      Path:        reqSend.URL.Path,
+      Query:       reqMgr.redactQuery(reqSend.URL.RawQuery),
+      Host:        reqSend.Host,
+      Header:      reqMgr.redactHeader(reqSend.Header),
+      ContentType: reqSend.Header.Get("Content-Type"),
+      BodyBytes:   bodyBytes,
+      Experiment:  sendReq.experiment,
+      Morfs:       sendReq.morfs,
+   }
+   if ex := sendReq.exchange; ex != nil {
+      summary.Route, summary.Operation = ex.route, ex.operation
+      summary.ProdStatus, summary.ProdLatencyMs = ex.status(), ex.prodLatency.Milliseconds()
+      if !ex.received.IsZero() {
+         summary.Time = ex.received
+      }
+      if ex.clientHost != "" {
+         summary.Host = ex.clientHost
+      }
+   }
+
+   hook := sendReq.target.hook.url.String()
+   buf := new(bytes.Buffer)
+   if err := reqMgr.webhookTemplate.Execute(buf, summary); err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrBuildRequest, Path: hook, Err: err})
+      return
+   }
+   if !json.Valid(buf.Bytes()) {
+      reqMgr.reportError(&ForwardError{Class: ErrBuildRequest, Path: hook, Err: errWebhookJson})
+      return
+   }
+   req, err := http.NewRequest("POST", hook, buf)
+   if err != nil {
+      reqMgr.reportError(&ForwardError{Class: ErrBuildRequest, Path: hook, Err: err})
+      return
+   }
+   req.Header.Set("Content-Type", "application/json")
+   reqMgr.markShadow(req)
+
+   resp, err := reqMgr.stagingClient(sendReq).Do(req)
+   if err == nil {
+      ioutil.ReadAll(resp.Body)
+      resp.Body.Close()
+      if resp.StatusCode >= http.StatusInternalServerError {
+         err = errors.New(resp.Status)
+      }
+   }
+   if err != nil {
+      reqMgr.Metrics.Inc("forktraffic_webhook_posts_total", "region", sendReq.target.label(), "status", "error")
+      reqMgr.reportError(&ForwardError{Class: ErrStagingUnavailable, Path: req.URL.Path, Err: err})
+      return
+   }
+   reqMgr.Metrics.Inc("forktraffic_webhook_posts_total", "region", sendReq.target.label(), "status", statusClass(resp.StatusCode))
+}
@@ -9,11 +9,13 @@ import (
 // ping data; this data is sent back to the client
 type Manger struct {
    ServiceName string
+   InstanceId  string
    StatusOk    bool
 }
 
 //
-// initialize the ping handler
+// initialize the ping handler on the default ServeMux
+// - prefer mounting the Manger itself on a dedicated ServeMux
 func (pm *Manger) Init() {
 
    http.HandleFunc("/ping", pm.handler)
@@ -21,6 +23,10 @@ func (pm *Manger) Init() {
 
 //
 // handle "/ping" path; return name and status
+func (pm *Manger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+   pm.handler(w, r)
+}
+
 func (pm *Manger) handler(w http.ResponseWriter, r *http.Request) {
 
    buf, _ := json.Marshal(pm)
@@ -15,6 +15,7 @@ import (
    "./forktraffic"
    "./ping"
    "bytes"
+   "context"
    "crypto/tls"
    "encoding/json"
    "fmt"
@@ -27,12 +28,14 @@ import (
    "os"
    "os/signal"
    "runtime/pprof"
+   "strconv"
    "strings"
    "syscall"
    "time"
 )
 
 const ListenerDefaultPort string = ":8888"
+const AdminDefaultPort string = "127.0.0.1:8890"
 const TransportTimeoutSec int = 60
 const IdleConnectionsLimit int = 2000
 const NumPendingRequests int = 10000
@@ -42,9 +45,14 @@ const MaxHeaderKb int = 8
 // define the input parameters
 type InputParams struct {
    Port                string
+   AdminPort           string
    Production, Staging string
+   ProductionIp        string
+   StagingIp           string
    LogFlags            int
    forktraffic.TestOptions
+   forktraffic.MirrorOptions
+   forktraffic.CaptureOptions
    CpuProfileFilename  string
    HeapProfileFilename string
 }
@@ -60,22 +68,222 @@ func readConfigFile(configFileName string, inputParams *InputParams) InputParams
       json.Unmarshal(fileInput, inputParams)
    }
 
+   // the address families are checked like the command line ones
+   if forktraffic.IpNetwork(inputParams.ProductionIp) == "" {
+      log.Printf("Warning - invalid address family: %v", inputParams.ProductionIp)
+      inputParams.ProductionIp = ""
+   }
+   if forktraffic.IpNetwork(inputParams.StagingIp) == "" {
+      log.Printf("Warning - invalid address family: %v", inputParams.StagingIp)
+      inputParams.StagingIp = ""
+   }
    return *inputParams
 }
 
+//
+// admin API address of a running instance for the subcommands; default http://127.0.0.1:8890
+func adminAddress(args []string, i int) string {
+   if len(args) > i {
+      return strings.TrimSuffix(args[i], "/")
+   }
+   return "http://" + AdminDefaultPort
+}
+
+//
+// "replay id [admin]" subcommand; ask a running instance to replay a stored mismatch
+func replayCommand(args []string) {
+   if len(args) < 1 || len(args) > 2 {
+      fmt.Println("usage:", os.Args[0], "replay mismatch-id [http://admin:port]")
+      os.Exit(2)
+   }
+   admin := adminAddress(args, 1)
+
+   client := &http.Client{Timeout: time.Duration(2*TransportTimeoutSec) * time.Second}
+   resp, err := client.Post(admin+"/admin/replay?id="+url.QueryEscape(args[0]), "", nil)
+   if err != nil {
+      log.Fatal(err)
+   }
+   defer resp.Body.Close()
+   body, _ := ioutil.ReadAll(resp.Body)
+   if resp.StatusCode != http.StatusOK {
+      log.Fatalf("replay %v: %v %s", args[0], resp.Status, body)
+   }
+
+   var result struct {
+      Reproduces  bool
+      Differences []string
+   }
+   json.Unmarshal(body, &result)
+   os.Stdout.Write(body)
+   fmt.Println()
+   if result.Reproduces {
+      fmt.Println("mismatch reproduces:", strings.Join(result.Differences, ", "))
+      os.Exit(1)
+   }
+   fmt.Println("mismatch no longer reproduces")
+}
+
+//
+// "sessions export|import file [admin]" subcommand; move the session mapping between instances
+func sessionsCommand(args []string) {
+   if len(args) < 2 || len(args) > 3 || (args[0] != "export" && args[0] != "import") {
+      fmt.Println("usage:", os.Args[0], "sessions export|import file [http://admin:port]")
+      os.Exit(2)
+   }
+   admin := adminAddress(args, 2)
+   client := &http.Client{Timeout: time.Duration(TransportTimeoutSec) * time.Second}
+
+   var resp *http.Response
+   var err error
+   if args[0] == "export" {
+      resp, err = client.Get(admin + "/admin/sessions/mapping")
+   } else {
+      var mapping []byte
+      if mapping, err = ioutil.ReadFile(args[1]); err == nil {
+         resp, err = client.Post(admin+"/admin/sessions/mapping", "application/json", bytes.NewReader(mapping))
+      }
+   }
+   if err != nil {
+      log.Fatal(err)
+   }
+   defer resp.Body.Close()
+   body, _ := ioutil.ReadAll(resp.Body)
+   if resp.StatusCode != http.StatusOK {
+      log.Fatalf("sessions %v: %v %s", args[0], resp.Status, body)
+   }
+
+   if args[0] == "export" {
+      if err := ioutil.WriteFile(args[1], body, 0600); err != nil {
+         log.Fatal(err)
+      }
+      fmt.Println("session mapping written to", args[1])
+   } else {
+      os.Stdout.Write(body)
+      fmt.Println()
+   }
+}
+
+//
+// "bench fork-url production-url [requests] [budget-ms]" subcommand; measure the
+// latency the fork adds to the production it fronts
+// - exits 1 when the added 99th percentile exceeds the budget
+func benchCommand(args []string) {
+   if len(args) < 2 || len(args) > 4 {
+      fmt.Println("usage:", os.Args[0], "bench http://fork:port/path http://production:port/path [requests] [budget-ms]")
+      os.Exit(2)
+   }
+   requests, budgetMs := forktraffic.DefaultBenchmarkRequests, 0
+   var err error
+   if len(args) > 2 {
+      if requests, err = strconv.Atoi(args[2]); err != nil || requests <= 0 {
+         log.Fatalf("invalid number of requests: %v", args[2])
+      }
+   }
+   if len(args) > 3 {
+      if budgetMs, err = strconv.Atoi(args[3]); err != nil || budgetMs < 0 {
+         log.Fatalf("invalid budget: %v", args[3])
+      }
+   }
+
+   client := &http.Client{Transport: newTransport("dual"), Timeout: time.Duration(TransportTimeoutSec) * time.Second}
+   report := forktraffic.Benchmark(client, args[0], args[1], requests, budgetMs)
+   body, _ := json.MarshalIndent(report, "", "  ")
+   os.Stdout.Write(body)
+   fmt.Println()
+   fmt.Printf("added latency: p50 %.2fms, p95 %.2fms, p99 %.2fms\n", report.AddedP50Ms, report.AddedP95Ms, report.AddedP99Ms)
+   if !report.WithinBudget {
+      fmt.Printf("over the %dms budget\n", budgetMs)
+      os.Exit(1)
+   }
+}
+
+//
+// transport to a destination
+// - ipMode selects the address family: "ipv4", "ipv6", or "dual" (default)
+//   trying both families with happy eyeballs fallback
+func newTransport(ipMode string) *http.Transport {
+   network := forktraffic.IpNetwork(ipMode)
+   if network == "" {
+      network = "tcp"
+   }
+   dialer := &net.Dialer{
+      Timeout:       time.Duration(TransportTimeoutSec) * time.Second,
+      KeepAlive:     time.Duration(TransportTimeoutSec) * time.Second,
+      FallbackDelay: 300 * time.Millisecond,
+   }
+
+   tr := new(http.Transport)
+   tr.MaxIdleConns = IdleConnectionsLimit
+   tr.MaxIdleConnsPerHost = IdleConnectionsLimit
+   tr.IdleConnTimeout = 15 * time.Second
+   tr.DisableCompression = true
+   tr.Proxy = nil
+   tr.ResponseHeaderTimeout = time.Duration(TransportTimeoutSec) * time.Second
+   tr.ExpectContinueTimeout = forktraffic.ExpectContinueTimeout
+   tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+   tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+      return dialer.DialContext(ctx, network, addr)
+   }
+   return tr
+}
+
 //
 // display help
 //
 func printHelp() {
    fmt.Println("usage:")
    fmt.Println(os.Args[0], " :port production [staging] [-H,--morfHeader] [-U,--morfUri] [[-f,--file] [file]] [--help]")
+   fmt.Println(os.Args[0], " replay mismatch-id [http://admin:port]")
+   fmt.Println(os.Args[0], " sessions export|import file [http://admin:port]")
+   fmt.Println(os.Args[0], " bench http://fork:port/path http://production:port/path [requests] [budget-ms]")
    fmt.Println("   :port              TCP port to listen on; default = 8888")
    fmt.Println("   production         http://destination:port/ the location of the next hop to forward all requests")
    fmt.Println("   staging            http://staging:port/ optional destination to duplicate the traffic to")
+   fmt.Println("                      or file:///path/mirror.ndjson to write the copies to a file as NDJSON")
+   fmt.Println("                      or webhook+https://host/hook to post a JSON summary of every copy")
+   fmt.Println("                      or nats://host:4222/subject to publish the copies to NATS JetStream")
+   fmt.Println("   --adminPort=addr   serve ping, metrics, admin API and pprof on this address; default = " + AdminDefaultPort)
+   fmt.Println("                      a port alone listens on 127.0.0.1 only")
    fmt.Println("   -q, --quiet        no logging; quiet mode")
    fmt.Println("   -l, --logFlags     [date, time, microsec, longfile, shortfile, UTC]; see the Golang log package")
    fmt.Println("   -U, --morfUri      test option: perform URI morfing when destination is " + forktraffic.DefaultMorfUriBase)
    fmt.Println("   -H, --morfHeader   test option: make one change in a single random header value")
+   fmt.Println("   --feedbackUrl=url  test option: guided fuzzing of staging using this coverage endpoint")
+   fmt.Println("   --morfUnicode      test option: morf URI and headers with unicode and encoding variants")
+   fmt.Println("   -C, --morfCookie   test option: change or truncate a cookie value of the staging copies")
+   fmt.Println("   -M, --morfMethod[=percent]  test option: change the method of some staging copies; default 10%")
+   fmt.Println("   --injectPayloads=sqli[,xss][,traversal][,crlf]  test option: inject security payloads into staging copies")
+   fmt.Println("   --protoFuzz=N      test option: send N% of the staging copies as malformed HTTP")
+   fmt.Println("   --faultPercent=N   test option: inject a network fault into N% of the staging copies")
+   fmt.Println("   --faults=reset[,truncate][,stall]  test option: fault kinds to inject; default all")
+   fmt.Println("   --orderedLanes=N   deliver each session's staging requests in order over N lanes; default 0 (unordered)")
+   fmt.Println("   --stagingRegion=region=url  additional staging destination tagged with its region; may be repeated")
+   fmt.Println("   --targetQueues     give every staging destination its own pending queue and sender")
+   fmt.Println("   --envoyShadow      mark staging copies like Envoy shadow traffic (Host suffixed with -shadow)")
+   fmt.Println("   --traceContext     link staging copies to the production trace as child spans")
+   fmt.Println("   --stripSecureCookies  send Secure cookies to a plaintext staging instead of dropping them")
+   fmt.Println("   --mirrorStatus=2xx[,5xx]  mirror only requests production answered with these status classes")
+   fmt.Println("   --mirrorPercent=N  mirror a sample of N% of the requests; default 100")
+   fmt.Println("   --mirrorFilter=expr  mirror only matching requests, e.g. 'header[X-Shadow] == true or cookie[beta] == yes'")
+   fmt.Println("   --bodyMethods=POST[,PUT]  mirror the request body of these methods only; default any method with a body")
+   fmt.Println("   --reproDir=dir     write a redacted reproduction bundle of every production 5xx to dir")
+   fmt.Println("   --reproReplay      replay production 5xx requests to staging with debug headers")
+   fmt.Println("   --retryWindowMs=N  mirror a single copy of client retries seen within N ms")
+   fmt.Println("   --captureResponses[=bytes]  capture production and staging response bodies for comparison")
+   fmt.Println("   --diffHeaders=h1[,h2]  compare these response headers between production and staging")
+   fmt.Println("   --diffResponses    compare status, diffHeaders and bodies of production and staging; log the mismatches")
+   fmt.Println("   --diffIgnore=/p1[,/p2]  JSON pointers left out of the body comparison, e.g. /meta/requestId,/items/*/id")
+   fmt.Println("   --mismatchFile=file  write a JSON report of every production/staging mismatch to file")
+   fmt.Println("   --mismatchWebhook=url  post the mismatch reports to this URL")
+   fmt.Println("   --userAgentSuffix=text  append text to the User-Agent of the staging copies, e.g. '+forktraffic/1.4 shadow'")
+   fmt.Println("   --recordTo=file    record production requests to file, one JSON document per line")
+   fmt.Println("   --captureFilter=expr  record only matching requests, e.g. 'method == POST and status == 5xx'")
+   fmt.Println("   --batchUrl=url     post the staging copies in NDJSON batches to this ingestion endpoint")
+   fmt.Println("   --jetStreamSource=nats://host:4222/subject?stream=name  replay the requests of a JetStream subject to staging")
+   fmt.Println("   --productionIp=ipv4|ipv6|dual  address family used to reach production; default dual")
+   fmt.Println("   --stagingIp=ipv4|ipv6|dual     address family used to reach staging; default dual")
+   fmt.Println("                                  a staging region may set its own IpMode")
+   fmt.Println("   --profileDir=dir   write heap and goroutine profile snapshots to dir every 5 minutes")
    fmt.Printf("   -f, --file[=file]  read program parameters from configuration file; default: ./redirector.json\n")
    fmt.Println("   -?, --help         display this help and exit")
    os.Exit(0)
@@ -96,6 +304,42 @@ const (
    displayHelp
    morfHeaderFlag
    morfUriFlag
+   orderedLanes
+   stagingRegion
+   envoyShadowFlag
+   traceContextFlag
+   stripSecureFlag
+   mirrorStatus
+   reproDir
+   reproReplayFlag
+   retryWindow
+   captureResponses
+   adminPort
+   diffHeaders
+   recordTo
+   captureFilter
+   productionIp
+   stagingIp
+   faultPercent
+   faultKinds
+   morfMethodFlag
+   morfCookieFlag
+   protoFuzz
+   injectPayloads
+   morfUnicodeFlag
+   feedbackUrl
+   batchUrl
+   profileDir
+   targetQueuesFlag
+   jetStreamSource
+   mirrorPercent
+   bodyMethods
+   mirrorFilter
+   diffResponsesFlag
+   diffIgnore
+   userAgentSuffix
+   mismatchFile
+   mismatchWebhook
 )
 
 func getInputParams() InputParams {
@@ -106,19 +350,57 @@ func getInputParams() InputParams {
    }{
       {"-U", "--morfUri", true, morfUriFlag},
       {"-H", "--morfHeader", false, morfHeaderFlag},
+      {"-M", "--morfMethod", true, morfMethodFlag},
+      {"-C", "--morfCookie", false, morfCookieFlag},
+      {"", "--morfUnicode", false, morfUnicodeFlag},
+      {"", "--feedbackUrl", true, feedbackUrl},
+      {"", "--protoFuzz", true, protoFuzz},
+      {"", "--injectPayloads", true, injectPayloads},
       {"-l", "--logLevel", true, setLogFlags},
       {"-f", "--file", true, inputFile},
       {"", "--CpuProfileFilename", true, cpuProfile},
       {"", "--HeapProfileFilename", true, heapProfile},
+      {"", "--orderedLanes", true, orderedLanes},
+      {"", "--stagingRegion", true, stagingRegion},
+      {"", "--envoyShadow", false, envoyShadowFlag},
+      {"", "--traceContext", false, traceContextFlag},
+      {"", "--stripSecureCookies", false, stripSecureFlag},
+      {"", "--mirrorStatus", true, mirrorStatus},
+      {"", "--reproDir", true, reproDir},
+      {"", "--reproReplay", false, reproReplayFlag},
+      {"", "--retryWindowMs", true, retryWindow},
+      {"", "--captureResponses", true, captureResponses},
+      {"", "--adminPort", true, adminPort},
+      {"", "--diffHeaders", true, diffHeaders},
+      {"", "--diffResponses", false, diffResponsesFlag},
+      {"", "--diffIgnore", true, diffIgnore},
+      {"", "--userAgentSuffix", true, userAgentSuffix},
+      {"", "--mismatchFile", true, mismatchFile},
+      {"", "--mismatchWebhook", true, mismatchWebhook},
+      {"", "--recordTo", true, recordTo},
+      {"", "--batchUrl", true, batchUrl},
+      {"", "--captureFilter", true, captureFilter},
+      {"", "--productionIp", true, productionIp},
+      {"", "--stagingIp", true, stagingIp},
+      {"", "--faultPercent", true, faultPercent},
+      {"", "--faults", true, faultKinds},
+      {"", "--profileDir", true, profileDir},
+      {"", "--targetQueues", false, targetQueuesFlag},
+      {"", "--jetStreamSource", true, jetStreamSource},
+      {"", "--mirrorPercent", true, mirrorPercent},
+      {"", "--bodyMethods", true, bodyMethods},
+      {"", "--mirrorFilter", true, mirrorFilter},
       {"-?", "--help", false, displayHelp},
    }
 
    userInput := InputParams{
       Port: ListenerDefaultPort,
+      AdminPort: AdminDefaultPort,
       Production: "http://router/",
       Staging: "",
       LogFlags: log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile | log.LUTC,
       TestOptions: forktraffic.TestOptions{ MorfUri: false, MorfHeader: false, MorfUriBase: forktraffic.DefaultMorfUriBase},
+      MirrorOptions: forktraffic.MirrorOptions{ OrderedLanes: 0},
       CpuProfileFilename: "",
       HeapProfileFilename: ""}
 
@@ -172,6 +454,36 @@ func getInputParams() InputParams {
                   }
                } else if inOption == morfHeaderFlag {
                   userInput.MorfHeader = true
+               } else if inOption == injectPayloads {
+                  userInput.InjectPayloads = nil
+                  for _, dict := range strings.Split(inValue, ",") {
+                     if dict = strings.TrimSpace(dict); dict != "" {
+                        userInput.InjectPayloads = append(userInput.InjectPayloads, dict)
+                     }
+                  }
+               } else if inOption == protoFuzz {
+                  percent, err := strconv.Atoi(inValue)
+                  if err != nil || percent < 0 || percent > 100 {
+                     log.Printf("Warning - invalid protocol fuzz percent: %v", inValue)
+                  } else {
+                     userInput.ProtoFuzzPercent = percent
+                  }
+               } else if inOption == feedbackUrl {
+                  userInput.FeedbackUrl = inValue
+               } else if inOption == morfUnicodeFlag {
+                  userInput.MorfUnicode = true
+               } else if inOption == morfCookieFlag {
+                  userInput.MorfCookie = true
+               } else if inOption == morfMethodFlag {
+                  userInput.MorfMethod = true
+                  if inValue != "" {
+                     percent, err := strconv.Atoi(inValue)
+                     if err != nil || percent <= 0 || percent > 100 {
+                        log.Printf("Warning - invalid morf method percent: %v", inValue)
+                     } else {
+                        userInput.MorfMethodPercent = percent
+                     }
+                  }
                } else if inOption == setLogFlags {
                   type logFlagDescription struct {
                      flag int
@@ -198,6 +510,139 @@ func getInputParams() InputParams {
                   } else {
                      log.Printf("Warning - CPU profiling requires a profile output file")
                   }
+               } else if inOption == orderedLanes {
+                  lanes, err := strconv.Atoi(inValue)
+                  if err != nil || lanes < 0 {
+                     log.Printf("Warning - invalid number of ordered lanes: %v", inValue)
+                  } else {
+                     userInput.OrderedLanes = lanes
+                  }
+               } else if inOption == stagingRegion {
+                  region := strings.SplitN(inValue, "=", 2)
+                  if len(region) != 2 || region[0] == "" || region[1] == "" {
+                     log.Printf("Warning - staging region requires region=url: %v", forktraffic.LoggableUrl(inValue))
+                  } else {
+                     userInput.StagingRegions = append(userInput.StagingRegions, forktraffic.StagingRegion{Region: region[0], Url: region[1]})
+                  }
+               } else if inOption == targetQueuesFlag {
+                  userInput.TargetQueues = true
+               } else if inOption == envoyShadowFlag {
+                  userInput.EnvoyShadow = true
+               } else if inOption == traceContextFlag {
+                  userInput.TracePropagation = true
+               } else if inOption == stripSecureFlag {
+                  userInput.StripSecureCookies = true
+               } else if inOption == mirrorStatus {
+                  userInput.MirrorStatusClasses = nil
+                  for _, class := range strings.Split(inValue, ",") {
+                     class = strings.TrimSpace(class)
+                     if len(class) == 3 && strings.EqualFold(class[1:], "xx") && class[0] >= '1' && class[0] <= '5' {
+                        userInput.MirrorStatusClasses = append(userInput.MirrorStatusClasses, int(class[0]-'0'))
+                     } else {
+                        log.Printf("Warning - invalid status class: %v", class)
+                     }
+                  }
+               } else if inOption == reproDir {
+                  userInput.ReproDir = inValue
+               } else if inOption == reproReplayFlag {
+                  userInput.ReproReplay = true
+               } else if inOption == retryWindow {
+                  window, err := strconv.Atoi(inValue)
+                  if err != nil || window < 0 {
+                     log.Printf("Warning - invalid retry window: %v", inValue)
+                  } else {
+                     userInput.RetryWindowMs = window
+                  }
+               } else if inOption == captureResponses {
+                  userInput.CaptureResponses = true
+                  if inValue != "" {
+                     maxBytes, err := strconv.Atoi(inValue)
+                     if err != nil || maxBytes < 0 {
+                        log.Printf("Warning - invalid capture size: %v", inValue)
+                     } else {
+                        userInput.CaptureMaxBytes = maxBytes
+                     }
+                  }
+               } else if inOption == adminPort {
+                  userInput.AdminPort = inValue
+                  if userInput.AdminPort == "" {
+                     userInput.AdminPort = AdminDefaultPort
+                  } else if !strings.Contains(userInput.AdminPort, ":") {
+                     userInput.AdminPort = "127.0.0.1:" + userInput.AdminPort
+                  }
+               } else if inOption == diffHeaders {
+                  userInput.DiffHeaders = nil
+                  for _, name := range strings.Split(inValue, ",") {
+                     if name = strings.TrimSpace(name); name != "" {
+                        userInput.DiffHeaders = append(userInput.DiffHeaders, name)
+                     }
+                  }
+               } else if inOption == diffResponsesFlag {
+                  userInput.DiffResponses = true
+               } else if inOption == mismatchFile {
+                  userInput.MismatchFile = inValue
+               } else if inOption == mismatchWebhook {
+                  userInput.MismatchWebhook = inValue
+               } else if inOption == userAgentSuffix {
+                  userInput.UserAgentSuffix = inValue
+               } else if inOption == diffIgnore {
+                  userInput.DiffIgnorePointers = nil
+                  for _, pointer := range strings.Split(inValue, ",") {
+                     if pointer = strings.TrimSpace(pointer); pointer != "" {
+                        userInput.DiffIgnorePointers = append(userInput.DiffIgnorePointers, pointer)
+                     }
+                  }
+               } else if inOption == batchUrl {
+                  userInput.BatchUrl = inValue
+               } else if inOption == recordTo {
+                  userInput.RecordFile = inValue
+               } else if inOption == jetStreamSource {
+                  userInput.JetStreamSource = inValue
+               } else if inOption == profileDir {
+                  userInput.ProfileDir = inValue
+               } else if inOption == mirrorFilter {
+                  userInput.MirrorFilter = inValue
+               } else if inOption == captureFilter {
+                  userInput.CaptureFilter = inValue
+               } else if inOption == productionIp || inOption == stagingIp {
+                  if inValue != "ipv4" && inValue != "ipv6" && inValue != "dual" {
+                     log.Printf("Warning - invalid address family: %v", inValue)
+                  } else if inOption == productionIp {
+                     userInput.ProductionIp = inValue
+                  } else {
+                     userInput.StagingIp = inValue
+                  }
+               } else if inOption == faultPercent {
+                  percent, err := strconv.Atoi(inValue)
+                  if err != nil || percent < 0 || percent > 100 {
+                     log.Printf("Warning - invalid fault percent: %v", inValue)
+                  } else {
+                     userInput.FaultPercent = percent
+                  }
+               } else if inOption == bodyMethods {
+                  userInput.BodyMethods = nil
+                  for _, method := range strings.Split(inValue, ",") {
+                     if method = strings.TrimSpace(method); method != "" {
+                        userInput.BodyMethods = append(userInput.BodyMethods, strings.ToUpper(method))
+                     }
+                  }
+               } else if inOption == mirrorPercent {
+                  percent, err := strconv.Atoi(inValue)
+                  if err != nil || percent < 0 || percent > 100 {
+                     log.Printf("Warning - invalid mirror percent: %v", inValue)
+                  } else {
+                     userInput.MirrorPercent = percent
+                  }
+               } else if inOption == faultKinds {
+                  userInput.FaultKinds = nil
+                  for _, kind := range strings.Split(inValue, ",") {
+                     kind = strings.TrimSpace(kind)
+                     if kind == "reset" || kind == "truncate" || kind == "stall" {
+                        userInput.FaultKinds = append(userInput.FaultKinds, kind)
+                     } else {
+                        log.Printf("Warning - invalid fault kind: %v", kind)
+                     }
+                  }
                } else if inOption == heapProfile {
                   if inValue != "" {
                      userInput.HeapProfileFilename = inValue
@@ -232,13 +677,37 @@ func getInputParams() InputParams {
       }
    }
 
-   b, err := json.Marshal(userInput)
+   // the secrets are not logged
+   logged := userInput
+   if logged.RedisPassword != "" {
+      logged.RedisPassword = "***"
+   }
+   if logged.SigningKey != "" {
+      logged.SigningKey = "***"
+   }
+   if logged.PseudonymKey != "" {
+      logged.PseudonymKey = "***"
+   }
+   if logged.SessionExportKey != "" {
+      logged.SessionExportKey = "***"
+   }
+   if logged.Staging != "" {
+      logged.Staging = forktraffic.LoggableUrl(logged.Staging)
+   }
+   if logged.JetStreamSource != "" {
+      logged.JetStreamSource = forktraffic.LoggableUrl(logged.JetStreamSource)
+   }
+   logged.StagingRegions = append([]forktraffic.StagingRegion(nil), logged.StagingRegions...)
+   for i := range logged.StagingRegions {
+      logged.StagingRegions[i].Url = forktraffic.LoggableUrl(logged.StagingRegions[i].Url)
+   }
+   b, err := json.Marshal(logged)
    if err == nil {
       var out bytes.Buffer
       json.Indent(&out, b, "", "  ")
       log.Printf("program input:")
       out.WriteTo(os.Stdout)
-      log.Printf("program input: %#v", userInput)
+      log.Printf("program input: %#v", logged)
    }
    return userInput
 }
@@ -247,12 +716,24 @@ func getInputParams() InputParams {
 // program start
 //
 func main() {
+   if len(os.Args) > 1 && os.Args[1] == "replay" {
+      replayCommand(os.Args[2:])
+      return
+   }
+   if len(os.Args) > 1 && os.Args[1] == "sessions" {
+      sessionsCommand(os.Args[2:])
+      return
+   }
+   if len(os.Args) > 1 && os.Args[1] == "bench" {
+      benchCommand(os.Args[2:])
+      return
+   }
    progInput := getInputParams()
 
    log.Print("listen port = ", progInput.Port)
    log.Print("production = ", progInput.Production)
-   log.Print("staging = ", progInput.Staging)
-   log.Printf("testing: { \"morfUri\":%v, \"morfHeader\":%v, \"morfUriBase\":%s}", progInput.MorfUri, progInput.MorfHeader, progInput.MorfUriBase)
+   log.Print("staging = ", forktraffic.LoggableUrl(progInput.Staging))
+   log.Printf("testing: { \"morfUri\":%v, \"morfHeader\":%v, \"morfUriBase\":%s, \"morfMethod\":%v}", progInput.MorfUri, progInput.MorfHeader, progInput.MorfUriBase, progInput.MorfMethod)
 
    // the production path is required and needs to be a valid url
    destProduction, err := url.Parse(progInput.Production)
@@ -267,107 +748,140 @@ func main() {
 
       destStaging, err := url.Parse(progInput.Staging)
       if err != nil {
-         log.Fatal(err)
+         log.Print("error: staging path is invalid")
+         os.Exit(1)
       } else {
 
          // check that the staging destination is valid
          if progInput.Staging != "" {
-            if destStaging.Scheme == "" || destStaging.Host == "" {
+            if destStaging.Scheme == "" || (destStaging.Host == "" && destStaging.Scheme != "file") {
                log.Print("error: staging path is invalid")
                os.Exit(1)
             }
-            if destStaging.Path == "" {
+            if destStaging.Path == "" && destStaging.Scheme != "file" {
                destStaging.Path = "/"
             }
          }
 
          //
-         tr := new(http.Transport)
-         tr.MaxIdleConns = IdleConnectionsLimit
-         tr.MaxIdleConnsPerHost = IdleConnectionsLimit
-         tr.IdleConnTimeout = 15 * time.Second
-         tr.DisableCompression = true
-         tr.Proxy = nil
-         tr.ResponseHeaderTimeout = time.Duration(TransportTimeoutSec) * time.Second
-         tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-         tr.DialContext = (&net.Dialer{
-            Timeout:   time.Duration(TransportTimeoutSec) * time.Second,
-            KeepAlive: time.Duration(TransportTimeoutSec) * time.Second,
-            DualStack: false,
-         }).DialContext
+         // production and staging dial with their own address families; a
+         // staging region may have its own
+         trProduction := newTransport(progInput.ProductionIp)
+         trStaging := newTransport(progInput.StagingIp)
 
          //
          // ping handler
          pingMgr := &ping.Manger{ ServiceName: "forktraffic", StatusOk: false }
-         pingMgr.Init()
 
          //
          // this is our main data structure
          //
-         destStag := &http.Client{Transport: tr, CheckRedirect: nil, Timeout: time.Duration(TransportTimeoutSec) * time.Second}
+         destStag := &http.Client{Transport: trStaging, CheckRedirect: nil, Timeout: time.Duration(TransportTimeoutSec) * time.Second}
          reqManager := &forktraffic.RequestManager{
-            UrlProduction:   destProduction,
-            DestProduction:  httputil.NewSingleHostReverseProxy(destProduction),
-            UrlStaging:      destStaging,
-            DestStaging:     destStag,
-            TestOptions:     progInput.TestOptions,
-            CacheData:       make(map[string]*forktraffic.StagKeys),
-            PendingRequests: make(chan *forktraffic.PendingRequest, NumPendingRequests)}
+            UrlProduction:  destProduction,
+            DestProduction: httputil.NewSingleHostReverseProxy(destProduction),
+            UrlStaging:     destStaging,
+            DestStaging:    destStag,
+            StagingIpMode:  progInput.StagingIp,
+            TestOptions:    progInput.TestOptions,
+            MirrorOptions:  progInput.MirrorOptions,
+            CaptureOptions: progInput.CaptureOptions,
+            PingManager:    pingMgr,
+            CacheData:      make(map[string]*forktraffic.StagKeys),
+            QueueSize:      NumPendingRequests}
          emptyKey := new(forktraffic.StagKeys)
          reqManager.CacheData[""] = emptyKey
-         reqManager.DestProduction.Transport = tr
+         reqManager.DestProduction.Transport = trProduction
          reqManager.Init()
+         log.SetPrefix("[" + reqManager.InstanceId + "] ")
 
          // start staging transport handler
          go reqManager.StagingHandler()
 
-         // for staging certificate
-         http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+         // traffic handlers; the default ServeMux is left alone
+         trafficMux := http.NewServeMux()
+         trafficMux.Handle("/", reqManager)
 
          // define server properties
+         maxHeaderKb := progInput.MaxHeaderKb
+         if maxHeaderKb <= 0 {
+            maxHeaderKb = MaxHeaderKb
+         }
          httpServer := &http.Server{
             Addr:              progInput.Port,
-            Handler:           nil,
+            Handler:           trafficMux,
             ReadTimeout:       time.Duration(TransportTimeoutSec) * time.Second,
             WriteTimeout:      time.Duration(TransportTimeoutSec) * time.Second,
             IdleTimeout:       time.Duration(TransportTimeoutSec) * time.Second,
             ReadHeaderTimeout: time.Duration(TransportTimeoutSec) * time.Second,
-            MaxHeaderBytes:    MaxHeaderKb * 1024,
+            MaxHeaderBytes:    maxHeaderKb * 1024,
          }
          httpServer.SetKeepAlivesEnabled(true)
 
+         // management listener; never served with the traffic
+         adminServer := &http.Server{
+            Addr:              progInput.AdminPort,
+            Handler:           reqManager.AdminHandler(),
+            ReadHeaderTimeout: time.Duration(TransportTimeoutSec) * time.Second,
+            MaxHeaderBytes:    MaxHeaderKb * 1024,
+         }
+         go func() {
+            log.Print("admin listen port = ", progInput.AdminPort)
+            if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+               log.Printf("error: admin listener: %v", err)
+            }
+         }()
+
          // setup signals handler and shutdown
          signals := make(chan os.Signal, 1)
          signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
          go func() {
             for sig := range signals { // wait for signal
                log.Printf("received signal: %+v; stopping program...", sig)
-               httpServer.Shutdown(nil)
+               adminServer.Shutdown(context.Background())
+               httpServer.Shutdown(context.Background())
             }
          }()
 
          // start CPU profiling
+         var fCpuProfile *os.File = nil
          if progInput.CpuProfileFilename != "" {
-            fCpuProfile, err := os.Create(progInput.CpuProfileFilename)
+            fCpuProfile, err = os.Create(progInput.CpuProfileFilename)
             if err == nil {
                pprof.StartCPUProfile(fCpuProfile)
-               defer func() { pprof.StopCPUProfile(); fCpuProfile.Close() }()
+            } else {
+               log.Printf("Warning - CPU profile: %v", err)
+               fCpuProfile = nil
             }
          }
 
          // start the listener, now we serve requests
          pingMgr.Set(true)
          log.Printf("%v started...", os.Args[0])
-         status := httpServer.ListenAndServe()
+         var status error
+         if progInput.TlsCertFile != "" {
+            reqManager.FingerprintTls(httpServer)
+            status = httpServer.ListenAndServeTLS(progInput.TlsCertFile, progInput.TlsKeyFile)
+         } else {
+            status = httpServer.ListenAndServe()
+         }
 
          // server stopped ...
 
+         // stop CPU profiling; log.Fatal below would skip a deferred stop
+         if fCpuProfile != nil {
+            pprof.StopCPUProfile()
+            fCpuProfile.Close()
+         }
+
          // dump heap profiling
          if progInput.HeapProfileFilename != "" {
             fHeapProf, err := os.Create(progInput.HeapProfileFilename)
-            if err != nil {
+            if err == nil {
                pprof.WriteHeapProfile(fHeapProf)
                fHeapProf.Close()
+            } else {
+               log.Printf("Warning - heap profile: %v", err)
             }
          }
          log.Printf("program stopped.")